@@ -93,6 +93,27 @@ func (_m *Dataset) Diff(snapshot string) ([]*zfsiface.InodeChange, error) {
 	return r0, r1
 }
 
+// EstimateSnapshot provides a mock function with given fields: base, flags
+func (_m *Dataset) EstimateSnapshot(base zfsiface.Dataset, flags []string) (int64, error) {
+	ret := _m.Called(base, flags)
+
+	var r0 int64
+	if rf, ok := ret.Get(0).(func(zfsiface.Dataset, []string) int64); ok {
+		r0 = rf(base, flags)
+	} else {
+		r0 = ret.Get(0).(int64)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(zfsiface.Dataset, []string) error); ok {
+		r1 = rf(base, flags)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // GetNativeProperties provides a mock function with given fields:
 func (_m *Dataset) GetNativeProperties() *zfsiface.NativeProperties {
 	ret := _m.Called()
@@ -225,6 +246,20 @@ func (_m *Dataset) SendSnapshot(output io.Writer) error {
 	return r0
 }
 
+// SendSnapshotWithFlags provides a mock function with given fields: base, flags, output
+func (_m *Dataset) SendSnapshotWithFlags(base zfsiface.Dataset, flags []string, output io.Writer) error {
+	ret := _m.Called(base, flags, output)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(zfsiface.Dataset, []string, io.Writer) error); ok {
+		r0 = rf(base, flags, output)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // SetProperty provides a mock function with given fields: key, val
 func (_m *Dataset) SetProperty(key string, val string) error {
 	ret := _m.Called(key, val)
@@ -0,0 +1,124 @@
+package bkp
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"net/url"
+	"strings"
+)
+
+// AWSProfile zfs attribute. The profile of the aws config file the aws targets use for the filesystem
+const AWSProfile = "ch.floor4:aws_profile"
+
+// AWSRegion zfs attribute. The aws region the aws targets use for the filesystem
+const AWSRegion = "ch.floor4:aws_region"
+
+// AWSRole zfs attribute. The arn of a role the aws targets assume for the filesystem, e.g. in another account
+const AWSRole = "ch.floor4:aws_role"
+
+// AWSEndpoint zfs attribute. Replaces the aws endpoint the aws targets send requests to for the filesystem
+const AWSEndpoint = "ch.floor4:aws_endpoint"
+
+// An AWSConfig selects the account, region and endpoint of the aws targets, empty fields keep the sdk defaults
+type AWSConfig struct {
+	// ConfigFile is the shared aws config file the credentials and profiles are read from
+	ConfigFile string
+	Profile    string
+	Region     string
+	// Role is the arn of a role which is assumed with the credentials of the profile
+	Role string
+	// Endpoint replaces the aws endpoint, e.g. with a local stand-in for tests
+	Endpoint string
+}
+
+// DefaultAWSConfig is the base of the settings of every aws target, it is set with the global flags
+var DefaultAWSConfig = AWSConfig{ConfigFile: "/etc/aws.conf"}
+
+// merge returns the settings of c overridden by the fields set in o
+func (c AWSConfig) merge(o AWSConfig) AWSConfig {
+	if o.ConfigFile != "" {
+		c.ConfigFile = o.ConfigFile
+	}
+	if o.Profile != "" {
+		c.Profile = o.Profile
+	}
+	if o.Region != "" {
+		c.Region = o.Region
+	}
+	if o.Role != "" {
+		c.Role = o.Role
+	}
+	if o.Endpoint != "" {
+		c.Endpoint = o.Endpoint
+	}
+	return c
+}
+
+// IsEmpty returns true if no setting is overridden
+func (c AWSConfig) IsEmpty() bool {
+	return c == AWSConfig{}
+}
+
+// String identifies the account and endpoint, configs with the same string use the same connection
+func (c AWSConfig) String() string {
+	return strings.Join([]string{c.ConfigFile, c.Profile, c.Region, c.Role, c.Endpoint}, "|")
+}
+
+// awsParams returns the settings given in the query of a target spec on top of DefaultAWSConfig
+func awsParams(q url.Values) AWSConfig {
+	return DefaultAWSConfig.merge(AWSConfig{
+		Profile:  q.Get("profile"),
+		Region:   q.Get("region"),
+		Role:     q.Get("role"),
+		Endpoint: q.Get("endpoint"),
+	})
+}
+
+// newAWSSession creates a session with the given settings
+// The credentials of the profile are used directly or to assume the role if one is set. The endpoint is not part of
+// the session, so the role is still assumed through aws, it is set on the service clients with endpointConfig.
+func newAWSSession(c AWSConfig) (*session.Session, error) {
+	o := session.Options{
+		Profile:           c.Profile,
+		SharedConfigState: session.SharedConfigEnable,
+	}
+	if c.Region != "" {
+		o.Config.Region = aws.String(c.Region)
+	}
+	if c.ConfigFile != "" {
+		o.SharedConfigFiles = []string{c.ConfigFile}
+	}
+	s, err := session.NewSessionWithOptions(o)
+	if err != nil {
+		return nil, err
+	}
+	if c.Role == "" {
+		return s, nil
+	}
+	return s.Copy(&aws.Config{Credentials: stscreds.NewCredentials(s, c.Role)}), nil
+}
+
+// endpointConfig returns the client config sending the requests to the endpoint, if one is set
+func (c AWSConfig) endpointConfig() *aws.Config {
+	cfg := &aws.Config{}
+	if c.Endpoint != "" {
+		cfg.Endpoint = aws.String(c.Endpoint)
+	}
+	return cfg
+}
+
+// An awsTarget connects to aws, filesystems can select another account or region for it with zfs attributes
+type awsTarget interface {
+	// withAWSConfig returns the same target connected with its settings overridden by c
+	withAWSConfig(c AWSConfig) (Target, error)
+}
+
+// withAWSConfig returns t connected with the settings c if it is an awsTarget, other targets are returned as they are
+func withAWSConfig(t Target, c AWSConfig) (Target, error) {
+	at, ok := t.(awsTarget)
+	if !ok || c.IsEmpty() {
+		return t, nil
+	}
+	return at.withAWSConfig(c)
+}
@@ -0,0 +1,70 @@
+package bkp
+
+import (
+	"testing"
+	"net/url"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/timaebi/go-zfs/zfsiface"
+)
+
+func TestAWSConfig_merge(t *testing.T) {
+	c := AWSConfig{ConfigFile: "/etc/aws.conf", Profile: "backup", Region: "eu-central-1"}
+	assert.Equal(t, c, c.merge(AWSConfig{}))
+	assert.Equal(t, AWSConfig{ConfigFile: "/etc/aws.conf", Profile: "offsite", Region: "eu-central-1",
+		Role: "arn:aws:iam::123456789012:role/backup"},
+		c.merge(AWSConfig{Profile: "offsite", Role: "arn:aws:iam::123456789012:role/backup"}))
+	assert.True(t, AWSConfig{}.IsEmpty())
+	assert.False(t, c.IsEmpty())
+	assert.NotEqual(t, c.String(), c.merge(AWSConfig{Endpoint: "http://localhost:9000"}).String())
+}
+
+func TestNewTarget_aws(t *testing.T) {
+	defer func(c AWSConfig) { DefaultAWSConfig = c }(DefaultAWSConfig)
+	DefaultAWSConfig = AWSConfig{ConfigFile: "/etc/zfs2glacier/aws.conf", Region: "eu-central-1"}
+
+	// the query overrides the defaults
+	q, err := url.ParseQuery("profile=offsite&role=arn:aws:iam::123456789012:role/backup&endpoint=http://localhost:9000")
+	require.NoError(t, err)
+	assert.Equal(t, AWSConfig{ConfigFile: "/etc/zfs2glacier/aws.conf", Profile: "offsite", Region: "eu-central-1",
+		Role: "arn:aws:iam::123456789012:role/backup", Endpoint: "http://localhost:9000"}, awsParams(q))
+
+	target, err := NewTarget("glacier")
+	require.NoError(t, err)
+	require.IsType(t, &glacierTarget{}, target)
+	assert.Equal(t, DefaultAWSConfig, target.(*glacierTarget).aws)
+	target, err = NewTarget("glacier?profile=offsite&region=us-east-1")
+	require.NoError(t, err)
+	require.IsType(t, &glacierTarget{}, target)
+	assert.Equal(t, "offsite", target.(*glacierTarget).aws.Profile)
+	assert.Equal(t, "us-east-1", target.(*glacierTarget).aws.Region)
+
+	// a filesystem connects to another account
+	other, err := target.(awsTarget).withAWSConfig(AWSConfig{Role: "arn:aws:iam::123456789012:role/backup"})
+	require.NoError(t, err)
+	assert.Equal(t, AWSConfig{ConfigFile: "/etc/zfs2glacier/aws.conf", Profile: "offsite", Region: "us-east-1",
+		Role: "arn:aws:iam::123456789012:role/backup"}, other.(*glacierTarget).aws)
+	target, err = NewTarget("s3://backup/zfs?profile=offsite")
+	require.NoError(t, err)
+	other, err = target.(awsTarget).withAWSConfig(AWSConfig{Region: "us-east-1"})
+	require.NoError(t, err)
+	assert.Equal(t, "zfs", other.(*s3Target).prefix)
+	assert.Equal(t, "us-east-1", other.(*s3Target).aws.Region)
+
+	_, err = NewTarget("glaciers")
+	assert.Error(t, err)
+}
+
+func TestZFSFilesystem_GetAWSConfig(t *testing.T) {
+	m := withoutAWSConfig(&Dataset{})
+	fs := &ZFSFilesystem{m}
+	assert.True(t, fs.GetAWSConfig().IsEmpty())
+
+	m = &Dataset{}
+	m.On("GetProperty", AWSProfile).Return("offsite", zfsiface.Inherited, nil)
+	m.On("GetProperty", AWSRegion).Return("-", zfsiface.None, nil)
+	m.On("GetProperty", AWSRole).Return("arn:aws:iam::123456789012:role/backup", zfsiface.Local, nil)
+	m.On("GetProperty", AWSEndpoint).Return("", zfsiface.None, assert.AnError)
+	fs = &ZFSFilesystem{m}
+	assert.Equal(t, AWSConfig{Profile: "offsite", Role: "arn:aws:iam::123456789012:role/backup"}, fs.GetAWSConfig())
+}
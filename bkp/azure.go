@@ -0,0 +1,417 @@
+package bkp
+
+import (
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/streaming"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blockblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+	log "github.com/sirupsen/logrus"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// azureDescriptionKey is the blob metadata key the archive description is stored in
+const azureDescriptionKey = "zfs2glacier_description"
+
+// AzureKeyVariable is the environment variable containing the shared key of the storage account
+const AzureKeyVariable = "AZURE_STORAGE_KEY"
+
+// azureMaxBlockSize is the size of the largest block azure stages
+const azureMaxBlockSize int64 = 4000 * 1024 * 1024
+
+// azureTiers are the access tiers that can be set with the StorageClass zfs attribute
+var azureTiers = []blob.AccessTier{blob.AccessTierHot, blob.AccessTierCool, blob.AccessTierCold, blob.AccessTierArchive}
+
+// azureTarget stores archives as block blobs in a container of an azure storage account
+// Like on s3, every filesystem has its own prefix below the target prefix, the vault name is used as container name.
+type azureTarget struct {
+	container    *container.Client
+	prefix       string
+	priority     blob.RehydratePriority
+	pollInterval time.Duration
+}
+
+// NewAzureTarget creates a Target storing archives in a container of the storage account below prefix
+// The shared key of the account is read from AzureKeyVariable. If endpoint is set, e.g. to the url of the account on
+// the Azurite emulator, requests are sent there instead of to azure.
+func NewAzureTarget(account, containerName, prefix, endpoint string) (Target, error) {
+	if account == "" || containerName == "" {
+		return nil, errors.New("azure target needs a storage account and a container")
+	}
+	key := os.Getenv(AzureKeyVariable)
+	if key == "" {
+		return nil, errors.New(AzureKeyVariable + " needs to contain the key of the storage account " + account)
+	}
+	cred, err := container.NewSharedKeyCredential(account, key)
+	if err != nil {
+		return nil, err
+	}
+	if endpoint == "" {
+		endpoint = "https://" + account + ".blob.core.windows.net"
+	}
+	c, err := container.NewClientWithSharedKeyCredential(strings.TrimSuffix(endpoint, "/")+"/"+containerName, cred, nil)
+	if err != nil {
+		return nil, err
+	}
+	return newAzureTarget(c, prefix), nil
+}
+
+func newAzureTarget(c *container.Client, prefix string) *azureTarget {
+	return &azureTarget{container: c, prefix: strings.Trim(prefix, "/"), priority: blob.RehydratePriorityStandard,
+		pollInterval: 15 * time.Minute}
+}
+
+// containerPrefix returns the name prefix of all blobs of a container
+func (t *azureTarget) containerPrefix(container string) string {
+	if t.prefix == "" {
+		return container + "/"
+	}
+	return t.prefix + "/" + container + "/"
+}
+
+func (t *azureTarget) blob(container, archiveID string) *blockblob.Client {
+	return t.container.NewBlockBlobClient(t.containerPrefix(container) + archiveID)
+}
+
+// list passes all blobs below prefix with their metadata to fn
+func (t *azureTarget) list(prefix string, fn func(b *container.BlobItem)) error {
+	pager := t.container.NewListBlobsFlatPager(&container.ListBlobsFlatOptions{
+		Prefix:  &prefix,
+		Include: container.ListBlobsInclude{Metadata: true},
+	})
+	for pager.More() {
+		page, err := pager.NextPage(context.Background())
+		if err != nil {
+			return err
+		}
+		for _, b := range page.Segment.BlobItems {
+			fn(b)
+		}
+	}
+	return nil
+}
+
+func (t *azureTarget) ListContainers() ([]*Container, error) {
+	p := ""
+	if t.prefix != "" {
+		p = t.prefix + "/"
+	}
+	containers := make([]*Container, 0)
+	byName := make(map[string]*Container)
+	err := t.list(p, func(b *container.BlobItem) {
+		parts := strings.SplitN(strings.TrimPrefix(azureString(b.Name), p), "/", 2)
+		if len(parts) != 2 {
+			return
+		}
+		c, ok := byName[parts[0]]
+		if !ok {
+			c = &Container{Name: parts[0], Listable: true}
+			byName[parts[0]] = c
+			containers = append(containers, c)
+		}
+		// the container itself is an empty blob named after the prefix
+		if parts[1] != "" && b.Properties != nil && b.Properties.ContentLength != nil {
+			c.Size += *b.Properties.ContentLength
+			c.Archives++
+		}
+	})
+	return containers, err
+}
+
+func (t *azureTarget) CreateContainer(name string) error {
+	_, err := t.container.NewBlockBlobClient(t.containerPrefix(name)).
+		Upload(context.Background(), streaming.NopCloser(bytes.NewReader([]byte{})), nil)
+	return err
+}
+
+// azureTier returns the access tier with the given name in any case, empty if there is none
+func azureTier(class string) blob.AccessTier {
+	for _, at := range azureTiers {
+		if strings.EqualFold(string(at), class) {
+			return at
+		}
+	}
+	return ""
+}
+
+func (t *azureTarget) hasStorageClass(class string) bool {
+	return azureTier(class) != ""
+}
+
+func (t *azureTarget) partSizeLimits() (int64, int64) {
+	return 0, azureMaxBlockSize
+}
+
+// BeginUpload prepares a block blob, every part is staged as a block
+// The blob is moved to the archive tier once the blocks are committed, unless the upload requests another tier.
+func (t *azureTarget) BeginUpload(container string, req *UploadRequest) (Upload, error) {
+	tier := blob.AccessTierArchive
+	if req.StorageClass != "" {
+		if tier = azureTier(req.StorageClass); tier == "" {
+			return nil, errors.New("unknown azure access tier " + req.StorageClass)
+		}
+	}
+	id, err := newObjectName()
+	if err != nil {
+		return nil, err
+	}
+	return &azureUpload{blob: t.blob(container, id), id: id, description: req.Description, tier: tier}, nil
+}
+
+// OpenRetrieval sets the priority in which archived blobs are rehydrated
+// azure tracks the rehydration itself, so no state file is needed.
+func (t *azureTarget) OpenRetrieval(stateFile, tier string) error {
+	switch tier {
+	case TierExpedited:
+		t.priority = blob.RehydratePriorityHigh
+	case TierStandard, TierBulk:
+		t.priority = blob.RehydratePriorityStandard
+	default:
+		return errors.New("unknown retrieval tier " + tier)
+	}
+	return nil
+}
+
+func (t *azureTarget) RequestArchives(container string) error {
+	return nil
+}
+
+func (t *azureTarget) ListArchives(vault string) (*Inventory, error) {
+	inv := &Inventory{InventoryDate: time.Now(), ArchiveList: make([]*InventoryArchive, 0)}
+	p := t.containerPrefix(vault)
+	err := t.list(p, func(b *container.BlobItem) {
+		name := azureString(b.Name)
+		if name == p || b.Properties == nil {
+			return
+		}
+		a := &InventoryArchive{
+			ArchiveId:          strings.TrimPrefix(name, p),
+			ArchiveDescription: azureDescription(b.Metadata),
+		}
+		if b.Properties.LastModified != nil {
+			a.CreationDate = *b.Properties.LastModified
+		}
+		if b.Properties.ContentLength != nil {
+			a.Size = *b.Properties.ContentLength
+		}
+		if m, err := ParseMetadata(a.ArchiveDescription); err == nil {
+			a.Metadata = m
+		}
+		inv.ArchiveList = append(inv.ArchiveList, a)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return inv, nil
+}
+
+// RequestArchive starts rehydrating an archived blob to the hot tier
+func (t *azureTarget) RequestArchive(container, archiveID string) error {
+	_, err := t.request(t.blob(container, archiveID))
+	return err
+}
+
+// request starts rehydrating an archived blob and returns its current properties
+func (t *azureTarget) request(b *blockblob.Client) (blob.GetPropertiesResponse, error) {
+	p, err := b.GetProperties(context.Background(), nil)
+	if err != nil {
+		return p, err
+	}
+	if !isAzureArchived(p) || p.ArchiveStatus != nil {
+		return p, nil
+	}
+	_, err = b.SetTier(context.Background(), blob.AccessTierHot, &blob.SetTierOptions{RehydratePriority: &t.priority})
+	if err != nil {
+		return p, err
+	}
+	log.WithField("blob", b.URL()).WithField("priority", t.priority).Info("blob rehydration requested")
+	return p, nil
+}
+
+// Retrieve waits until the blob is rehydrated and downloads it, a partially downloaded file is continued
+// The blob is moved back to the archive tier after it has been downloaded.
+func (t *azureTarget) Retrieve(container, archiveID, file string) (string, error) {
+	b := t.blob(container, archiveID)
+	p, err := t.request(b)
+	if err != nil {
+		return "", err
+	}
+	archived := isAzureArchived(p)
+	for isAzureArchived(p) {
+		log.WithField("blob", b.URL()).WithField("next poll", t.pollInterval).Info("waiting for blob rehydration")
+		time.Sleep(t.pollInterval)
+		if p, err = b.GetProperties(context.Background(), nil); err != nil {
+			return "", err
+		}
+	}
+
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	size := azureInt64(p.ContentLength)
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return "", err
+	}
+	if offset > size {
+		if err = f.Truncate(0); err != nil {
+			return "", err
+		}
+		if offset, err = f.Seek(0, io.SeekStart); err != nil {
+			return "", err
+		}
+	}
+	if offset < size {
+		if offset > 0 {
+			log.WithField("blob", b.URL()).WithField("offset", offset).Info("continuing download")
+		}
+		o, err := b.DownloadStream(context.Background(), &blob.DownloadStreamOptions{Range: blob.HTTPRange{Offset: offset}})
+		if err != nil {
+			return "", err
+		}
+		defer o.Body.Close()
+		if _, err = io.Copy(f, o.Body); err != nil {
+			return "", err
+		}
+		if err = f.Sync(); err != nil {
+			return "", err
+		}
+	}
+	if offset, err = f.Seek(0, io.SeekEnd); err != nil {
+		return "", err
+	}
+	if offset != size {
+		return "", fmt.Errorf("downloaded %d bytes of blob %s, expected %d", offset, b.URL(), size)
+	}
+	log.WithField("blob", b.URL()).WithField("size", size).Info("archive downloaded")
+	if archived {
+		if _, err = b.SetTier(context.Background(), blob.AccessTierArchive, nil); err != nil {
+			log.WithField("blob", b.URL()).Warn("could not move blob back to the archive tier: ", err)
+		}
+	}
+	return azureDescription(p.Metadata), nil
+}
+
+// azureUpload stages the parts of an archive as blocks of a block blob
+type azureUpload struct {
+	blob        *blockblob.Client
+	id          string
+	description string
+	tier        blob.AccessTier
+	// offsets of the staged blocks, mu guards them as blocks are staged concurrently
+	mu        sync.Mutex
+	offsets   []int64
+	committed bool
+}
+
+func (u *azureUpload) concurrent() {}
+
+// setStreamSHA256 adds the SHA-256 of the stream to the description, the blob's metadata is written at commit
+func (u *azureUpload) setStreamSHA256(sum string) {
+	u.description = withStreamSHA256(u.description, sum)
+}
+
+// blockID returns the id of the block starting at offset, all ids of a blob need to have the same length
+func blockID(offset int64) string {
+	return base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%020d", offset)))
+}
+
+func (u *azureUpload) UploadPart(offset int64, p io.ReadSeeker, h []byte) error {
+	sum := md5.New()
+	if _, err := io.Copy(sum, p); err != nil {
+		return err
+	}
+	if _, err := p.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	log.WithField("blob", u.blob.URL()).WithField("offset", offset).Debug("staging block")
+	_, err := u.blob.StageBlock(context.Background(), blockID(offset), streaming.NopCloser(p),
+		&blockblob.StageBlockOptions{TransactionalValidation: blob.TransferValidationTypeMD5(sum.Sum(nil))})
+	if err != nil {
+		return err
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.offsets = append(u.offsets, offset)
+	return nil
+}
+
+// Complete commits the staged blocks with the description as metadata and moves the blob to its access tier
+func (u *azureUpload) Complete(size int64, h []byte) (string, error) {
+	sort.Slice(u.offsets, func(i, j int) bool { return u.offsets[i] < u.offsets[j] })
+	ids := make([]string, len(u.offsets))
+	for i, o := range u.offsets {
+		ids[i] = blockID(o)
+	}
+	description := u.description
+	_, err := u.blob.CommitBlockList(context.Background(), ids, &blockblob.CommitBlockListOptions{
+		Metadata: map[string]*string{azureDescriptionKey: &description},
+	})
+	if err != nil {
+		return "", err
+	}
+	u.committed = true
+	p, err := u.blob.GetProperties(context.Background(), nil)
+	if err != nil {
+		return "", err
+	}
+	if azureInt64(p.ContentLength) != size {
+		return "", fmt.Errorf("blob %s has %d bytes, uploaded %d", u.blob.URL(), azureInt64(p.ContentLength), size)
+	}
+	if _, err = u.blob.SetTier(context.Background(), u.tier, nil); err != nil {
+		return "", err
+	}
+	log.WithField("blob", u.blob.URL()).WithField("tier", u.tier).Debug("blob committed")
+	return u.id, nil
+}
+
+// Abort deletes a blob that was committed already, staged blocks that are never committed are discarded by azure
+func (u *azureUpload) Abort() error {
+	if !u.committed {
+		return nil
+	}
+	_, err := u.blob.Delete(context.Background(), nil)
+	return err
+}
+
+// azureDescription returns the archive description from the blob metadata
+// The service may return the metadata keys in another case.
+func azureDescription(m map[string]*string) string {
+	for k, v := range m {
+		if strings.EqualFold(k, azureDescriptionKey) {
+			return azureString(v)
+		}
+	}
+	return ""
+}
+
+// isAzureArchived returns true if the blob needs to be rehydrated before it can be read
+func isAzureArchived(p blob.GetPropertiesResponse) bool {
+	return strings.EqualFold(azureString(p.AccessTier), string(blob.AccessTierArchive))
+}
+
+func azureString(p *string) string {
+	if p == nil {
+		return ""
+	}
+	return *p
+}
+
+func azureInt64(p *int64) int64 {
+	if p == nil {
+		return 0
+	}
+	return *p
+}
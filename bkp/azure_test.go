@@ -0,0 +1,301 @@
+package bkp
+
+import (
+	"testing"
+	"crypto/sha256"
+	"encoding/hex"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/aws/aws-sdk-go/service/glacier"
+)
+
+// azuriteKey is the well known key of the devstoreaccount1 account of the Azurite emulator
+const azuriteKey = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+
+// fakeBlob is a blob stored by fakeBlobService
+type fakeBlob struct {
+	data          []byte
+	metadata      map[string]string
+	tier          string
+	archiveStatus string
+	modified      time.Time
+}
+
+// fakeBlobService implements the parts of the azure blob api used by azureTarget for a single container
+// Rehydration of an archived blob completes after its properties have been read once.
+type fakeBlobService struct {
+	mutex  sync.Mutex
+	blobs  map[string]*fakeBlob
+	blocks map[string]map[string][]byte
+}
+
+func newFakeBlobService() *fakeBlobService {
+	return &fakeBlobService{blobs: make(map[string]*fakeBlob), blocks: make(map[string]map[string][]byte)}
+}
+
+func (s *fakeBlobService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	// the path is /account/container[/blob]
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 3)
+	q := r.URL.Query()
+	if len(parts) == 2 {
+		if r.Method == http.MethodGet && q.Get("comp") == "list" {
+			s.list(w, q.Get("prefix"))
+		} else {
+			w.WriteHeader(http.StatusCreated)
+		}
+		return
+	}
+	name := parts[2]
+	b := s.blobs[name]
+	switch {
+	case r.Method == http.MethodPut && q.Get("comp") == "block":
+		d, _ := ioutil.ReadAll(r.Body)
+		sum := md5.Sum(d)
+		if r.Header.Get("Content-MD5") != base64.StdEncoding.EncodeToString(sum[:]) {
+			fakeBlobError(w, http.StatusBadRequest, "Md5Mismatch")
+			return
+		}
+		if s.blocks[name] == nil {
+			s.blocks[name] = make(map[string][]byte)
+		}
+		s.blocks[name][q.Get("blockid")] = d
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodPut && q.Get("comp") == "blocklist":
+		var list struct {
+			Latest []string `xml:"Latest"`
+		}
+		if err := xml.NewDecoder(r.Body).Decode(&list); err != nil {
+			fakeBlobError(w, http.StatusBadRequest, "InvalidXmlDocument")
+			return
+		}
+		data := make([]byte, 0)
+		for _, id := range list.Latest {
+			d, ok := s.blocks[name][id]
+			if !ok {
+				fakeBlobError(w, http.StatusBadRequest, "InvalidBlockList")
+				return
+			}
+			data = append(data, d...)
+		}
+		delete(s.blocks, name)
+		s.put(name, data, r.Header)
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodPut && q.Get("comp") == "tier":
+		if b == nil {
+			fakeBlobError(w, http.StatusNotFound, "BlobNotFound")
+			return
+		}
+		tier := r.Header.Get("x-ms-access-tier")
+		if b.tier == "Archive" && tier != "Archive" {
+			b.archiveStatus = "rehydrate-pending-to-" + strings.ToLower(tier)
+		} else {
+			b.tier = tier
+		}
+		w.WriteHeader(http.StatusOK)
+	case r.Method == http.MethodPut:
+		d, _ := ioutil.ReadAll(r.Body)
+		s.put(name, d, r.Header)
+		w.WriteHeader(http.StatusCreated)
+	case b == nil:
+		fakeBlobError(w, http.StatusNotFound, "BlobNotFound")
+	case r.Method == http.MethodHead:
+		s.header(w, b)
+		w.Header().Set("Content-Length", strconv.Itoa(len(b.data)))
+		w.WriteHeader(http.StatusOK)
+		if b.archiveStatus != "" {
+			b.tier = "Hot"
+			b.archiveStatus = ""
+		}
+	case r.Method == http.MethodGet:
+		if b.tier == "Archive" {
+			fakeBlobError(w, http.StatusConflict, "BlobArchived")
+			return
+		}
+		offset := 0
+		if rng := r.Header.Get("x-ms-range"); rng != "" {
+			offset, _ = strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(rng, "bytes="), "-"))
+		}
+		s.header(w, b)
+		w.Header().Set("Content-Length", strconv.Itoa(len(b.data)-offset))
+		w.WriteHeader(http.StatusOK)
+		w.Write(b.data[offset:])
+	case r.Method == http.MethodDelete:
+		delete(s.blobs, name)
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *fakeBlobService) put(name string, data []byte, h http.Header) {
+	b := &fakeBlob{data: data, metadata: make(map[string]string), tier: "Hot", modified: time.Now()}
+	for k := range h {
+		if strings.HasPrefix(strings.ToLower(k), "x-ms-meta-") {
+			b.metadata[strings.ToLower(k[len("x-ms-meta-"):])] = h.Get(k)
+		}
+	}
+	s.blobs[name] = b
+}
+
+func (s *fakeBlobService) header(w http.ResponseWriter, b *fakeBlob) {
+	w.Header().Set("Last-Modified", b.modified.UTC().Format(http.TimeFormat))
+	w.Header().Set("x-ms-blob-type", "BlockBlob")
+	w.Header().Set("x-ms-access-tier", b.tier)
+	if b.archiveStatus != "" {
+		w.Header().Set("x-ms-archive-status", b.archiveStatus)
+	}
+	for k, v := range b.metadata {
+		w.Header().Set("x-ms-meta-"+k, v)
+	}
+}
+
+func (s *fakeBlobService) list(w http.ResponseWriter, prefix string) {
+	names := make([]string, 0)
+	for name := range s.blobs {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	out := &bytes.Buffer{}
+	out.WriteString(`<?xml version="1.0" encoding="utf-8"?><EnumerationResults><Blobs>`)
+	for _, name := range names {
+		b := s.blobs[name]
+		fmt.Fprintf(out, "<Blob><Name>%s</Name><Properties><Last-Modified>%s</Last-Modified>"+
+			"<Content-Length>%d</Content-Length><BlobType>BlockBlob</BlobType><AccessTier>%s</AccessTier>"+
+			"</Properties><Metadata>", name, b.modified.UTC().Format(http.TimeFormat), len(b.data), b.tier)
+		for k, v := range b.metadata {
+			fmt.Fprintf(out, "<%s>", k)
+			xml.EscapeText(out, []byte(v))
+			fmt.Fprintf(out, "</%s>", k)
+		}
+		out.WriteString("</Metadata></Blob>")
+	}
+	out.WriteString("</Blobs><NextMarker/></EnumerationResults>")
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write(out.Bytes())
+}
+
+func fakeBlobError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("x-ms-error-code", code)
+	w.WriteHeader(status)
+}
+
+// azureTestEndpoint returns the url of the devstoreaccount1 account, on Azurite if AZURITE_BLOB_ENDPOINT is set
+// (e.g. to http://127.0.0.1:10000/devstoreaccount1) and otherwise on a fake blob service.
+func azureTestEndpoint() (endpoint string, fake *fakeBlobService, stop func()) {
+	if endpoint = os.Getenv("AZURITE_BLOB_ENDPOINT"); endpoint != "" {
+		return endpoint, nil, func() {}
+	}
+	fake = newFakeBlobService()
+	s := httptest.NewServer(fake)
+	return s.URL + "/devstoreaccount1", fake, s.Close
+}
+
+func TestAzureTarget(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zfs2glacier")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	endpoint, fake, stop := azureTestEndpoint()
+	defer stop()
+	defer os.Setenv(AzureKeyVariable, os.Getenv(AzureKeyVariable))
+
+	os.Unsetenv(AzureKeyVariable)
+	_, err = NewTarget("azure://devstoreaccount1/backup?endpoint=" + endpoint)
+	assert.Error(t, err, "no key")
+	os.Setenv(AzureKeyVariable, azuriteKey)
+	_, err = NewTarget("azure://devstoreaccount1?endpoint=" + endpoint)
+	assert.Error(t, err, "no container")
+	prefix := fmt.Sprintf("zfs%d", time.Now().UnixNano())
+	target, err := NewTarget("azure://devstoreaccount1/backup/" + prefix + "?endpoint=" + endpoint)
+	require.NoError(t, err)
+	at := target.(*azureTarget)
+	at.pollInterval = 10 * time.Millisecond
+	_, err = at.container.Create(context.Background(), nil)
+	if err != nil && !bloberror.HasCode(err, bloberror.ContainerAlreadyExists) {
+		require.NoError(t, err)
+	}
+	require.NoError(t, target.CreateContainer("tank_test"))
+	containers, err := target.ListContainers()
+	require.NoError(t, err)
+	assert.Equal(t, []*Container{{Name: "tank_test", Listable: true}}, containers)
+
+	// every part is staged as a block, the committed blob is moved to the archive tier
+	data := bytes.Repeat([]byte{1, 2, 3, 4, 5}, 1024*512)
+	b := &Batch{targets: defaultTargets(target)}
+	require.NoError(t, b.upload("tank_test", &zfsBackup{zfsReader: bytes.NewBuffer(data), partSize: 1024 * 1024,
+		hasNext: true, dataset: withArchiveID(testDataset())}, "", allRequired(b)))
+	inv, err := target.ListArchives("tank_test")
+	require.NoError(t, err)
+	require.Len(t, inv.ArchiveList, 1)
+	a := inv.ArchiveList[0]
+	assert.Equal(t, int64(len(data)), a.Size)
+	require.NotNil(t, a.Metadata)
+	assert.Equal(t, "1234567890", a.Metadata.GUID)
+	assert.Equal(t, 1024*1024, a.Metadata.PartSize)
+	sum := sha256.Sum256(data)
+	assert.Equal(t, hex.EncodeToString(sum[:]), a.Metadata.StreamSHA256)
+	p, err := at.blob("tank_test", a.ArchiveId).GetProperties(context.Background(), nil)
+	require.NoError(t, err)
+	assert.Equal(t, string(blob.AccessTierArchive), azureString(p.AccessTier))
+	containers, err = target.ListContainers()
+	require.NoError(t, err)
+	assert.Equal(t, []*Container{{Name: "tank_test", Listable: true, Archives: 1, Size: int64(len(data))}}, containers)
+
+	// the blob is rehydrated, a partial download is continued and the blob is archived again
+	require.NoError(t, target.OpenRetrieval("", TierExpedited))
+	file := filepath.Join(dir, "archive")
+	require.NoError(t, ioutil.WriteFile(file, data[:500], 0600))
+	description, err := target.Retrieve("tank_test", a.ArchiveId, file)
+	require.NoError(t, err)
+	assert.Equal(t, a.ArchiveDescription, description)
+	d, err := ioutil.ReadFile(file)
+	require.NoError(t, err)
+	assert.Equal(t, data, d)
+	if fake != nil {
+		assert.Equal(t, "Archive", fake.blobs[prefix+"/tank_test/"+a.ArchiveId].tier)
+	}
+
+	// the storage class selects another tier
+	u, err := target.BeginUpload("tank_test", &UploadRequest{Description: "other", PartSize: 1024 * 1024, StorageClass: "COOL"})
+	require.NoError(t, err)
+	require.NoError(t, u.UploadPart(0, bytes.NewReader(data[:100]), glacier.ComputeHashes(bytes.NewReader(data[:100])).TreeHash))
+	id, err := u.Complete(100, glacier.ComputeHashes(bytes.NewReader(data[:100])).TreeHash)
+	require.NoError(t, err)
+	p, err = at.blob("tank_test", id).GetProperties(context.Background(), nil)
+	require.NoError(t, err)
+	assert.Equal(t, string(blob.AccessTierCool), azureString(p.AccessTier))
+	_, err = target.BeginUpload("tank_test", &UploadRequest{Description: "other", PartSize: 1024 * 1024, StorageClass: "GLACIER"})
+	assert.Error(t, err)
+
+	// a committed blob with the wrong size is deleted by abort
+	u, err = target.BeginUpload("tank_test", &UploadRequest{Description: "other", PartSize: 1024 * 1024})
+	require.NoError(t, err)
+	require.NoError(t, u.UploadPart(0, bytes.NewReader(data[:100]), glacier.ComputeHashes(bytes.NewReader(data[:100])).TreeHash))
+	_, err = u.Complete(200, glacier.ComputeHashes(bytes.NewReader(data[:200])).TreeHash)
+	assert.Error(t, err)
+	assert.NoError(t, u.Abort())
+	inv, err = target.ListArchives("tank_test")
+	require.NoError(t, err)
+	assert.Len(t, inv.ArchiveList, 2)
+}
@@ -6,44 +6,196 @@ import (
 	"bytes"
 	"github.com/aws/aws-sdk-go/service/glacier"
 	"strings"
-	"encoding/json"
+	"fmt"
+	"errors"
 	log "github.com/sirupsen/logrus"
 )
 
 const glacierArchiveID = "ch.floor4:glacier-archive-id"
 
+// SendFlagsProperty zfs attribute. The flags zfs send is called with, any of c, L, e and p, e.g. "-c -L" or "cLe"
+const SendFlagsProperty = "ch.floor4:send_flags"
+
+// sendFlagLetters are the zfs send flags that can be set with SendFlagsProperty in the order they are passed
+// c sends compressed blocks as they are stored, L blocks larger than 128 KiB, e embedded blocks as they are and
+// p the properties of the dataset.
+const sendFlagLetters = "cLep"
+
+// sendFlagFeatures are the pool features a receiver needs for streams sent with a flag
+var sendFlagFeatures = map[rune]string{'L': "large_blocks", 'e': "embedded_data"}
+
+// archiveIDProperty returns the zfs attribute the archive ids of the named target are stored in
+// The target without name uses glacierArchiveID, so existing backups stay valid.
+func archiveIDProperty(target string) string {
+	if target == "" {
+		return glacierArchiveID
+	}
+	return glacierArchiveID + ":" + target
+}
+
 // A Backup is a backup process that when started writes the backup to a backup location
 type Backup interface {
+	// MarkSuccessful stores the archive id of every target the backup was uploaded to, keyed by target name
 	// It can't be started again after calling MarkSuccessful
-	MarkSuccessful(archiveID string) error
+	MarkSuccessful(archiveIDs map[string]string) error
 	GetPartSize() int
+	// GetEstimatedSize returns the size zfs estimated for the send stream before it was sent, 0 if unknown
+	GetEstimatedSize() int64
 	NextPart() (io.ReadSeeker, []byte)
+	// ReadPart reads the next part into buf, which has to hold GetPartSize bytes, and returns its length
+	// Unlike NextPart it leaves computing the tree hash to the caller, so it can be done while the next part is read.
+	ReadPart(buf []byte) (int, error)
 	HasNextPart() bool
 	GetBaseDataset() zfsiface.Dataset
 	GetDataset() zfsiface.Dataset
 	IsIncremental() bool
-	GetDescription() string
+	// IsResumable returns false if the stream differs every time it is sent, e.g. because it is encrypted
+	IsResumable() bool
+	// GetDescription returns the archive description for the named target, it contains the target's base archive id
+	GetDescription(target string) (string, error)
+	// FullCopy returns a backup that sends the whole snapshot again once MarkSuccessful was called
+	// It catches up targets that lack the base snapshot, its MarkSuccessful only stores their archive ids.
+	FullCopy() Backup
+}
+
+// StreamOptions select how the send stream of a filesystem is processed before it is split into parts
+type StreamOptions struct {
+	// Raw sends the blocks of a natively encrypted dataset as they are stored, without loading its key
+	Raw bool
+	// SendFlags are the letters of further zfs send flags, see ParseSendFlags
+	SendFlags string
+	// Compression compresses the stream, it is sent uncompressed if nil
+	Compression *Compression
+	// Encryption encrypts the stream, it is sent unencrypted if nil
+	Encryption Encryption
+	// PartSize is the size of the parts the stream is uploaded in, 0 chooses it from the estimated stream size
+	PartSize int
+	// maxPartSize limits the part size chosen from the stream size to what the targets accept, see checkPartSize
+	maxPartSize int64
+}
+
+// checkDescription returns an error if the description of a backup with these options can exceed the limit of glacier
+// It encodes the options with identifiers of the longest possible length, e.g. an archive id of 138 characters.
+func (o *StreamOptions) checkDescription() error {
+	m := &Metadata{
+		BaseArchiveID: strings.Repeat("x", 138),
+		IsIncremental: true,
+		GUID:          strings.Repeat("9", 20),
+		FromGUID:      strings.Repeat("9", 20),
+		CreateTxg:     strings.Repeat("9", 20),
+		Tool:          Version,
+		PartSize:      int(maxPartSize),
+		StreamSHA256:  strings.Repeat("f", 64),
+		Raw:           o.Raw,
+		SendFlags:     o.SendFlags,
+	}
+	if o.Compression != nil {
+		m.Compression = o.Compression.Algorithm
+	}
+	if o.Encryption != nil {
+		m.Encryption = o.Encryption.Metadata()
+	}
+	_, err := m.Encode()
+	return err
+}
+
+// partSizeLimit returns the largest part size that may be chosen from the stream size
+func (o *StreamOptions) partSizeLimit() int64 {
+	if o.maxPartSize == 0 {
+		return maxPartSize
+	}
+	return o.maxPartSize
+}
+
+// sendFlags returns the flags zfs send is called with, the go-zfs wrapper sends without flags
+func (o *StreamOptions) sendFlags() []string {
+	flags := make([]string, 0)
+	if o.Raw {
+		flags = append(flags, "-w")
+	}
+	for _, f := range o.SendFlags {
+		flags = append(flags, "-"+string(f))
+	}
+	return flags
+}
+
+// ParseSendFlags returns the zfs send flags in value, separated by spaces or commas and with optional dashes
+// The flags are returned as their letters in the order of sendFlagLetters.
+func ParseSendFlags(value string) (string, error) {
+	set := make(map[rune]bool)
+	for _, f := range strings.FieldsFunc(value, func(r rune) bool { return r == ' ' || r == ',' }) {
+		for _, r := range strings.TrimPrefix(f, "-") {
+			if !strings.ContainsRune(sendFlagLetters, r) {
+				return "", fmt.Errorf("unsupported zfs send flag -%c, only -c, -L, -e and -p can be set", r)
+			}
+			set[r] = true
+		}
+	}
+	flags := ""
+	for _, r := range sendFlagLetters {
+		if set[r] {
+			flags += string(r)
+		}
+	}
+	return flags, nil
 }
 
-// Metadata contains information for a backup that is rendered as JSON
-// It is saved as description field in aws
-type Metadata struct {
-	BaseArchiveID string `json:",omitempty"`
-	IsIncremental bool
+// stages returns the writer the send stream is written to, it compresses and encrypts the stream written to w
+// The stages have to be closed in the returned order once the stream was sent.
+func (o *StreamOptions) stages(w io.Writer) (io.Writer, []io.WriteCloser, error) {
+	stages := make([]io.WriteCloser, 0, 2)
+	if o.Encryption != nil {
+		enc, err := o.Encryption.Encrypt(w)
+		if err != nil {
+			return nil, nil, err
+		}
+		stages = append(stages, enc)
+		w = enc
+	}
+	if o.Compression != nil {
+		c, err := o.Compression.compress(w)
+		if err != nil {
+			return nil, nil, err
+		}
+		stages = append([]io.WriteCloser{c}, stages...)
+		w = c
+	}
+	return w, stages, nil
 }
 
-func newBackup(dataset, base zfsiface.Dataset) Backup {
+// newBackup sends the dataset, or its difference to base if set, through the stages selected by o
+// The stream is compressed and then encrypted before it is split into parts.
+// The part size is chosen from the size zfs estimates for the stream unless o sets it.
+func newBackup(dataset, base zfsiface.Dataset, o *StreamOptions) Backup {
+	partSize := o.PartSize
+	size, err := estimateSize(dataset, base, o.sendFlags())
+	if err != nil {
+		log.WithField("fs", dataset.GetNativeProperties().Name).Warn("could not estimate the stream size: ", err)
+		if partSize == 0 {
+			partSize = unknownSizePartSize
+		}
+	} else if partSize == 0 {
+		partSize = partSizeFor(size, o.partSizeLimit())
+	}
+	log.WithField("fs", dataset.GetNativeProperties().Name).WithField("size", size).
+		WithField("partSize", partSize).Debug("stream size estimated")
 	reader, writer := io.Pipe()
 	go func() {
-		var err error
+		out, stages, err := o.stages(writer)
+		if err != nil {
+			writer.CloseWithError(err)
+			return
+		}
 		if base == nil {
 			log.WithField("fs", dataset.GetNativeProperties().Name).WithField("isFull", true).
 				Info("starting full backup")
-			err = dataset.SendSnapshot(writer)
 		} else {
 			log.WithField("fs", dataset.GetNativeProperties().Name).WithField("isFull", false).
 				Info("starting incremental backup")
-			err = dataset.SendIncrementalSnapshot(base, writer)
+		}
+		err = sendSnapshot(dataset, base, o.sendFlags(), out)
+		for i := 0; err == nil && i < len(stages); i++ {
+			err = stages[i].Close()
 		}
 		if err != nil {
 			err = writer.CloseWithError(err)
@@ -55,23 +207,60 @@ func newBackup(dataset, base zfsiface.Dataset) Backup {
 		}
 	}()
 	b := &zfsBackup{
-		data:      make([]byte, 1024*1024*128),
+		partSize:  partSize,
+		size:      size,
 		hashes:    make([][]byte, 0, 128),
 		zfsReader: reader,
 		hasNext:   true,
 		dataset:   dataset,
 		base:      base,
+		options:   o,
 	}
 	return b
 }
 
+// sendSnapshot writes the send stream of dataset, incremental from base if set, to w
+// Streams with flags need an optionDataset, the go-zfs datasets only send plain streams.
+func sendSnapshot(dataset, base zfsiface.Dataset, flags []string, w io.Writer) error {
+	if len(flags) > 0 {
+		od, ok := dataset.(optionDataset)
+		if !ok {
+			return errors.New("dataset " + dataset.GetNativeProperties().Name + " can't be sent with zfs send flags")
+		}
+		return od.SendSnapshotWithFlags(base, flags, w)
+	}
+	if base == nil {
+		return dataset.SendSnapshot(w)
+	}
+	return dataset.SendIncrementalSnapshot(base, w)
+}
+
+// estimateSize returns the size zfs estimates for the send stream of dataset, incremental from base if set
+func estimateSize(dataset, base zfsiface.Dataset, flags []string) (int64, error) {
+	od, ok := dataset.(optionDataset)
+	if !ok {
+		return 0, errors.New("dataset " + dataset.GetNativeProperties().Name + " can't estimate its stream size")
+	}
+	return od.EstimateSnapshot(base, flags)
+}
+
 type zfsBackup struct {
 	base      zfsiface.Dataset
 	dataset   zfsiface.Dataset
+	partSize  int
+	// size is the estimated size of the stream, 0 if unknown
+	size      int64
+	// data is the buffer of NextPart, it is allocated with the first part
 	data      []byte
 	hashes    [][]byte
 	zfsReader io.Reader
 	hasNext   bool
+	// options are the stages the stream was sent through, nil for a plain stream
+	options *StreamOptions
+	// previous are the snapshots of the backups a forced full backup replaces, they are destroyed once it succeeded
+	previous []zfsiface.Dataset
+	// copy is set for a full stream of a snapshot that was already backed up, it keeps its name, see FullCopy
+	copy bool
 }
 
 func (b *zfsBackup) GetBaseDataset() zfsiface.Dataset {
@@ -87,33 +276,59 @@ func (b *zfsBackup) HasNextPart() bool {
 }
 
 func (b *zfsBackup) GetPartSize() int {
-	return len(b.data)
+	return b.partSize
+}
+
+func (b *zfsBackup) GetEstimatedSize() int64 {
+	return b.size
 }
 
 func (b *zfsBackup) IsIncremental() bool {
 	return b.base != nil
 }
 
+// IsResumable returns false for encrypted streams, every encryption uses a new key or salt
+func (b *zfsBackup) IsResumable() bool {
+	return b.options == nil || b.options.Encryption == nil
+}
+
 func (b *zfsBackup) NextPart() (io.ReadSeeker, []byte) {
 	if !b.hasNext {
 		panic("No next chunck. Check first with HasNext")
 	}
-	n, err := io.ReadAtLeast(b.zfsReader, b.data, b.GetPartSize())
-	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
-		panic(err)
+	if b.data == nil {
+		b.data = make([]byte, b.partSize)
 	}
-	if err == io.EOF || err == io.ErrUnexpectedEOF {
-		b.hasNext = false
+	n, err := b.ReadPart(b.data)
+	if err != nil {
+		panic(err)
 	}
 	buf := bytes.NewReader(b.data[:n])
 	h := glacier.ComputeHashes(buf)
 	return buf, h.TreeHash
 }
 
-func (b *zfsBackup) MarkSuccessful(archiveID string) error {
-	err := b.dataset.SetProperty(glacierArchiveID, archiveID)
-	if err != nil {
-		return err
+func (b *zfsBackup) ReadPart(buf []byte) (int, error) {
+	if !b.hasNext {
+		return 0, errors.New("no next part, check first with HasNextPart")
+	}
+	n, err := io.ReadAtLeast(b.zfsReader, buf[:b.partSize], b.partSize)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		b.hasNext = false
+		err = nil
+	}
+	return n, err
+}
+
+func (b *zfsBackup) MarkSuccessful(archiveIDs map[string]string) error {
+	var err error
+	for target, id := range archiveIDs {
+		if err = b.dataset.SetProperty(archiveIDProperty(target), id); err != nil {
+			return err
+		}
+	}
+	if b.copy {
+		return nil
 	}
 	if b.IsIncremental() {
 		n := b.base.GetNativeProperties().Name
@@ -128,39 +343,94 @@ func (b *zfsBackup) MarkSuccessful(archiveID string) error {
 			}
 		}
 	}
-	np := b.dataset.GetNativeProperties()
-	p := strings.Split(np.Name, "@")
+	for _, p := range b.previous {
+		if err = p.Destroy(zfsiface.DestroyDefault); err != nil {
+			return err
+		}
+	}
+	b.dataset, err = b.dataset.Rename(b.finalName(), false, false)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// finalName returns the name the snapshot is renamed to once the upload succeeded
+func (b *zfsBackup) finalName() string {
+	n := b.dataset.GetNativeProperties().Name
+	p := strings.Split(n, "@")
 	if len(p) != 2 {
-		panic("unexpected snapshot name format " + np.Name)
+		panic("unexpected snapshot name format " + n)
+	}
+	if b.copy {
+		return n
 	}
 	if b.IsIncremental() {
-		b.dataset, err = b.dataset.Rename(p[0]+"@glacier-incremental", false, false)
-	} else {
-		b.dataset, err = b.dataset.Rename(p[0]+"@glacier-full", false, false)
+		return p[0] + "@glacier-incremental"
 	}
+	return p[0] + "@glacier-full"
+}
+
+func (b *zfsBackup) FullCopy() Backup {
+	o := b.options
+	if o == nil {
+		o = &StreamOptions{}
+	}
+	c := newBackup(b.dataset, nil, o).(*zfsBackup)
+	c.copy = true
+	return c
+}
+
+func (b *zfsBackup) GetDescription(target string) (string, error) {
+	m, err := b.metadata(target)
 	if err != nil {
-		return err
+		return "", err
 	}
-	return nil
+	return m.Encode()
 }
 
-func (b *zfsBackup) GetDescription() string {
+// metadata collects the Metadata of the backup for the named target from the sent snapshot and its base
+func (b *zfsBackup) metadata(target string) (*Metadata, error) {
+	np := b.dataset.GetNativeProperties()
+	p := strings.Split(b.finalName(), "@")
 	m := &Metadata{
+		Version:       MetadataVersion,
 		IsIncremental: b.IsIncremental(),
+		Dataset:       p[0],
+		Snapshot:      p[1],
+		Creation:      np.Creation,
+		Tool:          Version,
+		PartSize:      b.GetPartSize(),
+	}
+	if b.options != nil {
+		m.Raw = b.options.Raw
+		m.SendFlags = b.options.SendFlags
+	}
+	if b.options != nil && b.options.Compression != nil {
+		m.Compression = b.options.Compression.Algorithm
+	}
+	if b.options != nil && b.options.Encryption != nil {
+		m.Encryption = b.options.Encryption.Metadata()
+	}
+	var err error
+	if m.GUID, _, err = b.dataset.GetProperty("guid"); err != nil {
+		return nil, err
+	}
+	if m.CreateTxg, _, err = b.dataset.GetProperty("createtxg"); err != nil {
+		return nil, err
 	}
 	if b.base != nil {
-		bdID, _, err := b.base.GetProperty(glacierArchiveID)
+		bdID, _, err := b.base.GetProperty(archiveIDProperty(target))
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
 		if bdID == "" {
-			panic("No glacier archive ID found for base dataset")
+			return nil, errors.New("no glacier archive id found for the base snapshot")
 		}
 		m.BaseArchiveID = bdID
+		if m.FromGUID, _, err = b.base.GetProperty("guid"); err != nil {
+			return nil, err
+		}
 	}
-	d, err := json.Marshal(m)
-	if err != nil {
-		panic(err)
-	}
-	return string(d)
+	return m, nil
 }
@@ -6,6 +6,9 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/timaebi/go-zfs/zfsiface"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"time"
 )
 
 func TestZfsBackup_NextPart(t *testing.T) {
@@ -13,7 +16,7 @@ func TestZfsBackup_NextPart(t *testing.T) {
 	const chunckLength = 1024 * 1024 * 10
 
 	data := []byte{1, 2, 3}
-	b := zfsBackup{zfsReader: bytes.NewBuffer(data), data: make([]byte, chunckLength), hasNext: true}
+	b := zfsBackup{zfsReader: bytes.NewBuffer(data), partSize: chunckLength, hasNext: true}
 	assert.True(t, b.HasNextPart())
 	p, h := b.NextPart()
 	readBuf := make([]byte, b.GetPartSize())
@@ -34,7 +37,7 @@ func TestZfsBackup_MarkSuccessful(t *testing.T) {
 	d.On("GetNativeProperties").Return(&zfsiface.NativeProperties{Name: "test/fs@glacier-tmp"}).Once()
 	d.On("Rename", "test/fs@glacier-full", false, false).Return(&Dataset{}, nil)
 	b := zfsBackup{dataset: d}
-	err := b.MarkSuccessful("received-archive-id")
+	err := b.MarkSuccessful(map[string]string{"": "received-archive-id"})
 	assert.NoError(t, err)
 	mock.AssertExpectationsForObjects(t, d)
 
@@ -46,7 +49,7 @@ func TestZfsBackup_MarkSuccessful(t *testing.T) {
 	d.On("GetNativeProperties").Return(&zfsiface.NativeProperties{Name: "test/fs@glacier-tmp"}).Once()
 	d.On("Rename", "test/fs@glacier-incremental", false, false).Return(&Dataset{}, nil)
 	b = zfsBackup{dataset: d, base: base}
-	err = b.MarkSuccessful("received-archive-id")
+	err = b.MarkSuccessful(map[string]string{"": "received-archive-id"})
 	assert.NoError(t, err)
 	mock.AssertExpectationsForObjects(t, d)
 	mock.AssertExpectationsForObjects(t, base)
@@ -58,29 +61,111 @@ func TestZfsBackup_MarkSuccessful(t *testing.T) {
 	d.On("GetNativeProperties").Return(&zfsiface.NativeProperties{Name: "test/fs@glacier-tmp"}).Once()
 	d.On("Rename", "test/fs@glacier-incremental", false, false).Return(&Dataset{}, nil)
 	b = zfsBackup{dataset: d, base: base}
-	err = b.MarkSuccessful("received-archive-id")
+	err = b.MarkSuccessful(map[string]string{"": "received-archive-id"})
 	assert.NoError(t, err)
 	mock.AssertExpectationsForObjects(t, d)
 	mock.AssertExpectationsForObjects(t, base)
+
+	// every target has its own archive id
+	d = &Dataset{}
+	d.On("SetProperty", glacierArchiveID, "received-archive-id").Return(nil).Once()
+	d.On("SetProperty", "ch.floor4:glacier-archive-id:nas", "nas-archive-id").Return(nil).Once()
+	d.On("GetNativeProperties").Return(&zfsiface.NativeProperties{Name: "test/fs@glacier-tmp"}).Once()
+	d.On("Rename", "test/fs@glacier-full", false, false).Return(&Dataset{}, nil)
+	b = zfsBackup{dataset: d}
+	err = b.MarkSuccessful(map[string]string{"": "received-archive-id", "nas": "nas-archive-id"})
+	assert.NoError(t, err)
+	mock.AssertExpectationsForObjects(t, d)
 }
 
 func TestZfsBackup_GetDescription(t *testing.T) {
+	creation := time.Date(2018, 3, 1, 10, 0, 0, 0, time.UTC)
+	newDataset := func() *Dataset {
+		d := &Dataset{}
+		d.On("GetNativeProperties").Return(&zfsiface.NativeProperties{Name: "tank/test@glacier-tmp", Creation: creation})
+		d.On("GetProperty", "guid").Return("1234", zfsiface.None, nil)
+		d.On("GetProperty", "createtxg").Return("42", zfsiface.None, nil)
+		return d
+	}
+
 	// backup with existing base
 	base := &Dataset{}
 	base.On("GetProperty", glacierArchiveID).Return("id-abc-1234", zfsiface.Local, nil)
-	bkp := zfsBackup{base: base}
-	assert.Equal(t, `{"BaseArchiveID":"id-abc-1234","IsIncremental":true}`, bkp.GetDescription())
+	base.On("GetProperty", "guid").Return("1000", zfsiface.None, nil)
+	bkp := zfsBackup{dataset: newDataset(), base: base, partSize: 1024}
+	description, err := bkp.GetDescription("")
+	require.NoError(t, err)
+	assert.Equal(t, `{"v":2,"b":"id-abc-1234","i":true,"ds":"tank/test","sn":"glacier-incremental","g":"1234",`+
+		`"fg":"1000","tx":"42","ct":"2018-03-01T10:00:00Z","tv":"dev","ps":1024}`, description)
 	base.AssertExpectations(t)
+	m, err := ParseMetadata(description)
+	require.NoError(t, err)
+	assert.Equal(t, &Metadata{Version: 2, BaseArchiveID: "id-abc-1234", IsIncremental: true, Dataset: "tank/test",
+		Snapshot: "glacier-incremental", GUID: "1234", FromGUID: "1000", CreateTxg: "42", Creation: creation,
+		Tool: "dev", PartSize: 1024}, m)
+
+	// the base archive id is the one of the target
+	base.On("GetProperty", "ch.floor4:glacier-archive-id:nas").Return("nas-1", zfsiface.Local, nil)
+	description, err = bkp.GetDescription("nas")
+	require.NoError(t, err)
+	m, err = ParseMetadata(description)
+	require.NoError(t, err)
+	assert.Equal(t, "nas-1", m.BaseArchiveID)
 
 	// backup without existing base
-	bkp = zfsBackup{}
-	assert.Equal(t, `{"IsIncremental":false}`, bkp.GetDescription())
+	bkp = zfsBackup{dataset: newDataset()}
+	description, err = bkp.GetDescription("")
+	require.NoError(t, err)
+	assert.Equal(t, `{"v":2,"i":false,"ds":"tank/test","sn":"glacier-full","g":"1234","tx":"42",`+
+		`"ct":"2018-03-01T10:00:00Z","tv":"dev"}`, description)
 
-	// base snapshot without archive id should panic
+	// base snapshot without archive id is an error
 	base = &Dataset{}
 	base.On("GetProperty", glacierArchiveID).Return("", zfsiface.Unknown, nil)
-	bkp = zfsBackup{base: base}
-	assert.PanicsWithValue(t, "No glacier archive ID found for base dataset", func() {
-		bkp.GetDescription()
-	})
+	bkp = zfsBackup{dataset: newDataset(), base: base}
+	_, err = bkp.GetDescription("")
+	assert.EqualError(t, err, "no glacier archive id found for the base snapshot")
+}
+
+func TestParseMetadata(t *testing.T) {
+	// descriptions of older releases
+	m, err := ParseMetadata(`{"BaseArchiveID":"id-abc-1234","IsIncremental":true}`)
+	assert.NoError(t, err)
+	assert.Equal(t, &Metadata{Version: 1, BaseArchiveID: "id-abc-1234", IsIncremental: true}, m)
+	m, err = ParseMetadata(`{"IsIncremental":false}`)
+	assert.NoError(t, err)
+	assert.Equal(t, &Metadata{Version: 1}, m)
+
+	_, err = ParseMetadata(`{"v":3,"i":false}`)
+	assert.EqualError(t, err, "unsupported metadata version 3")
+	_, err = ParseMetadata("uploaded by hand")
+	assert.Error(t, err)
+}
+
+func TestMetadata_Encode(t *testing.T) {
+	m := &Metadata{Dataset: "tank/b\u00e4r", Snapshot: "glacier-full", GUID: "1",
+		Encryption: &EncryptionMetadata{Scheme: "age", Recipients: []string{"fp1"}}}
+	d, err := m.Encode()
+	assert.NoError(t, err)
+	for _, c := range d {
+		assert.True(t, c >= 0x20 && c <= 0x7e, "non printable character %q", c)
+	}
+	p, err := ParseMetadata(d)
+	assert.NoError(t, err)
+	assert.Equal(t, "tank/b\u00e4r", p.Dataset)
+	assert.Equal(t, m.Encryption, p.Encryption)
+
+	// names are left out when the description gets too long
+	m = &Metadata{Dataset: strings.Repeat("d", 600), Snapshot: strings.Repeat("s", 500), GUID: "1"}
+	d, err = m.Encode()
+	assert.NoError(t, err)
+	assert.True(t, len(d) <= 1024)
+	p, err = ParseMetadata(d)
+	assert.NoError(t, err)
+	assert.Equal(t, m.Dataset, p.Dataset)
+	assert.Empty(t, p.Snapshot)
+
+	m = &Metadata{Encryption: &EncryptionMetadata{Scheme: "age", Recipients: []string{strings.Repeat("r", 1024)}}}
+	_, err = m.Encode()
+	assert.Error(t, err)
 }
@@ -2,46 +2,50 @@ package bkp
 
 import (
 	"github.com/aws/aws-sdk-go/service/glacier"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/aws"
 	"errors"
-	"github.com/aws/aws-sdk-go/service/glacier/glacieriface"
 	"fmt"
 	log "github.com/sirupsen/logrus"
-	"strconv"
-	"io"
+	"strings"
+	"time"
+	"crypto/sha256"
 )
 
 // A Batch contains zfs filesystems that can be stored in aws glacier when executed
 type Batch struct {
-	filter         string
-	filesystems    []Filesystem
-	initialized    bool
-	existingVaults []*glacier.DescribeVaultOutput
-	glacier        glacieriface.GlacierAPI
+	filter      string
+	filesystems []Filesystem
+	initialized bool
+	// targets receive the backups, status, inventory and verification use the first one
+	targets []*NamedTarget
+	// containers are the existing containers of every target by target name, see accountTarget for other accounts
+	containers map[string][]*Container
+	// accounts are the targets connected with the aws settings of filesystems
+	accounts map[string]*NamedTarget
+	catalog  *Catalog
+	// workers upload parts at once, the part buffers take at most bufferBudget bytes, see SetConcurrency
+	workers      int
+	bufferBudget int64
 }
 
-// NewBatch creates a new batch
+// NewBatch creates a new batch which uploads to the given targets
 // If filter is set, only filesystems under the given path are considered.
-func NewBatch(filter string) (*Batch, error) {
-	g, err := setupGlacierClient()
-	if err != nil {
-		return nil, err
-	}
-	return &Batch{filter: filter, glacier: g}, nil
+func NewBatch(filter string, targets []*NamedTarget) *Batch {
+	return &Batch{filter: filter, targets: targets}
 }
 
-// setupGlacierClient initializes the connection to aws
-func setupGlacierClient() (glacieriface.GlacierAPI, error) {
-	// Setup AWS client
-	s, err := session.NewSessionWithOptions(session.Options{
-		SharedConfigFiles: []string{"/etc/aws.conf"}, // TODO make this configurable with
-		SharedConfigState: session.SharedConfigEnable,
-	})
-	if err != nil {
-		return nil, err
+// SetCatalog sets the catalog every completed upload is recorded in
+func (b *Batch) SetCatalog(c *Catalog) {
+	b.catalog = c
+	for _, t := range b.targets {
+		if ct, ok := t.Target.(catalogTarget); ok {
+			ct.setCatalog(c)
+		}
 	}
-	return glacier.New(s), nil
+}
+
+// primary returns the target status, inventory and verification work on
+func (b *Batch) primary() *NamedTarget {
+	return b.targets[0]
 }
 
 // Init prepares the Batch for execution with Run
@@ -57,17 +61,20 @@ func (b *Batch) Init() error {
 	b.filesystems = d
 
 	// List existing vaults
-	v, err := b.glacier.ListVaults(&glacier.ListVaultsInput{AccountId: aws.String("-")})
-	if err != nil {
-		return err
-	}
-	b.existingVaults = v.VaultList
+	b.containers = make(map[string][]*Container)
+	for _, t := range b.targets {
+		containers, err := t.ListContainers()
+		if err != nil {
+			return err
+		}
+		b.containers[t.Name] = containers
 
-	vaultNames := make([]string, len(b.existingVaults))
-	for i, v := range b.existingVaults {
-		vaultNames[i] = *v.VaultName
+		vaultNames := make([]string, len(containers))
+		for i, c := range containers {
+			vaultNames[i] = c.Name
+		}
+		log.WithField("target", t.Name).WithField("vaults", vaultNames).Debug("aws existing vaults")
 	}
-	log.WithField("vaults", vaultNames).Debug("aws existing vaults")
 
 	b.initialized = true
 	return nil
@@ -77,7 +84,8 @@ func (b *Batch) Init() error {
 // 1. create a snapshot of each ZFSFilesystem to backup
 // 2. create vaults for volumes without an existing vault
 // 3. create diff to previous snapshot
-// 4. upload one snapshot after the other
+// 4. upload one snapshot after the other, every part is uploaded to all targets of the filesystem at once while the
+//    workers set with SetConcurrency upload the next parts
 func (b *Batch) Run() error {
 	if !b.initialized {
 		return errors.New("batch needs to be initialized before run")
@@ -85,27 +93,41 @@ func (b *Batch) Run() error {
 	log.WithField("nFS", len(b.filesystems)).Info("starting batch")
 	for _, fs := range b.filesystems {
 		if fs.IsBackupEnabled() {
-			forceFull := false
 			vn := fs.GetVaultName()
-			if !b.vaultExists(vn) {
-				// create vault and force full backup
-				_, err := b.glacier.CreateVault(&glacier.CreateVaultInput{
-					AccountId: aws.String("-"),
-					VaultName: aws.String(vn),
-				})
-				if err != nil {
-					return err
-				}
-				log.WithField("vault", vn).Info("vault created")
-				forceFull = true
+			targets, forceFull, err := b.prepareTargets(fs)
+			if err != nil {
+				return err
 			}
 			due := fs.IsDue()
 			if due || forceFull {
+				if !forceFull {
+					if forceFull, err = b.chainMissing(fs, targets); err != nil {
+						return err
+					}
+				}
+				o, err := fs.GetStreamOptions()
+				if err != nil {
+					return err
+				}
+				if err = checkStreamOptions(vn, o, targets); err != nil {
+					return err
+				}
+				if err = checkPartSize(vn, o, targets); err != nil {
+					return err
+				}
 				log.WithField("vault", vn).Info("starting backup")
-				backup := fs.Backup(forceFull)
-				if err := b.upload(vn, backup); err != nil {
+				backup := fs.Backup(forceFull, o)
+				if backup == nil {
+					log.WithField("vault", vn).Info("backup is not due")
+					continue
+				}
+				current, lagging := splitLagging(backup, targets)
+				if err := b.upload(vn, backup, fs.GetStorageClass(), current); err != nil {
 					return err
 				}
+				if len(lagging) > 0 {
+					b.catchUp(vn, backup, fs.GetStorageClass(), lagging)
+				}
 				log.WithField("vault", vn).Info("finished backup")
 			} else {
 				log.WithField("vault", vn).Info("backup is not due")
@@ -118,68 +140,443 @@ func (b *Batch) Run() error {
 	return nil
 }
 
-func (b *Batch) upload(vault string, bkp Backup) error {
-	o, err := b.glacier.InitiateMultipartUpload(&glacier.InitiateMultipartUploadInput{
-		AccountId:          aws.String("-"),
-		ArchiveDescription: aws.String(bkp.GetDescription()),
-		PartSize:           aws.String(strconv.Itoa(bkp.GetPartSize())),
-		VaultName:          &vault,
-	})
+// An uploadTarget is a target a filesystem is uploaded to
+type uploadTarget struct {
+	*NamedTarget
+	// required targets have to succeed for the snapshot to be marked as uploaded
+	required bool
+}
+
+// prepareTargets selects the targets of a filesystem and creates its vault where it does not exist yet
+// A full backup is forced right away if no target had a vault for the filesystem, see also chainMissing.
+func (b *Batch) prepareTargets(fs Filesystem) ([]*uploadTarget, bool, error) {
+	vn := fs.GetVaultName()
+	selected := fs.GetTargets()
+	for name := range selected {
+		if b.target(name) == nil {
+			return nil, false, fmt.Errorf("%s of %s selects the unknown target %q", Targets, fs.GetVaultName(), name)
+		}
+	}
+	targets := make([]*uploadTarget, 0, len(b.targets))
+	created := 0
+	for _, t := range b.targets {
+		required, ok := selected[t.Name]
+		if selected == nil {
+			required, ok = true, true
+		}
+		if !ok {
+			continue
+		}
+		t, key, err := b.accountTarget(t, fs)
+		if err != nil {
+			return nil, false, err
+		}
+		if !b.containerExists(key, vn) {
+			if err := t.CreateContainer(vn); err != nil {
+				return nil, false, err
+			}
+			log.WithField("target", t.Name).WithField("vault", vn).Info("vault created")
+			b.containers[key] = append(b.containers[key], &Container{Name: vn})
+			created++
+		}
+		targets = append(targets, &uploadTarget{NamedTarget: t, required: required})
+	}
+	return targets, created > 0 && created == len(targets), nil
+}
+
+// checkStreamOptions returns an error if a target receiving the send stream would get it compressed or encrypted
+func checkStreamOptions(vault string, o *StreamOptions, targets []*uploadTarget) error {
+	if o.Compression == nil && o.Encryption == nil {
+		return nil
+	}
+	for _, t := range targets {
+		if _, ok := t.Target.(streamTarget); ok {
+			return fmt.Errorf("target %s of %s receives the send stream with zfs receive, it can't be compressed or encrypted",
+				t.Name, vault)
+		}
+	}
+	return nil
+}
+
+// chainMissing returns true if a required target lacks the archive of the base snapshot, so the next backup has to
+// be full. This is the case for a target added to a filesystem that has backups. Optional targets lacking it, e.g.
+// because their upload failed, are caught up after the incremental backup, see catchUp. Only if all targets lack it
+// the backup is full as well.
+func (b *Batch) chainMissing(fs Filesystem, targets []*uploadTarget) (bool, error) {
+	missing := 0
+	for _, t := range targets {
+		id, err := fs.GetLastArchiveID(t.Name)
+		if err != nil {
+			return false, err
+		}
+		if id != "" {
+			continue
+		}
+		missing++
+		if t.required || missing == len(targets) {
+			log.WithField("vault", fs.GetVaultName()).WithField("target", t.Name).
+				Info("target lacks the archive of the base snapshot, the backup is full")
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// splitLagging separates the optional targets lacking the base of an incremental backup from the other targets
+func splitLagging(bkp Backup, targets []*uploadTarget) ([]*uploadTarget, []*uploadTarget) {
+	if !bkp.IsIncremental() {
+		return targets, nil
+	}
+	current := make([]*uploadTarget, 0, len(targets))
+	lagging := make([]*uploadTarget, 0)
+	for _, t := range targets {
+		id, _, err := bkp.GetBaseDataset().GetProperty(archiveIDProperty(t.Name))
+		if !t.required && err == nil && (id == "" || id == "-") {
+			lagging = append(lagging, t)
+		} else {
+			current = append(current, t)
+		}
+	}
+	return current, lagging
+}
+
+// catchUp uploads the snapshot of a successful incremental backup in full to optional targets lacking its base
+// Their next incremental backup is based on it again. As the targets are optional, a failed upload is only logged.
+func (b *Batch) catchUp(vault string, bkp Backup, storageClass string, targets []*uploadTarget) {
+	for _, t := range targets {
+		log.WithField("vault", vault).WithField("target", t.Name).
+			Info("target lacks the base snapshot, it gets the backup in full")
+	}
+	if err := b.upload(vault, bkp.FullCopy(), storageClass, targets); err != nil {
+		log.WithField("vault", vault).Warn("full backup to the optional targets failed: ", err)
+	}
+}
+
+// accountTarget returns the target connected with the aws settings of a filesystem
+// It also returns the key the containers of the returned target are stored under in b.containers. Filesystems without
+// aws settings and targets that don't connect to aws use t itself.
+func (b *Batch) accountTarget(t *NamedTarget, fs Filesystem) (*NamedTarget, string, error) {
+	at, ok := t.Target.(awsTarget)
+	if !ok {
+		return t, t.Name, nil
+	}
+	c := fs.GetAWSConfig()
+	if c.IsEmpty() {
+		return t, t.Name, nil
+	}
+	key := t.Name + "|" + c.String()
+	if a, ok := b.accounts[key]; ok {
+		return a, key, nil
+	}
+	target, err := at.withAWSConfig(c)
+	if err != nil {
+		return nil, "", err
+	}
+	containers, err := target.ListContainers()
 	if err != nil {
+		return nil, "", err
+	}
+	a := &NamedTarget{Name: t.Name, Target: target}
+	if b.accounts == nil {
+		b.accounts = make(map[string]*NamedTarget)
+	}
+	b.accounts[key] = a
+	b.containers[key] = containers
+	log.WithField("target", t.Name).WithField("aws", c).Debug("connected with the aws settings of a filesystem")
+	return a, key, nil
+}
+
+// target returns the target with the given name, nil if there is none
+func (b *Batch) target(name string) *NamedTarget {
+	for _, t := range b.targets {
+		if t.Name == name {
+			return t
+		}
+	}
+	return nil
+}
+
+// A fanOut is the upload of a backup to one of its targets
+type fanOut struct {
+	*uploadTarget
+	upload Upload
+	// err is set once the upload failed, the target gets no further parts
+	err error
+	// skipped is set once the failure of an optional target has been handled
+	skipped bool
+	// resumed is the number of parts the target has from an interrupted upload, it gets the parts after them
+	resumed int
+}
+
+// upload sends the parts of the backup to all targets at once
+// The snapshot is marked as uploaded if every required target succeeded, failed optional targets are logged.
+// The uploads are recorded in the catalog as they run, so uploads of the same stream interrupted by the process dying
+// are continued after the parts the targets already have.
+func (b *Batch) upload(vault string, bkp Backup, storageClass string, targets []*uploadTarget) error {
+	started := time.Now()
+	uploads := make([]*fanOut, 0, len(targets))
+	for _, t := range targets {
+		f := &fanOut{uploadTarget: t}
+		uploads = append(uploads, f)
+		if bkp.IsIncremental() {
+			if id, _, err := bkp.GetBaseDataset().GetProperty(archiveIDProperty(t.Name)); err != nil {
+				f.err = err
+			} else if id == "" || id == "-" {
+				f.err = errors.New("the base snapshot was not uploaded to the target, it needs a full backup")
+			}
+		}
+	}
+	if err := checkStorageClass(storageClass, uploads); err != nil {
 		return err
 	}
-	log.WithField("vault", vault).Debug("multipart upload initiated")
-	pos := int64(0)
-	hashes := make([][]byte, 0, 100)
-	for bkp.HasNextPart() {
-		p, h := bkp.NextPart()
-		hashes = append(hashes, h)
-		var l int64
-		l, err = p.Seek(0, io.SeekEnd)
-		if err != nil {
+	state, skipped := b.resume(vault, bkp, uploads)
+	for _, f := range uploads {
+		if f.err == nil && f.upload == nil {
+			var description string
+			if description, f.err = bkp.GetDescription(f.Name); f.err == nil {
+				f.upload, f.err = f.BeginUpload(vault, &UploadRequest{
+					Description:  description,
+					PartSize:     bkp.GetPartSize(),
+					Size:         bkp.GetEstimatedSize(),
+					StorageClass: f.storageClass(storageClass),
+				})
+			}
+		}
+		if err := b.failed(vault, uploads); err != nil {
 			return err
 		}
-		_, err = p.Seek(0, io.SeekStart)
+	}
+	if state != nil {
+		started = state.UploadStarted
+	}
+	state = b.track(vault, bkp, uploads, state, started)
+
+	hashes, pos, sum, err := b.uploadParts(bkp, uploads, skipped, state)
+	if err != nil {
+		return b.abort(vault, uploads, err)
+	}
+	if err = b.failed(vault, uploads); err != nil {
+		return err
+	}
+	if len(hashes) < len(skipped) {
+		return b.abort(vault, uploads, errors.New("the stream is shorter than the interrupted upload"))
+	}
+	fullHash := glacier.ComputeTreeHash(hashes)
+
+	ids := make(map[string]string)
+	var cerr error
+	for _, f := range uploads {
+		if f.err != nil {
+			continue
+		}
+		if cu, ok := f.upload.(checksumUpload); ok {
+			cu.setStreamSHA256(sum)
+		}
+		id, err := f.upload.Complete(pos, fullHash)
 		if err != nil {
-			return err
+			f.err = err
+			continue
+		}
+		log.WithField("target", f.Name).WithField("vault", vault).WithField("archiveID", id).
+			Info("multipart upload completed")
+		// a completed archive is kept, even if the upload to another target fails
+		f.upload = nil
+		ids[f.Name] = id
+		// the archive exists now, the snapshot is marked even if it can't be recorded in the catalog
+		if err = b.record(vault, f.Name, id, bkp, pos, fmt.Sprintf("%x", fullHash), sum, started); err != nil {
+			cerr = err
+		}
+	}
+	if err := b.failed(vault, uploads); err != nil {
+		return err
+	}
+	b.forget(vault)
+	if len(ids) == 0 {
+		return errors.New("the backup was not uploaded to any target")
+	}
+	if err := bkp.MarkSuccessful(ids); err != nil {
+		return err
+	}
+	return cerr
+}
+
+// checkStorageClass returns an error if a storage class is set that none of the targets has, e.g. because of a typo
+func checkStorageClass(class string, uploads []*fanOut) error {
+	if class == "" {
+		return nil
+	}
+	for _, f := range uploads {
+		if f.storageClass(class) != "" {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s %s is not a storage class of any target", StorageClass, class)
+}
+
+// storageClass returns the class the upload to the target requests, empty for the target's default
+func (f *fanOut) storageClass(class string) string {
+	if ct, ok := f.Target.(classTarget); ok && class != "" && ct.hasStorageClass(class) {
+		return class
+	}
+	return ""
+}
+
+// failed aborts all uploads if a required target failed and returns its error
+// Failed optional targets are aborted and skipped.
+func (b *Batch) failed(vault string, uploads []*fanOut) error {
+	for _, f := range uploads {
+		if f.err == nil || f.skipped {
+			continue
+		}
+		if f.required && f.Name == "" {
+			return b.abort(vault, uploads, f.err)
+		} else if f.required {
+			return b.abort(vault, uploads, fmt.Errorf("upload to target %s failed: %v", f.Name, f.err))
 		}
-		r := fmt.Sprintf("bytes %d-%d/*", pos, pos+l-1)
-		pos = pos + l
+		log.WithField("target", f.Name).WithField("vault", vault).Warn("upload to optional target failed: ", f.err)
+		b.abortUpload(vault, f)
+		f.skipped = true
+	}
+	return nil
+}
 
-		treeHash := fmt.Sprintf("%x", h)
+// abort discards all uploads and returns the error that caused it
+func (b *Batch) abort(vault string, uploads []*fanOut, err error) error {
+	for _, f := range uploads {
+		b.abortUpload(vault, f)
+	}
+	b.forget(vault)
+	return err
+}
+
+// abortUpload discards an upload that was started
+func (b *Batch) abortUpload(vault string, f *fanOut) {
+	if f.upload == nil {
+		return
+	}
+	if aerr := f.upload.Abort(); aerr != nil {
+		log.WithField("target", f.Name).WithField("vault", vault).Warn("could not abort upload: ", aerr)
+	}
+	f.upload = nil
+}
 
-		log.WithField("range", r).WithField("vault", vault).Debug("multipart uploading range")
-		_, err = b.glacier.UploadMultipartPart(&glacier.UploadMultipartPartInput{
-			AccountId: aws.String("-"),
-			Body:      p,
-			Checksum:  &treeHash,
-			Range:     &r,
-			UploadId:  o.UploadId,
-			VaultName: &vault,
-		})
+// record adds an archive uploaded to the named target to the catalog
+func (b *Batch) record(vault, target, archiveID string, bkp Backup, size int64, treeHash, sum string, started time.Time) error {
+	if b.catalog == nil {
+		return nil
+	}
+	np := bkp.GetDataset().GetNativeProperties()
+	guid, _, err := bkp.GetDataset().GetProperty("guid")
+	if err != nil {
+		return err
+	}
+	description, err := bkp.GetDescription(target)
+	if err != nil {
+		return err
+	}
+	r := &CatalogRecord{
+		ArchiveID:       archiveID,
+		Target:          target,
+		VaultName:       vault,
+		Dataset:         strings.Split(np.Name, "@")[0],
+		Snapshot:        np.Name,
+		SnapshotGUID:    guid,
+		Creation:        np.Creation,
+		Size:            size,
+		TreeHash:        treeHash,
+		StreamSHA256:    sum,
+		PartSize:        bkp.GetPartSize(),
+		IsIncremental:   bkp.IsIncremental(),
+		Description:     description,
+		UploadStarted:   started,
+		UploadCompleted: time.Now(),
+	}
+	if bkp.IsIncremental() {
+		r.BaseArchiveID, _, err = bkp.GetBaseDataset().GetProperty(archiveIDProperty(target))
 		if err != nil {
 			return err
 		}
 	}
-	fullHash := fmt.Sprintf("%x", glacier.ComputeTreeHash(hashes))
-	cu, err := b.glacier.CompleteMultipartUpload(&glacier.CompleteMultipartUploadInput{
-		AccountId:   aws.String("-"),
-		ArchiveSize: aws.String(strconv.FormatInt(pos, 10)),
-		Checksum:    &fullHash,
-		UploadId:    o.UploadId,
-		VaultName:   &vault,
+	log.WithField("vault", vault).WithField("archiveID", archiveID).Debug("recording archive in catalog")
+	return b.catalog.Put(r)
+}
+
+// Inventory retrieves the inventory of the vault of every enabled filesystem and reconciles it with the local snapshots
+// The inventory retrieval jobs are tracked in stateFile, so a later call picks up jobs that did not complete yet.
+func (b *Batch) Inventory(stateFile string) ([]*Reconciliation, error) {
+	if !b.initialized {
+		return nil, errors.New("batch needs to be initialized before inventory")
+	}
+	recs := make([]*Reconciliation, 0)
+	err := b.inventories(stateFile, func(fs *ZFSFilesystem, inv *Inventory) error {
+		refs, err := fs.getArchiveReferences(b.primary().Name)
+		if err != nil {
+			return err
+		}
+		recs = append(recs, Reconcile(fs.GetVaultName(), inv, refs))
+		log.WithField("vault", fs.GetVaultName()).WithField("archives", len(inv.ArchiveList)).Info("inventory reconciled")
+		return nil
 	})
-	if err != nil {
+	return recs, err
+}
+
+// inventories retrieves the inventory of the vault of every enabled filesystem on the primary target and passes it to fn
+func (b *Batch) inventories(stateFile string, fn func(fs *ZFSFilesystem, inv *Inventory) error) error {
+	if err := b.primary().OpenRetrieval(stateFile, TierStandard); err != nil {
 		return err
 	}
-	log.WithField("vault", vault).WithField("archiveID", *cu.ArchiveId).
-		Info("multipart upload completed")
-	return bkp.MarkSuccessful(*cu.ArchiveId)
+	// request all lists first, so that glacier prepares the inventories in parallel
+	filesystems := make([]*ZFSFilesystem, 0, len(b.filesystems))
+	targets := make([]*NamedTarget, 0, len(b.filesystems))
+	opened := map[string]bool{b.primary().Name: true}
+	for _, fs := range b.filesystems {
+		vn := fs.GetVaultName()
+		if !fs.IsBackupEnabled() {
+			continue
+		}
+		t, key, err := b.accountTarget(b.primary(), fs)
+		if err != nil {
+			return err
+		}
+		if !b.containerExists(key, vn) {
+			continue
+		}
+		if !opened[key] {
+			if err = t.OpenRetrieval(accountStateFile(stateFile, key), TierStandard); err != nil {
+				return err
+			}
+			opened[key] = true
+		}
+		if err := t.RequestArchives(vn); err != nil {
+			return err
+		}
+		filesystems = append(filesystems, fs.(*ZFSFilesystem))
+		targets = append(targets, t)
+	}
+
+	for i, fs := range filesystems {
+		inv, err := targets[i].ListArchives(fs.GetVaultName())
+		if err != nil {
+			return err
+		}
+		if err = fn(fs, inv); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// accountStateFile returns the file the retrieval jobs of the target with the given accountTarget key are tracked in
+// The jobs of every aws account are kept apart, glacier only knows the jobs of its own account.
+func accountStateFile(stateFile, key string) string {
+	h := sha256.Sum256([]byte(key))
+	return fmt.Sprintf("%s-%x", stateFile, h[:6])
 }
 
-func (b *Batch) vaultExists(name string) bool {
-	for _, v := range b.existingVaults {
-		if *v.VaultName == name {
+// containerExists returns true if the named target has a container with the given name
+func (b *Batch) containerExists(target, name string) bool {
+	for _, c := range b.containers[target] {
+		if c.Name == name {
 			return true
 		}
 	}
@@ -216,9 +613,9 @@ func (b *Batch) Print() {
 
 		archives := "-"
 		vn := fs.GetVaultName()
-		for _, v := range b.existingVaults {
-			if *v.VaultName == vn {
-				archives = fmt.Sprintf("%3.1fGB (%d)", float64(*v.SizeInBytes)/1e9, *v.NumberOfArchives)
+		for _, c := range b.containers[b.primary().Name] {
+			if c.Name == vn {
+				archives = fmt.Sprintf("%3.1fGB (%d)", float64(c.Size)/1e9, c.Archives)
 			}
 		}
 		fmt.Printf(fmtStr, name, lastFullBackup, lastIncrBackup, incrInterval, archives)
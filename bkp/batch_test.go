@@ -2,13 +2,20 @@ package bkp
 
 import (
 	"testing"
+	"crypto/sha256"
+	"encoding/hex"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
-	"github.com/aws/aws-sdk-go/service/glacier"
-	"github.com/aws/aws-sdk-go/aws"
 	"github.com/timaebi/go-zfs/zfsiface"
 	"errors"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+	"github.com/stretchr/testify/require"
 )
 
 //func TestNewBatch(t *testing.T) {
@@ -16,14 +23,19 @@ import (
 //	assert.Equal(t, "tank/test", b.filter)
 //}
 
+// testDataset returns the snapshot tank/test@glacier-tmp as it is created before an upload
+func testDataset() *Dataset {
+	d := &Dataset{}
+	d.On("GetNativeProperties").Return(&zfsiface.NativeProperties{Name: "tank/test@glacier-tmp",
+		Creation: time.Date(2018, 3, 1, 0, 0, 0, 0, time.UTC)})
+	d.On("GetProperty", "guid").Return("1234567890", zfsiface.None, nil)
+	d.On("GetProperty", "createtxg").Return("42", zfsiface.None, nil)
+	return d
+}
+
 func TestBatch_Init(t *testing.T) {
-	api := &GlacierAPI{}
-	existingVaults := []*glacier.DescribeVaultOutput{
-		{CreationDate: aws.String("2012-03-20T17:03:43.221Z"), VaultName: aws.String("tank_testit")},
-	}
-	api.On("ListVaults", mock.AnythingOfType("*glacier.ListVaultsInput")).
-		Return(&glacier.ListVaultsOutput{VaultList: existingVaults}, nil)
-	b := &Batch{filter: "tank/test", glacier: api}
+	target := newMemTarget("tank_testit")
+	b := &Batch{filter: "tank/test", targets: defaultTargets(target)}
 	m := &zfsAPIMock{}
 	m.On("filesystems", "tank/test").
 		Return([]zfsiface.Dataset{}, nil)
@@ -31,12 +43,10 @@ func TestBatch_Init(t *testing.T) {
 	err := b.Init()
 	assert.NoError(t, err)
 	assert.True(t, b.initialized)
-	assert.Equal(t, existingVaults, b.existingVaults)
+	assert.Equal(t, []*Container{{Name: "tank_testit", Listable: true}}, b.containers[""])
+	assert.True(t, b.containerExists("", "tank_testit"))
 
-	api = &GlacierAPI{}
-	api.On("ListVaults", mock.AnythingOfType("*glacier.ListVaultsInput")).
-		Return(&glacier.ListVaultsOutput{VaultList: existingVaults}, nil)
-	b = &Batch{filter: "tank/test", glacier: api}
+	b = &Batch{filter: "tank/test", targets: defaultTargets(target)}
 	m = &zfsAPIMock{}
 	m.On("filesystems", "tank/test").
 		Return(nil, errors.New("Simulated error"))
@@ -45,10 +55,8 @@ func TestBatch_Init(t *testing.T) {
 	assert.Error(t, err)
 	assert.False(t, b.initialized)
 
-	api = &GlacierAPI{}
-	api.On("ListVaults", mock.AnythingOfType("*glacier.ListVaultsInput")).
-		Return(nil, errors.New("Simulated error"))
-	b = &Batch{filter: "tank/test", glacier: api}
+	target.err = errors.New("Simulated error")
+	b = &Batch{filter: "tank/test", targets: defaultTargets(target)}
 	m = &zfsAPIMock{}
 	m.On("filesystems", "tank/test").
 		Return([]zfsiface.Dataset{}, nil)
@@ -59,8 +67,390 @@ func TestBatch_Init(t *testing.T) {
 }
 
 func TestBatch_Run(t *testing.T) {
-	api := &GlacierAPI{}
-	b := &Batch{filter: "tank/test", glacier: api}
+	b := &Batch{filter: "tank/test", targets: defaultTargets(newMemTarget())}
 	err := b.Run()
 	assert.Error(t, err)
 }
+
+func TestBatch_upload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zfs2glacier")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c, err := OpenCatalog(filepath.Join(dir, "catalog.db"))
+	require.NoError(t, err)
+	defer c.Close()
+
+	creation := time.Date(2018, 3, 1, 0, 0, 0, 0, time.UTC)
+	data := bytes.Repeat([]byte{1, 2, 3, 4, 5}, 1024*512)
+	base := &Dataset{}
+	base.On("GetNativeProperties").Return(&zfsiface.NativeProperties{Name: "tank/test@glacier-full"})
+	base.On("GetProperty", glacierArchiveID).Return("archive-0", zfsiface.Local, nil)
+	base.On("GetProperty", "guid").Return("1234567000", zfsiface.None, nil)
+	d := testDataset()
+	d.On("SetProperty", glacierArchiveID, "archive-1").Return(nil).Once()
+	d.On("Rename", "tank/test@glacier-incremental", false, false).Return(&Dataset{}, nil).Once()
+	bkp := &zfsBackup{zfsReader: bytes.NewBuffer(data), partSize: 1024 * 1024, hasNext: true, dataset: d, base: base}
+
+	target := newMemTarget("tank_test")
+	b := &Batch{targets: defaultTargets(target), catalog: c}
+	err = b.upload("tank_test", bkp, "", allRequired(b))
+	assert.NoError(t, err)
+	mock.AssertExpectationsForObjects(t, d)
+	require.Len(t, target.containers["tank_test"], 1)
+	a := target.containers["tank_test"][0]
+	assert.Equal(t, data, a.data)
+	m, err := ParseMetadata(a.description)
+	require.NoError(t, err)
+	assert.Equal(t, "1234567890", m.GUID)
+	assert.Equal(t, "1234567000", m.FromGUID)
+	assert.Equal(t, "archive-0", m.BaseArchiveID)
+
+	r, err := c.Get("archive-1")
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, "tank_test", r.VaultName)
+	assert.Equal(t, "tank/test", r.Dataset)
+	assert.Equal(t, "tank/test@glacier-tmp", r.Snapshot)
+	assert.Equal(t, "1234567890", r.SnapshotGUID)
+	assert.Equal(t, creation, r.Creation)
+	assert.Equal(t, int64(len(data)), r.Size)
+	assert.Equal(t, treeHash(data), r.TreeHash)
+	assert.Equal(t, 1024*1024, r.PartSize)
+	assert.True(t, r.IsIncremental)
+	assert.Equal(t, "archive-0", r.BaseArchiveID)
+	assert.False(t, r.UploadCompleted.Before(r.UploadStarted))
+
+	// failed upload is aborted and the snapshot is not marked
+	d = testDataset()
+	bkp = &zfsBackup{zfsReader: bytes.NewBuffer(data), partSize: 1024, hasNext: true, dataset: d, base: base}
+	err = b.upload("tank_unknown", bkp, "", allRequired(b))
+	assert.Error(t, err)
+	d.AssertNotCalled(t, "SetProperty", glacierArchiveID, mock.Anything)
+}
+
+func TestBatch_uploadFanOut(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zfs2glacier")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c, err := OpenCatalog(filepath.Join(dir, "catalog.db"))
+	require.NoError(t, err)
+	defer c.Close()
+
+	data := bytes.Repeat([]byte{1, 2, 3, 4, 5}, 1024*512)
+	glacierTarget, nas := newMemTarget("tank_test"), newMemTarget("tank_test")
+	nas.nextID = 10
+	b := &Batch{targets: []*NamedTarget{{Target: glacierTarget}, {Name: "nas", Target: nas}}, catalog: c}
+	optional := func() []*uploadTarget {
+		return []*uploadTarget{{NamedTarget: b.targets[0], required: true}, {NamedTarget: b.targets[1]}}
+	}
+	newBackup := func(d *Dataset) *zfsBackup {
+		return &zfsBackup{zfsReader: bytes.NewBuffer(data), partSize: 1024 * 1024, hasNext: true, dataset: d}
+	}
+
+	// the stream is uploaded to both targets, the snapshot gets the archive id of each
+	d := testDataset()
+	d.On("SetProperty", glacierArchiveID, "archive-1").Return(nil).Once()
+	d.On("SetProperty", glacierArchiveID+":nas", "archive-11").Return(nil).Once()
+	d.On("Rename", "tank/test@glacier-full", false, false).Return(&Dataset{}, nil).Once()
+	require.NoError(t, b.upload("tank_test", newBackup(d), "", optional()))
+	mock.AssertExpectationsForObjects(t, d)
+	assert.Equal(t, data, glacierTarget.containers["tank_test"][0].data)
+	assert.Equal(t, data, nas.containers["tank_test"][0].data)
+	r, err := c.Get("archive-11")
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, "nas", r.Target)
+	sum := sha256.Sum256(data)
+	assert.Equal(t, hex.EncodeToString(sum[:]), r.StreamSHA256)
+	r, err = c.Latest("tank_test", "")
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, "archive-1", r.ArchiveID)
+
+	// a failed optional target is aborted, the snapshot is marked with the other archive id
+	nas.partErr = assert.AnError
+	d = testDataset()
+	d.On("SetProperty", glacierArchiveID, "archive-2").Return(nil).Once()
+	d.On("Rename", "tank/test@glacier-full", false, false).Return(&Dataset{}, nil).Once()
+	require.NoError(t, b.upload("tank_test", newBackup(d), "", optional()))
+	mock.AssertExpectationsForObjects(t, d)
+	d.AssertNotCalled(t, "SetProperty", glacierArchiveID+":nas", mock.Anything)
+	assert.Equal(t, 1, nas.aborted)
+	assert.Len(t, nas.containers["tank_test"], 1)
+
+	// a failed required target aborts all uploads
+	d = testDataset()
+	err = b.upload("tank_test", newBackup(d), "", allRequired(b))
+	assert.EqualError(t, err, "upload to target nas failed: "+assert.AnError.Error())
+	d.AssertNotCalled(t, "SetProperty", mock.Anything, mock.Anything)
+	assert.Equal(t, 2, nas.aborted)
+	assert.Len(t, glacierTarget.containers["tank_test"], 2)
+	nas.partErr = nil
+
+	// the base of an incremental backup was not uploaded to the optional target
+	base := &Dataset{}
+	base.On("GetNativeProperties").Return(&zfsiface.NativeProperties{Name: "tank/test@glacier-full"})
+	base.On("GetProperty", glacierArchiveID).Return("archive-2", zfsiface.Local, nil)
+	base.On("GetProperty", glacierArchiveID+":nas").Return("-", zfsiface.None, nil)
+	base.On("GetProperty", "guid").Return("1234567000", zfsiface.None, nil)
+	d = testDataset()
+	d.On("SetProperty", glacierArchiveID, "archive-3").Return(nil).Once()
+	d.On("Rename", "tank/test@glacier-incremental", false, false).Return(&Dataset{}, nil).Once()
+	bkp := newBackup(d)
+	bkp.base = base
+	require.NoError(t, b.upload("tank_test", bkp, "", optional()))
+	mock.AssertExpectationsForObjects(t, d)
+	assert.Len(t, nas.containers["tank_test"], 1)
+	bkp = newBackup(testDataset())
+	bkp.base = base
+	err = b.upload("tank_test", bkp, "", allRequired(b))
+	assert.EqualError(t, err, "upload to target nas failed: the base snapshot was not uploaded to the target, it needs a full backup")
+}
+
+func TestBatch_RunAddedTarget(t *testing.T) {
+	data := bytes.Repeat([]byte{1, 2, 3, 4, 5}, 1024*512)
+	full := &Dataset{}
+	full.On("GetNativeProperties").Return(&zfsiface.NativeProperties{Name: "tank/test@glacier-full",
+		Creation: time.Now().Add(-2 * time.Hour)})
+	full.On("GetProperty", glacierArchiveID).Return("archive-0", zfsiface.Local, nil)
+	full.On("GetProperty", glacierArchiveID+":nas").Return("-", zfsiface.None, nil)
+	full.On("Destroy", zfsiface.DestroyDefault).Return(nil).Once()
+	tmp := estimating(testDataset(), int64(len(data)))
+	tmp.On("SendSnapshot", mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+		args.Get(0).(io.Writer).Write(data)
+	}).Once()
+	tmp.On("SetProperty", glacierArchiveID, "archive-1").Return(nil).Once()
+	tmp.On("SetProperty", glacierArchiveID+":nas", "archive-11").Return(nil).Once()
+	tmp.On("Rename", "tank/test@glacier-full", false, false).Return(&Dataset{}, nil).Once()
+	m := withoutAWSConfig(&Dataset{})
+	m.On("GetNativeProperties").Return(&zfsiface.NativeProperties{Name: "tank/test"})
+	m.On("GetProperty", BackupEnabled).Return("true", zfsiface.Local, nil)
+	m.On("GetProperty", IncrementalInterval).Return("600", zfsiface.Local, nil)
+	for _, p := range []string{Targets, StorageClass, RawSend, SendFlagsProperty, CompressionProperty, PartSizeProperty,
+		AgeRecipients, PassphraseFile} {
+		m.On("GetProperty", p).Return("-", zfsiface.None, nil)
+	}
+	m.On("Snapshots").Return([]zfsiface.Dataset{full}, nil)
+	m.On("Diff", "tank/test@glacier-full").Return([]*zfsiface.InodeChange{{}}, nil)
+	m.On("Snapshot", "glacier-tmp", false).Return(tmp, nil).Once()
+
+	// the nas target was added after the full backup, it can't take an incremental backup
+	glacierTarget, nas := newMemTarget("tank_test"), newMemTarget()
+	nas.nextID = 10
+	b := &Batch{targets: []*NamedTarget{{Target: glacierTarget}, {Name: "nas", Target: nas}},
+		filesystems: []Filesystem{&ZFSFilesystem{m}}, initialized: true,
+		containers: map[string][]*Container{"": {{Name: "tank_test"}}, "nas": {}}}
+	require.NoError(t, b.Run())
+	mock.AssertExpectationsForObjects(t, full, tmp)
+	require.Len(t, nas.containers["tank_test"], 1)
+	assert.Equal(t, data, nas.containers["tank_test"][0].data)
+	md, err := ParseMetadata(nas.containers["tank_test"][0].description)
+	require.NoError(t, err)
+	assert.False(t, md.IsIncremental)
+	assert.Equal(t, data, glacierTarget.containers["tank_test"][0].data)
+}
+
+func TestBatch_RunLaggingOptionalTarget(t *testing.T) {
+	diff, data := []byte{1, 2, 3}, bytes.Repeat([]byte{1, 2, 3, 4, 5}, 1024)
+	full := &Dataset{}
+	full.On("GetNativeProperties").Return(&zfsiface.NativeProperties{Name: "tank/test@glacier-full",
+		Creation: time.Now().Add(-2 * time.Hour)})
+	full.On("GetProperty", glacierArchiveID).Return("archive-0", zfsiface.Local, nil)
+	full.On("GetProperty", glacierArchiveID+":nas").Return("-", zfsiface.None, nil)
+	full.On("GetProperty", "guid").Return("1000", zfsiface.None, nil)
+	incremental := &Dataset{}
+	incremental.On("GetNativeProperties").Return(&zfsiface.NativeProperties{Name: "tank/test@glacier-incremental"})
+	incremental.On("GetProperty", "guid").Return("1234567890", zfsiface.None, nil)
+	incremental.On("GetProperty", "createtxg").Return("42", zfsiface.None, nil)
+	estimating(incremental, int64(len(data)))
+	incremental.On("SendSnapshot", mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+		args.Get(0).(io.Writer).Write(data)
+	}).Once()
+	incremental.On("SetProperty", glacierArchiveID+":nas", "archive-11").Return(nil).Once()
+	tmp := estimating(testDataset(), int64(len(diff)))
+	tmp.On("SendIncrementalSnapshot", full, mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+		args.Get(1).(io.Writer).Write(diff)
+	}).Once()
+	tmp.On("SetProperty", glacierArchiveID, "archive-1").Return(nil).Once()
+	tmp.On("Rename", "tank/test@glacier-incremental", false, false).Return(incremental, nil).Once()
+	m := withoutAWSConfig(&Dataset{})
+	m.On("GetNativeProperties").Return(&zfsiface.NativeProperties{Name: "tank/test"})
+	m.On("GetProperty", BackupEnabled).Return("true", zfsiface.Local, nil)
+	m.On("GetProperty", IncrementalInterval).Return("600", zfsiface.Local, nil)
+	m.On("GetProperty", Targets).Return(",nas?", zfsiface.Local, nil)
+	for _, p := range []string{StorageClass, RawSend, SendFlagsProperty, CompressionProperty, PartSizeProperty,
+		AgeRecipients, PassphraseFile} {
+		m.On("GetProperty", p).Return("-", zfsiface.None, nil)
+	}
+	m.On("Snapshots").Return([]zfsiface.Dataset{full}, nil)
+	m.On("Diff", "tank/test@glacier-full").Return([]*zfsiface.InodeChange{{}}, nil)
+	m.On("Snapshot", "glacier-tmp", false).Return(tmp, nil).Once()
+
+	// the optional nas target lacks the base -> the required target still gets an incremental backup and the nas
+	// gets the new snapshot in full afterwards
+	glacierTarget, nas := newMemTarget("tank_test"), newMemTarget()
+	nas.nextID = 10
+	b := &Batch{targets: []*NamedTarget{{Target: glacierTarget}, {Name: "nas", Target: nas}},
+		filesystems: []Filesystem{&ZFSFilesystem{m}}, initialized: true,
+		containers: map[string][]*Container{"": {{Name: "tank_test"}}, "nas": {}}}
+	require.NoError(t, b.Run())
+	mock.AssertExpectationsForObjects(t, full, tmp, incremental)
+	require.Len(t, glacierTarget.containers["tank_test"], 1)
+	assert.Equal(t, diff, glacierTarget.containers["tank_test"][0].data)
+	md, err := ParseMetadata(glacierTarget.containers["tank_test"][0].description)
+	require.NoError(t, err)
+	assert.True(t, md.IsIncremental)
+	assert.Equal(t, "archive-0", md.BaseArchiveID)
+	require.Len(t, nas.containers["tank_test"], 1)
+	assert.Equal(t, data, nas.containers["tank_test"][0].data)
+	md, err = ParseMetadata(nas.containers["tank_test"][0].description)
+	require.NoError(t, err)
+	assert.False(t, md.IsIncremental)
+	assert.Equal(t, "glacier-incremental", md.Snapshot)
+}
+
+// classMemTarget is a memTarget with storage classes, it records the class of every upload
+type classMemTarget struct {
+	*memTarget
+	classes   []string
+	requested []string
+}
+
+func (t *classMemTarget) hasStorageClass(class string) bool {
+	for _, c := range t.classes {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *classMemTarget) BeginUpload(container string, req *UploadRequest) (Upload, error) {
+	t.requested = append(t.requested, req.StorageClass)
+	return t.memTarget.BeginUpload(container, req)
+}
+
+func TestBatch_uploadStorageClass(t *testing.T) {
+	data := bytes.Repeat([]byte{1, 2, 3, 4, 5}, 1024)
+	s3Like := &classMemTarget{memTarget: newMemTarget("tank_test"), classes: []string{"DEEP_ARCHIVE"}}
+	azureLike := &classMemTarget{memTarget: newMemTarget("tank_test"), classes: []string{"Cool"}}
+	b := &Batch{targets: []*NamedTarget{{Target: s3Like}, {Name: "azure", Target: azureLike}}}
+	newBackup := func(d *Dataset) *zfsBackup {
+		return &zfsBackup{zfsReader: bytes.NewBuffer(data), partSize: 1024 * 1024, hasNext: true, dataset: d}
+	}
+
+	// the class is only requested from the target that has it, the other one uses its default
+	d := testDataset()
+	d.On("SetProperty", mock.Anything, mock.Anything).Return(nil).Twice()
+	d.On("Rename", "tank/test@glacier-full", false, false).Return(&Dataset{}, nil).Once()
+	require.NoError(t, b.upload("tank_test", newBackup(d), "DEEP_ARCHIVE", allRequired(b)))
+	assert.Equal(t, []string{"DEEP_ARCHIVE"}, s3Like.requested)
+	assert.Equal(t, []string{""}, azureLike.requested)
+
+	// a class no target has is rejected before anything is uploaded
+	err := b.upload("tank_test", newBackup(testDataset()), "DEEP_ARCHVE", allRequired(b))
+	assert.EqualError(t, err, "ch.floor4:storage_class DEEP_ARCHVE is not a storage class of any target")
+	assert.Len(t, s3Like.requested, 1)
+}
+
+func TestBatch_prepareTargets(t *testing.T) {
+	glacierTarget, nas := newMemTarget("tank_test"), newMemTarget()
+	b := &Batch{targets: []*NamedTarget{{Target: glacierTarget}, {Name: "nas", Target: nas}},
+		containers: map[string][]*Container{"": {{Name: "tank_test"}}, "nas": {}}}
+
+	// the optional target gets a new vault, the backup can stay incremental
+	fs := testFilesystem("tank/test", ",nas?")
+	targets, forceFull, err := b.prepareTargets(fs)
+	require.NoError(t, err)
+	assert.False(t, forceFull)
+	require.Len(t, targets, 2)
+	assert.True(t, targets[0].required)
+	assert.False(t, targets[1].required)
+	assert.Contains(t, nas.containers, "tank_test")
+
+	// only new vaults -> full backup
+	targets, forceFull, err = b.prepareTargets(testFilesystem("tank/other", "nas"))
+	require.NoError(t, err)
+	assert.True(t, forceFull)
+	require.Len(t, targets, 1)
+	assert.Equal(t, "nas", targets[0].Name)
+	assert.NotContains(t, glacierTarget.containers, "tank_other")
+
+	_, _, err = b.prepareTargets(testFilesystem("tank/test", "tape"))
+	assert.EqualError(t, err, `ch.floor4:targets of tank_test selects the unknown target "tape"`)
+}
+
+// testFilesystem returns a filesystem with the given targets property
+func testFilesystem(name, targets string) *ZFSFilesystem {
+	m := &Dataset{}
+	m.On("GetNativeProperties").Return(&zfsiface.NativeProperties{Name: name})
+	m.On("GetProperty", Targets).Return(targets, zfsiface.Local, nil)
+	return &ZFSFilesystem{m}
+}
+
+// withoutAWSConfig prepares a filesystem mock without aws settings
+func withoutAWSConfig(d *Dataset) *Dataset {
+	for _, p := range []string{AWSProfile, AWSRegion, AWSRole, AWSEndpoint} {
+		d.On("GetProperty", p).Return("-", zfsiface.None, nil)
+	}
+	return d
+}
+
+// accountMemTarget is a memTarget with one memTarget for every aws config a filesystem connects with
+type accountMemTarget struct {
+	*memTarget
+	accounts map[AWSConfig]*memTarget
+}
+
+func (t *accountMemTarget) withAWSConfig(c AWSConfig) (Target, error) {
+	if _, ok := t.accounts[c]; !ok {
+		t.accounts[c] = newMemTarget()
+	}
+	return t.accounts[c], nil
+}
+
+func TestBatch_accountTarget(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zfs2glacier")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	target := &accountMemTarget{memTarget: newMemTarget("tank_test"), accounts: make(map[AWSConfig]*memTarget)}
+	nas := newMemTarget()
+	b := &Batch{targets: []*NamedTarget{{Target: target}, {Name: "nas", Target: nas}},
+		containers: map[string][]*Container{"": {{Name: "tank_test"}}, "nas": {}}}
+
+	// without aws settings the target itself is used
+	fs := withoutAWSConfig(&Dataset{})
+	fs.On("GetNativeProperties").Return(&zfsiface.NativeProperties{Name: "tank/test"})
+	fs.On("GetProperty", Targets).Return("-", zfsiface.None, nil)
+	targets, forceFull, err := b.prepareTargets(&ZFSFilesystem{fs})
+	require.NoError(t, err)
+	assert.False(t, forceFull)
+	assert.Equal(t, Target(target), targets[0].Target)
+
+	// a filesystem in another account gets its vault there, targets without aws settings are not affected
+	other := &Dataset{}
+	other.On("GetNativeProperties").Return(&zfsiface.NativeProperties{Name: "tank/test"})
+	other.On("GetProperty", Targets).Return("-", zfsiface.None, nil)
+	other.On("GetProperty", AWSProfile).Return("offsite", zfsiface.Inherited, nil)
+	other.On("GetProperty", AWSRegion).Return("-", zfsiface.None, nil)
+	other.On("GetProperty", AWSRole).Return("-", zfsiface.None, nil)
+	other.On("GetProperty", AWSEndpoint).Return("-", zfsiface.None, nil)
+	targets, forceFull, err = b.prepareTargets(&ZFSFilesystem{other})
+	require.NoError(t, err)
+	assert.False(t, forceFull)
+	require.Len(t, targets, 2)
+	account := target.accounts[AWSConfig{Profile: "offsite"}]
+	require.NotNil(t, account)
+	assert.Equal(t, Target(account), targets[0].Target)
+	assert.Equal(t, "", targets[0].Name)
+	assert.Contains(t, account.containers, "tank_test")
+	assert.Equal(t, Target(nas), targets[1].Target)
+
+	// the connection is reused
+	a, key, err := b.accountTarget(b.targets[0], &ZFSFilesystem{other})
+	require.NoError(t, err)
+	assert.Equal(t, Target(account), a.Target)
+	assert.True(t, b.containerExists(key, "tank_test"))
+	assert.Len(t, target.accounts, 1)
+	assert.NotEqual(t, accountStateFile(filepath.Join(dir, "jobs.json"), key), filepath.Join(dir, "jobs.json"))
+}
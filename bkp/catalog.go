@@ -0,0 +1,185 @@
+package bkp
+
+import (
+	bolt "go.etcd.io/bbolt"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// archivesBucket holds the CatalogRecords keyed by archive id
+var archivesBucket = []byte("archives")
+
+// uploadsBucket holds the UploadStates of running uploads keyed by vault name
+var uploadsBucket = []byte("uploads")
+
+// A CatalogRecord describes an archive uploaded by zfs2glacier
+type CatalogRecord struct {
+	ArchiveID string
+	// Target is the name of the target the archive was uploaded to, empty for the target without name
+	Target    string `json:",omitempty"`
+	VaultName string
+	Dataset   string
+	// Snapshot is the name of the snapshot when it was uploaded, it is renamed once the upload succeeded
+	Snapshot        string
+	SnapshotGUID    string
+	Creation        time.Time
+	Size            int64
+	TreeHash        string
+	// StreamSHA256 is the hex encoded SHA-256 of the stream, it verifies archives whose description lacks it
+	StreamSHA256    string `json:",omitempty"`
+	PartSize        int
+	IsIncremental   bool
+	BaseArchiveID   string `json:",omitempty"`
+	// Description is the archive description, targets that can't list it read it from here, see catalogTarget
+	Description     string `json:",omitempty"`
+	UploadStarted   time.Time
+	UploadCompleted time.Time
+}
+
+// A Catalog is a local database of all archives uploaded by zfs2glacier
+// Unlike the archive id stored on a snapshot, records survive renaming and destroying snapshots.
+type Catalog struct {
+	db *bolt.DB
+}
+
+// OpenCatalog opens the catalog database at path, it is created if it does not exist
+func OpenCatalog(path string) (*Catalog, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(archivesBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(uploadsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Catalog{db: db}, nil
+}
+
+// Close releases the catalog database
+func (c *Catalog) Close() error {
+	return c.db.Close()
+}
+
+// Put adds or replaces the record of an archive
+func (c *Catalog) Put(r *CatalogRecord) error {
+	d, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return c.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(archivesBucket).Put([]byte(r.ArchiveID), d)
+	})
+}
+
+// Get returns the record of an archive, nil is returned for unknown archives
+func (c *Catalog) Get(archiveID string) (*CatalogRecord, error) {
+	var r *CatalogRecord
+	err := c.db.View(func(tx *bolt.Tx) error {
+		d := tx.Bucket(archivesBucket).Get([]byte(archiveID))
+		if d == nil {
+			return nil
+		}
+		r = &CatalogRecord{}
+		return json.Unmarshal(d, r)
+	})
+	return r, err
+}
+
+// List returns the records of all archives in a vault ordered by snapshot creation
+// All records are returned if vault is empty.
+func (c *Catalog) List(vault string) ([]*CatalogRecord, error) {
+	records := make([]*CatalogRecord, 0)
+	err := c.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(archivesBucket).ForEach(func(k, v []byte) error {
+			r := &CatalogRecord{}
+			if err := json.Unmarshal(v, r); err != nil {
+				return err
+			}
+			if vault == "" || r.VaultName == vault {
+				records = append(records, r)
+			}
+			return nil
+		})
+	})
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Creation.Before(records[j].Creation)
+	})
+	return records, err
+}
+
+// Latest returns the record of the most recent archive in a vault of the named target
+// nil is returned if the target has no archive in the vault.
+func (c *Catalog) Latest(vault, target string) (*CatalogRecord, error) {
+	records, err := c.List(vault)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(records) - 1; i >= 0; i-- {
+		if records[i].Target == target {
+			return records[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// Heads returns the records of all archives in a vault that no other archive is based on
+// Every head is the latest archive of a chain of incremental backups.
+func (c *Catalog) Heads(vault string) ([]*CatalogRecord, error) {
+	records, err := c.List(vault)
+	if err != nil {
+		return nil, err
+	}
+	bases := make(map[string]bool)
+	for _, r := range records {
+		if r.IsIncremental {
+			bases[r.BaseArchiveID] = true
+		}
+	}
+	heads := make([]*CatalogRecord, 0)
+	for _, r := range records {
+		if !bases[r.ArchiveID] {
+			heads = append(heads, r)
+		}
+	}
+	return heads, nil
+}
+
+// Chain returns the records from the given archive down to the full backup it is based on
+// An error is returned together with the records found so far if a base archive is missing or the chain contains a cycle.
+func (c *Catalog) Chain(archiveID string) ([]*CatalogRecord, error) {
+	chain := make([]*CatalogRecord, 0)
+	seen := make(map[string]bool)
+	id := archiveID
+	for {
+		if seen[id] {
+			return chain, fmt.Errorf("archive %s is its own base", id)
+		}
+		seen[id] = true
+		r, err := c.Get(id)
+		if err != nil {
+			return chain, err
+		}
+		if r == nil {
+			return chain, fmt.Errorf("archive %s is not in the catalog", id)
+		}
+		chain = append(chain, r)
+		if !r.IsIncremental {
+			return chain, nil
+		}
+		id = r.BaseArchiveID
+	}
+}
@@ -0,0 +1,80 @@
+package bkp
+
+import (
+	"testing"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCatalog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zfs2glacier")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "catalog", "catalog.db")
+
+	c, err := OpenCatalog(path)
+	require.NoError(t, err)
+	full := &CatalogRecord{ArchiveID: "archive-1", VaultName: "tank_test", Dataset: "tank/test",
+		Creation: time.Date(2018, 3, 1, 0, 0, 0, 0, time.UTC), Size: 3}
+	incr := &CatalogRecord{ArchiveID: "archive-2", VaultName: "tank_test", Dataset: "tank/test",
+		Creation: time.Date(2018, 3, 2, 0, 0, 0, 0, time.UTC), IsIncremental: true, BaseArchiveID: "archive-1"}
+	other := &CatalogRecord{ArchiveID: "archive-3", VaultName: "tank_other", Dataset: "tank/other",
+		Creation: time.Date(2018, 2, 1, 0, 0, 0, 0, time.UTC)}
+	assert.NoError(t, c.Put(incr))
+	assert.NoError(t, c.Put(full))
+	assert.NoError(t, c.Put(other))
+	require.NoError(t, c.Close())
+
+	// records are kept when the catalog is opened again
+	c, err = OpenCatalog(path)
+	require.NoError(t, err)
+	defer c.Close()
+	r, err := c.Get("archive-2")
+	assert.NoError(t, err)
+	assert.Equal(t, incr, r)
+	r, err = c.Get("unknown")
+	assert.NoError(t, err)
+	assert.Nil(t, r)
+
+	records, err := c.List("tank_test")
+	assert.NoError(t, err)
+	assert.Equal(t, []*CatalogRecord{full, incr}, records)
+	records, err = c.List("")
+	assert.NoError(t, err)
+	assert.Equal(t, []*CatalogRecord{other, full, incr}, records)
+
+	latest, err := c.Latest("tank_test", "")
+	assert.NoError(t, err)
+	assert.Equal(t, incr, latest)
+	latest, err = c.Latest("tank_unknown", "")
+	assert.NoError(t, err)
+	assert.Nil(t, latest)
+	latest, err = c.Latest("tank_test", "nas")
+	assert.NoError(t, err)
+	assert.Nil(t, latest)
+
+	// chains of incremental backups
+	heads, err := c.Heads("tank_test")
+	assert.NoError(t, err)
+	assert.Equal(t, []*CatalogRecord{incr}, heads)
+	chain, err := c.Chain("archive-2")
+	assert.NoError(t, err)
+	assert.Equal(t, []*CatalogRecord{incr, full}, chain)
+
+	broken := &CatalogRecord{ArchiveID: "archive-4", VaultName: "tank_test", IsIncremental: true, BaseArchiveID: "archive-0",
+		Creation: time.Date(2018, 3, 3, 0, 0, 0, 0, time.UTC)}
+	assert.NoError(t, c.Put(broken))
+	chain, err = c.Chain("archive-4")
+	assert.EqualError(t, err, "archive archive-0 is not in the catalog")
+	assert.Equal(t, []*CatalogRecord{broken}, chain)
+
+	cycle := &CatalogRecord{ArchiveID: "archive-5", VaultName: "tank_test", IsIncremental: true, BaseArchiveID: "archive-5"}
+	assert.NoError(t, c.Put(cycle))
+	chain, err = c.Chain("archive-5")
+	assert.EqualError(t, err, "archive archive-5 is its own base")
+	assert.Len(t, chain, 1)
+}
@@ -0,0 +1,95 @@
+package bkp
+
+import (
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// CompressionProperty zfs attribute. The algorithm and optional level the send stream is compressed with, e.g.
+// "zstd", "zstd:19" or "lz4:1". Raw streams of encrypted datasets don't compress and should not set it.
+const CompressionProperty = "ch.floor4:compression"
+
+// Compression algorithms recorded in the Metadata of compressed archives
+const (
+	CompressionZstd = "zstd"
+	CompressionLZ4  = "lz4"
+)
+
+// lz4Levels maps the levels 0 to 9 to the lz4 compression levels, 0 is the fastest
+var lz4Levels = []lz4.CompressionLevel{lz4.Fast, lz4.Level1, lz4.Level2, lz4.Level3, lz4.Level4, lz4.Level5,
+	lz4.Level6, lz4.Level7, lz4.Level8, lz4.Level9}
+
+// A Compression compresses the send stream before it is encrypted and split into parts
+type Compression struct {
+	Algorithm string
+	// Level is the compression level of the algorithm, 0 selects its default
+	Level int
+}
+
+// ParseCompression reads a Compression written as algorithm[:level], it returns nil for "off"
+func ParseCompression(s string) (*Compression, error) {
+	p := strings.SplitN(strings.ToLower(strings.TrimSpace(s)), ":", 2)
+	c := &Compression{Algorithm: p[0]}
+	if len(p) == 2 {
+		l, err := strconv.Atoi(p[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid compression level %q", p[1])
+		}
+		c.Level = l
+	}
+	switch c.Algorithm {
+	case "off", "none":
+		return nil, nil
+	case CompressionZstd:
+		if c.Level < 0 || c.Level > 22 {
+			return nil, fmt.Errorf("zstd compression level %d is not within 0 and 22", c.Level)
+		}
+	case CompressionLZ4:
+		if c.Level < 0 || c.Level >= len(lz4Levels) {
+			return nil, fmt.Errorf("lz4 compression level %d is not within 0 and 9", c.Level)
+		}
+	default:
+		return nil, fmt.Errorf("unknown compression algorithm %q", c.Algorithm)
+	}
+	return c, nil
+}
+
+// compress returns a writer compressing to w, the compressed stream is only complete once the writer is closed
+func (c *Compression) compress(w io.Writer) (io.WriteCloser, error) {
+	switch c.Algorithm {
+	case CompressionZstd:
+		level := zstd.SpeedDefault
+		if c.Level > 0 {
+			level = zstd.EncoderLevelFromZstd(c.Level)
+		}
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(level))
+	case CompressionLZ4:
+		lw := lz4.NewWriter(w)
+		if err := lw.Apply(lz4.CompressionLevelOption(lz4Levels[c.Level])); err != nil {
+			return nil, err
+		}
+		return lw, nil
+	}
+	return nil, fmt.Errorf("unknown compression algorithm %q", c.Algorithm)
+}
+
+// decompress returns the decompressed stream of an archive compressed with the given algorithm
+// Closing the returned reader releases the decoder.
+func decompress(r io.Reader, algorithm string) (io.ReadCloser, error) {
+	switch algorithm {
+	case CompressionZstd:
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	case CompressionLZ4:
+		return ioutil.NopCloser(lz4.NewReader(r)), nil
+	}
+	return nil, fmt.Errorf("unsupported compression algorithm %q", algorithm)
+}
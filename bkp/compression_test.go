@@ -0,0 +1,129 @@
+package bkp
+
+import (
+	"testing"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/timaebi/go-zfs/zfsiface"
+)
+
+func TestParseCompression(t *testing.T) {
+	for s, expected := range map[string]*Compression{
+		"zstd":    {Algorithm: CompressionZstd},
+		"ZSTD:19": {Algorithm: CompressionZstd, Level: 19},
+		"lz4":     {Algorithm: CompressionLZ4},
+		" lz4:9":  {Algorithm: CompressionLZ4, Level: 9},
+		"off":     nil,
+	} {
+		c, err := ParseCompression(s)
+		assert.NoError(t, err, s)
+		assert.Equal(t, expected, c, s)
+	}
+	for _, s := range []string{"gzip", "zstd:x", "zstd:23", "lz4:10", "lz4:-1"} {
+		_, err := ParseCompression(s)
+		assert.Error(t, err, s)
+	}
+}
+
+// sendThrough returns the parts of a backup of data sent through the stages of o
+func sendThrough(t *testing.T, data []byte, o *StreamOptions) ([]byte, *Metadata) {
+	d := estimating(testDataset(), int64(len(data)))
+	d.On("SendSnapshot", mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+		args.Get(0).(io.Writer).Write(data)
+	}).Once()
+	b := newBackup(d, nil, o).(*zfsBackup)
+	b.partSize = 1024 * 1024
+	out := &bytes.Buffer{}
+	for b.HasNextPart() {
+		p, _ := b.NextPart()
+		_, err := io.Copy(out, p)
+		require.NoError(t, err)
+	}
+	description, err := b.GetDescription("")
+	require.NoError(t, err)
+	m, err := ParseMetadata(description)
+	require.NoError(t, err)
+	return out.Bytes(), m
+}
+
+func TestNewBackup_compression(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zfs2glacier")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	data := bytes.Repeat([]byte("INSERT INTO log VALUES (1, 'compressible');\n"), 1024*64)
+
+	for _, algorithm := range []string{CompressionZstd, CompressionLZ4} {
+		c, err := ParseCompression(algorithm)
+		require.NoError(t, err)
+		sent, m := sendThrough(t, data, &StreamOptions{Compression: c})
+		assert.Equal(t, algorithm, m.Compression)
+		if algorithm == CompressionZstd {
+			assert.True(t, len(sent) < len(data)/10, "%d bytes compressed to %d", len(data), len(sent))
+		}
+
+		// restore decompresses transparently
+		file := filepath.Join(dir, algorithm)
+		require.NoError(t, ioutil.WriteFile(file, sent, 0600))
+		description, err := m.Encode()
+		require.NoError(t, err)
+		var received []byte
+		api := &zfsAPIMock{}
+		api.On("receive", "tank/restored@glacier-restore-0", false, false, mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+			received, err = ioutil.ReadAll(args.Get(3).(io.Reader))
+			require.NoError(t, err)
+		}).Once()
+		defaultAPI = api
+		r := &Restore{workDir: dir}
+		require.NoError(t, r.receive(&restoreArchive{ArchiveID: "archive-1", Description: description, File: file},
+			"tank/restored@glacier-restore-0", false))
+		assert.Equal(t, data, received, algorithm)
+	}
+
+	// the stream is compressed before it is encrypted
+	e, err := newPassphraseEncryption([]byte("secret"), testArgon2Params)
+	require.NoError(t, err)
+	sent, m := sendThrough(t, data, &StreamOptions{Compression: &Compression{Algorithm: CompressionZstd}, Encryption: e})
+	assert.Equal(t, CompressionZstd, m.Compression)
+	assert.Equal(t, EncryptionPassphrase, m.Encryption.Scheme)
+	assert.True(t, len(sent) < len(data)/10)
+	in, err := passphraseDecryption(bytes.NewReader(sent), m.Encryption, []byte("secret"))
+	require.NoError(t, err)
+	d, err := decompress(in, m.Compression)
+	require.NoError(t, err)
+	defer d.Close()
+	received, err := ioutil.ReadAll(d)
+	require.NoError(t, err)
+	assert.Equal(t, data, received)
+
+	_, err = decompress(bytes.NewReader(sent), "brotli")
+	assert.Error(t, err)
+}
+
+func TestZFSFilesystem_GetStreamOptionsCompression(t *testing.T) {
+	m := &Dataset{}
+	m.On("GetProperty", RawSend).Return("-", zfsiface.None, nil)
+	m.On("GetProperty", SendFlagsProperty).Return("-", zfsiface.None, nil)
+	m.On("GetProperty", PartSizeProperty).Return("-", zfsiface.None, nil)
+	m.On("GetNativeProperties").Return(&zfsiface.NativeProperties{Name: "tank/test"})
+	m.On("GetProperty", AgeRecipients).Return("-", zfsiface.None, nil)
+	m.On("GetProperty", PassphraseFile).Return("-", zfsiface.None, nil)
+	m.On("GetProperty", CompressionProperty).Return("zstd:3", zfsiface.Inherited, nil).Once()
+	o, err := (&ZFSFilesystem{m}).GetStreamOptions()
+	require.NoError(t, err)
+	assert.Equal(t, &Compression{Algorithm: CompressionZstd, Level: 3}, o.Compression)
+
+	m.On("GetProperty", CompressionProperty).Return("-", zfsiface.None, nil).Once()
+	o, err = (&ZFSFilesystem{m}).GetStreamOptions()
+	require.NoError(t, err)
+	assert.Nil(t, o.Compression)
+
+	m.On("GetProperty", CompressionProperty).Return("gzip", zfsiface.Local, nil).Once()
+	_, err = (&ZFSFilesystem{m}).GetStreamOptions()
+	assert.Error(t, err)
+}
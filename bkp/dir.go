@@ -0,0 +1,390 @@
+package bkp
+
+import (
+	"github.com/aws/aws-sdk-go/service/glacier"
+	log "github.com/sirupsen/logrus"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// File name extensions used by dirTarget next to the archive file
+const (
+	sidecarExt = ".json"
+	partialExt = ".part"
+	uploadExt  = ".upload"
+)
+
+// dirTarget stores archives as files in a local directory, e.g. a mounted NAS
+// Every filesystem has its own directory named after its vault. An archive is written to <id>.part, its upload
+// progress is kept in <id>.upload. Completed archives are renamed to <id> and described by the sidecar <id>.json.
+type dirTarget struct {
+	root string
+}
+
+// A dirSidecar describes a completed archive of a dirTarget
+type dirSidecar struct {
+	Description string
+	// Metadata is decoded from the description and completed with the SHA-256 of the stream
+	Metadata *Metadata `json:",omitempty"`
+	TreeHash string
+	Size     int64
+	Created  time.Time
+}
+
+// newDirSidecar describes a completed archive with the hashes computed from its data
+func newDirSidecar(description string, size int64, hashes glacier.Hash) *dirSidecar {
+	s := &dirSidecar{Description: description, TreeHash: hex.EncodeToString(hashes.TreeHash), Size: size,
+		Created: time.Now()}
+	if m, err := ParseMetadata(description); err == nil {
+		m.StreamSHA256 = hex.EncodeToString(hashes.LinearHash)
+		s.Metadata = m
+	}
+	return s
+}
+
+// archive returns the inventory entry of the archive the sidecar describes
+func (s *dirSidecar) archive(id string) *InventoryArchive {
+	return &InventoryArchive{
+		ArchiveId:          id,
+		ArchiveDescription: s.Description,
+		CreationDate:       s.Created,
+		Size:               s.Size,
+		SHA256TreeHash:     s.TreeHash,
+		Metadata:           s.Metadata,
+	}
+}
+
+// description returns the archive description including the SHA-256 of the stream
+func (s *dirSidecar) description() string {
+	if s.Metadata != nil {
+		if d, err := s.Metadata.Encode(); err == nil {
+			return d
+		}
+	}
+	return s.Description
+}
+
+// copyArchive copies the archive described by s from src to file and verifies its tree hash
+// A partially copied file is continued.
+func copyArchive(src io.ReadSeeker, s *dirSidecar, archiveID, file string) (string, error) {
+	dst, err := os.OpenFile(file, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return "", err
+	}
+	defer dst.Close()
+
+	offset, err := dst.Seek(0, io.SeekEnd)
+	if err != nil {
+		return "", err
+	}
+	if offset > s.Size {
+		if err = dst.Truncate(0); err != nil {
+			return "", err
+		}
+		if offset, err = dst.Seek(0, io.SeekStart); err != nil {
+			return "", err
+		}
+	}
+	if _, err = src.Seek(offset, io.SeekStart); err != nil {
+		return "", err
+	}
+	if _, err = io.Copy(dst, src); err != nil {
+		return "", err
+	}
+	if err = dst.Sync(); err != nil {
+		return "", err
+	}
+	if _, err = dst.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	if h := hex.EncodeToString(glacier.ComputeHashes(dst).TreeHash); h != s.TreeHash {
+		return "", fmt.Errorf("tree hash of archive %s is %s, expected %s", archiveID, h, s.TreeHash)
+	}
+	log.WithField("id", archiveID).WithField("size", s.Size).Info("archive copied")
+	return s.description(), nil
+}
+
+// dirUploadState is the progress of an upload into a dirTarget
+type dirUploadState struct {
+	Description string
+	PartSize    int
+	Size        int64
+	// Hashes are the hex encoded tree hashes of the written parts
+	Hashes []string
+}
+
+// NewDirTarget creates a Target storing archives below root
+// The directory has to exist, so nothing is written to the mount point if the NAS is not mounted.
+func NewDirTarget(root string) (Target, error) {
+	fi, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, errors.New(root + " is not a directory")
+	}
+	return &dirTarget{root: root}, nil
+}
+
+func (t *dirTarget) path(container, name string) string {
+	return filepath.Join(t.root, container, name)
+}
+
+func (t *dirTarget) ListContainers() ([]*Container, error) {
+	entries, err := ioutil.ReadDir(t.root)
+	if err != nil {
+		return nil, err
+	}
+	containers := make([]*Container, 0)
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		sidecars, err := t.sidecars(e.Name())
+		if err != nil {
+			return nil, err
+		}
+		c := &Container{Name: e.Name(), Archives: int64(len(sidecars)), Listable: true}
+		for _, s := range sidecars {
+			c.Size += s.Size
+		}
+		containers = append(containers, c)
+	}
+	return containers, nil
+}
+
+// sidecars returns the sidecars of all completed archives in a container keyed by archive id
+func (t *dirTarget) sidecars(container string) (map[string]*dirSidecar, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(t.root, container))
+	if err != nil {
+		return nil, err
+	}
+	sidecars := make(map[string]*dirSidecar)
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), sidecarExt) {
+			continue
+		}
+		id := strings.TrimSuffix(e.Name(), sidecarExt)
+		// a sidecar without archive file belongs to an upload that was interrupted while it was completed
+		if _, err = os.Stat(t.path(container, id)); os.IsNotExist(err) {
+			continue
+		}
+		s := &dirSidecar{}
+		if err = readJSONFile(t.path(container, e.Name()), s); err != nil {
+			return nil, err
+		}
+		sidecars[id] = s
+	}
+	return sidecars, nil
+}
+
+func (t *dirTarget) CreateContainer(name string) error {
+	return os.Mkdir(filepath.Join(t.root, name), 0700)
+}
+
+// BeginUpload continues an interrupted upload of the same archive or starts a new one
+// An upload is continued if its description and part size match, so the same snapshot is sent again. Interrupted
+// uploads that don't match are deleted, their stream is not sent anymore.
+func (t *dirTarget) BeginUpload(container string, req *UploadRequest) (Upload, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(t.root, container))
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), uploadExt) {
+			continue
+		}
+		u := &dirUpload{target: t, container: container, id: strings.TrimSuffix(e.Name(), uploadExt)}
+		if err = readJSONFile(t.path(container, e.Name()), &u.state); err != nil {
+			return nil, err
+		}
+		if u.state.Description != req.Description || u.state.PartSize != req.PartSize {
+			log.WithField("dir", container).WithField("id", u.id).Info("deleting interrupted upload of another stream")
+			if err = u.discard(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		// data written after the state was saved is discarded
+		if err = os.Truncate(u.partial(), u.state.Size); err != nil {
+			return nil, err
+		}
+		log.WithField("dir", container).WithField("id", u.id).WithField("parts", len(u.state.Hashes)).
+			Info("continuing upload")
+		return u, nil
+	}
+
+	id, err := newObjectName()
+	if err != nil {
+		return nil, err
+	}
+	u := &dirUpload{target: t, container: container, id: id,
+		state: dirUploadState{Description: req.Description, PartSize: req.PartSize, Hashes: make([]string, 0)}}
+	f, err := os.OpenFile(u.partial(), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err = f.Close(); err != nil {
+		return nil, err
+	}
+	return u, u.save()
+}
+
+// OpenRetrieval does nothing, archives in a directory are available immediately
+func (t *dirTarget) OpenRetrieval(stateFile, tier string) error {
+	return nil
+}
+
+func (t *dirTarget) RequestArchives(container string) error {
+	return nil
+}
+
+func (t *dirTarget) ListArchives(container string) (*Inventory, error) {
+	sidecars, err := t.sidecars(container)
+	if err != nil {
+		return nil, err
+	}
+	inv := &Inventory{InventoryDate: time.Now(), ArchiveList: make([]*InventoryArchive, 0, len(sidecars))}
+	for id, s := range sidecars {
+		inv.ArchiveList = append(inv.ArchiveList, s.archive(id))
+	}
+	return inv, nil
+}
+
+func (t *dirTarget) RequestArchive(container, archiveID string) error {
+	_, err := os.Stat(t.path(container, archiveID))
+	return err
+}
+
+// Retrieve copies an archive to file and verifies its tree hash
+// The returned description contains the SHA-256 of the stream recorded when the archive was completed.
+func (t *dirTarget) Retrieve(container, archiveID, file string) (string, error) {
+	s := &dirSidecar{}
+	if err := readJSONFile(t.path(container, archiveID+sidecarExt), s); err != nil {
+		return "", err
+	}
+	src, err := os.Open(t.path(container, archiveID))
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	return copyArchive(src, s, archiveID, file)
+}
+
+// dirUpload writes the parts of an archive to a partial file
+type dirUpload struct {
+	target    *dirTarget
+	container string
+	id        string
+	state     dirUploadState
+}
+
+func (u *dirUpload) partial() string {
+	return u.target.path(u.container, u.id+partialExt)
+}
+
+func (u *dirUpload) save() error {
+	return writeJSONFile(u.target.path(u.container, u.id+uploadExt), &u.state)
+}
+
+// UploadPart writes a part, parts that were written before the upload was interrupted are skipped
+func (u *dirUpload) UploadPart(offset int64, p io.ReadSeeker, h []byte) error {
+	n := int(offset / int64(u.state.PartSize))
+	hash := hex.EncodeToString(h)
+	switch {
+	case offset%int64(u.state.PartSize) != 0 || offset > u.state.Size:
+		return fmt.Errorf("part at %d uploaded after %d bytes", offset, u.state.Size)
+	case n < len(u.state.Hashes) && u.state.Hashes[n] == hash:
+		log.WithField("id", u.id).WithField("offset", offset).Debug("skipping uploaded part")
+		return nil
+	case n < len(u.state.Hashes):
+		// the stream differs from the interrupted upload, everything from this part on is written again
+		log.WithField("id", u.id).WithField("offset", offset).Warn("part differs from interrupted upload")
+		u.state.Hashes = u.state.Hashes[:n]
+		u.state.Size = offset
+	}
+
+	f, err := os.OpenFile(u.partial(), os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err = f.Truncate(offset); err != nil {
+		return err
+	}
+	if _, err = f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	written, err := io.Copy(f, p)
+	if err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	u.state.Hashes = append(u.state.Hashes, hash)
+	u.state.Size = offset + written
+	return u.save()
+}
+
+// Complete verifies the written file, writes the sidecar and renames the file to its final name
+func (u *dirUpload) Complete(size int64, h []byte) (string, error) {
+	if size != u.state.Size {
+		return "", fmt.Errorf("size %d does not match the %d written bytes", size, u.state.Size)
+	}
+	f, err := os.Open(u.partial())
+	if err != nil {
+		return "", err
+	}
+	hashes := glacier.ComputeHashes(f)
+	f.Close()
+	if !bytes.Equal(hashes.TreeHash, h) {
+		return "", fmt.Errorf("tree hash of written file is %x, expected %x", hashes.TreeHash, h)
+	}
+
+	s := newDirSidecar(u.state.Description, size, hashes)
+	if err = writeJSONFile(u.target.path(u.container, u.id+sidecarExt), s); err != nil {
+		return "", err
+	}
+	if err = os.Rename(u.partial(), u.target.path(u.container, u.id)); err != nil {
+		return "", err
+	}
+	if err = syncDir(filepath.Join(u.target.root, u.container)); err != nil {
+		return "", err
+	}
+	return u.id, os.Remove(u.target.path(u.container, u.id+uploadExt))
+}
+
+// Abort keeps the written parts, e.g. if the upload to another target failed, the next run continues after them
+// BeginUpload deletes them once a different stream is uploaded.
+func (u *dirUpload) Abort() error {
+	log.WithField("dir", u.container).WithField("id", u.id).WithField("parts", len(u.state.Hashes)).
+		Info("keeping aborted upload to continue it")
+	return nil
+}
+
+// discard deletes the partial file and the state of the upload
+func (u *dirUpload) discard() error {
+	if err := os.Remove(u.partial()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Remove(u.target.path(u.container, u.id+uploadExt))
+}
+
+// syncDir flushes renames in a directory to disk
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
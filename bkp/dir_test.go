@@ -0,0 +1,142 @@
+package bkp
+
+import (
+	"testing"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/aws/aws-sdk-go/service/glacier"
+)
+
+func TestDirTarget(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zfs2glacier")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "nas")
+
+	// the directory has to exist
+	_, err = NewDirTarget(root)
+	assert.Error(t, err)
+	require.NoError(t, os.Mkdir(root, 0700))
+	target, err := NewTarget("file://" + root)
+	require.NoError(t, err)
+	require.NoError(t, target.CreateContainer("tank_test"))
+
+	// upload is interrupted after two of three parts
+	data := bytes.Repeat([]byte{1, 2, 3, 4, 5}, 1024*512)
+	part := func(i int) ([]byte, []byte) {
+		end := (i + 1) * 1024 * 1024
+		if end > len(data) {
+			end = len(data)
+		}
+		p := data[i*1024*1024 : end]
+		return p, glacier.ComputeHashes(bytes.NewReader(p)).TreeHash
+	}
+	req := &UploadRequest{Description: `{"v":2,"i":false,"g":"1234567890"}`, PartSize: 1024 * 1024}
+	u, err := target.BeginUpload("tank_test", req)
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		p, h := part(i)
+		require.NoError(t, u.UploadPart(int64(i*1024*1024), bytes.NewReader(p), h))
+	}
+	id := u.(*dirUpload).id
+	containers, err := target.ListContainers()
+	assert.NoError(t, err)
+	assert.Equal(t, []*Container{{Name: "tank_test", Listable: true}}, containers)
+
+	// the upload to another target failed -> the written parts are kept
+	require.NoError(t, u.Abort())
+	_, err = os.Stat(filepath.Join(root, "tank_test", id+partialExt))
+	assert.NoError(t, err)
+
+	// the same snapshot is sent again -> written parts are skipped, the upload keeps its id
+	u, err = target.BeginUpload("tank_test", req)
+	require.NoError(t, err)
+	assert.Equal(t, id, u.(*dirUpload).id)
+	for i := 0; i < 3; i++ {
+		p, h := part(i)
+		require.NoError(t, u.UploadPart(int64(i*1024*1024), bytes.NewReader(p), h))
+	}
+	archiveID, err := u.Complete(int64(len(data)), glacier.ComputeHashes(bytes.NewReader(data)).TreeHash)
+	require.NoError(t, err)
+	assert.Equal(t, id, archiveID)
+	_, err = os.Stat(filepath.Join(root, "tank_test", id+uploadExt))
+	assert.True(t, os.IsNotExist(err))
+
+	// another snapshot is sent -> the interrupted upload of the previous one is deleted
+	u, err = target.BeginUpload("tank_test", &UploadRequest{Description: `{"v":2,"i":false,"g":"1000"}`, PartSize: 1024 * 1024})
+	require.NoError(t, err)
+	stale := u.(*dirUpload).id
+	p, h := part(0)
+	require.NoError(t, u.UploadPart(0, bytes.NewReader(p), h))
+	require.NoError(t, u.Abort())
+	bkp := &zfsBackup{zfsReader: bytes.NewBuffer(data), partSize: 1024 * 1024, hasNext: true, dataset: testDataset()}
+	req.Description, err = bkp.GetDescription("")
+	require.NoError(t, err)
+	u, err = target.BeginUpload("tank_test", req)
+	require.NoError(t, err)
+	assert.NotEqual(t, stale, u.(*dirUpload).id, "description differs")
+	for _, ext := range []string{partialExt, uploadExt} {
+		_, err = os.Stat(filepath.Join(root, "tank_test", stale+ext))
+		assert.True(t, os.IsNotExist(err))
+	}
+	b := &Batch{targets: defaultTargets(target)}
+
+	// a second archive uploaded by a batch
+	require.NoError(t, b.upload("tank_test", &zfsBackup{zfsReader: bytes.NewBuffer(data[:100]), partSize: 1024 * 1024,
+		hasNext: true, dataset: withArchiveID(testDataset())}, "", allRequired(b)))
+	containers, err = target.ListContainers()
+	assert.NoError(t, err)
+	assert.Equal(t, []*Container{{Name: "tank_test", Listable: true, Archives: 2, Size: int64(len(data) + 100)}}, containers)
+	inv, err := target.ListArchives("tank_test")
+	assert.NoError(t, err)
+	assert.Len(t, inv.ArchiveList, 2)
+
+	// retrieval continues a partial copy, the description contains the stream checksum
+	file := filepath.Join(dir, "archive")
+	require.NoError(t, ioutil.WriteFile(file, data[:500], 0600))
+	description, err := target.Retrieve("tank_test", id, file)
+	require.NoError(t, err)
+	m, err := ParseMetadata(description)
+	require.NoError(t, err)
+	assert.Equal(t, "1234567890", m.GUID)
+	assert.NotEmpty(t, m.StreamSHA256)
+	d, err := ioutil.ReadFile(file)
+	assert.NoError(t, err)
+	assert.Equal(t, data, d)
+
+	// restore reads the archive from the directory
+	m2 := &zfsAPIMock{}
+	m2.On("receive", "tank/restored@glacier-restore-0", false, false, mock.Anything).Return(nil).Once()
+	defaultAPI = m2
+	work := filepath.Join(dir, "work")
+	r, err := NewRestore(&NamedTarget{Target: target}, "tank/test", "tank/restored", id, work, TierStandard)
+	require.NoError(t, err)
+	assert.NoError(t, r.Run())
+	m2.AssertExpectations(t)
+
+	// a corrupted archive is detected
+	require.NoError(t, ioutil.WriteFile(filepath.Join(root, "tank_test", id), data[1:], 0600))
+	require.NoError(t, os.Remove(file))
+	_, err = target.Retrieve("tank_test", id, file)
+	assert.Error(t, err)
+
+	// parts are uploaded in order
+	u, err = target.BeginUpload("tank_test", &UploadRequest{Description: "other", PartSize: 1024 * 1024})
+	require.NoError(t, err)
+	p, h = part(1)
+	assert.Error(t, u.UploadPart(1024*1024, bytes.NewReader(p), h))
+	_, err = u.Complete(0, glacier.ComputeHashes(bytes.NewReader(nil)).TreeHash)
+	assert.NoError(t, err)
+}
+
+// withArchiveID prepares a snapshot mock to be marked as successfully uploaded with any archive id
+func withArchiveID(d *Dataset) *Dataset {
+	d.On("SetProperty", glacierArchiveID, mock.AnythingOfType("string")).Return(nil).Once()
+	d.On("Rename", "tank/test@glacier-full", false, false).Return(&Dataset{}, nil).Once()
+	return d
+}
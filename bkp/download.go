@@ -0,0 +1,164 @@
+package bkp
+
+import (
+	"github.com/aws/aws-sdk-go/service/glacier"
+	"github.com/aws/aws-sdk-go/service/glacier/glacieriface"
+	"github.com/aws/aws-sdk-go/aws"
+	log "github.com/sirupsen/logrus"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// downloadChunkSize is the size of the byte ranges the output of a job is downloaded in
+// It is a power of two multiple of a megabyte, so every range is aligned to the tree hash
+// and aws glacier returns the tree hash of the range.
+const downloadChunkSize = 64 * 1024 * 1024
+
+// A download writes the output of a completed retrieval job to a spool file
+// The output is downloaded in ranges which are verified and retried on their own.
+// The verified ranges are saved in a progress file next to the spool file, so an interrupted download can be resumed.
+type download struct {
+	glacier    glacieriface.GlacierAPI
+	job        *RetrievalJob
+	file       string
+	chunkSize  int64
+	retries    int
+	retryDelay time.Duration
+	progress   downloadProgress
+}
+
+// downloadProgress is the part of the spool file which has been downloaded and verified
+type downloadProgress struct {
+	Offset      int64
+	Hashes      []string
+	Description string
+}
+
+func newDownload(g glacieriface.GlacierAPI, j *RetrievalJob, file string) *download {
+	return &download{
+		glacier:    g,
+		job:        j,
+		file:       file,
+		chunkSize:  downloadChunkSize,
+		retries:    5,
+		retryDelay: 10 * time.Second,
+	}
+}
+
+// Run downloads the job output and verifies its tree hash
+// It returns the description of the retrieved archive.
+func (d *download) Run() (string, error) {
+	if d.job.TreeHash == "" {
+		return "", errors.New("tree hash of the archive retrieved by job " + d.job.JobID + " is unknown")
+	}
+	progressFile := d.file + ".progress"
+	err := readJSONFile(progressFile, &d.progress)
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	f, err := os.OpenFile(d.file, os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	// drop everything that was written after the last verified range
+	if err = f.Truncate(d.progress.Offset); err != nil {
+		return "", err
+	}
+	if d.progress.Offset > 0 {
+		log.WithField("file", d.file).WithField("offset", d.progress.Offset).Info("resuming download")
+	}
+
+	for d.progress.Offset < d.job.ArchiveSize {
+		end := d.progress.Offset + d.chunkSize
+		if end > d.job.ArchiveSize {
+			end = d.job.ArchiveSize
+		}
+		data, h, err := d.downloadRange(d.progress.Offset, end)
+		if err != nil {
+			return "", err
+		}
+		if _, err = f.WriteAt(data, d.progress.Offset); err != nil {
+			return "", err
+		}
+		if err = f.Sync(); err != nil {
+			return "", err
+		}
+		d.progress.Offset = end
+		d.progress.Hashes = append(d.progress.Hashes, hex.EncodeToString(h))
+		if err = writeJSONFile(progressFile, &d.progress); err != nil {
+			return "", err
+		}
+	}
+
+	hashes := make([][]byte, len(d.progress.Hashes))
+	for i, h := range d.progress.Hashes {
+		if hashes[i], err = hex.DecodeString(h); err != nil {
+			return "", err
+		}
+	}
+	// the ranges are aligned to the tree hash, their hashes combine to the tree hash computed when uploading
+	treeHash := fmt.Sprintf("%x", glacier.ComputeTreeHash(hashes))
+	if treeHash != d.job.TreeHash {
+		return "", fmt.Errorf("tree hash %s of downloaded archive %s does not match %s", treeHash, d.job.ArchiveID, d.job.TreeHash)
+	}
+	if err = os.Remove(progressFile); err != nil {
+		return "", err
+	}
+	log.WithField("file", d.file).WithField("size", d.job.ArchiveSize).Debug("download verified")
+	return d.progress.Description, nil
+}
+
+// downloadRange downloads and verifies the bytes from start up to end
+// A failed range is retried with an increasing delay.
+func (d *download) downloadRange(start, end int64) ([]byte, []byte, error) {
+	var err error
+	for i := 0; i <= d.retries; i++ {
+		if i > 0 {
+			log.WithField("jobID", d.job.JobID).WithField("start", start).WithField("attempt", i).
+				Warn("retrying download of range: ", err)
+			time.Sleep(time.Duration(i) * d.retryDelay)
+		}
+		var data, h []byte
+		data, h, err = d.tryRange(start, end)
+		if err == nil {
+			return data, h, nil
+		}
+	}
+	return nil, nil, err
+}
+
+func (d *download) tryRange(start, end int64) ([]byte, []byte, error) {
+	r := fmt.Sprintf("bytes=%d-%d", start, end-1)
+	log.WithField("jobID", d.job.JobID).WithField("range", r).Debug("downloading range")
+	o, err := d.glacier.GetJobOutput(&glacier.GetJobOutputInput{
+		AccountId: aws.String("-"),
+		JobId:     &d.job.JobID,
+		Range:     &r,
+		VaultName: &d.job.VaultName,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	defer o.Body.Close()
+	buf := bytes.NewBuffer(make([]byte, 0, end-start))
+	if _, err = io.Copy(buf, o.Body); err != nil {
+		return nil, nil, err
+	}
+	if int64(buf.Len()) != end-start {
+		return nil, nil, fmt.Errorf("received %d bytes for range %s", buf.Len(), r)
+	}
+	h := glacier.ComputeHashes(bytes.NewReader(buf.Bytes())).TreeHash
+	if c := aws.StringValue(o.Checksum); c != "" && c != hex.EncodeToString(h) {
+		return nil, nil, fmt.Errorf("tree hash of range %s does not match %s", r, c)
+	}
+	if o.ArchiveDescription != nil {
+		d.progress.Description = *o.ArchiveDescription
+	}
+	return buf.Bytes(), h, nil
+}
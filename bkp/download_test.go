@@ -0,0 +1,111 @@
+package bkp
+
+import (
+	"testing"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/aws/aws-sdk-go/service/glacier"
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// onRange sets up the output of a single range of a job
+func onRange(api *GlacierAPI, data []byte, start, end int) *mock.Call {
+	r := fmt.Sprintf("bytes=%d-%d", start, end-1)
+	return api.On("GetJobOutput", mock.MatchedBy(func(i *glacier.GetJobOutputInput) bool {
+		return *i.Range == r
+	})).Return(func(*glacier.GetJobOutputInput) *glacier.GetJobOutputOutput {
+		return &glacier.GetJobOutputOutput{
+			ArchiveDescription: aws.String(`{"IsIncremental":false}`),
+			Body:               ioutil.NopCloser(bytes.NewReader(data[start:end])),
+			Checksum:           aws.String(treeHash(data[start:end])),
+		}
+	}, nil)
+}
+
+func TestDownload_Run(t *testing.T) {
+	const mb = 1024 * 1024
+	dir, err := ioutil.TempDir("", "zfs2glacier")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "archive-1")
+
+	data := make([]byte, 5*mb/2)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	job := &RetrievalJob{JobID: "job-1", VaultName: "tank_test", ArchiveID: "archive-1",
+		ArchiveSize: int64(len(data)), TreeHash: treeHash(data)}
+
+	// the second range fails once and is retried on its own
+	api := &GlacierAPI{}
+	onRange(api, data, 0, mb).Once()
+	api.On("GetJobOutput", mock.MatchedBy(func(i *glacier.GetJobOutputInput) bool {
+		return *i.Range == fmt.Sprintf("bytes=%d-%d", mb, 2*mb-1)
+	})).Return(nil, errors.New("Simulated error")).Once()
+	onRange(api, data, mb, 2*mb).Once()
+	onRange(api, data, 2*mb, len(data)).Once()
+	d := newDownload(api, job, file)
+	d.chunkSize = mb
+	d.retryDelay = 0
+	desc, err := d.Run()
+	assert.NoError(t, err)
+	assert.Equal(t, `{"IsIncremental":false}`, desc)
+	downloaded, err := ioutil.ReadFile(file)
+	require.NoError(t, err)
+	assert.Equal(t, data, downloaded)
+	_, err = os.Stat(file + ".progress")
+	assert.True(t, os.IsNotExist(err))
+	api.AssertExpectations(t)
+
+	// the download was interrupted after the first range -> only the remaining ranges are downloaded
+	require.NoError(t, ioutil.WriteFile(file, data[:mb+10], 0600))
+	progress := downloadProgress{Offset: mb, Hashes: []string{treeHash(data[:mb])}}
+	require.NoError(t, writeJSONFile(file+".progress", &progress))
+	api = &GlacierAPI{}
+	onRange(api, data, mb, 2*mb).Once()
+	onRange(api, data, 2*mb, len(data)).Once()
+	d = newDownload(api, job, file)
+	d.chunkSize = mb
+	_, err = d.Run()
+	assert.NoError(t, err)
+	downloaded, err = ioutil.ReadFile(file)
+	require.NoError(t, err)
+	assert.Equal(t, data, downloaded)
+	api.AssertExpectations(t)
+
+	// a range never matches its checksum -> download fails after the retries
+	api = &GlacierAPI{}
+	api.On("GetJobOutput", mock.AnythingOfType("*glacier.GetJobOutputInput")).
+		Return(func(*glacier.GetJobOutputInput) *glacier.GetJobOutputOutput {
+		return &glacier.GetJobOutputOutput{
+			Body:     ioutil.NopCloser(bytes.NewReader(data[:mb])),
+			Checksum: aws.String(treeHash(data[1:mb])),
+		}
+	}, nil).Times(3)
+	d = newDownload(api, job, filepath.Join(dir, "archive-2"))
+	d.chunkSize = mb
+	d.retries = 2
+	d.retryDelay = 0
+	_, err = d.Run()
+	assert.Error(t, err)
+	api.AssertExpectations(t)
+
+	// downloaded archive does not match the tree hash computed when it was uploaded
+	api = &GlacierAPI{}
+	onRange(api, data, 0, mb).Once()
+	onRange(api, data, mb, 2*mb).Once()
+	onRange(api, data, 2*mb, len(data)).Once()
+	wrongHash := &RetrievalJob{JobID: "job-1", VaultName: "tank_test", ArchiveID: "archive-1",
+		ArchiveSize: int64(len(data)), TreeHash: treeHash(data[1:])}
+	d = newDownload(api, wrongHash, filepath.Join(dir, "archive-3"))
+	d.chunkSize = mb
+	_, err = d.Run()
+	assert.Error(t, err)
+}
@@ -0,0 +1,163 @@
+package bkp
+
+import (
+	"filippo.io/age"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// AgeRecipients zfs attribute. Comma separated age X25519 public keys the backups of the filesystem are encrypted to
+// Instead of keys, the path of a recipients file with one key per line can be given.
+const AgeRecipients = "ch.floor4:age_recipients"
+
+// EncryptionAge is the scheme of archives encrypted to age recipients
+const EncryptionAge = "age"
+
+// An Encryption encrypts the send stream of a filesystem before it is split into parts
+type Encryption interface {
+	// Encrypt returns a writer encrypting to w, the encrypted stream is only complete once the writer is closed
+	Encrypt(w io.Writer) (io.WriteCloser, error)
+	// Metadata returns the parameters recorded in the archive description to decrypt the archive
+	Metadata() *EncryptionMetadata
+}
+
+// ageEncryption encrypts the stream to age X25519 recipients, only their public keys are needed
+type ageEncryption struct {
+	recipients   []age.Recipient
+	fingerprints []string
+}
+
+// NewAgeEncryption creates an Encryption to the given age public keys
+// A key starting with a slash is read as recipients file.
+func NewAgeEncryption(keys []string) (Encryption, error) {
+	e := &ageEncryption{}
+	for _, k := range keys {
+		k = strings.TrimSpace(k)
+		if k == "" {
+			continue
+		}
+		rs, err := parseRecipients(k)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range rs {
+			e.recipients = append(e.recipients, r)
+			e.fingerprints = append(e.fingerprints, ageFingerprint(r.String()))
+		}
+	}
+	if len(e.recipients) == 0 {
+		return nil, errors.New("no age recipients given")
+	}
+	return e, nil
+}
+
+// parseRecipients parses a public key or reads the keys of a recipients file
+func parseRecipients(key string) ([]*age.X25519Recipient, error) {
+	if !strings.HasPrefix(key, "/") {
+		r, err := age.ParseX25519Recipient(key)
+		if err != nil {
+			return nil, err
+		}
+		return []*age.X25519Recipient{r}, nil
+	}
+	f, err := os.Open(key)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	parsed, err := age.ParseRecipients(f)
+	if err != nil {
+		return nil, fmt.Errorf("recipients file %s: %v", key, err)
+	}
+	rs := make([]*age.X25519Recipient, 0, len(parsed))
+	for _, r := range parsed {
+		x, ok := r.(*age.X25519Recipient)
+		if !ok {
+			return nil, fmt.Errorf("recipients file %s contains other than X25519 recipients", key)
+		}
+		rs = append(rs, x)
+	}
+	return rs, nil
+}
+
+func (e *ageEncryption) Encrypt(w io.Writer) (io.WriteCloser, error) {
+	return age.Encrypt(w, e.recipients...)
+}
+
+func (e *ageEncryption) Metadata() *EncryptionMetadata {
+	return &EncryptionMetadata{Scheme: EncryptionAge, Recipients: e.fingerprints}
+}
+
+// ageFingerprint identifies a public key in the archive description without using up its 1024 characters
+func ageFingerprint(recipient string) string {
+	h := sha256.Sum256([]byte(recipient))
+	return hex.EncodeToString(h[:8])
+}
+
+// ReadIdentities reads the age identities from a file as written by age-keygen
+func ReadIdentities(file string) ([]age.Identity, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	ids, err := age.ParseIdentities(f)
+	if err != nil {
+		return nil, fmt.Errorf("identity file %s: %v", file, err)
+	}
+	return ids, nil
+}
+
+// A passphraseSource returns the passphrase archives are decrypted with, e.g. from a file or a prompt
+type passphraseSource func() ([]byte, error)
+
+// decrypt returns the decrypted stream of an archive with the given encryption parameters
+// The passphrase is only requested for archives encrypted with a passphrase.
+func decrypt(r io.Reader, m *EncryptionMetadata, identities []age.Identity, passphrase passphraseSource) (io.Reader, error) {
+	if m == nil {
+		return r, nil
+	}
+	switch m.Scheme {
+	case EncryptionAge:
+		return ageDecryption(r, m, identities)
+	case EncryptionPassphrase:
+		if passphrase == nil {
+			return nil, errors.New("the archive is encrypted with a passphrase, but none was given")
+		}
+		p, err := passphrase()
+		if err != nil {
+			return nil, err
+		}
+		return passphraseDecryption(r, m, p)
+	}
+	return nil, fmt.Errorf("unsupported encryption scheme %q", m.Scheme)
+}
+
+// ageDecryption returns the decrypted stream of an archive encrypted to age recipients
+// Only identities whose public key the archive was encrypted to are tried.
+func ageDecryption(r io.Reader, m *EncryptionMetadata, identities []age.Identity) (io.Reader, error) {
+	matching := make([]age.Identity, 0, len(identities))
+	for _, id := range identities {
+		x, ok := id.(*age.X25519Identity)
+		if !ok {
+			continue
+		}
+		fp := ageFingerprint(x.Recipient().String())
+		for _, r := range m.Recipients {
+			if r == fp {
+				matching = append(matching, id)
+				break
+			}
+		}
+	}
+	if len(matching) == 0 {
+		return nil, fmt.Errorf("no identity for the recipients %s the archive is encrypted to",
+			strings.Join(m.Recipients, ", "))
+	}
+	return age.Decrypt(r, matching...)
+}
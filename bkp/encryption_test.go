@@ -0,0 +1,166 @@
+package bkp
+
+import (
+	"testing"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"filippo.io/age"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/timaebi/go-zfs/zfsiface"
+)
+
+func TestNewAgeEncryption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zfs2glacier")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	id1, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	id2, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+
+	// keys are given directly or in a recipients file
+	file := filepath.Join(dir, "recipients")
+	require.NoError(t, ioutil.WriteFile(file, []byte("# offsite\n"+id2.Recipient().String()+"\n"), 0600))
+	e, err := NewAgeEncryption([]string{id1.Recipient().String(), " " + file})
+	require.NoError(t, err)
+	assert.Equal(t, &EncryptionMetadata{Scheme: EncryptionAge, Recipients: []string{
+		ageFingerprint(id1.Recipient().String()), ageFingerprint(id2.Recipient().String())}}, e.Metadata())
+	assert.Len(t, e.Metadata().Recipients[0], 16)
+
+	_, err = NewAgeEncryption([]string{"age1invalid"})
+	assert.Error(t, err)
+	_, err = NewAgeEncryption([]string{"", " "})
+	assert.EqualError(t, err, "no age recipients given")
+	_, err = NewAgeEncryption([]string{filepath.Join(dir, "missing")})
+	assert.Error(t, err)
+}
+
+func TestZFSFilesystem_GetStreamOptions(t *testing.T) {
+	id, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	m := &Dataset{}
+	m.On("GetProperty", RawSend).Return("-", zfsiface.None, nil)
+	m.On("GetProperty", SendFlagsProperty).Return("-", zfsiface.None, nil)
+	m.On("GetProperty", PartSizeProperty).Return("-", zfsiface.None, nil)
+	m.On("GetProperty", CompressionProperty).Return("-", zfsiface.None, nil)
+	m.On("GetProperty", PassphraseFile).Return("-", zfsiface.None, nil)
+	m.On("GetProperty", AgeRecipients).Return("-", zfsiface.None, nil).Once()
+	o, err := (&ZFSFilesystem{m}).GetStreamOptions()
+	require.NoError(t, err)
+	assert.Nil(t, o.Encryption)
+
+	m.On("GetProperty", AgeRecipients).Return(id.Recipient().String(), zfsiface.Inherited, nil).Once()
+	o, err = (&ZFSFilesystem{m}).GetStreamOptions()
+	require.NoError(t, err)
+	require.NotNil(t, o.Encryption)
+	assert.Equal(t, []string{ageFingerprint(id.Recipient().String())}, o.Encryption.Metadata().Recipients)
+
+	// a backup must not be sent unencrypted because the attribute can't be read
+	m.On("GetProperty", AgeRecipients).Return("", zfsiface.Unknown, assert.AnError).Once()
+	_, err = (&ZFSFilesystem{m}).GetStreamOptions()
+	assert.Error(t, err)
+	m.On("GetNativeProperties").Return(&zfsiface.NativeProperties{Name: "tank/test"})
+	m.On("GetProperty", AgeRecipients).Return("age1invalid", zfsiface.Local, nil).Once()
+	_, err = (&ZFSFilesystem{m}).GetStreamOptions()
+	assert.Error(t, err)
+
+	// the fingerprints of too many recipients don't fit into the description
+	recipients := make([]string, 0)
+	for i := 0; i < 60; i++ {
+		id, err := age.GenerateX25519Identity()
+		require.NoError(t, err)
+		recipients = append(recipients, id.Recipient().String())
+	}
+	m.On("GetProperty", AgeRecipients).Return(strings.Join(recipients, ","), zfsiface.Local, nil).Once()
+	_, err = (&ZFSFilesystem{m}).GetStreamOptions()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "too many recipients")
+}
+
+func TestNewBackup_encryption(t *testing.T) {
+	id, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	other, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	e, err := NewAgeEncryption([]string{id.Recipient().String()})
+	require.NoError(t, err)
+
+	// the send stream is encrypted before it is split into parts
+	data := bytes.Repeat([]byte{1, 2, 3, 4, 5}, 1024*512)
+	d := estimating(testDataset(), int64(len(data)))
+	d.On("SendSnapshot", mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+		args.Get(0).(io.Writer).Write(data)
+	}).Once()
+	b := newBackup(d, nil, &StreamOptions{Encryption: e}).(*zfsBackup)
+	b.partSize = 1024 * 1024
+	encrypted := &bytes.Buffer{}
+	for b.HasNextPart() {
+		p, _ := b.NextPart()
+		_, err = io.Copy(encrypted, p)
+		require.NoError(t, err)
+	}
+	assert.NotContains(t, encrypted.String(), string(data[:100]))
+	description, err := b.GetDescription("")
+	require.NoError(t, err)
+	m, err := ParseMetadata(description)
+	require.NoError(t, err)
+	assert.Equal(t, e.Metadata(), m.Encryption)
+
+	// only identities of the recipients are used to decrypt
+	_, err = decrypt(bytes.NewReader(encrypted.Bytes()), m.Encryption, []age.Identity{other}, nil)
+	assert.Error(t, err)
+	_, err = decrypt(bytes.NewReader(encrypted.Bytes()), &EncryptionMetadata{Scheme: "gpg"}, []age.Identity{id}, nil)
+	assert.Error(t, err)
+	r, err := decrypt(bytes.NewReader(encrypted.Bytes()), m.Encryption, []age.Identity{other, id}, nil)
+	require.NoError(t, err)
+	decrypted, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, data, decrypted)
+}
+
+func TestRestore_receiveEncrypted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zfs2glacier")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	id, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	e, err := NewAgeEncryption([]string{id.Recipient().String()})
+	require.NoError(t, err)
+	encrypted := &bytes.Buffer{}
+	w, err := e.Encrypt(encrypted)
+	require.NoError(t, err)
+	w.Write([]byte{1, 2, 3})
+	require.NoError(t, w.Close())
+	description, err := (&Metadata{Encryption: e.Metadata()}).Encode()
+	require.NoError(t, err)
+	file := filepath.Join(dir, "archive-1")
+	require.NoError(t, ioutil.WriteFile(file, encrypted.Bytes(), 0600))
+	a := &restoreArchive{ArchiveID: "archive-1", Description: description, File: file, Downloaded: true}
+
+	// without identity the archive is not received
+	m := &zfsAPIMock{}
+	defaultAPI = m
+	r := &Restore{workDir: dir}
+	assert.Error(t, r.receive(a, "tank/restored@glacier-restore-0", false))
+
+	// the identity file decrypts the archive on the way into zfs receive
+	idFile := filepath.Join(dir, "identity")
+	require.NoError(t, ioutil.WriteFile(idFile, []byte(id.String()+"\n"), 0600))
+	ids, err := ReadIdentities(idFile)
+	require.NoError(t, err)
+	var received []byte
+	m.On("receive", "tank/restored@glacier-restore-0", false, false, mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+		received, err = ioutil.ReadAll(args.Get(3).(io.Reader))
+		require.NoError(t, err)
+	}).Once()
+	r.SetIdentities(ids)
+	require.NoError(t, r.receive(a, "tank/restored@glacier-restore-0", false))
+	assert.Equal(t, []byte{1, 2, 3}, received)
+	mock.AssertExpectationsForObjects(t, m)
+}
@@ -4,6 +4,9 @@ import (
 	"github.com/timaebi/go-zfs"
 	"github.com/timaebi/go-zfs/zfsiface"
 	"strings"
+	"io"
+	"errors"
+	"fmt"
 	"regexp"
 	"time"
 	"strconv"
@@ -25,6 +28,18 @@ const BackupEnabled = "ch.floor4:backup_enabled"
 // IncrementalInterval zfs attribute. Specifies the time in seconds between two incremental backups
 const IncrementalInterval = "ch.floor4:incremental_interval"
 
+// StorageClass zfs attribute. Specifies the storage class of uploaded archives on targets that support them
+// Targets without the class use their default, the class has to be known to at least one target of the filesystem.
+const StorageClass = "ch.floor4:storage_class"
+
+// RawSend zfs attribute. True sends natively encrypted filesystems raw, so neither their key nor plaintext is needed
+const RawSend = "ch.floor4:raw_send"
+
+// Targets zfs attribute. Comma separated names of the targets a filesystem is uploaded to, all targets if not set
+// The target without name is selected with an empty name. Targets whose name ends with a question mark are
+// optional, the backup succeeds if only their upload fails.
+const Targets = "ch.floor4:targets"
+
 // A Filesystem provides all information to decide if a backup should be done
 type Filesystem interface {
 	// IsBackupEnabled returns true if the backup it should be backed up on a regular basis
@@ -36,7 +51,18 @@ type Filesystem interface {
 	IsDue() bool
 	// Backup returns a Backup which can be started. It will then write the backup to the given writer.
 	// Depending on the backup history it decides if a full or an incremental backup should be done.
-	Backup(forceFull bool) Backup
+	Backup(forceFull bool, o *StreamOptions) Backup
+	// GetStreamOptions returns how the send stream of the filesystem is processed before it is uploaded
+	GetStreamOptions() (*StreamOptions, error)
+	// GetStorageClass returns the storage class archives are uploaded with, empty for the target's default
+	GetStorageClass() string
+	// GetTargets returns the names of the targets the filesystem is uploaded to and whether they are required
+	// It returns nil if the filesystem is uploaded to all targets.
+	GetTargets() map[string]bool
+	// GetAWSConfig returns the aws settings the filesystem overrides for the aws targets
+	GetAWSConfig() AWSConfig
+	// GetLastArchiveID returns the archive id of the most recent backup on the named target, empty if there is none
+	GetLastArchiveID(target string) (string, error)
 }
 
 // ZFSFilesystem extends the go-zfs ZFSFilesystem with properties needed for
@@ -47,13 +73,42 @@ type ZFSFilesystem struct {
 // GetVaultName transforms the filesystem name into a valid aws vault name
 // It replaces all non -a-zA-Z0-9 characters with underscores
 func (fs *ZFSFilesystem) GetVaultName() string {
+	return VaultName(fs.dataset.GetNativeProperties().Name)
+}
+
+// VaultName transforms a filesystem name into a valid aws vault name
+// It is used where the filesystem itself may not exist locally, e.g. when restoring
+func VaultName(filesystem string) string {
 	// replace every underscore with two underscores
-	v := strings.Replace(fs.dataset.GetNativeProperties().Name, "_", "__", -1)
+	v := strings.Replace(filesystem, "_", "__", -1)
 	// replace every illegal character
 	re := regexp.MustCompile("[^-a-zA-Z0-9_]")
 	return re.ReplaceAllString(v, "_")
 }
 
+// vaultNameScheme matches the vault names created by VaultName
+var vaultNameScheme = regexp.MustCompile("^[a-zA-Z][-a-zA-Z0-9_]*$")
+
+// FilesystemName reverses VaultName, it returns false if the vault name does not follow its scheme
+// Characters other than slashes which were replaced by VaultName are restored as slashes.
+func FilesystemName(vault string) (string, bool) {
+	if !vaultNameScheme.MatchString(vault) || strings.HasSuffix(strings.Replace(vault, "__", "", -1), "_") {
+		return "", false
+	}
+	n := make([]byte, 0, len(vault))
+	for i := 0; i < len(vault); i++ {
+		if vault[i] != '_' {
+			n = append(n, vault[i])
+		} else if i+1 < len(vault) && vault[i+1] == '_' {
+			n = append(n, '_')
+			i++
+		} else {
+			n = append(n, '/')
+		}
+	}
+	return string(n), true
+}
+
 // IsDue returns true if it is time for a next backup
 func (fs *ZFSFilesystem) IsDue() bool {
 	if fs.nextBackupType() == none {
@@ -84,32 +139,34 @@ func (fs *ZFSFilesystem) getIncrementalInterval() time.Duration {
 
 // Backup returns a Backup which can be started. It will then write the backup to the given writer.
 // Depending on the backup history it decides if a full or an incremental backup should be done.
-func (fs *ZFSFilesystem) Backup(forceFull bool) Backup {
+// The stream is processed as selected by o. A forced full backup replaces the snapshots of the previous backups once
+// it succeeded.
+func (fs *ZFSFilesystem) Backup(forceFull bool, o *StreamOptions) Backup {
 	nextType := fs.nextBackupType()
+	if forceFull {
+		nextType = full
+	}
 	if nextType == none {
 		return nil
 	}
 
-	existingSnap := fs.findSnapshotWithName("glacier-tmp")
-	base := fs.findBaseSnapshot()
-	if existingSnap != nil {
-		if !forceFull && nextType == incremental {
-			return newBackup(existingSnap, base)
-		} else if nextType == full {
-			return newBackup(existingSnap, nil)
+	snap := fs.findSnapshotWithName("glacier-tmp")
+	if snap == nil {
+		var err error
+		if snap, err = fs.dataset.Snapshot("glacier-tmp", false); err != nil {
+			panic(err)
 		}
 	}
-	snap, err := fs.dataset.Snapshot("glacier-tmp", false)
-	if err != nil {
-		panic(err)
+	if nextType == incremental {
+		return newBackup(snap, fs.findBaseSnapshot(), o)
 	}
-	if !forceFull && nextType == incremental {
-		return newBackup(snap, base)
-	} else if nextType == full {
-		return newBackup(snap, nil)
+	b := newBackup(snap, nil, o).(*zfsBackup)
+	for _, previous := range []zfsiface.Dataset{fs.getLastIncrementalBackup(), fs.getLastFullBackup()} {
+		if previous != nil {
+			b.previous = append(b.previous, previous)
+		}
 	}
-
-	return nil
+	return b
 }
 
 // IsBackupEnabled returns true if the backup it should be backed up on a regular basis
@@ -121,6 +178,120 @@ func (fs *ZFSFilesystem) IsBackupEnabled() bool {
 	return cases.Lower(language.English).String(enabled) == "true" || enabled == "1"
 }
 
+// GetStorageClass returns the storage class archives are uploaded with, empty for the target's default
+func (fs *ZFSFilesystem) GetStorageClass() string {
+	class, _, err := fs.dataset.GetProperty(StorageClass)
+	if err != nil || class == "-" {
+		return ""
+	}
+	return strings.ToUpper(class)
+}
+
+// GetTargets returns the names of the targets the filesystem is uploaded to and whether they are required
+// It returns nil if the filesystem is uploaded to all targets.
+func (fs *ZFSFilesystem) GetTargets() map[string]bool {
+	value, _, err := fs.dataset.GetProperty(Targets)
+	if err != nil || value == "-" {
+		return nil
+	}
+	targets := make(map[string]bool)
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		targets[strings.TrimSuffix(name, "?")] = !strings.HasSuffix(name, "?")
+	}
+	return targets
+}
+
+// GetAWSConfig returns the aws settings the filesystem overrides for the aws targets
+// They are read from the zfs attributes AWSProfile, AWSRegion, AWSRole and AWSEndpoint, so they are inherited.
+func (fs *ZFSFilesystem) GetAWSConfig() AWSConfig {
+	get := func(property string) string {
+		v, _, err := fs.dataset.GetProperty(property)
+		if err != nil || v == "-" {
+			return ""
+		}
+		return v
+	}
+	return AWSConfig{
+		Profile:  get(AWSProfile),
+		Region:   get(AWSRegion),
+		Role:     get(AWSRole),
+		Endpoint: get(AWSEndpoint),
+	}
+}
+
+// GetStreamOptions returns how the send stream of the filesystem is processed before it is uploaded
+// The stream is encrypted to the keys in the zfs attribute AgeRecipients or with the passphrase in the file of
+// PassphraseFile. As a backup must not be uploaded unencrypted by mistake, an attribute that can't be read is an error.
+// It is sent raw if the zfs attribute RawSend is set, with the flags in SendFlagsProperty and compressed as set in
+// CompressionProperty.
+func (fs *ZFSFilesystem) GetStreamOptions() (*StreamOptions, error) {
+	o := &StreamOptions{}
+	raw, _, err := fs.dataset.GetProperty(RawSend)
+	if err != nil {
+		return nil, err
+	}
+	o.Raw = cases.Lower(language.English).String(raw) == "true" || raw == "1"
+	flags, _, err := fs.dataset.GetProperty(SendFlagsProperty)
+	if err != nil {
+		return nil, err
+	}
+	if flags != "-" {
+		if o.SendFlags, err = ParseSendFlags(flags); err != nil {
+			return nil, fmt.Errorf("%s of %s: %v", SendFlagsProperty, fs.GetVaultName(), err)
+		}
+	}
+	compression, _, err := fs.dataset.GetProperty(CompressionProperty)
+	if err != nil {
+		return nil, err
+	}
+	if compression != "-" && compression != "" {
+		if o.Compression, err = ParseCompression(compression); err != nil {
+			return nil, fmt.Errorf("%s of %s: %v", CompressionProperty, fs.GetVaultName(), err)
+		}
+	}
+	o.PartSize = DefaultPartSize
+	partSize, _, err := fs.dataset.GetProperty(PartSizeProperty)
+	if err != nil {
+		return nil, err
+	}
+	if partSize != "-" && partSize != "" {
+		if o.PartSize, err = ParsePartSize(partSize); err != nil {
+			return nil, fmt.Errorf("%s of %s: %v", PartSizeProperty, fs.GetVaultName(), err)
+		}
+	}
+	recipients, _, err := fs.dataset.GetProperty(AgeRecipients)
+	if err != nil {
+		return nil, err
+	}
+	passphraseFile, _, err := fs.dataset.GetProperty(PassphraseFile)
+	if err != nil {
+		return nil, err
+	}
+	hasRecipients := recipients != "-" && recipients != ""
+	hasPassphrase := passphraseFile != "-" && passphraseFile != ""
+	switch {
+	case hasRecipients && hasPassphrase:
+		return nil, fmt.Errorf("%s sets both %s and %s", fs.GetVaultName(), AgeRecipients, PassphraseFile)
+	case hasRecipients:
+		if o.Encryption, err = NewAgeEncryption(strings.Split(recipients, ",")); err != nil {
+			return nil, fmt.Errorf("%s of %s: %v", AgeRecipients, fs.GetVaultName(), err)
+		}
+	case hasPassphrase:
+		p, err := ReadPassphrase(passphraseFile)
+		if err != nil {
+			return nil, fmt.Errorf("%s of %s: %v", PassphraseFile, fs.GetVaultName(), err)
+		}
+		if o.Encryption, err = NewPassphraseEncryption(p); err != nil {
+			return nil, err
+		}
+	}
+	if err := o.checkDescription(); err != nil {
+		return nil, fmt.Errorf("%s of %s: too many recipients, %v", AgeRecipients, fs.GetVaultName(), err)
+	}
+	return o, nil
+}
+
 func (fs *ZFSFilesystem) getLastFullBackup() zfsiface.Dataset {
 	return fs.findSnapshotWithName("glacier-full")
 }
@@ -171,14 +342,36 @@ func (fs *ZFSFilesystem) findBaseSnapshot() zfsiface.Dataset {
 	return fs.getLastFullBackup()
 }
 
+// GetLastArchiveID returns the archive id of the most recent successful backup on the named target
+// An empty string is returned if the filesystem has never been backed up or the backup was not uploaded to the target
+func (fs *ZFSFilesystem) GetLastArchiveID(target string) (string, error) {
+	bs := fs.findBaseSnapshot()
+	if bs == nil {
+		return "", nil
+	}
+	id, _, err := bs.GetProperty(archiveIDProperty(target))
+	if id == "-" {
+		id = ""
+	}
+	return id, err
+}
+
 type zfsAPI interface {
 	filesystems(filter string) ([]zfsiface.Dataset, error)
+	// receive reads a zfs send stream from input and stores it as the snapshot with the given name
+	// A raw stream is received without mounting the filesystem, its key has to be loaded first.
+	receive(snapshot string, force, raw bool, input io.Reader) error
 }
 
 type api struct{}
 
+// filesystems returns the datasets under filter, they are wrapped to send their snapshots with options
 func (api *api) filesystems(filter string) ([]zfsiface.Dataset, error) {
-	return zfs.Filesystems(filter)
+	return wrapDatasets(zfs.Filesystems(filter))
+}
+
+func (api *api) receive(snapshot string, force, raw bool, input io.Reader) error {
+	return receiveSnapshot(snapshot, force, raw, input)
 }
 
 var defaultAPI zfsAPI = &api{}
@@ -195,3 +388,46 @@ func ListZFSFilesystems(filter string) ([]Filesystem, error) {
 	}
 	return fsList, nil
 }
+
+// FilesystemAWSConfig returns the aws settings of a local filesystem, see ZFSFilesystem.GetAWSConfig
+// As they are inherited, a filesystem that does not exist, e.g. on a fresh machine, gets those of its closest parent.
+func FilesystemAWSConfig(filesystem string) AWSConfig {
+	name := filesystem
+	for {
+		datasets, err := defaultAPI.filesystems(name)
+		if err == nil {
+			for _, ds := range datasets {
+				if ds.GetNativeProperties().Name == name {
+					return (&ZFSFilesystem{ds}).GetAWSConfig()
+				}
+			}
+		}
+		i := strings.LastIndex(name, "/")
+		if i < 0 {
+			return AWSConfig{}
+		}
+		name = name[:i]
+	}
+}
+
+// LatestArchiveID returns the archive id of the most recent backup of the given local filesystem on the named target
+func LatestArchiveID(filesystem, target string) (string, error) {
+	datasets, err := defaultAPI.filesystems(filesystem)
+	if err != nil {
+		return "", err
+	}
+	for _, ds := range datasets {
+		if ds.GetNativeProperties().Name != filesystem {
+			continue
+		}
+		id, err := (&ZFSFilesystem{ds}).GetLastArchiveID(target)
+		if err != nil {
+			return "", err
+		}
+		if id == "" {
+			return "", errors.New("no backup found for " + filesystem)
+		}
+		return id, nil
+	}
+	return "", errors.New("filesystem " + filesystem + " not found")
+}
@@ -22,6 +22,23 @@ func TestZFSFilesystem_VaultName(t *testing.T) {
 	assert.Equal(t, "tank_test__volume_with__underscores", d.GetVaultName())
 }
 
+func TestFilesystemName(t *testing.T) {
+	fs, ok := FilesystemName("tank_test_volume")
+	assert.True(t, ok)
+	assert.Equal(t, "tank/test/volume", fs)
+	fs, ok = FilesystemName("tank_test__volume_with__underscores")
+	assert.True(t, ok)
+	assert.Equal(t, "tank/test_volume/with_underscores", fs)
+	fs, ok = FilesystemName("tank__")
+	assert.True(t, ok)
+	assert.Equal(t, "tank_", fs)
+
+	for _, v := range []string{"tank_", "_tank", "tank.test", "my-vault_", ""} {
+		_, ok = FilesystemName(v)
+		assert.False(t, ok, v)
+	}
+}
+
 func TestZFSFilesystem_IsBackupEnabled(t *testing.T) {
 	m := &Dataset{}
 	m.On("GetProperty", "ch.floor4:backup_enabled").
@@ -206,7 +223,7 @@ func TestZFSFilesystem_Backup(t *testing.T) {
 	})
 
 	// backup due no existing backup -> backup full backup should be created
-	existingTmp := &Dataset{}
+	existingTmp := estimating(&Dataset{}, 1024)
 	existingTmp.On("SendSnapshot", mock.Anything).Return(nil).Once()
 	existingTmp.On("GetNativeProperties").Return(&zfsiface.NativeProperties{Name: "tank/test@glacier-tmp"})
 	m := &Dataset{}
@@ -217,13 +234,13 @@ func TestZFSFilesystem_Backup(t *testing.T) {
 	m.On("Snapshot", "glacier-tmp", false).
 		Return(existingTmp, nil)
 	d := ZFSFilesystem{m}
-	b := d.Backup(false).(*zfsBackup)
+	b := d.Backup(false, &StreamOptions{}).(*zfsBackup)
 	require.NotNil(t, b)
 	b.NextPart()
 	assert.Equal(t, "tank/test@glacier-tmp", b.dataset.GetNativeProperties().Name)
 
 	// backup due, existing full backup -> create incremental backup with full bkp as base
-	existingTmp = &Dataset{}
+	existingTmp = estimating(&Dataset{}, 1024)
 	existingTmp.On("SendIncrementalSnapshot", full2HoursAgo, mock.Anything).Return(nil).Once()
 	existingTmp.On("GetNativeProperties").Return(&zfsiface.NativeProperties{Name: "tank/test@glacier-tmp"})
 	m = &Dataset{}
@@ -234,13 +251,13 @@ func TestZFSFilesystem_Backup(t *testing.T) {
 	m.On("Snapshot", "glacier-tmp", false).
 		Return(existingTmp, nil)
 	d = ZFSFilesystem{m}
-	b = d.Backup(false).(*zfsBackup)
+	b = d.Backup(false, &StreamOptions{}).(*zfsBackup)
 	b.NextPart()
 	assert.Equal(t, "tank/test@glacier-tmp", b.GetDataset().GetNativeProperties().Name)
 	assert.Equal(t, "tank/test@glacier-full", b.GetBaseDataset().GetNativeProperties().Name)
 
 	// backup due, existing full backup and incremental -> create incremental backup with incremental bkp as base
-	existingTmp = &Dataset{}
+	existingTmp = estimating(&Dataset{}, 1024)
 	existingTmp.On("SendIncrementalSnapshot", incremental1HourAgo, mock.Anything).Return(nil).Once()
 	existingTmp.On("GetNativeProperties").Return(&zfsiface.NativeProperties{Name: "tank/test@glacier-tmp"})
 	m = &Dataset{}
@@ -251,7 +268,7 @@ func TestZFSFilesystem_Backup(t *testing.T) {
 	m.On("Snapshot", "glacier-tmp", false).
 		Return(existingTmp, nil)
 	d = ZFSFilesystem{m}
-	b = d.Backup(false).(*zfsBackup)
+	b = d.Backup(false, &StreamOptions{}).(*zfsBackup)
 	b.NextPart()
 	assert.Equal(t, "tank/test@glacier-tmp", b.GetDataset().GetNativeProperties().Name)
 	assert.Equal(t, "tank/test@glacier-incremental", b.GetBaseDataset().GetNativeProperties().Name)
@@ -263,12 +280,12 @@ func TestZFSFilesystem_Backup(t *testing.T) {
 	m.On("GetProperty", "ch.floor4:incremental_interval").
 		Return("10000", zfsiface.Local, nil)
 	d = ZFSFilesystem{m}
-	n := d.Backup(false)
+	n := d.Backup(false, &StreamOptions{})
 	assert.Nil(t, n)
 
 	// backup due, existing full backup and tmp snap because previous was aborted
 	// -> create incremental backup with full bkp as base
-	existingTmp = &Dataset{}
+	existingTmp = estimating(&Dataset{}, 1024)
 	existingTmp.On("SendIncrementalSnapshot", full2HoursAgo, mock.Anything).Return(nil).Once()
 	existingTmp.On("GetNativeProperties").Return(&zfsiface.NativeProperties{Name: "tank/test@glacier-tmp"})
 	m = &Dataset{}
@@ -277,8 +294,9 @@ func TestZFSFilesystem_Backup(t *testing.T) {
 	m.On("GetProperty", "ch.floor4:incremental_interval").
 		Return("600", zfsiface.Local, nil)
 	d = ZFSFilesystem{m}
-	b = d.Backup(false).(*zfsBackup)
+	b = d.Backup(false, &StreamOptions{}).(*zfsBackup)
 	b.NextPart()
 	assert.Equal(t, "tank/test@glacier-tmp", b.GetDataset().GetNativeProperties().Name)
 	assert.Equal(t, "tank/test@glacier-full", b.GetBaseDataset().GetNativeProperties().Name)
+	existingTmp.AssertExpectations(t)
 }
@@ -0,0 +1,532 @@
+package bkp
+
+import (
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// gcsDescriptionKey is the custom object metadata key the archive description is stored in
+const gcsDescriptionKey = "zfs2glacier-description"
+
+// gcsScope is the oauth scope needed to read and write objects
+const gcsScope = "https://www.googleapis.com/auth/devstorage.read_write"
+
+// gcsStorageClasses are the storage classes that can be set with the StorageClass zfs attribute
+var gcsStorageClasses = []string{"STANDARD", "NEARLINE", "COLDLINE", "ARCHIVE"}
+
+// gcsObject is the part of the object resource of the gcs json api used by gcsTarget
+type gcsObject struct {
+	Name         string            `json:"name"`
+	Size         int64             `json:"size,string"`
+	Updated      time.Time         `json:"updated"`
+	StorageClass string            `json:"storageClass,omitempty"`
+	Metadata     map[string]string `json:"metadata,omitempty"`
+	CRC32C       string            `json:"crc32c,omitempty"`
+	MD5Hash      string            `json:"md5Hash,omitempty"`
+}
+
+// gcsTarget stores archives as objects in a google cloud storage bucket through the json api
+// Every filesystem has its own prefix below the target prefix, the vault name is used as container name.
+// Objects of the archive storage class can be read immediately, so no restore is needed.
+type gcsTarget struct {
+	client *http.Client
+	// base is the url of the api, e.g. of a fake gcs server
+	base   string
+	bucket string
+	prefix string
+}
+
+// NewGCSTarget creates a Target storing archives in the given bucket below prefix
+// The credentials are read from credentialsFile or found like the gcloud tools do. If endpoint is set, requests are
+// sent there instead of to google, without credentials unless a credentials file is given.
+func NewGCSTarget(bucket, prefix, endpoint, credentialsFile string) (Target, error) {
+	if bucket == "" {
+		return nil, errors.New("gcs target needs a bucket")
+	}
+	ctx := context.Background()
+	client := http.DefaultClient
+	if credentialsFile != "" {
+		d, err := ioutil.ReadFile(credentialsFile)
+		if err != nil {
+			return nil, err
+		}
+		creds, err := google.CredentialsFromJSON(ctx, d, gcsScope)
+		if err != nil {
+			return nil, err
+		}
+		client = oauth2.NewClient(ctx, creds.TokenSource)
+	} else if endpoint == "" {
+		var err error
+		if client, err = google.DefaultClient(ctx, gcsScope); err != nil {
+			return nil, err
+		}
+	}
+	if endpoint == "" {
+		endpoint = "https://storage.googleapis.com"
+	}
+	return newGCSTarget(client, endpoint, bucket, prefix), nil
+}
+
+func newGCSTarget(client *http.Client, endpoint, bucket, prefix string) *gcsTarget {
+	return &gcsTarget{client: client, base: strings.TrimSuffix(endpoint, "/"), bucket: bucket, prefix: strings.Trim(prefix, "/")}
+}
+
+// containerPrefix returns the name prefix of all objects of a container
+func (t *gcsTarget) containerPrefix(container string) string {
+	if t.prefix == "" {
+		return container + "/"
+	}
+	return t.prefix + "/" + container + "/"
+}
+
+func (t *gcsTarget) name(container, archiveID string) string {
+	return t.containerPrefix(container) + archiveID
+}
+
+// objectURL returns the url of the metadata of an object
+func (t *gcsTarget) objectURL(name string) string {
+	return t.base + "/storage/v1/b/" + url.PathEscape(t.bucket) + "/o/" + url.PathEscape(name)
+}
+
+// uploadURL returns the url objects are uploaded to with the given upload type
+func (t *gcsTarget) uploadURL(uploadType, name string) string {
+	q := url.Values{"uploadType": {uploadType}}
+	if name != "" {
+		q.Set("name", name)
+	}
+	return t.base + "/upload/storage/v1/b/" + url.PathEscape(t.bucket) + "/o?" + q.Encode()
+}
+
+// do sends a request and returns the response if it has one of the accepted status codes
+// The body of other responses is returned in the error.
+func (t *gcsTarget) do(req *http.Request, accepted ...int) (*http.Response, error) {
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range accepted {
+		if resp.StatusCode == s {
+			return resp, nil
+		}
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	return nil, fmt.Errorf("gcs %s %s: %s: %s", req.Method, req.URL.Path, resp.Status, strings.TrimSpace(string(body)))
+}
+
+// doJSON sends a request and decodes the json response into v
+func (t *gcsTarget) doJSON(req *http.Request, v interface{}) error {
+	resp, err := t.do(req, http.StatusOK, http.StatusCreated)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// list passes all objects below prefix to fn
+func (t *gcsTarget) list(prefix string, fn func(o *gcsObject)) error {
+	token := ""
+	for {
+		q := url.Values{"prefix": {prefix}}
+		if token != "" {
+			q.Set("pageToken", token)
+		}
+		req, err := http.NewRequest(http.MethodGet, t.base+"/storage/v1/b/"+url.PathEscape(t.bucket)+"/o?"+q.Encode(), nil)
+		if err != nil {
+			return err
+		}
+		var page struct {
+			Items         []*gcsObject `json:"items"`
+			NextPageToken string       `json:"nextPageToken"`
+		}
+		if err = t.doJSON(req, &page); err != nil {
+			return err
+		}
+		for _, o := range page.Items {
+			fn(o)
+		}
+		if page.NextPageToken == "" {
+			return nil
+		}
+		token = page.NextPageToken
+	}
+}
+
+// get returns the metadata of an object
+func (t *gcsTarget) get(name string) (*gcsObject, error) {
+	req, err := http.NewRequest(http.MethodGet, t.objectURL(name), nil)
+	if err != nil {
+		return nil, err
+	}
+	o := &gcsObject{}
+	return o, t.doJSON(req, o)
+}
+
+// setDescription replaces the description in the metadata of an object
+func (t *gcsTarget) setDescription(name, description string) error {
+	body, err := json.Marshal(map[string]interface{}{"metadata": map[string]string{gcsDescriptionKey: description}})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPatch, t.objectURL(name), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	return t.doJSON(req, &gcsObject{})
+}
+
+// delete removes an object
+func (t *gcsTarget) delete(name string) error {
+	req, err := http.NewRequest(http.MethodDelete, t.objectURL(name), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := t.do(req, http.StatusOK, http.StatusNoContent)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (t *gcsTarget) ListContainers() ([]*Container, error) {
+	p := ""
+	if t.prefix != "" {
+		p = t.prefix + "/"
+	}
+	containers := make([]*Container, 0)
+	byName := make(map[string]*Container)
+	err := t.list(p, func(o *gcsObject) {
+		parts := strings.SplitN(strings.TrimPrefix(o.Name, p), "/", 2)
+		if len(parts) != 2 {
+			return
+		}
+		c, ok := byName[parts[0]]
+		if !ok {
+			c = &Container{Name: parts[0], Listable: true}
+			byName[parts[0]] = c
+			containers = append(containers, c)
+		}
+		// the container itself is an empty object named after the prefix
+		if parts[1] != "" {
+			c.Size += o.Size
+			c.Archives++
+		}
+	})
+	return containers, err
+}
+
+func (t *gcsTarget) CreateContainer(name string) error {
+	req, err := http.NewRequest(http.MethodPost, t.uploadURL("media", t.containerPrefix(name)), bytes.NewReader([]byte{}))
+	if err != nil {
+		return err
+	}
+	resp, err := t.do(req, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// BeginUpload starts a resumable upload session, the description is stored as custom metadata of the object
+func (t *gcsTarget) BeginUpload(container string, req *UploadRequest) (Upload, error) {
+	class := req.StorageClass
+	if class == "" {
+		class = "ARCHIVE"
+	}
+	if !isGCSStorageClass(class) {
+		return nil, errors.New("unknown gcs storage class " + class)
+	}
+	id, err := newObjectName()
+	if err != nil {
+		return nil, err
+	}
+	o := &gcsObject{
+		Name:         t.name(container, id),
+		StorageClass: class,
+		Metadata:     map[string]string{gcsDescriptionKey: req.Description},
+	}
+	body, err := json.Marshal(o)
+	if err != nil {
+		return nil, err
+	}
+	r, err := http.NewRequest(http.MethodPost, t.uploadURL("resumable", ""), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	r.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	resp, err := t.do(r, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	session := resp.Header.Get("Location")
+	if session == "" {
+		return nil, errors.New("gcs did not return the url of the upload session")
+	}
+	log.WithField("object", o.Name).WithField("storageClass", class).Debug("resumable upload initiated")
+	return &gcsUpload{target: t, id: id, name: o.Name, session: session, partSize: int64(req.PartSize),
+		crc: crc32.New(crc32.MakeTable(crc32.Castagnoli)), md5: md5.New()}, nil
+}
+
+// OpenRetrieval only checks the tier, objects of all gcs storage classes can be read immediately
+func (t *gcsTarget) OpenRetrieval(stateFile, tier string) error {
+	if tier != TierExpedited && tier != TierStandard && tier != TierBulk {
+		return errors.New("unknown retrieval tier " + tier)
+	}
+	return nil
+}
+
+func (t *gcsTarget) RequestArchives(container string) error {
+	return nil
+}
+
+func (t *gcsTarget) ListArchives(container string) (*Inventory, error) {
+	inv := &Inventory{InventoryDate: time.Now(), ArchiveList: make([]*InventoryArchive, 0)}
+	p := t.containerPrefix(container)
+	err := t.list(p, func(o *gcsObject) {
+		if o.Name == p {
+			return
+		}
+		a := &InventoryArchive{
+			ArchiveId:          strings.TrimPrefix(o.Name, p),
+			ArchiveDescription: o.Metadata[gcsDescriptionKey],
+			CreationDate:       o.Updated,
+			Size:               o.Size,
+		}
+		if m, err := ParseMetadata(a.ArchiveDescription); err == nil {
+			a.Metadata = m
+		}
+		inv.ArchiveList = append(inv.ArchiveList, a)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return inv, nil
+}
+
+// RequestArchive checks that the archive exists
+func (t *gcsTarget) RequestArchive(container, archiveID string) error {
+	_, err := t.get(t.name(container, archiveID))
+	return err
+}
+
+// Retrieve downloads an object, a partially downloaded file is continued
+func (t *gcsTarget) Retrieve(container, archiveID, file string) (string, error) {
+	name := t.name(container, archiveID)
+	o, err := t.get(name)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return "", err
+	}
+	if offset > o.Size {
+		if err = f.Truncate(0); err != nil {
+			return "", err
+		}
+		if offset, err = f.Seek(0, io.SeekStart); err != nil {
+			return "", err
+		}
+	}
+	if offset < o.Size {
+		if offset > 0 {
+			log.WithField("object", name).WithField("offset", offset).Info("continuing download")
+		}
+		req, err := http.NewRequest(http.MethodGet, t.objectURL(name)+"?alt=media", nil)
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		resp, err := t.do(req, http.StatusOK, http.StatusPartialContent)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		// a server ignoring the range sends the whole object
+		if resp.StatusCode == http.StatusOK && offset > 0 {
+			if _, err = io.CopyN(ioutil.Discard, resp.Body, offset); err != nil {
+				return "", err
+			}
+		}
+		if _, err = io.Copy(f, resp.Body); err != nil {
+			return "", err
+		}
+		if err = f.Sync(); err != nil {
+			return "", err
+		}
+	}
+	if offset, err = f.Seek(0, io.SeekEnd); err != nil {
+		return "", err
+	}
+	if offset != o.Size {
+		return "", fmt.Errorf("downloaded %d bytes of object %s, expected %d", offset, name, o.Size)
+	}
+	log.WithField("object", name).WithField("size", o.Size).Info("archive downloaded")
+	return o.Metadata[gcsDescriptionKey], nil
+}
+
+// gcsUpload sends the parts to a resumable upload session
+// The last chunk of a session needs to carry the size of the object. A part shorter than the part size is the last
+// one, otherwise the session is finished with an empty chunk when the upload is completed.
+type gcsUpload struct {
+	target   *gcsTarget
+	id       string
+	name     string
+	session  string
+	partSize int64
+	size     int64
+	crc      hash.Hash32
+	md5      hash.Hash
+	// object is the object gcs created with the last chunk, nil before
+	object    *gcsObject
+	completed bool
+	// sha256 is added to the description of the object once it is completed
+	sha256 string
+}
+
+func (u *gcsUpload) setStreamSHA256(sum string) {
+	u.sha256 = sum
+}
+
+func (u *gcsUpload) UploadPart(offset int64, p io.ReadSeeker, h []byte) error {
+	if offset != u.size {
+		return fmt.Errorf("part at %d uploaded after %d bytes", offset, u.size)
+	}
+	n, err := io.Copy(io.MultiWriter(u.crc, u.md5), p)
+	if err != nil {
+		return err
+	}
+	if _, err = p.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	u.size += n
+	total := int64(-1)
+	if n < u.partSize {
+		total = u.size
+	}
+	return u.send(offset, p, n, total)
+}
+
+// send uploads a chunk of n bytes at offset, total is the size of the object for the last chunk and -1 otherwise
+func (u *gcsUpload) send(offset int64, body io.Reader, n int64, total int64) error {
+	req, err := http.NewRequest(http.MethodPut, u.session, body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = n
+	size := "*"
+	if total >= 0 {
+		size = fmt.Sprint(total)
+		req.Header.Set("X-Goog-Hash", "crc32c="+u.crc32c()+",md5="+base64.StdEncoding.EncodeToString(u.md5.Sum(nil)))
+	}
+	if n == 0 {
+		req.Header.Set("Content-Range", "bytes */"+size)
+	} else {
+		req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%s", offset, offset+n-1, size))
+	}
+	log.WithField("object", u.name).WithField("offset", offset).Debug("uploading chunk")
+	accepted := []int{http.StatusPermanentRedirect}
+	if total >= 0 {
+		accepted = []int{http.StatusOK, http.StatusCreated}
+	}
+	resp, err := u.target.do(req, accepted...)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if total < 0 {
+		return nil
+	}
+	u.completed = true
+	u.object = &gcsObject{}
+	return json.NewDecoder(resp.Body).Decode(u.object)
+}
+
+// crc32c returns the checksum of the uploaded bytes in the format of the json api
+func (u *gcsUpload) crc32c() string {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, u.crc.Sum32())
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// Complete finishes the session if the last part did not and compares the size and checksums of the object to the
+// uploaded bytes
+func (u *gcsUpload) Complete(size int64, h []byte) (string, error) {
+	if size != u.size {
+		return "", fmt.Errorf("uploaded %d bytes to object %s, expected %d", u.size, u.name, size)
+	}
+	if u.object == nil {
+		if err := u.send(size, nil, 0, size); err != nil {
+			return "", err
+		}
+	}
+	o := u.object
+	md5Hash := base64.StdEncoding.EncodeToString(u.md5.Sum(nil))
+	if o.Size != size || o.CRC32C != u.crc32c() || o.MD5Hash != md5Hash {
+		return "", fmt.Errorf("object %s has %d bytes with crc32c %s and md5 %s, uploaded %d bytes with crc32c %s and md5 %s",
+			u.name, o.Size, o.CRC32C, o.MD5Hash, size, u.crc32c(), md5Hash)
+	}
+	if u.sha256 != "" {
+		if err := u.target.setDescription(u.name, withStreamSHA256(o.Metadata[gcsDescriptionKey], u.sha256)); err != nil {
+			return "", err
+		}
+	}
+	log.WithField("object", u.name).WithField("size", size).Debug("resumable upload completed")
+	return u.id, nil
+}
+
+// Abort cancels the upload session, an object that was completed already is deleted
+func (u *gcsUpload) Abort() error {
+	if u.completed {
+		return u.target.delete(u.name)
+	}
+	req, err := http.NewRequest(http.MethodDelete, u.session, nil)
+	if err != nil {
+		return err
+	}
+	// gcs answers a cancelled session with 499
+	resp, err := u.target.do(req, 499, http.StatusNoContent, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (t *gcsTarget) hasStorageClass(class string) bool {
+	return isGCSStorageClass(class)
+}
+
+func isGCSStorageClass(class string) bool {
+	for _, c := range gcsStorageClasses {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
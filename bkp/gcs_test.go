@@ -0,0 +1,300 @@
+package bkp
+
+import (
+	"testing"
+	"crypto/sha256"
+	"encoding/hex"
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/aws/aws-sdk-go/service/glacier"
+)
+
+// fakeGCSSession is a resumable upload session of fakeGCS
+type fakeGCSSession struct {
+	object *gcsObject
+	data   []byte
+}
+
+// fakeGCS implements the parts of the gcs json api used by gcsTarget for a single bucket
+// If corrupt is set, the last byte of completed objects is changed.
+type fakeGCS struct {
+	mutex    sync.Mutex
+	url      string
+	objects  map[string]*gcsObject
+	data     map[string][]byte
+	sessions map[string]*fakeGCSSession
+	corrupt  bool
+}
+
+func newFakeGCS() *fakeGCS {
+	return &fakeGCS{objects: make(map[string]*gcsObject), data: make(map[string][]byte),
+		sessions: make(map[string]*fakeGCSSession)}
+}
+
+func (s *fakeGCS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	q := r.URL.Query()
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/upload/") && q.Get("upload_id") != "":
+		s.session(w, r, q.Get("upload_id"))
+	case strings.HasPrefix(r.URL.Path, "/upload/") && q.Get("uploadType") == "media":
+		d, _ := ioutil.ReadAll(r.Body)
+		s.json(w, s.put(&gcsObject{Name: q.Get("name"), StorageClass: "STANDARD"}, d))
+	case strings.HasPrefix(r.URL.Path, "/upload/") && q.Get("uploadType") == "resumable":
+		o := &gcsObject{}
+		if err := json.NewDecoder(r.Body).Decode(o); err != nil || o.Name == "" {
+			http.Error(w, "invalid object", http.StatusBadRequest)
+			return
+		}
+		id := strconv.Itoa(len(s.sessions) + 1)
+		s.sessions[id] = &fakeGCSSession{object: o, data: make([]byte, 0)}
+		w.Header().Set("Location", s.url+r.URL.Path+"?uploadType=resumable&upload_id="+id)
+		w.WriteHeader(http.StatusOK)
+	case strings.HasSuffix(r.URL.Path, "/o") && r.Method == http.MethodGet:
+		s.list(w, q.Get("prefix"))
+	default:
+		// the path is /storage/v1/b/bucket/o/name
+		parts := strings.SplitN(r.URL.Path, "/o/", 2)
+		o := s.objects[parts[len(parts)-1]]
+		switch {
+		case len(parts) != 2 || o == nil:
+			http.Error(w, "no such object", http.StatusNotFound)
+		case r.Method == http.MethodDelete:
+			delete(s.objects, o.Name)
+			delete(s.data, o.Name)
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == http.MethodPatch:
+			patch := &gcsObject{}
+			if err := json.NewDecoder(r.Body).Decode(patch); err != nil {
+				http.Error(w, "invalid object", http.StatusBadRequest)
+				return
+			}
+			for k, v := range patch.Metadata {
+				o.Metadata[k] = v
+			}
+			s.json(w, o)
+		case q.Get("alt") == "media":
+			offset := 0
+			if rng := r.Header.Get("Range"); rng != "" {
+				offset, _ = strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(rng, "bytes="), "-"))
+			}
+			w.Header().Set("Content-Length", strconv.Itoa(len(s.data[o.Name])-offset))
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(s.data[o.Name][offset:])
+		default:
+			s.json(w, o)
+		}
+	}
+}
+
+// session handles the chunks of a resumable upload, the object is stored when its size is known
+func (s *fakeGCS) session(w http.ResponseWriter, r *http.Request, id string) {
+	u, ok := s.sessions[id]
+	if !ok {
+		http.Error(w, "no such session", http.StatusNotFound)
+		return
+	}
+	if r.Method == http.MethodDelete {
+		delete(s.sessions, id)
+		w.WriteHeader(499)
+		return
+	}
+	d, _ := ioutil.ReadAll(r.Body)
+	var first, last int
+	var total string
+	rng := strings.TrimPrefix(r.Header.Get("Content-Range"), "bytes ")
+	if strings.HasPrefix(rng, "*/") {
+		first, last, total = len(u.data), len(u.data)-1, rng[2:]
+	} else if _, err := fmt.Sscanf(strings.Replace(rng, "/", " ", 1), "%d-%d %s", &first, &last, &total); err != nil {
+		http.Error(w, "invalid range "+rng, http.StatusBadRequest)
+		return
+	}
+	if first != len(u.data) || last-first+1 != len(d) {
+		http.Error(w, "unexpected range "+rng, http.StatusBadRequest)
+		return
+	}
+	u.data = append(u.data, d...)
+	if total == "*" {
+		w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(u.data)-1))
+		w.WriteHeader(http.StatusPermanentRedirect)
+		return
+	}
+	if total != strconv.Itoa(len(u.data)) {
+		http.Error(w, "size mismatch", http.StatusBadRequest)
+		return
+	}
+	delete(s.sessions, id)
+	if s.corrupt && len(u.data) > 0 {
+		u.data[len(u.data)-1]++
+	}
+	s.json(w, s.put(u.object, u.data))
+}
+
+func (s *fakeGCS) put(o *gcsObject, d []byte) *gcsObject {
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.Checksum(d, crc32.MakeTable(crc32.Castagnoli)))
+	sum := md5.Sum(d)
+	o.Size, o.Updated = int64(len(d)), time.Now()
+	o.CRC32C, o.MD5Hash = base64.StdEncoding.EncodeToString(crc), base64.StdEncoding.EncodeToString(sum[:])
+	s.objects[o.Name] = o
+	s.data[o.Name] = d
+	return o
+}
+
+func (s *fakeGCS) list(w http.ResponseWriter, prefix string) {
+	names := make([]string, 0)
+	for name := range s.objects {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	items := make([]*gcsObject, 0)
+	for _, name := range names {
+		items = append(items, s.objects[name])
+	}
+	s.json(w, map[string]interface{}{"items": items})
+}
+
+func (s *fakeGCS) json(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// gcsTestEndpoint returns the url of a gcs api with the bucket backup, on fake-gcs-server if FAKE_GCS_ENDPOINT is set
+// (e.g. to http://127.0.0.1:4443 for a server started with -scheme http) and otherwise on a fake gcs.
+func gcsTestEndpoint(t *testing.T) (endpoint string, fake *fakeGCS, stop func()) {
+	if endpoint = os.Getenv("FAKE_GCS_ENDPOINT"); endpoint != "" {
+		resp, err := http.Post(endpoint+"/storage/v1/b?project=test", "application/json",
+			strings.NewReader(`{"name": "backup"}`))
+		require.NoError(t, err)
+		resp.Body.Close()
+		return endpoint, nil, func() {}
+	}
+	fake = newFakeGCS()
+	s := httptest.NewServer(fake)
+	fake.url = s.URL
+	return s.URL, fake, s.Close
+}
+
+func TestGCSTarget(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zfs2glacier")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	endpoint, fake, stop := gcsTestEndpoint(t)
+	defer stop()
+
+	_, err = NewTarget("gs:///zfs?endpoint=" + endpoint)
+	assert.Error(t, err, "no bucket")
+	prefix := fmt.Sprintf("zfs%d", time.Now().UnixNano())
+	target, err := NewTarget("gs://backup/" + prefix + "?endpoint=" + endpoint)
+	require.NoError(t, err)
+	gt := target.(*gcsTarget)
+	require.NoError(t, target.CreateContainer("tank_test"))
+	containers, err := target.ListContainers()
+	require.NoError(t, err)
+	assert.Equal(t, []*Container{{Name: "tank_test", Listable: true}}, containers)
+
+	// the parts are sent as chunks of a resumable upload to an object of the archive class
+	data := bytes.Repeat([]byte{1, 2, 3, 4, 5}, 1024*512)
+	b := &Batch{targets: defaultTargets(target)}
+	require.NoError(t, b.upload("tank_test", &zfsBackup{zfsReader: bytes.NewBuffer(data), partSize: 1024 * 1024,
+		hasNext: true, dataset: withArchiveID(testDataset())}, "", allRequired(b)))
+	inv, err := target.ListArchives("tank_test")
+	require.NoError(t, err)
+	require.Len(t, inv.ArchiveList, 1)
+	a := inv.ArchiveList[0]
+	assert.Equal(t, int64(len(data)), a.Size)
+	require.NotNil(t, a.Metadata)
+	assert.Equal(t, "1234567890", a.Metadata.GUID)
+	assert.Equal(t, 1024*1024, a.Metadata.PartSize)
+	sum := sha256.Sum256(data)
+	assert.Equal(t, hex.EncodeToString(sum[:]), a.Metadata.StreamSHA256)
+	o, err := gt.get(gt.name("tank_test", a.ArchiveId))
+	require.NoError(t, err)
+	assert.Equal(t, "ARCHIVE", o.StorageClass)
+	containers, err = target.ListContainers()
+	require.NoError(t, err)
+	assert.Equal(t, []*Container{{Name: "tank_test", Listable: true, Archives: 1, Size: int64(len(data))}}, containers)
+
+	// a partial download is continued
+	require.NoError(t, target.OpenRetrieval("", TierBulk))
+	require.NoError(t, target.RequestArchive("tank_test", a.ArchiveId))
+	file := filepath.Join(dir, "archive")
+	require.NoError(t, ioutil.WriteFile(file, data[:500], 0600))
+	description, err := target.Retrieve("tank_test", a.ArchiveId, file)
+	require.NoError(t, err)
+	assert.Equal(t, a.ArchiveDescription, description)
+	d, err := ioutil.ReadFile(file)
+	require.NoError(t, err)
+	assert.Equal(t, data, d)
+
+	// the storage class selects another class
+	u, err := target.BeginUpload("tank_test", &UploadRequest{Description: "other", PartSize: 1024 * 1024, StorageClass: "COLDLINE"})
+	require.NoError(t, err)
+	require.NoError(t, u.UploadPart(0, bytes.NewReader(data[:100]), glacier.ComputeHashes(bytes.NewReader(data[:100])).TreeHash))
+	id, err := u.Complete(100, glacier.ComputeHashes(bytes.NewReader(data[:100])).TreeHash)
+	require.NoError(t, err)
+	o, err = gt.get(gt.name("tank_test", id))
+	require.NoError(t, err)
+	assert.Equal(t, "COLDLINE", o.StorageClass)
+	_, err = target.BeginUpload("tank_test", &UploadRequest{Description: "other", PartSize: 1024 * 1024, StorageClass: "GLACIER"})
+	assert.Error(t, err)
+
+	// a stream of whole parts is finished with an empty chunk
+	whole := data[:2*1024*1024]
+	u, err = target.BeginUpload("tank_test", &UploadRequest{Description: "other", PartSize: 1024 * 1024})
+	require.NoError(t, err)
+	require.NoError(t, u.UploadPart(0, bytes.NewReader(whole[:1024*1024]), nil))
+	require.NoError(t, u.UploadPart(1024*1024, bytes.NewReader(whole[1024*1024:]), nil))
+	id, err = u.Complete(int64(len(whole)), nil)
+	require.NoError(t, err)
+	o, err = gt.get(gt.name("tank_test", id))
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(whole)), o.Size)
+	require.NoError(t, gt.delete(gt.name("tank_test", id)))
+
+	// an upload with the wrong size is cancelled by abort
+	u, err = target.BeginUpload("tank_test", &UploadRequest{Description: "other", PartSize: 1024 * 1024})
+	require.NoError(t, err)
+	require.NoError(t, u.UploadPart(0, bytes.NewReader(data[:100]), glacier.ComputeHashes(bytes.NewReader(data[:100])).TreeHash))
+	_, err = u.Complete(200, glacier.ComputeHashes(bytes.NewReader(data[:200])).TreeHash)
+	assert.Error(t, err)
+	assert.NoError(t, u.Abort())
+	inv, err = target.ListArchives("tank_test")
+	require.NoError(t, err)
+	assert.Len(t, inv.ArchiveList, 2)
+	if fake == nil {
+		return
+	}
+
+	// an object with other checksums than the uploaded bytes is deleted by abort
+	fake.corrupt = true
+	u, err = target.BeginUpload("tank_test", &UploadRequest{Description: "other", PartSize: 1024 * 1024})
+	require.NoError(t, err)
+	require.NoError(t, u.UploadPart(0, bytes.NewReader(data[:100]), glacier.ComputeHashes(bytes.NewReader(data[:100])).TreeHash))
+	_, err = u.Complete(100, glacier.ComputeHashes(bytes.NewReader(data[:100])).TreeHash)
+	assert.Error(t, err)
+	assert.NoError(t, u.Abort())
+	inv, err = target.ListArchives("tank_test")
+	require.NoError(t, err)
+	assert.Len(t, inv.ArchiveList, 2)
+}
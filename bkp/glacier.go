@@ -0,0 +1,350 @@
+package bkp
+
+import (
+	"github.com/aws/aws-sdk-go/service/glacier"
+	"github.com/aws/aws-sdk-go/service/glacier/glacieriface"
+	"github.com/aws/aws-sdk-go/aws"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"bytes"
+	"strconv"
+)
+
+// singleRequestSize is the size up to which archives expected to fit in one part are uploaded with a single request
+// A multipart upload takes at least three requests and an archive request is billed the same.
+const singleRequestSize = 8 * 1024 * 1024
+
+// glacierTarget stores archives in aws glacier vaults
+type glacierTarget struct {
+	glacier   glacieriface.GlacierAPI
+	retrieval *Retrieval
+	aws       AWSConfig
+}
+
+// NewGlacierTarget creates a Target connected to aws glacier with the given settings
+func NewGlacierTarget(c AWSConfig) (Target, error) {
+	g, err := setupGlacierClient(c)
+	if err != nil {
+		return nil, err
+	}
+	return &glacierTarget{glacier: g, aws: c}, nil
+}
+
+// setupGlacierClient initializes the connection to aws
+func setupGlacierClient(c AWSConfig) (glacieriface.GlacierAPI, error) {
+	s, err := newAWSSession(c)
+	if err != nil {
+		return nil, err
+	}
+	return glacier.New(s, c.endpointConfig()), nil
+}
+
+// withAWSConfig connects to glacier with the settings of a filesystem, e.g. in another account
+func (t *glacierTarget) withAWSConfig(c AWSConfig) (Target, error) {
+	return NewGlacierTarget(t.aws.merge(c))
+}
+
+func (t *glacierTarget) ListContainers() ([]*Container, error) {
+	containers := make([]*Container, 0)
+	err := t.glacier.ListVaultsPages(&glacier.ListVaultsInput{AccountId: aws.String("-")},
+		func(o *glacier.ListVaultsOutput, lastPage bool) bool {
+			for _, v := range o.VaultList {
+				containers = append(containers, &Container{
+					Name:     aws.StringValue(v.VaultName),
+					Size:     aws.Int64Value(v.SizeInBytes),
+					Archives: aws.Int64Value(v.NumberOfArchives),
+					// glacier creates the first inventory about a day after the first upload
+					Listable: v.LastInventoryDate != nil,
+				})
+			}
+			return true
+		})
+	return containers, err
+}
+
+func (t *glacierTarget) CreateContainer(name string) error {
+	_, err := t.glacier.CreateVault(&glacier.CreateVaultInput{
+		AccountId: aws.String("-"),
+		VaultName: aws.String(name),
+	})
+	return err
+}
+
+// BeginUpload starts a multipart upload, archives estimated to fit in one small part are kept for a single request
+func (t *glacierTarget) BeginUpload(vault string, req *UploadRequest) (Upload, error) {
+	if req.Size > 0 && req.Size <= singleRequestSize && req.Size <= int64(req.PartSize) {
+		log.WithField("vault", vault).Debug("archive is uploaded with a single request")
+		return &glacierArchiveUpload{target: t, vault: vault, req: req}, nil
+	}
+	return t.initiateUpload(vault, req)
+}
+
+// initiateUpload starts a multipart upload
+func (t *glacierTarget) initiateUpload(vault string, req *UploadRequest) (Upload, error) {
+	o, err := t.glacier.InitiateMultipartUpload(&glacier.InitiateMultipartUploadInput{
+		AccountId:          aws.String("-"),
+		ArchiveDescription: aws.String(req.Description),
+		PartSize:           aws.String(strconv.Itoa(req.PartSize)),
+		VaultName:          &vault,
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.WithField("vault", vault).Debug("multipart upload initiated")
+	return &glacierUpload{glacier: t.glacier, vault: vault, uploadID: aws.StringValue(o.UploadId)}, nil
+}
+
+// resumeUpload lists the parts glacier has of the upload
+// The upload has to be initiated with the description and part size of req.
+func (t *glacierTarget) resumeUpload(vault, uploadID string, req *UploadRequest) (Upload, [][]byte, error) {
+	var description string
+	var partSize int64
+	hashes := make(map[int64][]byte)
+	var perr error
+	err := t.glacier.ListPartsPages(&glacier.ListPartsInput{
+		AccountId: aws.String("-"),
+		UploadId:  &uploadID,
+		VaultName: &vault,
+	}, func(o *glacier.ListPartsOutput, lastPage bool) bool {
+		description = aws.StringValue(o.ArchiveDescription)
+		partSize = aws.Int64Value(o.PartSizeInBytes)
+		for _, p := range o.Parts {
+			var start, end int64
+			if _, perr = fmt.Sscanf(aws.StringValue(p.RangeInBytes), "%d-%d", &start, &end); perr != nil {
+				return false
+			}
+			if hashes[start], perr = hex.DecodeString(aws.StringValue(p.SHA256TreeHash)); perr != nil {
+				return false
+			}
+		}
+		return true
+	})
+	if err == nil {
+		err = perr
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if description != req.Description || partSize != int64(req.PartSize) {
+		return nil, nil, fmt.Errorf("upload %s was initiated for another archive", uploadID)
+	}
+	parts := make([][]byte, 0, len(hashes))
+	for h, ok := hashes[0]; ok; h, ok = hashes[int64(len(parts))*partSize] {
+		parts = append(parts, h)
+	}
+	log.WithField("vault", vault).WithField("parts", len(parts)).Debug("multipart upload resumed")
+	return &glacierUpload{glacier: t.glacier, vault: vault, uploadID: uploadID}, parts, nil
+}
+
+func (t *glacierTarget) discardUpload(vault, uploadID string) error {
+	return (&glacierUpload{glacier: t.glacier, vault: vault, uploadID: uploadID}).Abort()
+}
+
+// OpenRetrieval loads the retrieval jobs tracked in stateFile
+// Jobs that aws glacier does not list anymore are dropped.
+func (t *glacierTarget) OpenRetrieval(stateFile, tier string) error {
+	r, err := NewRetrieval(t.glacier, stateFile, tier)
+	if err != nil {
+		return err
+	}
+	vaults := make(map[string]bool)
+	for _, j := range r.jobs {
+		if !vaults[j.VaultName] {
+			vaults[j.VaultName] = true
+			if err = r.Refresh(j.VaultName); err != nil {
+				return err
+			}
+		}
+	}
+	t.retrieval = r
+	return nil
+}
+
+func (t *glacierTarget) RequestArchives(vault string) error {
+	if t.retrieval == nil {
+		return errors.New("retrieval needs to be opened before requesting archives")
+	}
+	_, err := t.retrieval.RetrieveInventory(vault)
+	return err
+}
+
+func (t *glacierTarget) ListArchives(vault string) (*Inventory, error) {
+	if t.retrieval == nil {
+		return nil, errors.New("retrieval needs to be opened before listing archives")
+	}
+	j, err := t.retrieval.RetrieveInventory(vault)
+	if err != nil {
+		return nil, err
+	}
+	if err = t.retrieval.Wait(j); err != nil {
+		return nil, err
+	}
+	inv, err := downloadInventory(t.glacier, j)
+	if err != nil {
+		return nil, err
+	}
+	return inv, t.retrieval.Done(j)
+}
+
+func (t *glacierTarget) RequestArchive(vault, archiveID string) error {
+	if t.retrieval == nil {
+		return errors.New("retrieval needs to be opened before requesting an archive")
+	}
+	_, err := t.retrieval.RetrieveArchive(vault, archiveID)
+	return err
+}
+
+func (t *glacierTarget) Retrieve(vault, archiveID, file string) (string, error) {
+	if t.retrieval == nil {
+		return "", errors.New("retrieval needs to be opened before retrieving an archive")
+	}
+	j, err := t.retrieval.RetrieveArchive(vault, archiveID)
+	if err != nil {
+		return "", err
+	}
+	if err = t.retrieval.Wait(j); err != nil {
+		return "", err
+	}
+	description, err := newDownload(t.glacier, j, file).Run()
+	if err != nil {
+		return "", err
+	}
+	log.WithField("vault", vault).WithField("archiveID", archiveID).WithField("size", j.ArchiveSize).
+		Info("archive downloaded")
+	return description, t.retrieval.Done(j)
+}
+
+// glacierUpload is a multipart upload into an aws glacier vault
+type glacierUpload struct {
+	glacier  glacieriface.GlacierAPI
+	vault    string
+	uploadID string
+}
+
+// concurrent parts are fine, glacier places every part at the range it is uploaded with
+func (u *glacierUpload) concurrent() {}
+
+func (u *glacierUpload) id() string {
+	return u.uploadID
+}
+
+func (u *glacierUpload) UploadPart(offset int64, p io.ReadSeeker, h []byte) error {
+	l, err := p.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	_, err = p.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	r := fmt.Sprintf("bytes %d-%d/*", offset, offset+l-1)
+	treeHash := fmt.Sprintf("%x", h)
+
+	log.WithField("range", r).WithField("vault", u.vault).Debug("multipart uploading range")
+	_, err = u.glacier.UploadMultipartPart(&glacier.UploadMultipartPartInput{
+		AccountId: aws.String("-"),
+		Body:      p,
+		Checksum:  &treeHash,
+		Range:     &r,
+		UploadId:  &u.uploadID,
+		VaultName: &u.vault,
+	})
+	return err
+}
+
+func (u *glacierUpload) Complete(size int64, h []byte) (string, error) {
+	fullHash := fmt.Sprintf("%x", h)
+	cu, err := u.glacier.CompleteMultipartUpload(&glacier.CompleteMultipartUploadInput{
+		AccountId:   aws.String("-"),
+		ArchiveSize: aws.String(strconv.FormatInt(size, 10)),
+		Checksum:    &fullHash,
+		UploadId:    &u.uploadID,
+		VaultName:   &u.vault,
+	})
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(cu.ArchiveId), nil
+}
+
+func (u *glacierUpload) Abort() error {
+	_, err := u.glacier.AbortMultipartUpload(&glacier.AbortMultipartUploadInput{
+		AccountId: aws.String("-"),
+		UploadId:  &u.uploadID,
+		VaultName: &u.vault,
+	})
+	return err
+}
+
+// glacierArchiveUpload uploads an archive with a single request once its only part is complete
+// The part is kept until Complete, a second part turns the upload into a multipart upload, e.g. if the estimated size
+// was too low.
+type glacierArchiveUpload struct {
+	target *glacierTarget
+	vault  string
+	req    *UploadRequest
+	// part and hash are the first part and its tree hash, hash is nil until it was uploaded
+	part      []byte
+	hash      []byte
+	multipart Upload
+}
+
+func (u *glacierArchiveUpload) UploadPart(offset int64, p io.ReadSeeker, h []byte) error {
+	if u.multipart == nil && u.hash == nil && offset == 0 {
+		// the caller reuses the buffer of p, so the part is copied
+		data, err := ioutil.ReadAll(p)
+		if err != nil {
+			return err
+		}
+		u.part, u.hash = data, h
+		return nil
+	}
+	if u.multipart == nil {
+		m, err := u.target.initiateUpload(u.vault, u.req)
+		if err != nil {
+			return err
+		}
+		u.multipart = m
+		if u.hash != nil {
+			if err = m.UploadPart(0, bytes.NewReader(u.part), u.hash); err != nil {
+				return err
+			}
+			u.part = nil
+		}
+	}
+	return u.multipart.UploadPart(offset, p, h)
+}
+
+func (u *glacierArchiveUpload) Complete(size int64, h []byte) (string, error) {
+	if u.multipart != nil {
+		return u.multipart.Complete(size, h)
+	}
+	if int64(len(u.part)) != size {
+		return "", fmt.Errorf("archive of %d bytes has %d bytes uploaded", size, len(u.part))
+	}
+	treeHash := fmt.Sprintf("%x", h)
+	a, err := u.target.glacier.UploadArchive(&glacier.UploadArchiveInput{
+		AccountId:          aws.String("-"),
+		ArchiveDescription: aws.String(u.req.Description),
+		Body:               bytes.NewReader(u.part),
+		Checksum:           &treeHash,
+		VaultName:          &u.vault,
+	})
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(a.ArchiveId), nil
+}
+
+// Abort aborts the multipart upload the archive turned into, nothing was sent otherwise
+func (u *glacierArchiveUpload) Abort() error {
+	u.part = nil
+	if u.multipart != nil {
+		return u.multipart.Abort()
+	}
+	return nil
+}
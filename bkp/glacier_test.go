@@ -0,0 +1,75 @@
+package bkp
+
+import (
+	"testing"
+	"bytes"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/aws/aws-sdk-go/service/glacier"
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func TestGlacierTarget_ListContainers(t *testing.T) {
+	api := &GlacierAPI{}
+	api.On("ListVaultsPages", mock.AnythingOfType("*glacier.ListVaultsInput"), mock.Anything).Return(nil).
+		Run(func(args mock.Arguments) {
+		fn := args.Get(1).(func(*glacier.ListVaultsOutput, bool) bool)
+		fn(&glacier.ListVaultsOutput{VaultList: []*glacier.DescribeVaultOutput{
+			{VaultName: aws.String("tank_test"), SizeInBytes: aws.Int64(2000), NumberOfArchives: aws.Int64(2),
+				LastInventoryDate: aws.String("2018-03-20T10:00:00.000Z")},
+		}}, false)
+		fn(&glacier.ListVaultsOutput{VaultList: []*glacier.DescribeVaultOutput{
+			{VaultName: aws.String("tank_new")},
+		}}, true)
+	}).Once()
+	target := &glacierTarget{glacier: api}
+	containers, err := target.ListContainers()
+	assert.NoError(t, err)
+	assert.Equal(t, []*Container{
+		{Name: "tank_test", Size: 2000, Archives: 2, Listable: true},
+		{Name: "tank_new"},
+	}, containers)
+
+	_, err = target.ListArchives("tank_test")
+	assert.Error(t, err)
+}
+
+func TestGlacierTarget_Upload(t *testing.T) {
+	data := []byte{1, 2, 3}
+	h := glacier.ComputeHashes(bytes.NewReader(data)).TreeHash
+	api := &GlacierAPI{}
+	api.On("InitiateMultipartUpload", mock.MatchedBy(func(i *glacier.InitiateMultipartUploadInput) bool {
+		return *i.VaultName == "tank_test" && *i.ArchiveDescription == `{"v":2}` && *i.PartSize == "1048576"
+	})).Return(&glacier.InitiateMultipartUploadOutput{UploadId: aws.String("upload-1")}, nil).Once()
+	api.On("UploadMultipartPart", mock.MatchedBy(func(i *glacier.UploadMultipartPartInput) bool {
+		return *i.Range == "bytes 1048576-1048578/*" && *i.Checksum == treeHash(data) && *i.UploadId == "upload-1"
+	})).Return(&glacier.UploadMultipartPartOutput{}, nil).Once()
+	api.On("CompleteMultipartUpload", mock.MatchedBy(func(i *glacier.CompleteMultipartUploadInput) bool {
+		return *i.ArchiveSize == "1048579" && *i.Checksum == treeHash(data)
+	})).Return(&glacier.ArchiveCreationOutput{ArchiveId: aws.String("archive-2")}, nil).Once()
+	target := &glacierTarget{glacier: api}
+	u, err := target.BeginUpload("tank_test", &UploadRequest{Description: `{"v":2}`, PartSize: 1024 * 1024})
+	require.NoError(t, err)
+	assert.NoError(t, u.UploadPart(1024*1024, bytes.NewReader(data), h))
+	id, err := u.Complete(1024*1024+3, h)
+	assert.NoError(t, err)
+	assert.Equal(t, "archive-2", id)
+	api.AssertExpectations(t)
+
+	// failed upload is aborted
+	api = &GlacierAPI{}
+	api.On("InitiateMultipartUpload", mock.AnythingOfType("*glacier.InitiateMultipartUploadInput")).
+		Return(&glacier.InitiateMultipartUploadOutput{UploadId: aws.String("upload-2")}, nil).Once()
+	api.On("UploadMultipartPart", mock.AnythingOfType("*glacier.UploadMultipartPartInput")).
+		Return(nil, errors.New("Simulated error")).Once()
+	api.On("AbortMultipartUpload", mock.MatchedBy(func(i *glacier.AbortMultipartUploadInput) bool {
+		return *i.UploadId == "upload-2" && *i.VaultName == "tank_test"
+	})).Return(&glacier.AbortMultipartUploadOutput{}, nil).Once()
+	b := &Batch{targets: defaultTargets(&glacierTarget{glacier: api})}
+	bkp := &zfsBackup{zfsReader: bytes.NewBuffer(data), partSize: 1024, hasNext: true, dataset: testDataset()}
+	err = b.upload("tank_test", bkp, "", allRequired(b))
+	assert.EqualError(t, err, "Simulated error")
+	api.AssertExpectations(t)
+}
@@ -0,0 +1,178 @@
+package bkp
+
+import (
+	"github.com/aws/aws-sdk-go/service/glacier"
+	"github.com/aws/aws-sdk-go/service/glacier/glacieriface"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/timaebi/go-zfs/zfsiface"
+	log "github.com/sirupsen/logrus"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// An Inventory lists the archives aws glacier stores in a vault
+// Glacier updates the inventory about once a day, archives uploaded since InventoryDate are not listed.
+type Inventory struct {
+	VaultARN      string
+	InventoryDate time.Time
+	ArchiveList   []*InventoryArchive
+}
+
+// An InventoryArchive is an archive listed in an Inventory
+type InventoryArchive struct {
+	ArchiveId          string
+	ArchiveDescription string
+	CreationDate       time.Time
+	Size               int64
+	SHA256TreeHash     string
+	// Metadata is decoded from the description, it is nil for archives not uploaded by zfs2glacier
+	Metadata *Metadata `json:"-"`
+}
+
+// ParseInventory decodes the JSON output of an inventory retrieval job
+func ParseInventory(r io.Reader) (*Inventory, error) {
+	inv := &Inventory{}
+	if err := json.NewDecoder(r).Decode(inv); err != nil {
+		return nil, err
+	}
+	for _, a := range inv.ArchiveList {
+		m, err := ParseMetadata(a.ArchiveDescription)
+		if err != nil {
+			log.WithField("archiveID", a.ArchiveId).Debug("archive description is not zfs2glacier metadata")
+			continue
+		}
+		a.Metadata = m
+	}
+	return inv, nil
+}
+
+// downloadInventory reads the output of a completed inventory retrieval job
+func downloadInventory(g glacieriface.GlacierAPI, j *RetrievalJob) (*Inventory, error) {
+	o, err := g.GetJobOutput(&glacier.GetJobOutputInput{
+		AccountId: aws.String("-"),
+		JobId:     &j.JobID,
+		VaultName: &j.VaultName,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer o.Body.Close()
+	return ParseInventory(o.Body)
+}
+
+// An archiveReference is a local backup snapshot with the id of the archive it was uploaded as
+type archiveReference struct {
+	Snapshot  string
+	ArchiveID string
+	Creation  time.Time
+}
+
+// getArchiveReferences returns the archive ids of the named target stored on the glacier-full and glacier-incremental
+// snapshots
+func (fs *ZFSFilesystem) getArchiveReferences(target string) ([]*archiveReference, error) {
+	refs := make([]*archiveReference, 0, 2)
+	for _, snap := range []zfsiface.Dataset{fs.getLastFullBackup(), fs.getLastIncrementalBackup()} {
+		if snap == nil {
+			continue
+		}
+		id, _, err := snap.GetProperty(archiveIDProperty(target))
+		if err != nil {
+			return nil, err
+		}
+		np := snap.GetNativeProperties()
+		refs = append(refs, &archiveReference{Snapshot: np.Name, ArchiveID: id, Creation: np.Creation})
+	}
+	return refs, nil
+}
+
+// A Reconciliation compares the inventory of a vault with the archive ids stored on the local backup snapshots
+type Reconciliation struct {
+	VaultName     string
+	InventoryDate time.Time
+	// Referenced archives are referenced by a local snapshot
+	Referenced []*InventoryArchive
+	// Bases are not referenced locally, but a referenced archive is based on them
+	Bases []*InventoryArchive
+	// Unreferenced archives are neither referenced locally nor needed to restore a referenced archive
+	Unreferenced []*InventoryArchive
+	// Missing references point to archives not listed in the inventory
+	Missing []*archiveReference
+	// Pending references were created after the inventory date and can't be listed in the inventory yet
+	Pending []*archiveReference
+}
+
+// Reconcile compares the inventory of a vault with the local snapshot references of its filesystem
+func Reconcile(vault string, inv *Inventory, refs []*archiveReference) *Reconciliation {
+	r := &Reconciliation{VaultName: vault, InventoryDate: inv.InventoryDate}
+	archives := make(map[string]*InventoryArchive)
+	for _, a := range inv.ArchiveList {
+		archives[a.ArchiveId] = a
+	}
+
+	// mark referenced archives and follow their chain down to the full backup
+	needed := make(map[string]bool)
+	for _, ref := range refs {
+		a, ok := archives[ref.ArchiveID]
+		if !ok {
+			if ref.Creation.After(inv.InventoryDate) {
+				r.Pending = append(r.Pending, ref)
+			} else {
+				r.Missing = append(r.Missing, ref)
+			}
+			continue
+		}
+		r.Referenced = append(r.Referenced, a)
+		needed[a.ArchiveId] = true
+		for a.Metadata != nil && a.Metadata.IsIncremental {
+			base, ok := archives[a.Metadata.BaseArchiveID]
+			if !ok || needed[base.ArchiveId] {
+				break
+			}
+			needed[base.ArchiveId] = true
+			r.Bases = append(r.Bases, base)
+			a = base
+		}
+	}
+	for _, a := range inv.ArchiveList {
+		if !needed[a.ArchiveId] {
+			r.Unreferenced = append(r.Unreferenced, a)
+		}
+	}
+	return r
+}
+
+// IsConsistent returns true if every local reference points to an archive in the vault and every archive is needed
+func (r *Reconciliation) IsConsistent() bool {
+	return len(r.Missing) == 0 && len(r.Unreferenced) == 0
+}
+
+// Print renders the reconciliation report to stdout
+func (r *Reconciliation) Print() {
+	const fmtStr = "  %-14s | %-30s | %12s | %s\n"
+	fmt.Printf("Vault %s, inventory of %s\n", r.VaultName, r.InventoryDate.String())
+	for _, a := range r.Referenced {
+		fmt.Printf(fmtStr, "referenced", a.CreationDate.String(), formatSize(a.Size), a.ArchiveId)
+	}
+	for _, a := range r.Bases {
+		fmt.Printf(fmtStr, "base", a.CreationDate.String(), formatSize(a.Size), a.ArchiveId)
+	}
+	for _, a := range r.Unreferenced {
+		fmt.Printf(fmtStr, "UNREFERENCED", a.CreationDate.String(), formatSize(a.Size), a.ArchiveId)
+	}
+	for _, ref := range r.Pending {
+		fmt.Printf(fmtStr, "pending", ref.Creation.String(), ref.Snapshot, ref.ArchiveID)
+	}
+	for _, ref := range r.Missing {
+		fmt.Printf(fmtStr, "MISSING", ref.Creation.String(), ref.Snapshot, ref.ArchiveID)
+	}
+	if r.IsConsistent() {
+		fmt.Println("  ok")
+	}
+}
+
+func formatSize(size int64) string {
+	return strings.TrimSpace(fmt.Sprintf("%6.2fGB", float64(size)/1e9))
+}
@@ -0,0 +1,137 @@
+package bkp
+
+import (
+	"testing"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/aws/aws-sdk-go/service/glacier"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/timaebi/go-zfs/zfsiface"
+)
+
+const testInventory = `{
+  "VaultARN": "arn:aws:glacier:eu-central-1:012345678901:vaults/tank_test",
+  "InventoryDate": "2018-03-20T10:00:00Z",
+  "ArchiveList": [
+    {
+      "ArchiveId": "archive-1",
+      "ArchiveDescription": "{\"IsIncremental\":false}",
+      "CreationDate": "2018-03-01T10:00:00Z",
+      "Size": 3000000000,
+      "SHA256TreeHash": "aa"
+    },
+    {
+      "ArchiveId": "archive-2",
+      "ArchiveDescription": "{\"BaseArchiveID\":\"archive-1\",\"IsIncremental\":true}",
+      "CreationDate": "2018-03-10T10:00:00Z",
+      "Size": 1000,
+      "SHA256TreeHash": "bb"
+    },
+    {
+      "ArchiveId": "archive-3",
+      "ArchiveDescription": "{\"BaseArchiveID\":\"archive-2\",\"IsIncremental\":true}",
+      "CreationDate": "2018-03-15T10:00:00Z",
+      "Size": 1000,
+      "SHA256TreeHash": "cc"
+    },
+    {
+      "ArchiveId": "archive-4",
+      "ArchiveDescription": "uploaded by hand",
+      "CreationDate": "2018-02-01T10:00:00Z",
+      "Size": 10,
+      "SHA256TreeHash": "dd"
+    }
+  ]
+}`
+
+func TestParseInventory(t *testing.T) {
+	inv, err := ParseInventory(strings.NewReader(testInventory))
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2018, 3, 20, 10, 0, 0, 0, time.UTC), inv.InventoryDate)
+	require.Len(t, inv.ArchiveList, 4)
+	assert.Equal(t, int64(3000000000), inv.ArchiveList[0].Size)
+	assert.Equal(t, &Metadata{Version: 1, IsIncremental: false}, inv.ArchiveList[0].Metadata)
+	assert.Equal(t, &Metadata{Version: 1, IsIncremental: true, BaseArchiveID: "archive-1"}, inv.ArchiveList[1].Metadata)
+	assert.Nil(t, inv.ArchiveList[3].Metadata)
+
+	_, err = ParseInventory(strings.NewReader("no json"))
+	assert.Error(t, err)
+}
+
+func TestReconcile(t *testing.T) {
+	inv, err := ParseInventory(strings.NewReader(testInventory))
+	require.NoError(t, err)
+
+	// full and latest incremental referenced -> intermediate incremental is a base, hand upload is unreferenced
+	refs := []*archiveReference{
+		{Snapshot: "tank/test@glacier-full", ArchiveID: "archive-1", Creation: time.Date(2018, 3, 1, 9, 0, 0, 0, time.UTC)},
+		{Snapshot: "tank/test@glacier-incremental", ArchiveID: "archive-3", Creation: time.Date(2018, 3, 15, 9, 0, 0, 0, time.UTC)},
+	}
+	r := Reconcile("tank_test", inv, refs)
+	assert.Equal(t, []*InventoryArchive{inv.ArchiveList[0], inv.ArchiveList[2]}, r.Referenced)
+	assert.Equal(t, []*InventoryArchive{inv.ArchiveList[1]}, r.Bases)
+	assert.Equal(t, []*InventoryArchive{inv.ArchiveList[3]}, r.Unreferenced)
+	assert.Empty(t, r.Missing)
+	assert.Empty(t, r.Pending)
+	assert.False(t, r.IsConsistent())
+
+	// references to archives that are not in the inventory
+	refs = []*archiveReference{
+		{Snapshot: "tank/test@glacier-full", ArchiveID: "archive-0", Creation: time.Date(2018, 1, 1, 9, 0, 0, 0, time.UTC)},
+		{Snapshot: "tank/test@glacier-incremental", ArchiveID: "archive-5", Creation: time.Date(2018, 3, 21, 9, 0, 0, 0, time.UTC)},
+	}
+	r = Reconcile("tank_test", inv, refs)
+	assert.Equal(t, refs[:1], r.Missing)
+	assert.Equal(t, refs[1:], r.Pending)
+	assert.Len(t, r.Unreferenced, 4)
+}
+
+func TestBatch_Inventory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zfs2glacier")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	full := &Dataset{}
+	full.On("GetNativeProperties").Return(&zfsiface.NativeProperties{Name: "tank/test@glacier-full"})
+	full.On("GetProperty", glacierArchiveID).Return("archive-1", zfsiface.Local, nil)
+	incremental := &Dataset{}
+	incremental.On("GetNativeProperties").Return(&zfsiface.NativeProperties{Name: "tank/test@glacier-incremental"})
+	incremental.On("GetProperty", glacierArchiveID).Return("archive-3", zfsiface.Local, nil)
+	ds := &Dataset{}
+	ds.On("GetNativeProperties").Return(&zfsiface.NativeProperties{Name: "tank/test"})
+	ds.On("GetProperty", BackupEnabled).Return("true", zfsiface.Local, nil)
+	ds.On("Snapshots").Return([]zfsiface.Dataset{full, incremental}, nil)
+	withoutAWSConfig(ds)
+
+	api := &GlacierAPI{}
+	api.On("InitiateJob", mock.MatchedBy(func(i *glacier.InitiateJobInput) bool {
+		return *i.VaultName == "tank_test" && *i.JobParameters.Type == "inventory-retrieval"
+	})).Return(&glacier.InitiateJobOutput{JobId: aws.String("job-1")}, nil).Once()
+	api.On("DescribeJob", mock.AnythingOfType("*glacier.DescribeJobInput")).Return(&glacier.JobDescription{
+		Completed:  aws.Bool(true),
+		StatusCode: aws.String(glacier.StatusCodeSucceeded),
+	}, nil).Once()
+	api.On("GetJobOutput", mock.AnythingOfType("*glacier.GetJobOutputInput")).Return(&glacier.GetJobOutputOutput{
+		Body: ioutil.NopCloser(bytes.NewReader([]byte(testInventory))),
+	}, nil).Once()
+	b := &Batch{
+		targets:     defaultTargets(&glacierTarget{glacier: api}),
+		filesystems: []Filesystem{&ZFSFilesystem{ds}},
+		containers:  map[string][]*Container{"": {{Name: "tank_test"}}},
+		initialized: true,
+	}
+	recs, err := b.Inventory(filepath.Join(dir, jobStateFile))
+	assert.NoError(t, err)
+	require.Len(t, recs, 1)
+	assert.Equal(t, "tank_test", recs[0].VaultName)
+	assert.Len(t, recs[0].Referenced, 2)
+	assert.Len(t, recs[0].Bases, 1)
+	api.AssertExpectations(t)
+}
@@ -0,0 +1,157 @@
+package bkp
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// MetadataVersion is the version of the description schema written by GetDescription
+const MetadataVersion = 2
+
+// maxDescriptionLength is the maximal length of an archive description accepted by aws glacier
+const maxDescriptionLength = 1024
+
+// Version of zfs2glacier that is recorded in the Metadata of new archives
+var Version = "dev"
+
+// Metadata contains information for a backup that is rendered as JSON
+// It is saved as description field in aws. The keys are kept short to stay within the 1024 characters glacier accepts.
+type Metadata struct {
+	Version       int    `json:"v"`
+	BaseArchiveID string `json:"b,omitempty"`
+	IsIncremental bool   `json:"i"`
+	Dataset       string `json:"ds,omitempty"`
+	// Snapshot is the name the snapshot gets once the upload succeeded, without the dataset
+	Snapshot  string    `json:"sn,omitempty"`
+	GUID      string    `json:"g,omitempty"`
+	FromGUID  string    `json:"fg,omitempty"`
+	CreateTxg string    `json:"tx,omitempty"`
+	Creation  time.Time `json:"ct"`
+	Tool      string    `json:"tv,omitempty"`
+	PartSize  int       `json:"ps,omitempty"`
+	// StreamSHA256 is the hex encoded SHA-256 of the uploaded stream, it is only known if the description is written
+	// after the upload, see checksumUpload
+	StreamSHA256 string              `json:"sha,omitempty"`
+	Compression  string              `json:"c,omitempty"`
+	Encryption   *EncryptionMetadata `json:"e,omitempty"`
+	// Raw is set for raw streams of natively encrypted filesystems, they are received without being mounted
+	Raw bool `json:"w,omitempty"`
+	// SendFlags are the letters of the further flags the stream was sent with, see ParseSendFlags
+	SendFlags string `json:"f,omitempty"`
+}
+
+// EncryptionMetadata holds the parameters needed to decrypt an archive
+type EncryptionMetadata struct {
+	Scheme string `json:"s"`
+	// Recipients are the fingerprints of the public keys an archive is encrypted to
+	Recipients []string `json:"r,omitempty"`
+	KDF        string   `json:"k,omitempty"`
+	Salt       string   `json:"sa,omitempty"`
+	Params     string   `json:"p,omitempty"`
+}
+
+// ReceiverFeatures returns the pool features a receiver needs for the stream besides the ones of a plain stream
+func (m *Metadata) ReceiverFeatures() []string {
+	features := make([]string, 0)
+	if m.Raw {
+		features = append(features, "encryption")
+	}
+	for _, f := range m.SendFlags {
+		if feature, ok := sendFlagFeatures[f]; ok {
+			features = append(features, feature)
+		}
+	}
+	return features
+}
+
+// legacyMetadata is the description written before the schema was versioned
+type legacyMetadata struct {
+	BaseArchiveID string `json:",omitempty"`
+	IsIncremental bool
+}
+
+// ParseMetadata reads the Metadata from an archive description
+// Descriptions without version are decoded as written by older releases.
+func ParseMetadata(description string) (*Metadata, error) {
+	v := &struct {
+		Version int `json:"v"`
+	}{}
+	if err := json.Unmarshal([]byte(description), v); err != nil {
+		return nil, err
+	}
+	switch {
+	case v.Version == 0:
+		l := &legacyMetadata{}
+		if err := json.Unmarshal([]byte(description), l); err != nil {
+			return nil, err
+		}
+		return &Metadata{Version: 1, BaseArchiveID: l.BaseArchiveID, IsIncremental: l.IsIncremental}, nil
+	case v.Version > MetadataVersion:
+		return nil, fmt.Errorf("unsupported metadata version %d", v.Version)
+	}
+	m := &Metadata{}
+	if err := json.Unmarshal([]byte(description), m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Encode renders the Metadata as printable ASCII of at most 1024 characters
+// If the description gets too long the dataset and snapshot names are left out, the GUIDs still identify the snapshot.
+func (m *Metadata) Encode() (string, error) {
+	c := *m
+	c.Version = MetadataVersion
+	for {
+		d, err := json.Marshal(&c)
+		if err != nil {
+			return "", err
+		}
+		s := escapeNonASCII(string(d))
+		if len(s) <= maxDescriptionLength {
+			return s, nil
+		}
+		switch {
+		case c.Snapshot != "":
+			c.Snapshot = ""
+		case c.Dataset != "":
+			c.Dataset = ""
+		default:
+			return "", fmt.Errorf("description of %d characters exceeds the limit of %d", len(s), maxDescriptionLength)
+		}
+	}
+}
+
+// escapeNonASCII replaces all non ASCII characters of a JSON document with \u escapes
+func escapeNonASCII(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r < utf8.RuneSelf:
+			b.WriteRune(r)
+		case r > 0xffff:
+			r -= 0x10000
+			fmt.Fprintf(&b, `\u%04x\u%04x`, 0xd800+(r>>10), 0xdc00+(r&0x3ff))
+		default:
+			fmt.Fprintf(&b, `\u%04x`, r)
+		}
+	}
+	return b.String()
+}
+
+// withStreamSHA256 returns the description with the SHA-256 of the stream added, descriptions without version are
+// returned as they are
+func withStreamSHA256(description, sum string) string {
+	m, err := ParseMetadata(description)
+	if err != nil || m.Version < MetadataVersion {
+		return description
+	}
+	m.StreamSHA256 = sum
+	d, err := m.Encode()
+	if err != nil {
+		return description
+	}
+	return d
+}
@@ -0,0 +1,89 @@
+package bkp
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// PartSizeProperty zfs attribute. The size of the parts an archive is uploaded in, a power of two from 1M to 4G,
+// e.g. "64M". S3 targets need at least 8M and azure targets at most 2G. It is chosen from the estimated size of the
+// send stream if not set or "auto".
+const PartSizeProperty = "ch.floor4:part_size"
+
+// DefaultPartSize is the part size of filesystems that don't set PartSizeProperty, 0 chooses it from the stream size
+var DefaultPartSize int
+
+const (
+	// minPartSize and maxPartSize are the part sizes glacier accepts, only the powers of two in between are valid
+	minPartSize int64 = 1024 * 1024
+	maxPartSize int64 = 4 * 1024 * 1024 * 1024
+	// maxParts is the number of parts glacier and s3 allow per archive
+	maxParts = 10000
+	// minAutoPartSize is the smallest part size chosen from the stream size, s3 needs parts of at least 5 MiB
+	minAutoPartSize int64 = 8 * 1024 * 1024
+	// unknownSizePartSize is used if the size of the stream can't be estimated, it holds streams up to 1.28 TB
+	unknownSizePartSize = 128 * 1024 * 1024
+)
+
+// partSizeUnits are the shifts of the suffixes a part size can be written with
+var partSizeUnits = map[byte]uint{'K': 10, 'M': 20, 'G': 30}
+
+// ParsePartSize reads a part size in bytes with an optional K, M or G suffix, it returns 0 for "auto"
+func ParsePartSize(s string) (int, error) {
+	v := strings.ToUpper(strings.TrimSpace(s))
+	if v == "AUTO" {
+		return 0, nil
+	}
+	v = strings.TrimSuffix(strings.TrimSuffix(v, "IB"), "B")
+	shift := uint(0)
+	if len(v) > 0 && partSizeUnits[v[len(v)-1]] > 0 {
+		shift = partSizeUnits[v[len(v)-1]]
+		v = v[:len(v)-1]
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid part size %q", s)
+	}
+	if n > maxPartSize>>shift {
+		return 0, fmt.Errorf("part size %s is larger than 4G", s)
+	}
+	n = n << shift
+	if n < minPartSize || n&(n-1) != 0 {
+		return 0, fmt.Errorf("part size %s is not a power of two from 1M to 4G", s)
+	}
+	return int(n), nil
+}
+
+// partSizeFor returns the smallest power of two part size from minAutoPartSize on that splits a stream of the
+// estimated size into at most maxParts parts. The estimate gets a margin for the encryption overhead and estimates
+// that turn out low, streams too large even for the largest part size up to max get it anyway.
+func partSizeFor(size, max int64) int {
+	size += size / 64
+	p := minAutoPartSize
+	for p*2 <= max && p*maxParts < size {
+		p *= 2
+	}
+	return int(p)
+}
+
+// checkPartSize returns an error if a target does not accept the part size set for a filesystem
+// The part size chosen from the stream size is limited to the largest one every target accepts.
+func checkPartSize(vault string, o *StreamOptions, targets []*uploadTarget) error {
+	o.maxPartSize = maxPartSize
+	for _, t := range targets {
+		pt, ok := t.Target.(partSizeTarget)
+		if !ok {
+			continue
+		}
+		min, max := pt.partSizeLimits()
+		if o.PartSize != 0 && (int64(o.PartSize) < min || int64(o.PartSize) > max) {
+			return fmt.Errorf("target %s of %s does not accept parts of %d bytes, they need to have %d to %d bytes",
+				t.Name, vault, o.PartSize, min, max)
+		}
+		if max < o.maxPartSize {
+			o.maxPartSize = max
+		}
+	}
+	return nil
+}
@@ -0,0 +1,202 @@
+package bkp
+
+import (
+	"testing"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/glacier"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/timaebi/go-zfs/zfsiface"
+)
+
+// estimating prepares a dataset mock that estimates every stream at size bytes
+func estimating(d *Dataset, size int64) *Dataset {
+	d.On("EstimateSnapshot", mock.Anything, mock.Anything).Return(size, nil)
+	return d
+}
+
+func TestParsePartSize(t *testing.T) {
+	for value, expected := range map[string]int{
+		"auto":     0,
+		"1M":       1024 * 1024,
+		"64m":      64 * 1024 * 1024,
+		"256MiB":   256 * 1024 * 1024,
+		"4G":       4 * 1024 * 1024 * 1024,
+		"2048K":    2 * 1024 * 1024,
+		"16777216": 16 * 1024 * 1024,
+	} {
+		size, err := ParsePartSize(value)
+		assert.NoError(t, err, value)
+		assert.Equal(t, expected, size, value)
+	}
+	for _, value := range []string{"", "512K", "8G", "3M", "-1M", "100000000000G", "1T"} {
+		_, err := ParsePartSize(value)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestPartSizeFor(t *testing.T) {
+	const mib = 1024 * 1024
+	for size, expected := range map[int64]int{
+		0:                   8 * mib,
+		1000:                8 * mib,
+		80 * 1000 * mib:     16 * mib,
+		1280 * 1000 * mib:   256 * mib,
+		1330000000000:       256 * mib,
+		1270000000000:       128 * mib,
+		20000 * 1000 * mib:  2048 * mib,
+		100000 * 1000 * mib: 4096 * mib,
+	} {
+		assert.Equal(t, expected, partSizeFor(size, maxPartSize), "%d bytes", size)
+	}
+	// azure stages blocks of at most 4000 MiB
+	assert.Equal(t, 2048*mib, partSizeFor(100000*1000*mib, azureMaxBlockSize))
+}
+
+func TestCheckPartSize(t *testing.T) {
+	targets := []*uploadTarget{{NamedTarget: &NamedTarget{Target: newMemTarget()}},
+		{NamedTarget: &NamedTarget{Name: "s3", Target: &s3Target{}}},
+		{NamedTarget: &NamedTarget{Name: "azure", Target: &azureTarget{}}}}
+
+	// parts below 5 MiB are rejected by s3, parts of 4 GiB by azure
+	o := &StreamOptions{PartSize: 4 * 1024 * 1024}
+	assert.EqualError(t, checkPartSize("tank_test", o, targets),
+		"target s3 of tank_test does not accept parts of 4194304 bytes, they need to have 5242880 to 5368709120 bytes")
+	o = &StreamOptions{PartSize: 4 * 1024 * 1024 * 1024}
+	assert.Error(t, checkPartSize("tank_test", o, targets))
+	assert.NoError(t, checkPartSize("tank_test", o, targets[:2]))
+	o = &StreamOptions{PartSize: 8 * 1024 * 1024}
+	assert.NoError(t, checkPartSize("tank_test", o, targets))
+
+	// the part size chosen from the stream size stays below the limit of every target
+	o = &StreamOptions{}
+	require.NoError(t, checkPartSize("tank_test", o, targets))
+	assert.Equal(t, azureMaxBlockSize, o.partSizeLimit())
+	require.NoError(t, checkPartSize("tank_test", o, targets[:1]))
+	assert.Equal(t, maxPartSize, o.partSizeLimit())
+}
+
+func TestParseSendSize(t *testing.T) {
+	size, err := parseSendSize("incremental\ttank/test@a\ttank/test@b\t3145728\nsize\t3145728\n")
+	require.NoError(t, err)
+	assert.Equal(t, int64(3145728), size)
+	_, err = parseSendSize("cannot open 'tank/test@b': dataset does not exist\n")
+	assert.Error(t, err)
+}
+
+func TestNewBackup_partSize(t *testing.T) {
+	base := &Dataset{}
+	base.On("GetNativeProperties").Return(&zfsiface.NativeProperties{Name: "tank/test@glacier-full"})
+	d := testDataset()
+	d.On("EstimateSnapshot", base, []string{"-c"}).Return(int64(200*1000*1024*1024), nil).Twice()
+	d.On("SendSnapshotWithFlags", base, []string{"-c"}, mock.Anything).Return(nil)
+	b := newBackup(d, base, &StreamOptions{SendFlags: "c"})
+	assert.Equal(t, 32*1024*1024, b.GetPartSize())
+	assert.Equal(t, int64(200*1000*1024*1024), b.GetEstimatedSize())
+
+	// a part size set for the filesystem wins over the estimate
+	b = newBackup(d, base, &StreamOptions{SendFlags: "c", PartSize: 1024 * 1024 * 1024})
+	assert.Equal(t, 1024*1024*1024, b.GetPartSize())
+	d.AssertNumberOfCalls(t, "EstimateSnapshot", 2)
+
+	// streams that can't be estimated get the size that holds streams up to 1.28 TB
+	d = testDataset()
+	d.On("EstimateSnapshot", nil, []string{}).Return(int64(0), errors.New("simulated error")).Once()
+	d.On("SendSnapshot", mock.Anything).Return(nil)
+	b = newBackup(d, nil, &StreamOptions{})
+	assert.Equal(t, 128*1024*1024, b.GetPartSize())
+	assert.Equal(t, int64(0), b.GetEstimatedSize())
+}
+
+func TestZFSFilesystem_GetStreamOptionsPartSize(t *testing.T) {
+	defer func() { DefaultPartSize = 0 }()
+	m := &Dataset{}
+	m.On("GetProperty", RawSend).Return("-", zfsiface.None, nil)
+	m.On("GetProperty", SendFlagsProperty).Return("-", zfsiface.None, nil)
+	m.On("GetProperty", CompressionProperty).Return("-", zfsiface.None, nil)
+	m.On("GetProperty", AgeRecipients).Return("-", zfsiface.None, nil)
+	m.On("GetProperty", PassphraseFile).Return("-", zfsiface.None, nil)
+	m.On("GetNativeProperties").Return(&zfsiface.NativeProperties{Name: "tank/test"})
+	m.On("GetProperty", PartSizeProperty).Return("-", zfsiface.None, nil).Once()
+	DefaultPartSize = 64 * 1024 * 1024
+	o, err := (&ZFSFilesystem{m}).GetStreamOptions()
+	require.NoError(t, err)
+	assert.Equal(t, 64*1024*1024, o.PartSize)
+
+	m.On("GetProperty", PartSizeProperty).Return("auto", zfsiface.Inherited, nil).Once()
+	o, err = (&ZFSFilesystem{m}).GetStreamOptions()
+	require.NoError(t, err)
+	assert.Equal(t, 0, o.PartSize)
+
+	m.On("GetProperty", PartSizeProperty).Return("512M", zfsiface.Local, nil).Once()
+	o, err = (&ZFSFilesystem{m}).GetStreamOptions()
+	require.NoError(t, err)
+	assert.Equal(t, 512*1024*1024, o.PartSize)
+
+	m.On("GetProperty", PartSizeProperty).Return("100M", zfsiface.Local, nil).Once()
+	_, err = (&ZFSFilesystem{m}).GetStreamOptions()
+	assert.Error(t, err)
+}
+
+func TestGlacierTarget_uploadArchive(t *testing.T) {
+	data := []byte{1, 2, 3}
+	api := &GlacierAPI{}
+	api.On("UploadArchive", mock.MatchedBy(func(i *glacier.UploadArchiveInput) bool {
+		i.Body.Seek(0, io.SeekStart)
+		body, _ := ioutil.ReadAll(i.Body)
+		return *i.VaultName == "tank_test" && *i.ArchiveDescription == `{"v":2}` &&
+			*i.Checksum == treeHash(data) && bytes.Equal(body, data)
+	})).Return(&glacier.ArchiveCreationOutput{ArchiveId: aws.String("archive-1")}, nil).Once()
+	target := &glacierTarget{glacier: api}
+	hash := func(d []byte) []byte {
+		return glacier.ComputeHashes(bytes.NewReader(d)).TreeHash
+	}
+
+	// a stream expected to fit in one part is uploaded with a single request, the part's buffer may be reused
+	req := &UploadRequest{Description: `{"v":2}`, PartSize: 1024 * 1024, Size: 3}
+	u, err := target.BeginUpload("tank_test", req)
+	require.NoError(t, err)
+	part := append([]byte{}, data...)
+	require.NoError(t, u.UploadPart(0, bytes.NewReader(part), hash(data)))
+	part[0] = 9
+	id, err := u.Complete(3, hash(data))
+	require.NoError(t, err)
+	assert.Equal(t, "archive-1", id)
+	api.AssertExpectations(t)
+
+	// a stream larger than estimated continues as multipart upload
+	first := bytes.Repeat([]byte{7}, 1024*1024)
+	api.On("InitiateMultipartUpload", mock.MatchedBy(func(i *glacier.InitiateMultipartUploadInput) bool {
+		return *i.VaultName == "tank_test" && *i.PartSize == "1048576"
+	})).Return(&glacier.InitiateMultipartUploadOutput{UploadId: aws.String("upload-1")}, nil).Once()
+	api.On("UploadMultipartPart", mock.MatchedBy(func(i *glacier.UploadMultipartPartInput) bool {
+		return *i.Range == "bytes 0-1048575/*" && *i.Checksum == treeHash(first)
+	})).Return(&glacier.UploadMultipartPartOutput{}, nil).Once()
+	api.On("UploadMultipartPart", mock.MatchedBy(func(i *glacier.UploadMultipartPartInput) bool {
+		return *i.Range == "bytes 1048576-1048578/*" && *i.Checksum == treeHash(data)
+	})).Return(&glacier.UploadMultipartPartOutput{}, nil).Once()
+	api.On("CompleteMultipartUpload", mock.MatchedBy(func(i *glacier.CompleteMultipartUploadInput) bool {
+		return *i.UploadId == "upload-1" && *i.ArchiveSize == "1048579"
+	})).Return(&glacier.ArchiveCreationOutput{ArchiveId: aws.String("archive-2")}, nil).Once()
+	u, err = target.BeginUpload("tank_test", req)
+	require.NoError(t, err)
+	require.NoError(t, u.UploadPart(0, bytes.NewReader(first), hash(first)))
+	require.NoError(t, u.UploadPart(1024*1024, bytes.NewReader(data), hash(data)))
+	id, err = u.Complete(1024*1024+3, []byte{1})
+	require.NoError(t, err)
+	assert.Equal(t, "archive-2", id)
+	api.AssertExpectations(t)
+
+	// larger streams start a multipart upload right away
+	api.On("InitiateMultipartUpload", mock.AnythingOfType("*glacier.InitiateMultipartUploadInput")).
+		Return(&glacier.InitiateMultipartUploadOutput{UploadId: aws.String("upload-2")}, nil).Once()
+	u, err = target.BeginUpload("tank_test", &UploadRequest{PartSize: 16 * 1024 * 1024, Size: 12 * 1024 * 1024})
+	require.NoError(t, err)
+	assert.Equal(t, "upload-2", u.(resumableUpload).id())
+	api.AssertExpectations(t)
+}
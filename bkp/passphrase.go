@@ -0,0 +1,235 @@
+package bkp
+
+import (
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// PassphraseFile zfs attribute. The file with the passphrase the backups of the filesystem are encrypted with
+const PassphraseFile = "ch.floor4:passphrase_file"
+
+// EncryptionPassphrase is the scheme of archives encrypted with a key derived from a passphrase
+const EncryptionPassphrase = "passphrase"
+
+// kdfArgon2id is the key derivation function recorded in the EncryptionMetadata of passphrase encrypted archives
+const kdfArgon2id = "argon2id"
+
+// passphraseChunkSize is the size of the plaintext of every chunk of a passphrase encrypted stream
+const passphraseChunkSize = 64 * 1024
+
+// argon2Params are the cost parameters of argon2id
+type argon2Params struct {
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+}
+
+// defaultArgon2Params take about a second and 256 MiB of memory to derive a key
+var defaultArgon2Params = argon2Params{Time: 4, Memory: 256 * 1024, Threads: 4}
+
+func (p argon2Params) String() string {
+	return fmt.Sprintf("t=%d,m=%d,p=%d", p.Time, p.Memory, p.Threads)
+}
+
+// parseArgon2Params reads the parameters as written by String
+func parseArgon2Params(s string) (argon2Params, error) {
+	p := argon2Params{}
+	if _, err := fmt.Sscanf(s, "t=%d,m=%d,p=%d", &p.Time, &p.Memory, &p.Threads); err != nil {
+		return p, fmt.Errorf("invalid argon2id parameters %q", s)
+	}
+	if p.Time == 0 || p.Memory == 0 || p.Threads == 0 {
+		return p, fmt.Errorf("invalid argon2id parameters %q", s)
+	}
+	return p, nil
+}
+
+func (p argon2Params) key(passphrase, salt []byte) []byte {
+	return argon2.IDKey(passphrase, salt, p.Time, p.Memory, p.Threads, chacha20poly1305.KeySize)
+}
+
+// passphraseEncryption encrypts the stream with a key derived from a passphrase and a random salt
+// The stream is split into chunks of passphraseChunkSize which are sealed with chacha20poly1305, the nonce is the
+// chunk counter with a flag marking the last chunk. A tampered, reordered or truncated chunk fails to open.
+type passphraseEncryption struct {
+	aead   cipher.AEAD
+	salt   []byte
+	params argon2Params
+}
+
+// NewPassphraseEncryption creates an Encryption with a key derived from the passphrase with a new salt
+func NewPassphraseEncryption(passphrase []byte) (Encryption, error) {
+	return newPassphraseEncryption(passphrase, defaultArgon2Params)
+}
+
+func newPassphraseEncryption(passphrase []byte, p argon2Params) (*passphraseEncryption, error) {
+	if len(passphrase) == 0 {
+		return nil, errors.New("empty passphrase")
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.New(p.key(passphrase, salt))
+	if err != nil {
+		return nil, err
+	}
+	return &passphraseEncryption{aead: aead, salt: salt, params: p}, nil
+}
+
+// ReadPassphrase reads a passphrase from a file, the line break at its end is not part of the passphrase
+func ReadPassphrase(file string) ([]byte, error) {
+	d, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	p := strings.TrimRight(string(d), "\r\n")
+	if p == "" {
+		return nil, errors.New("passphrase file " + file + " is empty")
+	}
+	return []byte(p), nil
+}
+
+func (e *passphraseEncryption) Encrypt(w io.Writer) (io.WriteCloser, error) {
+	return &chunkWriter{aead: e.aead, w: w, buf: make([]byte, 0, passphraseChunkSize)}, nil
+}
+
+func (e *passphraseEncryption) Metadata() *EncryptionMetadata {
+	return &EncryptionMetadata{
+		Scheme: EncryptionPassphrase,
+		KDF:    kdfArgon2id,
+		Salt:   base64.RawStdEncoding.EncodeToString(e.salt),
+		Params: e.params.String(),
+	}
+}
+
+// passphraseDecryption returns a reader decrypting a stream with the parameters of its EncryptionMetadata
+func passphraseDecryption(r io.Reader, m *EncryptionMetadata, passphrase []byte) (io.Reader, error) {
+	if m.KDF != kdfArgon2id {
+		return nil, fmt.Errorf("unsupported key derivation function %q", m.KDF)
+	}
+	p, err := parseArgon2Params(m.Params)
+	if err != nil {
+		return nil, err
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(m.Salt)
+	if err != nil {
+		return nil, fmt.Errorf("invalid salt: %v", err)
+	}
+	aead, err := chacha20poly1305.New(p.key(passphrase, salt))
+	if err != nil {
+		return nil, err
+	}
+	return &chunkReader{aead: aead, r: r, buf: make([]byte, passphraseChunkSize+aead.Overhead())}, nil
+}
+
+// chunkNonce returns the nonce of the nth chunk
+func chunkNonce(n uint64, last bool) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.BigEndian.PutUint64(nonce[3:11], n)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// chunkWriter seals the stream in chunks, the last chunk is shorter than passphraseChunkSize and possibly empty
+type chunkWriter struct {
+	aead cipher.AEAD
+	w    io.Writer
+	buf  []byte
+	n    uint64
+}
+
+func (c *chunkWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// a full chunk is only sealed when more data follows, so the last chunk is never full
+		if len(c.buf) == passphraseChunkSize {
+			if err := c.flush(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(c.buf[len(c.buf):cap(c.buf)], p)
+		c.buf = c.buf[:len(c.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (c *chunkWriter) flush(last bool) error {
+	if _, err := c.w.Write(c.aead.Seal(nil, chunkNonce(c.n, last), c.buf, nil)); err != nil {
+		return err
+	}
+	c.n++
+	c.buf = c.buf[:0]
+	return nil
+}
+
+// Close seals the last chunk
+func (c *chunkWriter) Close() error {
+	if len(c.buf) == passphraseChunkSize {
+		if err := c.flush(false); err != nil {
+			return err
+		}
+	}
+	return c.flush(true)
+}
+
+// chunkReader opens the chunks written by chunkWriter
+type chunkReader struct {
+	aead  cipher.AEAD
+	r     io.Reader
+	buf   []byte
+	plain []byte
+	n     uint64
+	done  bool
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for len(c.plain) == 0 {
+		if c.done {
+			return 0, io.EOF
+		}
+		if err := c.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.plain)
+	c.plain = c.plain[n:]
+	return n, nil
+}
+
+// next opens the next chunk, a chunk shorter than a full one is the last
+func (c *chunkReader) next() error {
+	n, err := io.ReadFull(c.r, c.buf)
+	last := false
+	switch {
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		last = true
+	case err != nil:
+		return err
+	}
+	if last && n < c.aead.Overhead() {
+		return errors.New("encrypted stream is truncated")
+	}
+	c.plain, err = c.aead.Open(c.buf[:0], chunkNonce(c.n, last), c.buf[:n], nil)
+	if err != nil {
+		if c.n == 0 {
+			return errors.New("wrong passphrase or tampered first chunk")
+		}
+		return fmt.Errorf("chunk %d is tampered or the stream is truncated", c.n)
+	}
+	c.n++
+	c.done = last
+	return nil
+}
@@ -0,0 +1,139 @@
+package bkp
+
+import (
+	"testing"
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/timaebi/go-zfs/zfsiface"
+)
+
+// testArgon2Params keep the key derivation fast in tests
+var testArgon2Params = argon2Params{Time: 1, Memory: 64, Threads: 1}
+
+// passphraseEncrypt encrypts data with a key derived from passphrase
+func passphraseEncrypt(t *testing.T, passphrase string, data []byte) ([]byte, *EncryptionMetadata) {
+	e, err := newPassphraseEncryption([]byte(passphrase), testArgon2Params)
+	require.NoError(t, err)
+	out := &bytes.Buffer{}
+	w, err := e.Encrypt(out)
+	require.NoError(t, err)
+	_, err = w.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	return out.Bytes(), e.Metadata()
+}
+
+func passphraseDecrypt(passphrase string, d []byte, m *EncryptionMetadata) ([]byte, error) {
+	r, err := passphraseDecryption(bytes.NewReader(d), m, []byte(passphrase))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+func TestPassphraseEncryption(t *testing.T) {
+	data := make([]byte, 3*passphraseChunkSize+100)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+	for _, n := range []int{0, 1, passphraseChunkSize - 1, passphraseChunkSize, passphraseChunkSize + 1, 3 * passphraseChunkSize} {
+		encrypted, m := passphraseEncrypt(t, "secret", data[:n])
+		chunks := n/passphraseChunkSize + 1
+		assert.Equal(t, n+chunks*16, len(encrypted), "size of %d bytes", n)
+		d, err := passphraseDecrypt("secret", encrypted, m)
+		require.NoError(t, err, "decrypt %d bytes", n)
+		assert.Equal(t, data[:n], d, "decrypt %d bytes", n)
+	}
+
+	// the salt and kdf parameters are recorded, every stream gets a new salt
+	encrypted, m := passphraseEncrypt(t, "secret", data)
+	assert.Equal(t, EncryptionPassphrase, m.Scheme)
+	assert.Equal(t, "argon2id", m.KDF)
+	assert.Equal(t, "t=1,m=64,p=1", m.Params)
+	_, m2 := passphraseEncrypt(t, "secret", data)
+	assert.NotEqual(t, m.Salt, m2.Salt)
+
+	_, err = passphraseDecrypt("wrong", encrypted, m)
+	assert.EqualError(t, err, "wrong passphrase or tampered first chunk")
+	tampered := append([]byte{}, encrypted...)
+	tampered[passphraseChunkSize+16+10]++
+	_, err = passphraseDecrypt("secret", tampered, m)
+	assert.EqualError(t, err, "chunk 1 is tampered or the stream is truncated")
+	_, err = passphraseDecrypt("secret", encrypted[:2*(passphraseChunkSize+16)], m)
+	assert.Error(t, err, "truncated at a chunk boundary")
+	_, err = passphraseDecrypt("secret", encrypted[:2*(passphraseChunkSize+16)+50], m)
+	assert.Error(t, err, "truncated within a chunk")
+	_, err = passphraseDecrypt("secret", encrypted, &EncryptionMetadata{Scheme: EncryptionPassphrase, KDF: "scrypt",
+		Salt: m.Salt, Params: m.Params})
+	assert.Error(t, err)
+	_, err = passphraseDecrypt("secret", encrypted, &EncryptionMetadata{Scheme: EncryptionPassphrase, KDF: "argon2id",
+		Salt: m.Salt, Params: "t=0,m=64,p=1"})
+	assert.Error(t, err)
+
+	_, err = newPassphraseEncryption([]byte{}, testArgon2Params)
+	assert.Error(t, err)
+}
+
+func TestRestore_SetPassphrase(t *testing.T) {
+	encrypted, m := passphraseEncrypt(t, "secret", []byte{1, 2, 3})
+	_, err := decrypt(bytes.NewReader(encrypted), m, nil, nil)
+	assert.Error(t, err, "no passphrase")
+
+	// the passphrase is requested once for all archives
+	requested := 0
+	r := &Restore{}
+	r.SetPassphrase(func() ([]byte, error) {
+		requested++
+		return []byte("secret"), nil
+	})
+	for i := 0; i < 2; i++ {
+		in, err := decrypt(bytes.NewReader(encrypted), m, nil, r.passphrase)
+		require.NoError(t, err)
+		d, err := ioutil.ReadAll(in)
+		require.NoError(t, err)
+		assert.Equal(t, []byte{1, 2, 3}, d)
+	}
+	assert.Equal(t, 1, requested)
+}
+
+func TestZFSFilesystem_GetStreamOptionsPassphrase(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zfs2glacier")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defer func(p argon2Params) { defaultArgon2Params = p }(defaultArgon2Params)
+	defaultArgon2Params = testArgon2Params
+	file := filepath.Join(dir, "passphrase")
+	require.NoError(t, ioutil.WriteFile(file, []byte("secret\n"), 0600))
+	p, err := ReadPassphrase(file)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("secret"), p)
+
+	m := &Dataset{}
+	m.On("GetProperty", RawSend).Return("-", zfsiface.None, nil)
+	m.On("GetProperty", SendFlagsProperty).Return("-", zfsiface.None, nil)
+	m.On("GetProperty", PartSizeProperty).Return("-", zfsiface.None, nil)
+	m.On("GetProperty", CompressionProperty).Return("-", zfsiface.None, nil)
+	m.On("GetNativeProperties").Return(&zfsiface.NativeProperties{Name: "tank/test"})
+	m.On("GetProperty", AgeRecipients).Return("-", zfsiface.None, nil).Once()
+	m.On("GetProperty", PassphraseFile).Return(file, zfsiface.Inherited, nil).Once()
+	o, err := (&ZFSFilesystem{m}).GetStreamOptions()
+	require.NoError(t, err)
+	require.NotNil(t, o.Encryption)
+	assert.Equal(t, EncryptionPassphrase, o.Encryption.Metadata().Scheme)
+
+	// only one encryption can be selected
+	m.On("GetProperty", AgeRecipients).Return("age1xyz", zfsiface.Local, nil).Once()
+	m.On("GetProperty", PassphraseFile).Return(file, zfsiface.Inherited, nil).Once()
+	_, err = (&ZFSFilesystem{m}).GetStreamOptions()
+	assert.Error(t, err)
+
+	require.NoError(t, ioutil.WriteFile(file, []byte("\n"), 0600))
+	m.On("GetProperty", AgeRecipients).Return("-", zfsiface.None, nil).Once()
+	m.On("GetProperty", PassphraseFile).Return(file, zfsiface.Inherited, nil).Once()
+	_, err = (&ZFSFilesystem{m}).GetStreamOptions()
+	assert.Error(t, err)
+}
@@ -0,0 +1,230 @@
+package bkp
+
+import (
+	"github.com/aws/aws-sdk-go/service/glacier"
+	log "github.com/sirupsen/logrus"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// A part is a piece of the send stream in one of the buffers of a partPipeline
+type part struct {
+	index  int
+	offset int64
+	data   []byte
+	// buf is the whole buffer the part was read into, it is reused once the part is uploaded
+	buf []byte
+}
+
+// A partPipeline uploads parts with several workers while the next parts are read from the stream
+// The tree hashes are computed by the workers, so they finish in any order and are put in place by index.
+type partPipeline struct {
+	uploads []*fanOut
+	// skipped are the tree hashes of the parts the resumed uploads have from an interrupted upload
+	skipped [][]byte
+	// record is called with the tree hash of every part all targets completed, in order
+	record func(h []byte)
+
+	// mu guards the fields below and the errors of the uploads
+	mu sync.Mutex
+	// progress is signalled whenever a part is done on a target or the pipeline fails
+	progress *sync.Cond
+	// hashes are the tree hashes of the parts by index, nil for parts that are not done yet
+	hashes   [][]byte
+	recorded int
+	// next is the index of the part the targets taking their parts in order get next
+	next map[*fanOut]int
+	err  error
+}
+
+// SetConcurrency sets the number of parts uploaded at once and the memory the part buffers may take in total
+// Every worker needs a buffer and one more lets the next part be read meanwhile, a budget that does not hold them
+// reduces the workers. At least one part is always buffered.
+func (b *Batch) SetConcurrency(workers int, bufferBudget int64) {
+	b.workers = workers
+	b.bufferBudget = bufferBudget
+}
+
+// concurrency returns the number of workers and buffers for parts of the given size
+func (b *Batch) concurrency(partSize int) (int, int) {
+	workers := b.workers
+	if workers < 1 {
+		workers = 1
+	}
+	buffers := workers + 1
+	if b.bufferBudget > 0 && int64(buffers)*int64(partSize) > b.bufferBudget {
+		buffers = int(b.bufferBudget / int64(partSize))
+	}
+	if buffers < 1 {
+		buffers = 1
+	}
+	if workers > buffers {
+		workers = buffers
+	}
+	return workers, buffers
+}
+
+// uploadParts reads the parts of the backup and uploads them to all targets without error
+// It returns the tree hashes of all parts in order, the size of the stream and its hex SHA-256. Failed targets get no
+// further parts, their uploads are left to the caller.
+func (b *Batch) uploadParts(bkp Backup, uploads []*fanOut, skipped [][]byte, state *UploadState) ([][]byte, int64, string, error) {
+	workers, buffers := b.concurrency(bkp.GetPartSize())
+	log.WithField("workers", workers).WithField("buffers", buffers).Debug("uploading parts")
+	p := &partPipeline{
+		uploads: uploads,
+		skipped: skipped,
+		record:  func(h []byte) { b.recordPart(state, h) },
+		hashes:  make([][]byte, 0, 100),
+		next:    make(map[*fanOut]int),
+	}
+	p.progress = sync.NewCond(&p.mu)
+	for _, f := range uploads {
+		p.next[f] = f.resumed
+	}
+
+	queue := make(chan *part)
+	free := make(chan []byte, buffers)
+	wg := sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for pt := range queue {
+				p.upload(pt)
+				free <- pt.buf
+			}
+		}()
+	}
+	allocated := 0
+	pos := int64(0)
+	sum := sha256.New()
+	for i := 0; bkp.HasNextPart() && !p.stopped(); i++ {
+		var buf []byte
+		select {
+		case buf = <-free:
+		default:
+			// buffers are only allocated as the stream needs them, small streams don't take the whole budget
+			if allocated < buffers {
+				buf = make([]byte, bkp.GetPartSize())
+				allocated++
+			} else {
+				buf = <-free
+			}
+		}
+		n, err := bkp.ReadPart(buf)
+		if err != nil {
+			p.fail(err)
+			break
+		}
+		sum.Write(buf[:n])
+		queue <- &part{index: i, offset: pos, data: buf[:n], buf: buf}
+		pos = pos + int64(n)
+	}
+	close(queue)
+	wg.Wait()
+	if p.err != nil {
+		return nil, 0, "", p.err
+	}
+	return p.hashes, pos, hex.EncodeToString(sum.Sum(nil)), nil
+}
+
+// upload hashes a part and uploads it to all targets at once
+// Resumed uploads have the parts from the interrupted upload already, they are only uploaded to the other targets.
+func (p *partPipeline) upload(pt *part) {
+	h := glacier.ComputeHashes(bytes.NewReader(pt.data)).TreeHash
+	if pt.index < len(p.skipped) && !bytes.Equal(h, p.skipped[pt.index]) {
+		p.fail(fmt.Errorf("part %d of the stream differs from the interrupted upload", pt.index))
+		p.complete(pt.index, h)
+		return
+	}
+	ra := bytes.NewReader(pt.data)
+	wg := sync.WaitGroup{}
+	for _, f := range p.uploads {
+		if pt.index < f.resumed {
+			continue
+		}
+		wg.Add(1)
+		go func(f *fanOut) {
+			defer wg.Done()
+			p.send(f, pt, ra, h)
+		}(f)
+	}
+	wg.Wait()
+	p.complete(pt.index, h)
+}
+
+// send uploads a part to a target without error, targets taking their parts in order wait for the previous part
+func (p *partPipeline) send(f *fanOut, pt *part, ra io.ReaderAt, h []byte) {
+	p.mu.Lock()
+	_, concurrent := f.upload.(concurrentUpload)
+	for !concurrent && p.next[f] != pt.index && f.err == nil && !p.halted() {
+		p.progress.Wait()
+	}
+	u, skip := f.upload, f.err != nil || p.halted()
+	p.mu.Unlock()
+
+	var err error
+	if !skip {
+		err = u.UploadPart(pt.offset, io.NewSectionReader(ra, 0, int64(len(pt.data))), h)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err != nil && f.err == nil {
+		f.err = err
+	}
+	if !concurrent {
+		p.next[f] = pt.index + 1
+	}
+	p.progress.Broadcast()
+}
+
+// complete stores the tree hash of a part all targets are done with and records the parts done in order
+func (p *partPipeline) complete(index int, h []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for len(p.hashes) <= index {
+		p.hashes = append(p.hashes, nil)
+	}
+	p.hashes[index] = h
+	for p.recorded < len(p.hashes) && p.hashes[p.recorded] != nil {
+		if p.recorded >= len(p.skipped) && !p.halted() {
+			p.record(p.hashes[p.recorded])
+		}
+		p.recorded++
+	}
+}
+
+// fail stops the pipeline, the parts being uploaded are finished but no further parts are read
+func (p *partPipeline) fail(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err == nil {
+		p.err = err
+	}
+	p.progress.Broadcast()
+}
+
+// stopped returns true once no further parts are read, see halted
+func (p *partPipeline) stopped() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.halted()
+}
+
+// halted returns true once the pipeline or a required target failed, the backup is aborted then
+// The caller holds mu.
+func (p *partPipeline) halted() bool {
+	if p.err != nil {
+		return true
+	}
+	for _, f := range p.uploads {
+		if f.required && f.err != nil {
+			return true
+		}
+	}
+	return false
+}
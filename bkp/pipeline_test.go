@@ -0,0 +1,182 @@
+package bkp
+
+import (
+	"testing"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"github.com/aws/aws-sdk-go/service/glacier"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// concurrentMemTarget is a memTarget whose uploads take their parts in any order and at once
+// The upload of a part sends its offset to started and waits until release of the offset is closed, then it sends
+// the offset to done.
+type concurrentMemTarget struct {
+	*memTarget
+	started chan int64
+	release map[int64]chan struct{}
+	done    chan int64
+	mu      sync.Mutex
+	// inFlight counts the parts being uploaded, maxInFlight the most at once
+	inFlight    int
+	maxInFlight int
+	order       []int64
+}
+
+// concurrentMemUpload collects the parts of a concurrentMemTarget by offset
+type concurrentMemUpload struct {
+	target      *concurrentMemTarget
+	container   string
+	description string
+	parts       map[int64][]byte
+}
+
+func newConcurrentMemTarget(partSize int64, parts int, containers ...string) *concurrentMemTarget {
+	t := &concurrentMemTarget{memTarget: newMemTarget(containers...), started: make(chan int64, parts),
+		release: make(map[int64]chan struct{}), done: make(chan int64, parts)}
+	for i := 0; i < parts; i++ {
+		t.release[int64(i)*partSize] = make(chan struct{})
+	}
+	return t
+}
+
+func (t *concurrentMemTarget) BeginUpload(container string, req *UploadRequest) (Upload, error) {
+	if _, ok := t.containers[container]; !ok {
+		return nil, errors.New("container " + container + " does not exist")
+	}
+	return &concurrentMemUpload{target: t, container: container, description: req.Description,
+		parts: make(map[int64][]byte)}, nil
+}
+
+func (u *concurrentMemUpload) concurrent() {}
+
+func (u *concurrentMemUpload) UploadPart(offset int64, part io.ReadSeeker, h []byte) error {
+	t := u.target
+	t.mu.Lock()
+	t.inFlight++
+	if t.inFlight > t.maxInFlight {
+		t.maxInFlight = t.inFlight
+	}
+	t.mu.Unlock()
+	t.started <- offset
+	<-t.release[offset]
+	d, err := ioutil.ReadAll(part)
+	if err == nil && !bytes.Equal(glacier.ComputeHashes(bytes.NewReader(d)).TreeHash, h) {
+		err = errors.New("tree hash of part does not match")
+	}
+	t.mu.Lock()
+	t.inFlight--
+	t.order = append(t.order, offset)
+	u.parts[offset] = d
+	t.mu.Unlock()
+	t.done <- offset
+	return err
+}
+
+func (u *concurrentMemUpload) Complete(size int64, h []byte) (string, error) {
+	data := make([]byte, 0, size)
+	for int64(len(data)) < size {
+		p, ok := u.parts[int64(len(data))]
+		if !ok {
+			return "", fmt.Errorf("no part at %d", len(data))
+		}
+		data = append(data, p...)
+	}
+	if !bytes.Equal(glacier.ComputeHashes(bytes.NewReader(data)).TreeHash, h) {
+		return "", errors.New("tree hash of archive does not match")
+	}
+	u.target.nextID++
+	id := fmt.Sprintf("archive-%d", u.target.nextID)
+	u.target.put(u.container, id, u.description, data)
+	return id, nil
+}
+
+func (u *concurrentMemUpload) Abort() error {
+	u.target.aborted++
+	return nil
+}
+
+// bufferCountingBackup counts the distinct buffers the parts are read into
+type bufferCountingBackup struct {
+	*zfsBackup
+	buffers map[*byte]bool
+}
+
+func (b *bufferCountingBackup) ReadPart(buf []byte) (int, error) {
+	b.buffers[&buf[0]] = true
+	return b.zfsBackup.ReadPart(buf)
+}
+
+func TestBatch_concurrency(t *testing.T) {
+	for _, c := range []struct {
+		workers         int
+		budget          int64
+		expectedWorkers int
+		expectedBuffers int
+	}{
+		{0, 0, 1, 2},
+		{4, 0, 4, 5},
+		{4, 1024 * 1024 * 1024, 4, 5},
+		{4, 3 * 128 * 1024 * 1024, 3, 3},
+		{4, 1024, 1, 1},
+	} {
+		b := &Batch{}
+		b.SetConcurrency(c.workers, c.budget)
+		workers, buffers := b.concurrency(128 * 1024 * 1024)
+		assert.Equal(t, c.expectedWorkers, workers, "%d workers with %d bytes", c.workers, c.budget)
+		assert.Equal(t, c.expectedBuffers, buffers, "%d workers with %d bytes", c.workers, c.budget)
+	}
+}
+
+func TestBatch_uploadConcurrent(t *testing.T) {
+	data := make([]byte, 10*1024*1024+100)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	const mib = 1024 * 1024
+	concurrent := newConcurrentMemTarget(mib, 11, "tank_test")
+	ordered := newMemTarget("tank_test")
+	ordered.nextID = 10
+	b := &Batch{targets: []*NamedTarget{{Target: concurrent}, {Name: "nas", Target: ordered}}}
+	b.SetConcurrency(4, 6*1024*1024)
+
+	d := testDataset()
+	d.On("SetProperty", glacierArchiveID, "archive-1").Return(nil).Once()
+	d.On("SetProperty", glacierArchiveID+":nas", "archive-11").Return(nil).Once()
+	d.On("Rename", "tank/test@glacier-full", false, false).Return(&Dataset{}, nil).Once()
+	bkp := &bufferCountingBackup{zfsBackup: &zfsBackup{zfsReader: bytes.NewBuffer(data), partSize: 1024 * 1024,
+		hasNext: true, dataset: d}, buffers: make(map[*byte]bool)}
+	errs := make(chan error)
+	go func() {
+		errs <- b.upload("tank_test", bkp, "", allRequired(b))
+	}()
+
+	// the workers upload the first parts at once, they complete in reverse order
+	first := make(map[int64]bool)
+	for i := 0; i < 4; i++ {
+		first[<-concurrent.started] = true
+	}
+	assert.Equal(t, map[int64]bool{0: true, mib: true, 2 * mib: true, 3 * mib: true}, first)
+	for o := int64(3); o >= 0; o-- {
+		close(concurrent.release[o*mib])
+		assert.Equal(t, o*mib, <-concurrent.done)
+	}
+	for o := int64(4); o < 11; o++ {
+		close(concurrent.release[o*mib])
+	}
+	require.NoError(t, <-errs)
+	mock.AssertExpectationsForObjects(t, d)
+
+	// the parts were uploaded at once and out of order, the archives are complete anyway
+	assert.Equal(t, 4, concurrent.maxInFlight)
+	assert.Equal(t, []int64{3 * mib, 2 * mib, mib, 0}, concurrent.order[:4])
+	assert.Equal(t, data, concurrent.containers["tank_test"][0].data)
+	assert.Equal(t, data, ordered.containers["tank_test"][0].data)
+	assert.Len(t, bkp.buffers, 5)
+}
@@ -0,0 +1,86 @@
+package bkp
+
+import (
+	"testing"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/timaebi/go-zfs/zfsiface"
+)
+
+func TestNewBackup_raw(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zfs2glacier")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	data := []byte("raw stream")
+	write := func(args mock.Arguments) {
+		args.Get(2).(io.Writer).Write(data)
+	}
+
+	// raw streams are sent with zfs send -w
+	d := testDataset()
+	d.On("EstimateSnapshot", nil, []string{"-w"}).Return(int64(len(data)), nil).Once()
+	d.On("SendSnapshotWithFlags", nil, []string{"-w"}, mock.Anything).Return(nil).Run(write).Once()
+	b := newBackup(d, nil, &StreamOptions{Raw: true}).(*zfsBackup)
+	p, _ := b.NextPart()
+	sent, err := ioutil.ReadAll(p)
+	require.NoError(t, err)
+	assert.Equal(t, data, sent)
+	description, err := b.GetDescription("")
+	require.NoError(t, err)
+	m, err := ParseMetadata(description)
+	require.NoError(t, err)
+	assert.True(t, m.Raw)
+
+	base := &Dataset{}
+	base.On("GetNativeProperties").Return(&zfsiface.NativeProperties{Name: "tank/test@glacier-full"})
+	incremental := &Dataset{}
+	incremental.On("GetNativeProperties").Return(&zfsiface.NativeProperties{Name: "tank/test@glacier-tmp"})
+	incremental.On("EstimateSnapshot", base, []string{"-w"}).Return(int64(len(data)), nil).Once()
+	incremental.On("SendSnapshotWithFlags", base, []string{"-w"}, mock.Anything).Return(nil).Run(write).Once()
+	b = newBackup(incremental, base, &StreamOptions{Raw: true}).(*zfsBackup)
+	p, _ = b.NextPart()
+	sent, err = ioutil.ReadAll(p)
+	require.NoError(t, err)
+	assert.Equal(t, data, sent)
+	mock.AssertExpectationsForObjects(t, d, incremental)
+
+	// a raw archive is received without mounting it
+	file := filepath.Join(dir, "archive-1")
+	require.NoError(t, ioutil.WriteFile(file, data, 0600))
+	api := &zfsAPIMock{}
+	api.On("receive", "tank/restored@glacier-restore-0", false, true, mock.Anything).Return(nil).Once()
+	defaultAPI = api
+	r := &Restore{workDir: dir}
+	require.NoError(t, r.receive(&restoreArchive{ArchiveID: "archive-1", Description: `{"v":2,"i":false,"w":true}`,
+		File: file}, "tank/restored@glacier-restore-0", false))
+	mock.AssertExpectationsForObjects(t, api)
+}
+
+func TestZFSFilesystem_GetStreamOptionsRaw(t *testing.T) {
+	m := &Dataset{}
+	m.On("GetProperty", CompressionProperty).Return("-", zfsiface.None, nil)
+	m.On("GetProperty", AgeRecipients).Return("-", zfsiface.None, nil)
+	m.On("GetProperty", SendFlagsProperty).Return("-", zfsiface.None, nil)
+	m.On("GetProperty", PartSizeProperty).Return("-", zfsiface.None, nil)
+	m.On("GetProperty", PassphraseFile).Return("-", zfsiface.None, nil)
+	m.On("GetProperty", RawSend).Return("True", zfsiface.Inherited, nil).Once()
+	o, err := (&ZFSFilesystem{m}).GetStreamOptions()
+	require.NoError(t, err)
+	assert.True(t, o.Raw)
+	assert.Equal(t, []string{"-w"}, o.sendFlags())
+
+	m.On("GetProperty", RawSend).Return("-", zfsiface.None, nil).Once()
+	o, err = (&ZFSFilesystem{m}).GetStreamOptions()
+	require.NoError(t, err)
+	assert.False(t, o.Raw)
+	assert.Empty(t, o.sendFlags())
+
+	m.On("GetProperty", RawSend).Return("", zfsiface.Unknown, assert.AnError).Once()
+	_, err = (&ZFSFilesystem{m}).GetStreamOptions()
+	assert.Error(t, err)
+}
@@ -0,0 +1,140 @@
+package bkp
+
+import (
+	log "github.com/sirupsen/logrus"
+	"fmt"
+	"strings"
+)
+
+// RebuildCatalog records the archives of every vault created by zfs2glacier in the catalog
+// It only needs access to the target, no local zfs state is used. Inventory retrieval jobs are tracked in stateFile,
+// so a later call picks up jobs that did not complete yet. If filter is set, only vaults of filesystems under
+// the given path are considered. The records are assigned to the named target.
+func RebuildCatalog(t *NamedTarget, c *Catalog, stateFile, filter string) ([]string, error) {
+	if err := t.OpenRetrieval(stateFile, TierStandard); err != nil {
+		return nil, err
+	}
+	if ct, ok := t.Target.(catalogTarget); ok {
+		ct.setCatalog(c)
+	}
+	return rebuildCatalog(t, c, filter)
+}
+
+func rebuildCatalog(t *NamedTarget, c *Catalog, filter string) ([]string, error) {
+	containers, err := t.ListContainers()
+	if err != nil {
+		return nil, err
+	}
+	vaults := make([]string, 0)
+	for _, ct := range containers {
+		fs, ok := FilesystemName(ct.Name)
+		if !ok || (filter != "" && fs != filter && !strings.HasPrefix(fs, filter+"/")) {
+			log.WithField("vault", ct.Name).Debug("skipping vault")
+			continue
+		}
+		if !ct.Listable {
+			log.WithField("vault", ct.Name).Info("skipping vault without inventory")
+			continue
+		}
+		vaults = append(vaults, ct.Name)
+	}
+
+	// request all lists first, so that glacier prepares the inventories in parallel
+	for _, vn := range vaults {
+		if err = t.RequestArchives(vn); err != nil {
+			return nil, err
+		}
+	}
+	for _, vn := range vaults {
+		inv, err := t.ListArchives(vn)
+		if err != nil {
+			return nil, err
+		}
+		n, err := recordInventory(c, t.Name, vn, inv)
+		if err != nil {
+			return nil, err
+		}
+		log.WithField("vault", vn).WithField("archives", n).Info("inventory recorded in catalog")
+	}
+	return vaults, nil
+}
+
+// recordInventory adds the archives of an inventory of the named target to the catalog
+// Archives which are already recorded are kept, their records contain more details than the inventory.
+// The dataset is read from the description, the vault name is only decoded for descriptions that lack it, since
+// names with characters vault names can't hold don't survive the encoding.
+func recordInventory(c *Catalog, target, vault string, inv *Inventory) (int, error) {
+	vaultFS, _ := FilesystemName(vault)
+	n := 0
+	for _, a := range inv.ArchiveList {
+		if a.Metadata == nil {
+			log.WithField("vault", vault).WithField("archiveID", a.ArchiveId).
+				Warn("skipping archive not uploaded by zfs2glacier")
+			continue
+		}
+		existing, err := c.Get(a.ArchiveId)
+		if err != nil {
+			return n, err
+		}
+		if existing != nil {
+			continue
+		}
+		fs := vaultFS
+		if a.Metadata.Dataset != "" {
+			fs = a.Metadata.Dataset
+		}
+		r := &CatalogRecord{
+			ArchiveID:       a.ArchiveId,
+			Target:          target,
+			VaultName:       vault,
+			Dataset:         fs,
+			Creation:        a.CreationDate,
+			Size:            a.Size,
+			TreeHash:        a.SHA256TreeHash,
+			SnapshotGUID:    a.Metadata.GUID,
+			PartSize:        a.Metadata.PartSize,
+			IsIncremental:   a.Metadata.IsIncremental,
+			BaseArchiveID:   a.Metadata.BaseArchiveID,
+			Description:     a.ArchiveDescription,
+			UploadCompleted: a.CreationDate,
+		}
+		// descriptions of older releases only contain the chain, the archive creation is the best guess for the snapshot
+		if !a.Metadata.Creation.IsZero() {
+			r.Creation = a.Metadata.Creation
+		}
+		if a.Metadata.Snapshot != "" {
+			r.Snapshot = fs + "@" + a.Metadata.Snapshot
+		}
+		if err = c.Put(r); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// PrintChains renders the archive chains of a vault to stdout
+// Every chain starts with its latest archive and ends with the full backup it is based on.
+func (c *Catalog) PrintChains(vault string) error {
+	heads, err := c.Heads(vault)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Vault %s\n", vault)
+	for _, h := range heads {
+		chain, err := c.Chain(h.ArchiveID)
+		status := "complete"
+		if err != nil {
+			status = "BROKEN: " + err.Error()
+		}
+		fmt.Printf("  chain of %d archives, latest from %s, %s\n", len(chain), h.Creation.String(), status)
+		for _, r := range chain {
+			kind := "full"
+			if r.IsIncremental {
+				kind = "incremental"
+			}
+			fmt.Printf("    %-11s | %-30s | %12s | %s\n", kind, r.Creation.String(), formatSize(r.Size), r.ArchiveID)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package bkp
+
+import (
+	"testing"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/aws/aws-sdk-go/service/glacier"
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func TestRebuildCatalog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zfs2glacier")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c, err := OpenCatalog(filepath.Join(dir, "catalog.db"))
+	require.NoError(t, err)
+	defer c.Close()
+
+	// an archive recorded during upload is kept as is
+	known := &CatalogRecord{ArchiveID: "archive-1", VaultName: "tank_test", Dataset: "tank/test",
+		Snapshot: "tank/test@glacier-full", PartSize: 1 << 20, Creation: time.Date(2018, 3, 1, 9, 0, 0, 0, time.UTC)}
+	require.NoError(t, c.Put(known))
+
+	api := &GlacierAPI{}
+	api.On("ListVaultsPages", mock.AnythingOfType("*glacier.ListVaultsInput"), mock.Anything).Return(nil).
+		Run(func(args mock.Arguments) {
+		fn := args.Get(1).(func(*glacier.ListVaultsOutput, bool) bool)
+		fn(&glacier.ListVaultsOutput{VaultList: []*glacier.DescribeVaultOutput{
+			{VaultName: aws.String("tank_test"), LastInventoryDate: aws.String("2018-03-20T10:00:00.000Z")},
+			{VaultName: aws.String("tank_new")},
+			{VaultName: aws.String("other_test"), LastInventoryDate: aws.String("2018-03-20T10:00:00.000Z")},
+			{VaultName: aws.String("my.vault"), LastInventoryDate: aws.String("2018-03-20T10:00:00.000Z")},
+		}}, true)
+	}).Once()
+	api.On("InitiateJob", mock.MatchedBy(func(i *glacier.InitiateJobInput) bool {
+		return *i.VaultName == "tank_test" && *i.JobParameters.Type == "inventory-retrieval"
+	})).Return(&glacier.InitiateJobOutput{JobId: aws.String("job-1")}, nil).Once()
+	api.On("DescribeJob", mock.AnythingOfType("*glacier.DescribeJobInput")).Return(&glacier.JobDescription{
+		Completed:  aws.Bool(true),
+		StatusCode: aws.String(glacier.StatusCodeSucceeded),
+	}, nil).Once()
+	api.On("GetJobOutput", mock.AnythingOfType("*glacier.GetJobOutputInput")).Return(&glacier.GetJobOutputOutput{
+		Body: ioutil.NopCloser(bytes.NewReader([]byte(testInventory))),
+	}, nil).Once()
+
+	target := &glacierTarget{glacier: api}
+	require.NoError(t, target.OpenRetrieval(filepath.Join(dir, jobStateFile), TierStandard))
+	vaults, err := rebuildCatalog(&NamedTarget{Target: target}, c, "tank")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"tank_test"}, vaults)
+	api.AssertExpectations(t)
+
+	r, err := c.Get("archive-1")
+	assert.NoError(t, err)
+	assert.Equal(t, known, r)
+	r, err = c.Get("archive-3")
+	assert.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, "tank/test", r.Dataset)
+	assert.Equal(t, "archive-2", r.BaseArchiveID)
+	assert.True(t, r.IsIncremental)
+	assert.Equal(t, time.Date(2018, 3, 15, 10, 0, 0, 0, time.UTC), r.Creation)
+	r, err = c.Get("archive-4")
+	assert.NoError(t, err)
+	assert.Nil(t, r)
+
+	// the rebuilt catalog is enough to find the latest archive and its chain
+	latest, err := c.Latest("tank_test", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "archive-3", latest.ArchiveID)
+	chain, err := c.Chain(latest.ArchiveID)
+	assert.NoError(t, err)
+	assert.Len(t, chain, 3)
+}
+
+func TestRecordInventory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zfs2glacier")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c, err := OpenCatalog(filepath.Join(dir, "catalog.db"))
+	require.NoError(t, err)
+	defer c.Close()
+
+	// the dataset of the description wins over the vault name, which turned the dot into a slash
+	vault := VaultName("tank/my.data")
+	inv := &Inventory{ArchiveList: []*InventoryArchive{
+		{ArchiveId: "archive-1", Metadata: &Metadata{Version: 2, Dataset: "tank/my.data", Snapshot: "glacier-full"}},
+		{ArchiveId: "archive-2", Metadata: &Metadata{IsIncremental: true, BaseArchiveID: "archive-1"}},
+	}}
+	n, err := recordInventory(c, "", vault, inv)
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+	r, err := c.Get("archive-1")
+	require.NoError(t, err)
+	assert.Equal(t, "tank/my.data", r.Dataset)
+	assert.Equal(t, "tank/my.data@glacier-full", r.Snapshot)
+	r, err = c.Get("archive-2")
+	require.NoError(t, err)
+	assert.Equal(t, "tank/my/data", r.Dataset)
+}
@@ -0,0 +1,24 @@
+// Code generated by mockery v1.0.0
+package bkp
+
+import io "io"
+import mock "github.com/stretchr/testify/mock"
+
+// remoteShellMock is an autogenerated mock type for the remoteShell type
+type remoteShellMock struct {
+	mock.Mock
+}
+
+// run provides a mock function with given fields: cmd, stdin, stdout
+func (_m *remoteShellMock) run(cmd string, stdin io.Reader, stdout io.Writer) error {
+	ret := _m.Called(cmd, stdin, stdout)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(string, io.Reader, io.Writer) error); ok {
+		r0 = rf(cmd, stdin, stdout)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
@@ -0,0 +1,305 @@
+package bkp
+
+import (
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ReplicaDescription zfs attribute. Set on the snapshots received by a replica target, it contains the archive description
+const ReplicaDescription = "ch.floor4:description"
+
+// A remoteShell runs commands on the host of a replica target
+type remoteShell interface {
+	// run executes cmd with the given stdin and stdout, both may be nil
+	run(cmd string, stdin io.Reader, stdout io.Writer) error
+}
+
+// sshShell runs commands in sessions of an ssh connection
+type sshShell struct {
+	client *ssh.Client
+}
+
+func (s *sshShell) run(cmd string, stdin io.Reader, stdout io.Writer) error {
+	session, err := s.client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	stderr := &bytes.Buffer{}
+	session.Stdin = stdin
+	session.Stdout = stdout
+	session.Stderr = stderr
+	if err = session.Run(cmd); err != nil {
+		return fmt.Errorf("%s: %s: %v", cmd, strings.TrimSpace(stderr.String()), err)
+	}
+	return nil
+}
+
+// replicaTarget receives the backup streams into zfs filesystems on a remote host, which is a warm copy of them
+// Every filesystem is received into root/<vault name>. An upload creates a snapshot there, its name is used as
+// archive id, so the base snapshot of an incremental stream is the snapshot of its base archive. As the stream is
+// received, filesystems uploaded to a replica can't set compression or encryption, raw streams are fine.
+type replicaTarget struct {
+	shell remoteShell
+	root  string
+}
+
+// NewReplicaTarget connects to host as user and creates a Target receiving the backups into filesystems below root
+// The client authenticates with the private key in keyFile, the host key is checked against knownHostsFile.
+func NewReplicaTarget(host, user, root, keyFile, knownHostsFile string) (Target, error) {
+	conn, err := dialSSH(host, user, keyFile, knownHostsFile)
+	if err != nil {
+		return nil, err
+	}
+	return newReplicaTarget(&sshShell{client: conn}, root)
+}
+
+func newReplicaTarget(shell remoteShell, root string) (Target, error) {
+	if root == "" {
+		return nil, errors.New("the replica target needs a filesystem to receive into")
+	}
+	t := &replicaTarget{shell: shell, root: root}
+	if _, err := t.output("zfs list -H -o name " + shellQuote(root)); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *replicaTarget) receivesStream() {}
+
+func (t *replicaTarget) filesystem(container string) string {
+	return t.root + "/" + container
+}
+
+func (t *replicaTarget) snapshot(container, archiveID string) string {
+	return t.filesystem(container) + "@" + archiveID
+}
+
+// output runs cmd and returns the lines it writes to stdout split into tab separated fields
+func (t *replicaTarget) output(cmd string) ([][]string, error) {
+	out := &bytes.Buffer{}
+	if err := t.shell.run(cmd, nil, out); err != nil {
+		return nil, err
+	}
+	lines := make([][]string, 0)
+	s := bufio.NewScanner(out)
+	for s.Scan() {
+		if s.Text() != "" {
+			lines = append(lines, strings.Split(s.Text(), "\t"))
+		}
+	}
+	return lines, s.Err()
+}
+
+func (t *replicaTarget) ListContainers() ([]*Container, error) {
+	filesystems, err := t.output("zfs list -H -p -o name,used -t filesystem -d 1 " + shellQuote(t.root))
+	if err != nil {
+		return nil, err
+	}
+	snapshots, err := t.output("zfs list -H -o name -t snapshot -d 2 " + shellQuote(t.root))
+	if err != nil {
+		return nil, err
+	}
+	containers := make([]*Container, 0)
+	for _, fs := range filesystems {
+		if len(fs) != 2 || !strings.HasPrefix(fs[0], t.root+"/") {
+			continue
+		}
+		c := &Container{Name: strings.TrimPrefix(fs[0], t.root+"/"), Listable: true}
+		c.Size, _ = strconv.ParseInt(fs[1], 10, 64)
+		for _, snap := range snapshots {
+			if strings.HasPrefix(snap[0], fs[0]+"@") {
+				c.Archives++
+			}
+		}
+		containers = append(containers, c)
+	}
+	return containers, nil
+}
+
+// CreateContainer creates the filesystem the backups are received into, it is not mounted
+func (t *replicaTarget) CreateContainer(name string) error {
+	return t.shell.run("zfs create -p -o canmount=off "+shellQuote(t.filesystem(name)), nil, nil)
+}
+
+// BeginUpload starts zfs receive on the remote host, the parts are piped into it
+// A full stream replaces the filesystem with all of its snapshots.
+func (t *replicaTarget) BeginUpload(container string, req *UploadRequest) (Upload, error) {
+	id, err := newObjectName()
+	if err != nil {
+		return nil, err
+	}
+	r, w := io.Pipe()
+	u := &replicaUpload{target: t, container: container, id: id, description: req.Description, stream: w,
+		done: make(chan error, 1)}
+	cmd := "zfs receive -u -F " + shellQuote(t.snapshot(container, id))
+	go func() {
+		err := t.shell.run(cmd, r, nil)
+		// parts written after zfs receive exited fail
+		r.CloseWithError(err)
+		u.done <- err
+	}()
+	return u, nil
+}
+
+// OpenRetrieval does nothing, the snapshots of a replica are available immediately
+func (t *replicaTarget) OpenRetrieval(stateFile, tier string) error {
+	return nil
+}
+
+func (t *replicaTarget) RequestArchives(container string) error {
+	return nil
+}
+
+func (t *replicaTarget) ListArchives(container string) (*Inventory, error) {
+	snapshots, err := t.output("zfs list -H -p -o name,creation,used," + ReplicaDescription +
+		" -t snapshot -d 1 " + shellQuote(t.filesystem(container)))
+	if err != nil {
+		return nil, err
+	}
+	inv := &Inventory{InventoryDate: time.Now(), ArchiveList: make([]*InventoryArchive, 0, len(snapshots))}
+	for _, snap := range snapshots {
+		if len(snap) != 4 {
+			return nil, fmt.Errorf("unexpected zfs list output %q", strings.Join(snap, "\t"))
+		}
+		a := &InventoryArchive{ArchiveId: snap[0][strings.Index(snap[0], "@")+1:]}
+		if creation, err := strconv.ParseInt(snap[1], 10, 64); err == nil {
+			a.CreationDate = time.Unix(creation, 0)
+		}
+		a.Size, _ = strconv.ParseInt(snap[2], 10, 64)
+		if snap[3] != "-" {
+			a.ArchiveDescription = snap[3]
+			if m, err := ParseMetadata(a.ArchiveDescription); err == nil {
+				a.Metadata = m
+			}
+		}
+		inv.ArchiveList = append(inv.ArchiveList, a)
+	}
+	return inv, nil
+}
+
+func (t *replicaTarget) RequestArchive(container, archiveID string) error {
+	return t.shell.run("zfs list -H -o name "+shellQuote(t.snapshot(container, archiveID)), nil, nil)
+}
+
+// description returns the archive description stored on a received snapshot
+func (t *replicaTarget) description(container, archiveID string) (string, error) {
+	out, err := t.output("zfs get -H -o value " + ReplicaDescription + " " + shellQuote(t.snapshot(container, archiveID)))
+	if err != nil {
+		return "", err
+	}
+	if len(out) != 1 || out[0][0] == "-" {
+		return "", fmt.Errorf("snapshot %s has no description", t.snapshot(container, archiveID))
+	}
+	return out[0][0], nil
+}
+
+// Retrieve sends a snapshot of the replica to file
+// Incremental archives are sent from the snapshot of their base archive, so they can be received on top of it.
+// A partially retrieved file is sent again from the beginning.
+func (t *replicaTarget) Retrieve(container, archiveID, file string) (string, error) {
+	description, err := t.description(container, archiveID)
+	if err != nil {
+		return "", err
+	}
+	m, err := ParseMetadata(description)
+	if err != nil {
+		return "", err
+	}
+	cmd := "zfs send "
+	// the blocks of a raw stream stay encrypted on the replica, they can only be sent raw again
+	if m.Raw {
+		cmd += "-w "
+	}
+	if m.IsIncremental {
+		cmd += "-i " + shellQuote("@"+m.BaseArchiveID) + " "
+	}
+	f, err := os.Create(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if err = t.shell.run(cmd+shellQuote(t.snapshot(container, archiveID)), nil, f); err != nil {
+		return "", err
+	}
+	log.WithField("filesystem", t.filesystem(container)).WithField("snapshot", archiveID).Info("snapshot sent")
+	return description, f.Sync()
+}
+
+// replicaUpload pipes the parts of a backup into zfs receive
+type replicaUpload struct {
+	target      *replicaTarget
+	container   string
+	id          string
+	description string
+	stream      *io.PipeWriter
+	size        int64
+	// done receives the result of zfs receive
+	done chan error
+	err  error
+}
+
+func (u *replicaUpload) UploadPart(offset int64, p io.ReadSeeker, h []byte) error {
+	if offset != u.size {
+		return fmt.Errorf("part at %d uploaded after %d bytes", offset, u.size)
+	}
+	n, err := io.Copy(u.stream, p)
+	u.size += n
+	return err
+}
+
+// Complete waits for zfs receive and stores the description on the received snapshot
+// The guid of the received snapshot is compared to the one of the sent snapshot.
+func (u *replicaUpload) Complete(size int64, h []byte) (string, error) {
+	u.stream.Close()
+	if err := u.wait(); err != nil {
+		return "", err
+	}
+	if u.size != size {
+		return "", fmt.Errorf("zfs receive got %d bytes, expected %d", u.size, size)
+	}
+	snapshot := u.target.snapshot(u.container, u.id)
+	out, err := u.target.output("zfs get -H -o value guid " + shellQuote(snapshot))
+	if err != nil {
+		return "", err
+	}
+	if m, err := ParseMetadata(u.description); err == nil && m.GUID != "" && (len(out) != 1 || out[0][0] != m.GUID) {
+		return "", fmt.Errorf("received snapshot %s does not have the guid %s of the sent snapshot", snapshot, m.GUID)
+	}
+	err = u.target.shell.run("zfs set "+shellQuote(ReplicaDescription+"="+u.description)+" "+shellQuote(snapshot), nil, nil)
+	if err != nil {
+		return "", err
+	}
+	log.WithField("snapshot", snapshot).WithField("size", size).Info("snapshot received")
+	return u.id, nil
+}
+
+// Abort ends the stream early, so zfs receive discards it
+func (u *replicaUpload) Abort() error {
+	u.stream.CloseWithError(errors.New("upload aborted"))
+	u.wait()
+	return nil
+}
+
+// wait returns the result of zfs receive once it exited
+func (u *replicaUpload) wait() error {
+	if u.done != nil {
+		u.err = <-u.done
+		u.done = nil
+	}
+	return u.err
+}
+
+// shellQuote quotes s as a single argument for the remote shell
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
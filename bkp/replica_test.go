@@ -0,0 +1,170 @@
+package bkp
+
+import (
+	"testing"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// onCommand sets up the shell mock to run a command once, it writes output to stdout
+func onCommand(m *remoteShellMock, cmd interface{}, output string) *mock.Call {
+	return m.On("run", cmd, mock.Anything, mock.Anything).Return(func(_ string, _ io.Reader, stdout io.Writer) error {
+		if output == "" {
+			return nil
+		}
+		_, err := io.WriteString(stdout, output)
+		return err
+	}).Once()
+}
+
+// startingWith matches commands with the given prefix
+func startingWith(prefix string) interface{} {
+	return mock.MatchedBy(func(cmd string) bool {
+		return strings.HasPrefix(cmd, prefix)
+	})
+}
+
+func TestReplicaTarget(t *testing.T) {
+	m := &remoteShellMock{}
+	onCommand(m, "zfs list -H -o name 'pool/replica'", "pool/replica\n")
+	target, err := newReplicaTarget(m, "pool/replica")
+	require.NoError(t, err)
+
+	onCommand(m, "zfs list -H -p -o name,used -t filesystem -d 1 'pool/replica'",
+		"pool/replica\t5100\npool/replica/tank_test\t5000\n")
+	onCommand(m, "zfs list -H -o name -t snapshot -d 2 'pool/replica'",
+		"pool/replica@old\npool/replica/tank_test@a\npool/replica/tank_test@b\n")
+	containers, err := target.ListContainers()
+	assert.NoError(t, err)
+	assert.Equal(t, []*Container{{Name: "tank_test", Size: 5000, Archives: 2, Listable: true}}, containers)
+
+	// the stream of a batch is piped into zfs receive, the received snapshot becomes the archive id
+	data := bytes.Repeat([]byte{1, 2, 3, 4, 5}, 1024*512)
+	received := &bytes.Buffer{}
+	m.On("run", startingWith("zfs receive -u -F 'pool/replica/tank_test@"), mock.Anything, mock.Anything).
+		Return(func(_ string, stdin io.Reader, _ io.Writer) error {
+		_, err := io.Copy(received, stdin)
+		return err
+	}).Once()
+	onCommand(m, startingWith("zfs get -H -o value guid 'pool/replica/tank_test@"), "1234567890\n")
+	onCommand(m, startingWith(`zfs set 'ch.floor4:description={"v":2,`), "")
+	b := &Batch{targets: defaultTargets(target)}
+	require.NoError(t, b.upload("tank_test", &zfsBackup{zfsReader: bytes.NewBuffer(data), partSize: 1024 * 1024,
+		hasNext: true, dataset: withArchiveID(testDataset())}, "", allRequired(b)))
+	assert.Equal(t, data, received.Bytes())
+	m.AssertExpectations(t)
+
+	// the received snapshot is not the sent one
+	req := &UploadRequest{Description: `{"v":2,"i":false,"g":"1"}`, PartSize: 1024 * 1024}
+	m.On("run", startingWith("zfs receive"), mock.Anything, mock.Anything).Return(func(_ string, stdin io.Reader, _ io.Writer) error {
+		_, err := ioutil.ReadAll(stdin)
+		return err
+	}).Once()
+	onCommand(m, startingWith("zfs get -H -o value guid"), "2\n")
+	u, err := target.BeginUpload("tank_test", req)
+	require.NoError(t, err)
+	require.NoError(t, u.UploadPart(0, bytes.NewReader(data[:100]), nil))
+	_, err = u.Complete(100, nil)
+	assert.Error(t, err)
+	assert.NoError(t, u.Abort())
+
+	// zfs receive fails -> parts can't be written anymore
+	m.On("run", startingWith("zfs receive"), mock.Anything, mock.Anything).Return(errors.New("cannot receive")).Once()
+	u, err = target.BeginUpload("tank_test", req)
+	require.NoError(t, err)
+	assert.Error(t, u.UploadPart(0, bytes.NewReader(data), nil))
+	_, err = u.Complete(int64(len(data)), nil)
+	assert.EqualError(t, err, "cannot receive")
+	assert.NoError(t, u.Abort())
+
+	// aborted upload
+	m.On("run", startingWith("zfs receive"), mock.Anything, mock.Anything).Return(func(_ string, stdin io.Reader, _ io.Writer) error {
+		_, err := ioutil.ReadAll(stdin)
+		return err
+	}).Once()
+	u, err = target.BeginUpload("tank_test", req)
+	require.NoError(t, err)
+	require.NoError(t, u.UploadPart(0, bytes.NewReader(data[:100]), nil))
+	assert.NoError(t, u.Abort())
+
+	// snapshots of a replica are listed with their descriptions
+	onCommand(m, "zfs list -H -p -o name,creation,used,ch.floor4:description -t snapshot -d 1 'pool/replica/tank_test'",
+		"pool/replica/tank_test@a\t1520000000\t100\t{\"v\":2,\"i\":false,\"g\":\"1\"}\n"+
+			"pool/replica/tank_test@b\t1520000100\t50\t{\"v\":2,\"b\":\"a\",\"i\":true,\"g\":\"2\",\"fg\":\"1\"}\n"+
+			"pool/replica/tank_test@manual\t1520000200\t0\t-\n")
+	inv, err := target.ListArchives("tank_test")
+	require.NoError(t, err)
+	require.Len(t, inv.ArchiveList, 3)
+	assert.Equal(t, "b", inv.ArchiveList[1].ArchiveId)
+	assert.Equal(t, int64(50), inv.ArchiveList[1].Size)
+	assert.Equal(t, "a", inv.ArchiveList[1].Metadata.BaseArchiveID)
+	assert.Nil(t, inv.ArchiveList[2].Metadata)
+
+	// an incremental archive is sent from the snapshot of its base archive
+	dir, err := ioutil.TempDir("", "zfs2glacier")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	onCommand(m, "zfs get -H -o value ch.floor4:description 'pool/replica/tank_test@b'",
+		"{\"v\":2,\"b\":\"a\",\"i\":true,\"g\":\"2\",\"fg\":\"1\"}\n")
+	onCommand(m, "zfs send -i '@a' 'pool/replica/tank_test@b'", "stream")
+	description, err := target.Retrieve("tank_test", "b", filepath.Join(dir, "b"))
+	require.NoError(t, err)
+	assert.Equal(t, `{"v":2,"b":"a","i":true,"g":"2","fg":"1"}`, description)
+	d, err := ioutil.ReadFile(filepath.Join(dir, "b"))
+	assert.NoError(t, err)
+	assert.Equal(t, "stream", string(d))
+
+	// a raw archive is sent raw again
+	onCommand(m, "zfs get -H -o value ch.floor4:description 'pool/replica/tank_test@a'", "{\"v\":2,\"i\":false,\"g\":\"1\",\"w\":true}\n")
+	onCommand(m, "zfs send -w 'pool/replica/tank_test@a'", "raw")
+	_, err = target.Retrieve("tank_test", "a", filepath.Join(dir, "a"))
+	require.NoError(t, err)
+	m.AssertExpectations(t)
+
+	assert.Equal(t, `'it'\''s'`, shellQuote("it's"))
+}
+
+func TestSSHShell(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zfs2glacier")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	addr, keyFile, knownHosts, stop := startSSHServer(t, dir)
+	defer stop()
+
+	conn, err := dialSSH(addr, "backup", keyFile, knownHosts)
+	require.NoError(t, err)
+	out := &bytes.Buffer{}
+	assert.NoError(t, (&sshShell{client: conn}).run("cat", strings.NewReader("stream"), out))
+	assert.Equal(t, "stream", out.String())
+
+	// the error contains what the command wrote to stderr
+	_, err = NewTarget("zfs://backup@" + addr + "/pool/replica?key=" + keyFile + "&known_hosts=" + knownHosts)
+	assert.EqualError(t, err, "zfs list -H -o name 'pool/replica': zfs list -H -o name 'pool/replica': command not found: "+
+		"Process exited with status 127")
+}
+
+func TestCheckStreamOptions(t *testing.T) {
+	m := &remoteShellMock{}
+	onCommand(m, "zfs list -H -o name 'pool/replica'", "pool/replica\n")
+	replica, err := newReplicaTarget(m, "pool/replica")
+	require.NoError(t, err)
+	targets := []*uploadTarget{{NamedTarget: &NamedTarget{Target: newMemTarget()}},
+		{NamedTarget: &NamedTarget{Name: "nas", Target: replica}}}
+
+	// a replica receives the stream, zstd or age bytes would fail zfs receive
+	assert.NoError(t, checkStreamOptions("tank_test", &StreamOptions{Raw: true}, targets))
+	err = checkStreamOptions("tank_test", &StreamOptions{Compression: &Compression{Algorithm: CompressionZstd}}, targets)
+	assert.EqualError(t, err, "target nas of tank_test receives the send stream with zfs receive, it can't be compressed or encrypted")
+	e, err := newPassphraseEncryption([]byte("secret"), testArgon2Params)
+	require.NoError(t, err)
+	assert.Error(t, checkStreamOptions("tank_test", &StreamOptions{Encryption: e}, targets))
+	assert.NoError(t, checkStreamOptions("tank_test", &StreamOptions{Encryption: e}, targets[:1]))
+}
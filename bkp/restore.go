@@ -0,0 +1,357 @@
+package bkp
+
+import (
+	log "github.com/sirupsen/logrus"
+	"filippo.io/age"
+	"errors"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const restoreStateFile = "restore.json"
+const jobStateFile = "jobs.json"
+
+// A Restore rebuilds a zfs filesystem from the chain of archives stored in its aws glacier vault
+// Its progress is saved in the work directory, so an interrupted restore can be resumed.
+type Restore struct {
+	state   restoreState
+	workDir string
+	target  Target
+	// identities decrypt archives encrypted to age recipients
+	identities []age.Identity
+	// passphrase decrypts archives encrypted with a passphrase, it is requested once when it is needed
+	passphrase passphraseSource
+	// catalog has the SHA-256 of archives whose description lacks it, nil if there is no catalog
+	catalog *Catalog
+}
+
+// restoreState is the progress of a Restore saved in the work directory
+type restoreState struct {
+	VaultName string
+	Target    string
+	// From is the name of the target the archives are retrieved from, a resumed restore uses it again
+	From      string
+	ArchiveID string
+	// Chain contains the archives starting with the restored archive, followed by its base archives
+	Chain []*restoreArchive
+	// Requested is set once the retrievals of the archives the catalog knows of have been started
+	Requested bool `json:",omitempty"`
+	// AWS are the aws settings of the restored filesystem, a resumed restore connects with them again
+	AWS AWSConfig
+}
+
+// restoreArchive is an archive of the chain which is retrieved and received
+type restoreArchive struct {
+	ArchiveID   string
+	Description string `json:",omitempty"`
+	File        string
+	Downloaded  bool
+	Received    bool
+}
+
+// NewRestore creates a new restore of the archive with the given id into target
+// Archives are retrieved with the given retrieval tier and downloaded to workDir until they have been received.
+func NewRestore(t *NamedTarget, filesystem, target, archiveID, workDir, tier string) (*Restore, error) {
+	if _, err := os.Stat(filepath.Join(workDir, restoreStateFile)); err == nil {
+		return nil, errors.New("there is an unfinished restore in " + workDir + ", resume it or remove the directory")
+	}
+	var c AWSConfig
+	if _, ok := t.Target.(awsTarget); ok {
+		c = FilesystemAWSConfig(filesystem)
+	}
+	r, err := newRestore(t.Target, c, workDir, tier)
+	if err != nil {
+		return nil, err
+	}
+	r.state = restoreState{
+		VaultName: VaultName(filesystem),
+		Target:    target,
+		From:      t.Name,
+		ArchiveID: archiveID,
+		Chain:     []*restoreArchive{r.newArchive(archiveID)},
+		AWS:       c,
+	}
+	return r, nil
+}
+
+// ResumeRestore continues the restore whose progress was saved in workDir from the target it was started from
+// Retrieval jobs that have not completed yet are polled again instead of being initiated. If from is set, it has to
+// name that target.
+func ResumeRestore(targets []*NamedTarget, from, workDir, tier string) (*Restore, error) {
+	state := restoreState{}
+	if err := readJSONFile(filepath.Join(workDir, restoreStateFile), &state); err != nil {
+		return nil, err
+	}
+	if from != "" && from != state.From {
+		return nil, fmt.Errorf("the restore was started from the target %q, it can't be changed when resuming", state.From)
+	}
+	t := findTarget(targets, state.From)
+	if t == nil {
+		return nil, fmt.Errorf("the restore was started from the target %q, which is not configured", state.From)
+	}
+	r, err := newRestore(t.Target, state.AWS, workDir, tier)
+	if err != nil {
+		return nil, err
+	}
+	r.state = state
+	log.WithField("vault", r.state.VaultName).WithField("target", r.state.Target).WithField("from", t.Name).
+		Info("resuming restore")
+	return r, nil
+}
+
+// findTarget returns the target with the given name, the first one for the empty name if there is no unnamed target
+func findTarget(targets []*NamedTarget, name string) *NamedTarget {
+	for _, t := range targets {
+		if t.Name == name {
+			return t
+		}
+	}
+	if name == "" && len(targets) > 0 {
+		return targets[0]
+	}
+	return nil
+}
+
+// newRestore prepares a restore from t connected with the aws settings c of the restored filesystem
+func newRestore(t Target, c AWSConfig, workDir, tier string) (*Restore, error) {
+	t, err := withAWSConfig(t, c)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(workDir, 0700); err != nil {
+		return nil, err
+	}
+	if err = t.OpenRetrieval(filepath.Join(workDir, jobStateFile), tier); err != nil {
+		return nil, err
+	}
+	return &Restore{workDir: workDir, target: t}, nil
+}
+
+// SetIdentities sets the age identities encrypted archives are decrypted with
+func (r *Restore) SetIdentities(identities []age.Identity) {
+	r.identities = identities
+}
+
+// SetCatalog sets the catalog archives whose description has no SHA-256 are verified with
+func (r *Restore) SetCatalog(c *Catalog) {
+	r.catalog = c
+}
+
+// SetPassphrase sets the function the passphrase of passphrase encrypted archives is requested from
+// It is called at most once, e.g. to prompt for the passphrase only if an archive needs it.
+func (r *Restore) SetPassphrase(fn func() ([]byte, error)) {
+	var p []byte
+	r.passphrase = func() ([]byte, error) {
+		if p != nil {
+			return p, nil
+		}
+		var err error
+		p, err = fn()
+		return p, err
+	}
+}
+
+func (r *Restore) newArchive(archiveID string) *restoreArchive {
+	return &restoreArchive{ArchiveID: archiveID, File: filepath.Join(r.workDir, archiveID)}
+}
+
+// Run restores the archive
+// 1. retrieve the archive and all archives it is based on, down to the full backup
+// 2. receive the full backup and the incremental backups in the order they were created
+// Retrieving archives from glacier takes several hours, Run blocks until all are received. The retrievals of the
+// chain recorded in the catalog are started at once, other base archives are requested once the description of the
+// archive based on them has been downloaded.
+func (r *Restore) Run() error {
+	if err := r.save(); err != nil {
+		return err
+	}
+	if err := r.requestChain(); err != nil {
+		return err
+	}
+	var child *Metadata
+	for {
+		a := r.state.Chain[len(r.state.Chain)-1]
+		if !a.Downloaded {
+			if err := r.retrieve(a); err != nil {
+				return err
+			}
+		}
+		m, err := ParseMetadata(a.Description)
+		if err != nil {
+			return fmt.Errorf("archive %s has an invalid description: %v", a.ArchiveID, err)
+		}
+		if child != nil && child.FromGUID != "" && m.GUID != "" && child.FromGUID != m.GUID {
+			return fmt.Errorf("archive %s contains snapshot %s, but the incremental backup based on it was sent from %s",
+				a.ArchiveID, m.GUID, child.FromGUID)
+		}
+		child = m
+		if !m.IsIncremental {
+			break
+		}
+		if m.BaseArchiveID == "" {
+			return fmt.Errorf("incremental archive %s has no base archive", a.ArchiveID)
+		}
+		for _, c := range r.state.Chain {
+			if c.ArchiveID == m.BaseArchiveID {
+				return fmt.Errorf("archive %s is based on itself", m.BaseArchiveID)
+			}
+		}
+		r.state.Chain = append(r.state.Chain, r.newArchive(m.BaseArchiveID))
+		if err = r.save(); err != nil {
+			return err
+		}
+	}
+	log.WithField("vault", r.state.VaultName).WithField("archives", len(r.state.Chain)).Info("archive chain retrieved")
+
+	n := len(r.state.Chain)
+	for i := n - 1; i >= 0; i-- {
+		a := r.state.Chain[i]
+		if a.Received {
+			continue
+		}
+		snapshot := fmt.Sprintf("%s@glacier-restore-%d", r.state.Target, n-1-i)
+		if err := r.receive(a, snapshot, i != n-1); err != nil {
+			return err
+		}
+		a.Received = true
+		if err := r.save(); err != nil {
+			return err
+		}
+		if err := os.Remove(a.File); err != nil {
+			log.WithField("file", a.File).Warn(err)
+		}
+	}
+	log.WithField("vault", r.state.VaultName).WithField("target", r.state.Target).Info("restore completed")
+	return os.Remove(filepath.Join(r.workDir, restoreStateFile))
+}
+
+// requestChain starts the retrievals of the restored archive and the base archives recorded in the catalog
+func (r *Restore) requestChain() error {
+	if r.state.Requested {
+		return nil
+	}
+	ids := []string{r.state.ArchiveID}
+	if r.catalog != nil {
+		chain, err := r.catalog.Chain(r.state.ArchiveID)
+		if err != nil {
+			log.WithField("archiveID", r.state.ArchiveID).
+				Info("archive chain is not in the catalog, base archives are retrieved one after the other: ", err)
+		}
+		for _, c := range chain {
+			if c.ArchiveID != r.state.ArchiveID {
+				ids = append(ids, c.ArchiveID)
+			}
+		}
+	}
+	for _, id := range ids {
+		if a := r.archive(id); a != nil && a.Downloaded {
+			continue
+		}
+		if err := r.target.RequestArchive(r.state.VaultName, id); err != nil {
+			return err
+		}
+	}
+	log.WithField("vault", r.state.VaultName).WithField("archives", len(ids)).Info("archive retrievals requested")
+	r.state.Requested = true
+	return r.save()
+}
+
+// archive returns the archive of the chain with the given id, nil if it is not part of the chain yet
+func (r *Restore) archive(id string) *restoreArchive {
+	for _, a := range r.state.Chain {
+		if a.ArchiveID == id {
+			return a
+		}
+	}
+	return nil
+}
+
+// retrieve waits for the archive and downloads it
+// A partially downloaded archive is continued where the previous download stopped.
+func (r *Restore) retrieve(a *restoreArchive) error {
+	var err error
+	a.Description, err = r.target.Retrieve(r.state.VaultName, a.ArchiveID, a.File)
+	if err != nil {
+		return err
+	}
+	if expected := r.streamSHA256(a); expected != "" {
+		sum, err := fileSHA256(a.File)
+		if err != nil {
+			return err
+		}
+		if sum != expected {
+			return fmt.Errorf("SHA-256 of archive %s is %s, expected %s", a.ArchiveID, sum, expected)
+		}
+	}
+	a.Downloaded = true
+	return r.save()
+}
+
+// streamSHA256 returns the SHA-256 of an archive from its description or the catalog, empty if neither has it
+func (r *Restore) streamSHA256(a *restoreArchive) string {
+	if m, err := ParseMetadata(a.Description); err == nil && m.StreamSHA256 != "" {
+		return m.StreamSHA256
+	}
+	if r.catalog == nil {
+		return ""
+	}
+	c, err := r.catalog.Get(a.ArchiveID)
+	if err != nil || c == nil {
+		return ""
+	}
+	return c.StreamSHA256
+}
+
+// receive pipes a downloaded archive into zfs receive, it is decrypted and decompressed on the way
+func (r *Restore) receive(a *restoreArchive, snapshot string, incremental bool) error {
+	m, err := ParseMetadata(a.Description)
+	if err != nil {
+		return fmt.Errorf("archive %s has an invalid description: %v", a.ArchiveID, err)
+	}
+	f, err := os.Open(a.File)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	in, err := decrypt(f, m.Encryption, r.identities, r.passphrase)
+	if err != nil {
+		return fmt.Errorf("archive %s: %v", a.ArchiveID, err)
+	}
+	if m.Compression != "" {
+		d, err := decompress(in, m.Compression)
+		if err != nil {
+			return fmt.Errorf("archive %s: %v", a.ArchiveID, err)
+		}
+		defer d.Close()
+		in = d
+	}
+	if features := m.ReceiverFeatures(); len(features) > 0 {
+		log.WithField("archiveID", a.ArchiveID).WithField("features", features).
+			Info("the stream needs a pool with these features enabled")
+	}
+	log.WithField("archiveID", a.ArchiveID).WithField("snapshot", snapshot).WithField("raw", m.Raw).
+		WithField("sendFlags", m.SendFlags).Info("receiving archive")
+	return defaultAPI.receive(snapshot, incremental, m.Raw, in)
+}
+
+// fileSHA256 returns the hex encoded SHA-256 of a file
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (r *Restore) save() error {
+	return writeJSONFile(filepath.Join(r.workDir, restoreStateFile), &r.state)
+}
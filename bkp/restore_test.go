@@ -0,0 +1,285 @@
+package bkp
+
+import (
+	"testing"
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"errors"
+	"path/filepath"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/aws/aws-sdk-go/service/glacier"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/timaebi/go-zfs/zfsiface"
+)
+
+// onArchiveRetrieval sets up a completed retrieval job for the given archive
+func onArchiveRetrieval(api *GlacierAPI, archiveID, jobID, description string, data []byte) {
+	api.On("InitiateJob", mock.MatchedBy(func(i *glacier.InitiateJobInput) bool {
+		return *i.JobParameters.ArchiveId == archiveID
+	})).Return(&glacier.InitiateJobOutput{JobId: aws.String(jobID)}, nil).Once()
+	api.On("DescribeJob", mock.MatchedBy(func(i *glacier.DescribeJobInput) bool {
+		return *i.JobId == jobID
+	})).Return(&glacier.JobDescription{
+		Completed:             aws.Bool(true),
+		StatusCode:            aws.String(glacier.StatusCodeSucceeded),
+		ArchiveSizeInBytes:    aws.Int64(int64(len(data))),
+		ArchiveSHA256TreeHash: aws.String(treeHash(data)),
+	}, nil).Once()
+	api.On("GetJobOutput", mock.MatchedBy(func(i *glacier.GetJobOutputInput) bool {
+		return *i.JobId == jobID
+	})).Return(&glacier.GetJobOutputOutput{
+		ArchiveDescription: aws.String(description),
+		Body:               ioutil.NopCloser(bytes.NewReader(data)),
+		Checksum:           aws.String(treeHash(data)),
+	}, nil).Once()
+}
+
+// treeHash returns the hex encoded aws glacier tree hash of data
+func treeHash(data []byte) string {
+	return hex.EncodeToString(glacier.ComputeHashes(bytes.NewReader(data)).TreeHash)
+}
+
+// testRestore creates a Restore of archiveID into tank/restored that uses the given glacier mock
+func testRestore(t *testing.T, api *GlacierAPI, dir, archiveID string) *Restore {
+	rt, err := NewRetrieval(api, filepath.Join(dir, jobStateFile), TierStandard)
+	require.NoError(t, err)
+	r := &Restore{workDir: dir, target: &glacierTarget{glacier: api, retrieval: rt}}
+	r.state = restoreState{
+		VaultName: "tank_test",
+		Target:    "tank/restored",
+		ArchiveID: archiveID,
+		Chain:     []*restoreArchive{r.newArchive(archiveID)},
+	}
+	return r
+}
+
+// resetDir removes everything from the work directory of a previous restore
+func resetDir(t *testing.T, dir string) {
+	require.NoError(t, os.RemoveAll(dir))
+	require.NoError(t, os.Mkdir(dir, 0700))
+}
+
+func TestRestore_Run(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zfs2glacier")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// incremental archive based on a full archive -> full archive is received first
+	api := &GlacierAPI{}
+	onArchiveRetrieval(api, "archive-2", "job-2", `{"BaseArchiveID":"archive-1","IsIncremental":true}`, []byte{4, 5})
+	onArchiveRetrieval(api, "archive-1", "job-1", `{"IsIncremental":false}`, []byte{1, 2, 3})
+	received := make([][]byte, 0)
+	readAll := func(args mock.Arguments) {
+		d, err := ioutil.ReadAll(args.Get(3).(*os.File))
+		require.NoError(t, err)
+		received = append(received, d)
+	}
+	m := &zfsAPIMock{}
+	m.On("receive", "tank/restored@glacier-restore-0", false, false, mock.Anything).Return(nil).Run(readAll).Once()
+	m.On("receive", "tank/restored@glacier-restore-1", true, false, mock.Anything).Return(nil).Run(readAll).Once()
+	defaultAPI = m
+	err = testRestore(t, api, dir, "archive-2").Run()
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{{1, 2, 3}, {4, 5}}, received)
+	mock.AssertExpectationsForObjects(t, api, m)
+	_, err = os.Stat(filepath.Join(dir, restoreStateFile))
+	assert.True(t, os.IsNotExist(err))
+
+	// incremental archive without base archive id
+	api = &GlacierAPI{}
+	onArchiveRetrieval(api, "archive-2", "job-2", `{"IsIncremental":true}`, []byte{4, 5})
+	err = testRestore(t, api, dir, "archive-2").Run()
+	assert.Error(t, err)
+	resetDir(t, dir)
+
+	// base archive contains a different snapshot than the incremental archive was sent from
+	api = &GlacierAPI{}
+	onArchiveRetrieval(api, "archive-2", "job-2", `{"v":2,"b":"archive-1","i":true,"g":"2","fg":"1"}`, []byte{4, 5})
+	onArchiveRetrieval(api, "archive-1", "job-1", `{"v":2,"i":false,"g":"3"}`, []byte{1, 2, 3})
+	err = testRestore(t, api, dir, "archive-2").Run()
+	assert.EqualError(t, err, "archive archive-1 contains snapshot 3, but the incremental backup based on it was sent from 1")
+	resetDir(t, dir)
+
+	// stream checksum of the description does not match
+	api = &GlacierAPI{}
+	onArchiveRetrieval(api, "archive-1", "job-1", `{"v":2,"i":false,"sha":"00"}`, []byte{1, 2, 3})
+	err = testRestore(t, api, dir, "archive-1").Run()
+	assert.Error(t, err)
+	resetDir(t, dir)
+
+	// the catalog has the stream checksum of archives whose description lacks it
+	catalogDir, err := ioutil.TempDir("", "zfs2glacier")
+	require.NoError(t, err)
+	defer os.RemoveAll(catalogDir)
+	c, err := OpenCatalog(filepath.Join(catalogDir, "catalog.db"))
+	require.NoError(t, err)
+	defer c.Close()
+	require.NoError(t, c.Put(&CatalogRecord{ArchiveID: "archive-1", VaultName: "tank_test", StreamSHA256: "00"}))
+	api = &GlacierAPI{}
+	onArchiveRetrieval(api, "archive-1", "job-1", `{"v":2,"i":false}`, []byte{1, 2, 3})
+	r := testRestore(t, api, dir, "archive-1")
+	r.SetCatalog(c)
+	err = r.Run()
+	assert.EqualError(t, err, "SHA-256 of archive archive-1 is "+
+		"039058c6f2c0cb492c533b0a4d14ef77cc0f78abccced5287d84a1a2011cfb81, expected 00")
+	resetDir(t, dir)
+
+	// failed retrieval job
+	api = &GlacierAPI{}
+	api.On("InitiateJob", mock.AnythingOfType("*glacier.InitiateJobInput")).
+		Return(&glacier.InitiateJobOutput{JobId: aws.String("job-1")}, nil)
+	api.On("DescribeJob", mock.AnythingOfType("*glacier.DescribeJobInput")).
+		Return(&glacier.JobDescription{
+		Completed:     aws.Bool(true),
+		StatusCode:    aws.String(glacier.StatusCodeFailed),
+		StatusMessage: aws.String("Simulated error"),
+	}, nil)
+	err = testRestore(t, api, dir, "archive-1").Run()
+	assert.Error(t, err)
+	resetDir(t, dir)
+
+	// zfs receive fails -> progress is kept for a resume
+	api = &GlacierAPI{}
+	onArchiveRetrieval(api, "archive-1", "job-1", `{"IsIncremental":false}`, []byte{1, 2, 3})
+	m = &zfsAPIMock{}
+	m.On("receive", "tank/restored@glacier-restore-0", false, false, mock.Anything).Return(errors.New("Simulated error"))
+	defaultAPI = m
+	err = testRestore(t, api, dir, "archive-1").Run()
+	assert.Error(t, err)
+	state := restoreState{}
+	require.NoError(t, readJSONFile(filepath.Join(dir, restoreStateFile), &state))
+	require.Len(t, state.Chain, 1)
+	assert.True(t, state.Chain[0].Downloaded)
+	assert.False(t, state.Chain[0].Received)
+}
+
+func TestRestore_Resume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zfs2glacier")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// the incremental archive was downloaded before the process exited, the job for its base is in progress
+	state := restoreState{
+		VaultName: "tank_test",
+		Target:    "tank/restored",
+		ArchiveID: "archive-2",
+		Chain: []*restoreArchive{
+			{ArchiveID: "archive-2", Description: `{"BaseArchiveID":"archive-1","IsIncremental":true}`,
+				File: filepath.Join(dir, "archive-2"), Downloaded: true},
+			{ArchiveID: "archive-1", File: filepath.Join(dir, "archive-1")},
+		},
+	}
+	require.NoError(t, writeJSONFile(filepath.Join(dir, restoreStateFile), &state))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "archive-2"), []byte{4, 5}, 0600))
+	jobs := []*RetrievalJob{{JobID: "job-1", VaultName: "tank_test", ArchiveID: "archive-1", Type: archiveRetrieval,
+		StatusCode: glacier.StatusCodeInProgress}}
+	require.NoError(t, writeJSONFile(filepath.Join(dir, jobStateFile), jobs))
+
+	api := &GlacierAPI{}
+	api.On("DescribeJob", mock.MatchedBy(func(i *glacier.DescribeJobInput) bool {
+		return *i.JobId == "job-1"
+	})).Return(&glacier.JobDescription{
+		Completed:             aws.Bool(true),
+		StatusCode:            aws.String(glacier.StatusCodeSucceeded),
+		ArchiveSizeInBytes:    aws.Int64(3),
+		ArchiveSHA256TreeHash: aws.String(treeHash([]byte{1, 2, 3})),
+	}, nil).Once()
+	api.On("GetJobOutput", mock.AnythingOfType("*glacier.GetJobOutputInput")).Return(&glacier.GetJobOutputOutput{
+		ArchiveDescription: aws.String(`{"IsIncremental":false}`),
+		Body:               ioutil.NopCloser(bytes.NewReader([]byte{1, 2, 3})),
+	}, nil).Once()
+	m := &zfsAPIMock{}
+	m.On("receive", "tank/restored@glacier-restore-0", false, false, mock.Anything).Return(nil).Once()
+	m.On("receive", "tank/restored@glacier-restore-1", true, false, mock.Anything).Return(nil).Once()
+	defaultAPI = m
+
+	rt, err := NewRetrieval(api, filepath.Join(dir, jobStateFile), TierBulk)
+	require.NoError(t, err)
+	r := &Restore{workDir: dir, target: &glacierTarget{glacier: api, retrieval: rt}}
+	require.NoError(t, readJSONFile(filepath.Join(dir, restoreStateFile), &r.state))
+	err = r.Run()
+	assert.NoError(t, err)
+	mock.AssertExpectationsForObjects(t, api, m)
+}
+
+func TestRestore_RunRequestsChain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zfs2glacier")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c, err := OpenCatalog(filepath.Join(dir, "catalog.db"))
+	require.NoError(t, err)
+	defer c.Close()
+	work := filepath.Join(dir, "work")
+	require.NoError(t, os.Mkdir(work, 0700))
+
+	// the chain recorded in the catalog is requested before the first archive is downloaded
+	require.NoError(t, c.Put(&CatalogRecord{ArchiveID: "archive-1", VaultName: "tank_test"}))
+	require.NoError(t, c.Put(&CatalogRecord{ArchiveID: "archive-2", VaultName: "tank_test", IsIncremental: true,
+		BaseArchiveID: "archive-1"}))
+	require.NoError(t, c.Put(&CatalogRecord{ArchiveID: "archive-3", VaultName: "tank_test", IsIncremental: true,
+		BaseArchiveID: "archive-2"}))
+	api := &GlacierAPI{}
+	onArchiveRetrieval(api, "archive-3", "job-3", `{"v":2,"b":"archive-2","i":true}`, []byte{6})
+	onArchiveRetrieval(api, "archive-2", "job-2", `{"v":2,"b":"archive-1","i":true}`, []byte{4, 5})
+	onArchiveRetrieval(api, "archive-1", "job-1", `{"v":2,"i":false}`, []byte{1, 2, 3})
+	m := &zfsAPIMock{}
+	m.On("receive", mock.Anything, mock.Anything, false, mock.Anything).Return(nil).Times(3)
+	defaultAPI = m
+	r := testRestore(t, api, work, "archive-3")
+	r.SetCatalog(c)
+	require.NoError(t, r.Run())
+	mock.AssertExpectationsForObjects(t, api, m)
+	methods := make([]string, 0)
+	for _, call := range api.Calls {
+		if call.Method == "InitiateJob" || call.Method == "GetJobOutput" {
+			methods = append(methods, call.Method)
+		}
+	}
+	assert.Equal(t, []string{"InitiateJob", "InitiateJob", "InitiateJob", "GetJobOutput", "GetJobOutput",
+		"GetJobOutput"}, methods)
+}
+
+func TestNewRestore_awsConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zfs2glacier")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	target := &accountMemTarget{memTarget: newMemTarget("tank_test"), accounts: make(map[AWSConfig]*memTarget)}
+
+	// a filesystem that does not exist gets the aws settings of its closest parent
+	parent := &Dataset{}
+	parent.On("GetNativeProperties").Return(&zfsiface.NativeProperties{Name: "tank"})
+	parent.On("GetProperty", AWSProfile).Return("offsite", zfsiface.Local, nil)
+	parent.On("GetProperty", AWSRegion).Return("-", zfsiface.None, nil)
+	parent.On("GetProperty", AWSRole).Return("-", zfsiface.None, nil)
+	parent.On("GetProperty", AWSEndpoint).Return("-", zfsiface.None, nil)
+	m := &zfsAPIMock{}
+	m.On("filesystems", "tank/test").Return(nil, errors.New("dataset does not exist")).Once()
+	m.On("filesystems", "tank").Return([]zfsiface.Dataset{parent}, nil).Once()
+	defaultAPI = m
+	named := []*NamedTarget{{Target: newMemTarget()}, {Name: "offsite", Target: target}}
+	r, err := NewRestore(named[1], "tank/test", "tank/test", "archive-1", dir, TierStandard)
+	require.NoError(t, err)
+	account := target.accounts[AWSConfig{Profile: "offsite"}]
+	require.NotNil(t, account)
+	assert.Equal(t, Target(account), r.target)
+	m.AssertExpectations(t)
+
+	// a resumed restore connects to the same target with the saved settings
+	require.NoError(t, r.save())
+	r, err = ResumeRestore(named, "", dir, TierStandard)
+	require.NoError(t, err)
+	assert.Equal(t, Target(account), r.target)
+	assert.Len(t, target.accounts, 1)
+	_, err = ResumeRestore(named, "offsite", dir, TierStandard)
+	assert.NoError(t, err)
+
+	// the target can't be changed or removed
+	_, err = ResumeRestore(named, "nas", dir, TierStandard)
+	assert.EqualError(t, err, `the restore was started from the target "offsite", it can't be changed when resuming`)
+	_, err = ResumeRestore(named[:1], "", dir, TierStandard)
+	assert.EqualError(t, err, `the restore was started from the target "offsite", which is not configured`)
+}
@@ -0,0 +1,220 @@
+package bkp
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+	"time"
+)
+
+// An UploadState records a running upload of a backup, so that a later run can resume it if the process died
+type UploadState struct {
+	VaultName string
+	// SnapshotGUID identifies the glacier-tmp snapshot the stream is sent from
+	SnapshotGUID string
+	PartSize     int
+	// Uploads are the ids of the multipart uploads by target name
+	Uploads map[string]string
+	// PartHashes are the hex tree hashes of the parts every target completed so far, in order
+	// A resumed upload continues after the parts it confirms of them.
+	PartHashes    []string
+	UploadStarted time.Time
+}
+
+// A resumableTarget continues multipart uploads that were started by another process
+type resumableTarget interface {
+	// resumeUpload continues the upload with the given id and returns the tree hashes of the parts the target has
+	// The hashes are in order from the start of the archive. An upload started with another description or part
+	// size is an error.
+	resumeUpload(container, uploadID string, req *UploadRequest) (Upload, [][]byte, error)
+	// discardUpload aborts the upload with the given id
+	discardUpload(container, uploadID string) error
+}
+
+// A resumableUpload is an Upload its target can continue with resumeUpload
+type resumableUpload interface {
+	Upload
+	// id identifies the upload on its target
+	id() string
+}
+
+// PutUpload adds or replaces the state of the running upload into a vault
+func (c *Catalog) PutUpload(s *UploadState) error {
+	d, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return c.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(uploadsBucket).Put([]byte(s.VaultName), d)
+	})
+}
+
+// GetUpload returns the state of the upload into a vault, nil is returned if no upload is running
+func (c *Catalog) GetUpload(vault string) (*UploadState, error) {
+	var s *UploadState
+	err := c.db.View(func(tx *bolt.Tx) error {
+		d := tx.Bucket(uploadsBucket).Get([]byte(vault))
+		if d == nil {
+			return nil
+		}
+		s = &UploadState{}
+		return json.Unmarshal(d, s)
+	})
+	return s, err
+}
+
+// DeleteUpload removes the state of the upload into a vault once it completed or was aborted
+func (c *Catalog) DeleteUpload(vault string) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(uploadsBucket).Delete([]byte(vault))
+	})
+}
+
+// resume continues the uploads an earlier run left behind for the same stream and returns the state recorded for it
+// It also returns the tree hashes of the parts every resumed upload confirmed, these uploads continue after them.
+// Targets whose upload can't be resumed start from the beginning, their recorded uploads are aborted. If no upload
+// can be resumed, nil is returned.
+func (b *Batch) resume(vault string, bkp Backup, uploads []*fanOut) (*UploadState, [][]byte) {
+	if b.catalog == nil {
+		return nil, nil
+	}
+	s, err := b.catalog.GetUpload(vault)
+	if err != nil {
+		log.WithField("vault", vault).Warn("could not read the state of an interrupted upload: ", err)
+		return nil, nil
+	}
+	if s == nil {
+		return nil, nil
+	}
+	guid, _, err := bkp.GetDataset().GetProperty("guid")
+	resumable := err == nil && bkp.IsResumable() && s.SnapshotGUID == guid && s.PartSize == bkp.GetPartSize()
+	parts := make([][]byte, 0, len(s.PartHashes))
+	for _, p := range s.PartHashes {
+		h, err := hex.DecodeString(p)
+		if err != nil {
+			resumable = false
+			break
+		}
+		parts = append(parts, h)
+	}
+	resumed := make(map[string]string)
+	for _, f := range uploads {
+		id, ok := s.Uploads[f.Name]
+		rt, isResumable := f.Target.(resumableTarget)
+		if !resumable || !ok || !isResumable || f.err != nil {
+			continue
+		}
+		description, err := bkp.GetDescription(f.Name)
+		if err != nil {
+			f.err = err
+			continue
+		}
+		u, confirmed, err := rt.resumeUpload(vault, id, &UploadRequest{Description: description,
+			PartSize: bkp.GetPartSize()})
+		if err != nil {
+			log.WithField("target", f.Name).WithField("vault", vault).
+				Warn("could not resume upload, it starts from the beginning: ", err)
+			continue
+		}
+		f.upload = u
+		resumed[f.Name] = id
+		n := 0
+		for n < len(parts) && n < len(confirmed) && bytes.Equal(parts[n], confirmed[n]) {
+			n++
+		}
+		parts = parts[:n]
+	}
+	b.discard(vault, s, uploads)
+	if len(resumed) == 0 {
+		log.WithField("vault", vault).Info("interrupted upload can't be resumed, starting from the beginning")
+		b.forget(vault)
+		return nil, nil
+	}
+	for _, f := range uploads {
+		if f.upload != nil {
+			f.resumed = len(parts)
+		}
+	}
+	s.Uploads = resumed
+	s.PartHashes = s.PartHashes[:len(parts)]
+	log.WithField("vault", vault).WithField("parts", len(parts)).WithField("started", s.UploadStarted).
+		Info("resuming interrupted upload")
+	return s, parts
+}
+
+// discard aborts the recorded uploads of an interrupted upload that were not resumed, so they are not left behind
+func (b *Batch) discard(vault string, s *UploadState, uploads []*fanOut) {
+	for name, id := range s.Uploads {
+		var f *fanOut
+		for _, u := range uploads {
+			if u.Name == name {
+				f = u
+			}
+		}
+		if f == nil {
+			log.WithField("target", name).WithField("vault", vault).WithField("uploadID", id).
+				Warn("interrupted upload to a target that is no longer configured can't be aborted")
+			continue
+		}
+		rt, ok := f.Target.(resumableTarget)
+		if !ok || f.upload != nil {
+			continue
+		}
+		if err := rt.discardUpload(vault, id); err != nil {
+			log.WithField("target", name).WithField("vault", vault).Warn("could not abort interrupted upload: ", err)
+		}
+	}
+}
+
+// track records the resumable uploads of a backup, so a later run can continue them, nil is returned if there are none
+// The uploads to targets that can't resume theirs start from the beginning in the later run. s is the state of the
+// resumed uploads, nil if none were resumed.
+func (b *Batch) track(vault string, bkp Backup, uploads []*fanOut, s *UploadState, started time.Time) *UploadState {
+	if b.catalog == nil || !bkp.IsResumable() {
+		return nil
+	}
+	if s == nil {
+		guid, _, err := bkp.GetDataset().GetProperty("guid")
+		if err != nil {
+			return nil
+		}
+		s = &UploadState{VaultName: vault, SnapshotGUID: guid, PartSize: bkp.GetPartSize(),
+			Uploads: make(map[string]string), PartHashes: make([]string, 0), UploadStarted: started}
+	}
+	for _, f := range uploads {
+		if u, ok := f.upload.(resumableUpload); ok && f.err == nil {
+			s.Uploads[f.Name] = u.id()
+		}
+	}
+	if len(s.Uploads) == 0 {
+		return nil
+	}
+	if err := b.catalog.PutUpload(s); err != nil {
+		log.WithField("vault", vault).Warn("could not record the upload, it can't be resumed: ", err)
+		return nil
+	}
+	return s
+}
+
+// recordPart adds a part every target completed to the state of a tracked upload
+func (b *Batch) recordPart(s *UploadState, h []byte) {
+	if s == nil {
+		return
+	}
+	s.PartHashes = append(s.PartHashes, hex.EncodeToString(h))
+	if err := b.catalog.PutUpload(s); err != nil {
+		log.WithField("vault", s.VaultName).Warn("could not record the uploaded part: ", err)
+	}
+}
+
+// forget removes the state of the upload into a vault once its uploads completed or were aborted
+func (b *Batch) forget(vault string) {
+	if b.catalog == nil {
+		return
+	}
+	if err := b.catalog.DeleteUpload(vault); err != nil {
+		log.WithField("vault", vault).Warn("could not remove the state of the upload: ", err)
+	}
+}
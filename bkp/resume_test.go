@@ -0,0 +1,253 @@
+package bkp
+
+import (
+	"testing"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/glacier"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// resumableMemTarget is a memTarget whose uploads outlive the process that started them
+type resumableMemTarget struct {
+	*memTarget
+	uploads map[string]*memUpload
+}
+
+// resumableMemUpload is a memUpload that can be continued with its id
+type resumableMemUpload struct {
+	*memUpload
+	uploadID string
+}
+
+func (u *resumableMemUpload) id() string {
+	return u.uploadID
+}
+
+func newResumableMemTarget(containers ...string) *resumableMemTarget {
+	return &resumableMemTarget{memTarget: newMemTarget(containers...), uploads: make(map[string]*memUpload)}
+}
+
+func (t *resumableMemTarget) BeginUpload(container string, req *UploadRequest) (Upload, error) {
+	u, err := t.memTarget.BeginUpload(container, req)
+	if err != nil {
+		return nil, err
+	}
+	id := fmt.Sprintf("upload-%d", len(t.uploads)+1)
+	t.uploads[id] = u.(*memUpload)
+	return &resumableMemUpload{memUpload: u.(*memUpload), uploadID: id}, nil
+}
+
+func (t *resumableMemTarget) resumeUpload(container, uploadID string, req *UploadRequest) (Upload, [][]byte, error) {
+	u, ok := t.uploads[uploadID]
+	if !ok || u.description != req.Description {
+		return nil, nil, errors.New("unknown upload " + uploadID)
+	}
+	parts := make([][]byte, 0)
+	for o := 0; o < len(u.data); o += req.PartSize {
+		end := o + req.PartSize
+		if end > len(u.data) {
+			end = len(u.data)
+		}
+		parts = append(parts, glacier.ComputeHashes(bytes.NewReader(u.data[o:end])).TreeHash)
+	}
+	return &resumableMemUpload{memUpload: u, uploadID: uploadID}, parts, nil
+}
+
+func (t *resumableMemTarget) discardUpload(container, uploadID string) error {
+	delete(t.uploads, uploadID)
+	t.aborted++
+	return nil
+}
+
+// interruptedUpload starts an upload of the first parts of data and records it like a run that died
+func interruptedUpload(t *testing.T, c *Catalog, target *resumableMemTarget, data []byte, parts int) {
+	d := testDataset()
+	description, err := (&zfsBackup{dataset: d, partSize: 1024 * 1024}).GetDescription("")
+	require.NoError(t, err)
+	req := &UploadRequest{Description: description, PartSize: 1024 * 1024}
+	u, err := target.BeginUpload("tank_test", req)
+	require.NoError(t, err)
+	s := &UploadState{VaultName: "tank_test", SnapshotGUID: "1234567890", PartSize: req.PartSize,
+		Uploads: map[string]string{"": u.(resumableUpload).id()}, PartHashes: make([]string, 0),
+		UploadStarted: time.Date(2018, 3, 1, 1, 0, 0, 0, time.UTC)}
+	for i := 0; i < parts; i++ {
+		p := data[i*req.PartSize : (i+1)*req.PartSize]
+		h := glacier.ComputeHashes(bytes.NewReader(p)).TreeHash
+		require.NoError(t, u.UploadPart(int64(i*req.PartSize), bytes.NewReader(p), h))
+		s.PartHashes = append(s.PartHashes, fmt.Sprintf("%x", h))
+	}
+	require.NoError(t, c.PutUpload(s))
+}
+
+func TestBatch_uploadResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zfs2glacier")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c, err := OpenCatalog(filepath.Join(dir, "catalog.db"))
+	require.NoError(t, err)
+	defer c.Close()
+	data := bytes.Repeat([]byte{1, 2, 3, 4, 5}, 1024*512)
+	newBackup := func(d *Dataset, data []byte) *zfsBackup {
+		return &zfsBackup{zfsReader: bytes.NewBuffer(data), partSize: 1024 * 1024, hasNext: true, dataset: d}
+	}
+	target := newResumableMemTarget("tank_test")
+	b := &Batch{targets: defaultTargets(target), catalog: c}
+
+	// the upload continues after the parts the target has, the parts are only read from the stream
+	interruptedUpload(t, c, target, data, 2)
+	d := testDataset()
+	d.On("SetProperty", glacierArchiveID, "archive-1").Return(nil).Once()
+	d.On("Rename", "tank/test@glacier-full", false, false).Return(&Dataset{}, nil).Once()
+	require.NoError(t, b.upload("tank_test", newBackup(d, data), "", allRequired(b)))
+	mock.AssertExpectationsForObjects(t, d)
+	require.Len(t, target.containers["tank_test"], 1)
+	assert.Equal(t, data, target.containers["tank_test"][0].data)
+	assert.Equal(t, 0, target.aborted)
+	s, err := c.GetUpload("tank_test")
+	require.NoError(t, err)
+	assert.Nil(t, s)
+	r, err := c.Get("archive-1")
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2018, 3, 1, 1, 0, 0, 0, time.UTC), r.UploadStarted.UTC())
+
+	// an interrupted upload of another stream is aborted and the backup starts from the beginning
+	interruptedUpload(t, c, target, bytes.Repeat([]byte{9}, len(data)), 2)
+	d = testDataset()
+	err = b.upload("tank_test", newBackup(d, data), "", allRequired(b))
+	assert.EqualError(t, err, "part 0 of the stream differs from the interrupted upload")
+	d.AssertNotCalled(t, "SetProperty", mock.Anything, mock.Anything)
+	s, err = c.GetUpload("tank_test")
+	require.NoError(t, err)
+	assert.Nil(t, s)
+
+	interruptedUpload(t, c, target, data, 1)
+	s, err = c.GetUpload("tank_test")
+	require.NoError(t, err)
+	s.SnapshotGUID = "1234567000"
+	require.NoError(t, c.PutUpload(s))
+	aborted := target.aborted
+	d = testDataset()
+	d.On("SetProperty", glacierArchiveID, "archive-2").Return(nil).Once()
+	d.On("Rename", "tank/test@glacier-full", false, false).Return(&Dataset{}, nil).Once()
+	require.NoError(t, b.upload("tank_test", newBackup(d, data), "", allRequired(b)))
+	assert.Equal(t, aborted+1, target.aborted)
+	assert.Equal(t, data, target.containers["tank_test"][1].data)
+
+	// encrypted streams are not resumed
+	e, err := newPassphraseEncryption([]byte("secret"), testArgon2Params)
+	require.NoError(t, err)
+	bkp := newBackup(testDataset(), data)
+	bkp.options = &StreamOptions{Encryption: e}
+	assert.False(t, bkp.IsResumable())
+	assert.Nil(t, b.track("tank_test", bkp, nil, nil, time.Now()))
+}
+
+func TestBatch_uploadResumeMixed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zfs2glacier")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c, err := OpenCatalog(filepath.Join(dir, "catalog.db"))
+	require.NoError(t, err)
+	defer c.Close()
+	data := bytes.Repeat([]byte{1, 2, 3, 4, 5}, 1024*512)
+	glacierTarget, nas := newResumableMemTarget("tank_test"), newMemTarget("tank_test")
+	nas.nextID = 10
+	b := &Batch{targets: []*NamedTarget{{Target: glacierTarget}, {Name: "nas", Target: nas}}, catalog: c}
+
+	// only the upload that can be resumed is recorded
+	bkp := &zfsBackup{zfsReader: bytes.NewBuffer(data), partSize: 1024 * 1024, hasNext: true, dataset: testDataset()}
+	uploads := make([]*fanOut, 0)
+	for _, u := range allRequired(b) {
+		f := &fanOut{uploadTarget: u}
+		description, err := bkp.GetDescription(u.Name)
+		require.NoError(t, err)
+		f.upload, err = u.BeginUpload("tank_test", &UploadRequest{Description: description, PartSize: 1024 * 1024})
+		require.NoError(t, err)
+		uploads = append(uploads, f)
+	}
+	s := b.track("tank_test", bkp, uploads, nil, time.Now())
+	require.NotNil(t, s)
+	assert.Equal(t, map[string]string{"": "upload-1"}, s.Uploads)
+	b.forget("tank_test")
+
+	// the glacier upload continues after its parts, the nas gets the whole stream
+	interruptedUpload(t, c, glacierTarget, data, 2)
+	d := testDataset()
+	d.On("SetProperty", glacierArchiveID, "archive-1").Return(nil).Once()
+	d.On("SetProperty", glacierArchiveID+":nas", "archive-11").Return(nil).Once()
+	d.On("Rename", "tank/test@glacier-full", false, false).Return(&Dataset{}, nil).Once()
+	bkp = &zfsBackup{zfsReader: bytes.NewBuffer(data), partSize: 1024 * 1024, hasNext: true, dataset: d}
+	require.NoError(t, b.upload("tank_test", bkp, "", allRequired(b)))
+	mock.AssertExpectationsForObjects(t, d)
+	assert.Equal(t, data, glacierTarget.containers["tank_test"][0].data)
+	assert.Equal(t, data, nas.containers["tank_test"][0].data)
+	assert.Equal(t, 0, glacierTarget.aborted)
+	s, err = c.GetUpload("tank_test")
+	require.NoError(t, err)
+	assert.Nil(t, s)
+
+	// a recorded upload that can't be resumed is aborted and the backup starts from the beginning
+	interruptedUpload(t, c, glacierTarget, data, 1)
+	s, err = c.GetUpload("tank_test")
+	require.NoError(t, err)
+	s.Uploads[""] = "upload-0"
+	s.Uploads["gone"] = "upload-9"
+	require.NoError(t, c.PutUpload(s))
+	d = testDataset()
+	d.On("SetProperty", glacierArchiveID, "archive-2").Return(nil).Once()
+	d.On("SetProperty", glacierArchiveID+":nas", "archive-12").Return(nil).Once()
+	d.On("Rename", "tank/test@glacier-full", false, false).Return(&Dataset{}, nil).Once()
+	bkp = &zfsBackup{zfsReader: bytes.NewBuffer(data), partSize: 1024 * 1024, hasNext: true, dataset: d}
+	require.NoError(t, b.upload("tank_test", bkp, "", allRequired(b)))
+	mock.AssertExpectationsForObjects(t, d)
+	assert.Equal(t, 1, glacierTarget.aborted)
+	assert.Equal(t, data, glacierTarget.containers["tank_test"][1].data)
+	assert.Equal(t, data, nas.containers["tank_test"][1].data)
+}
+
+func TestGlacierTarget_resumeUpload(t *testing.T) {
+	parts := func(o *glacier.ListPartsOutput) func(mock.Arguments) {
+		return func(args mock.Arguments) {
+			args.Get(1).(func(*glacier.ListPartsOutput, bool) bool)(o, true)
+		}
+	}
+	h := []byte{1, 2, 3, 4}
+	api := &GlacierAPI{}
+	api.On("ListPartsPages", mock.MatchedBy(func(i *glacier.ListPartsInput) bool {
+		return *i.UploadId == "upload-1" && *i.VaultName == "tank_test"
+	}), mock.Anything).Return(nil).Run(parts(&glacier.ListPartsOutput{
+		ArchiveDescription: aws.String(`{"v":2}`),
+		PartSizeInBytes:    aws.Int64(1024 * 1024),
+		Parts: []*glacier.PartListElement{
+			{RangeInBytes: aws.String("1048576-2097151"), SHA256TreeHash: aws.String("05060708")},
+			{RangeInBytes: aws.String("0-1048575"), SHA256TreeHash: aws.String("01020304")},
+			{RangeInBytes: aws.String("3145728-4194303"), SHA256TreeHash: aws.String("0a0b0c0d")},
+		},
+	})).Twice()
+	target := &glacierTarget{glacier: api}
+
+	// only the parts from the start of the archive on are confirmed
+	u, confirmed, err := target.resumeUpload("tank_test", "upload-1", &UploadRequest{Description: `{"v":2}`,
+		PartSize: 1024 * 1024})
+	require.NoError(t, err)
+	assert.Equal(t, [][]byte{h, {5, 6, 7, 8}}, confirmed)
+	assert.Equal(t, "upload-1", u.(resumableUpload).id())
+	_, _, err = target.resumeUpload("tank_test", "upload-1", &UploadRequest{Description: `{"v":2}`,
+		PartSize: 2 * 1024 * 1024})
+	assert.Error(t, err)
+
+	api.On("AbortMultipartUpload", mock.MatchedBy(func(i *glacier.AbortMultipartUploadInput) bool {
+		return *i.UploadId == "upload-1" && *i.VaultName == "tank_test"
+	})).Return(&glacier.AbortMultipartUploadOutput{}, nil).Once()
+	assert.NoError(t, target.discardUpload("tank_test", "upload-1"))
+	api.AssertExpectations(t)
+}
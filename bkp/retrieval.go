@@ -0,0 +1,275 @@
+package bkp
+
+import (
+	"github.com/aws/aws-sdk-go/service/glacier"
+	"github.com/aws/aws-sdk-go/service/glacier/glacieriface"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	log "github.com/sirupsen/logrus"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Retrieval tiers supported by aws glacier
+// Expedited retrievals complete within minutes, Standard within hours and Bulk within half a day.
+const (
+	TierExpedited = "Expedited"
+	TierStandard  = "Standard"
+	TierBulk      = "Bulk"
+)
+
+// Job types of aws glacier retrieval jobs
+const (
+	archiveRetrieval   = "archive-retrieval"
+	inventoryRetrieval = "inventory-retrieval"
+)
+
+// A RetrievalJob is an aws glacier job tracked in the retrieval state file
+type RetrievalJob struct {
+	JobID      string
+	VaultName  string
+	ArchiveID  string `json:",omitempty"`
+	Type       string
+	Tier       string `json:",omitempty"`
+	StatusCode string
+	Completed  bool
+	Initiated  time.Time
+	// ArchiveSize and TreeHash describe the retrieved archive once aws glacier reports them
+	ArchiveSize int64  `json:",omitempty"`
+	TreeHash    string `json:",omitempty"`
+}
+
+// A Retrieval starts aws glacier retrieval jobs and saves them to a local state file
+// A later Retrieval with the same state file picks the jobs up again, so a retrieval survives the process exiting.
+type Retrieval struct {
+	glacier      glacieriface.GlacierAPI
+	stateFile    string
+	tier         string
+	pollInterval time.Duration
+	jobs         []*RetrievalJob
+}
+
+// NewRetrieval creates a Retrieval which starts jobs with the given tier
+// Jobs saved in stateFile by a previous run are loaded.
+func NewRetrieval(g glacieriface.GlacierAPI, stateFile, tier string) (*Retrieval, error) {
+	if tier != TierExpedited && tier != TierStandard && tier != TierBulk {
+		return nil, errors.New("unknown retrieval tier " + tier)
+	}
+	if err := os.MkdirAll(filepath.Dir(stateFile), 0700); err != nil {
+		return nil, err
+	}
+	r := &Retrieval{
+		glacier:      g,
+		stateFile:    stateFile,
+		tier:         tier,
+		pollInterval: 15 * time.Minute,
+		jobs:         make([]*RetrievalJob, 0),
+	}
+	if err := readJSONFile(stateFile, &r.jobs); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return r, nil
+}
+
+// RetrieveArchive returns the job retrieving the given archive
+// A job is only initiated if there is no tracked job for the archive which can still be used.
+func (r *Retrieval) RetrieveArchive(vault, archiveID string) (*RetrievalJob, error) {
+	j, err := r.find(vault, archiveRetrieval, archiveID)
+	if err != nil || j != nil {
+		return j, err
+	}
+	return r.initiate(vault, &glacier.JobParameters{
+		Type:      aws.String(archiveRetrieval),
+		ArchiveId: &archiveID,
+		Tier:      &r.tier,
+	})
+}
+
+// RetrieveInventory returns the job retrieving the JSON inventory of the given vault
+// A job is only initiated if there is no tracked job for the vault which can still be used.
+func (r *Retrieval) RetrieveInventory(vault string) (*RetrievalJob, error) {
+	j, err := r.find(vault, inventoryRetrieval, "")
+	if err != nil || j != nil {
+		return j, err
+	}
+	return r.initiate(vault, &glacier.JobParameters{
+		Type:   aws.String(inventoryRetrieval),
+		Format: aws.String("JSON"),
+	})
+}
+
+// find returns the tracked job if it can still be used
+func (r *Retrieval) find(vault, jobType, archiveID string) (*RetrievalJob, error) {
+	for _, j := range r.jobs {
+		if j.Type == jobType && j.VaultName == vault && j.ArchiveID == archiveID {
+			ok, err := r.update(j)
+			if err != nil || !ok {
+				return nil, err
+			}
+			return j, nil
+		}
+	}
+	return nil, nil
+}
+
+// initiate starts a new job and adds it to the state file
+func (r *Retrieval) initiate(vault string, p *glacier.JobParameters) (*RetrievalJob, error) {
+	o, err := r.glacier.InitiateJob(&glacier.InitiateJobInput{
+		AccountId:     aws.String("-"),
+		VaultName:     &vault,
+		JobParameters: p,
+	})
+	if err != nil {
+		return nil, err
+	}
+	j := &RetrievalJob{
+		JobID:      *o.JobId,
+		VaultName:  vault,
+		ArchiveID:  aws.StringValue(p.ArchiveId),
+		Type:       *p.Type,
+		Tier:       aws.StringValue(p.Tier),
+		StatusCode: glacier.StatusCodeInProgress,
+		Initiated:  time.Now(),
+	}
+	r.remove(j.VaultName, j.Type, j.ArchiveID)
+	r.jobs = append(r.jobs, j)
+	log.WithField("vault", vault).WithField("jobID", j.JobID).WithField("type", j.Type).
+		WithField("tier", j.Tier).Info("retrieval job initiated")
+	return j, r.save()
+}
+
+// update refreshes the status of a tracked job with DescribeJob
+// It returns false if the job is unknown to aws glacier or has failed and needs to be initiated again.
+func (r *Retrieval) update(j *RetrievalJob) (bool, error) {
+	d, err := r.glacier.DescribeJob(&glacier.DescribeJobInput{
+		AccountId: aws.String("-"),
+		JobId:     &j.JobID,
+		VaultName: &j.VaultName,
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == glacier.ErrCodeResourceNotFoundException {
+		log.WithField("vault", j.VaultName).WithField("jobID", j.JobID).Info("retrieval job has expired")
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	r.apply(j, d)
+	if err = r.save(); err != nil {
+		return false, err
+	}
+	return j.StatusCode != glacier.StatusCodeFailed, nil
+}
+
+// apply copies the status of a job description to a tracked job
+func (r *Retrieval) apply(j *RetrievalJob, d *glacier.JobDescription) {
+	j.Completed = aws.BoolValue(d.Completed)
+	j.StatusCode = aws.StringValue(d.StatusCode)
+	if d.ArchiveSizeInBytes != nil {
+		j.ArchiveSize = *d.ArchiveSizeInBytes
+	}
+	if d.ArchiveSHA256TreeHash != nil {
+		j.TreeHash = *d.ArchiveSHA256TreeHash
+	}
+}
+
+// Refresh updates all tracked jobs of a vault with a single ListJobs listing
+// Tracked jobs which are no longer listed have expired and are dropped from the state file.
+func (r *Retrieval) Refresh(vault string) error {
+	listed := make(map[string]*glacier.JobDescription)
+	err := r.glacier.ListJobsPages(&glacier.ListJobsInput{
+		AccountId: aws.String("-"),
+		VaultName: &vault,
+	}, func(o *glacier.ListJobsOutput, lastPage bool) bool {
+		for _, d := range o.JobList {
+			listed[aws.StringValue(d.JobId)] = d
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	jobs := make([]*RetrievalJob, 0, len(r.jobs))
+	for _, j := range r.jobs {
+		if j.VaultName != vault {
+			jobs = append(jobs, j)
+			continue
+		}
+		d, ok := listed[j.JobID]
+		if !ok {
+			log.WithField("vault", vault).WithField("jobID", j.JobID).Info("retrieval job has expired")
+			continue
+		}
+		r.apply(j, d)
+		jobs = append(jobs, j)
+	}
+	r.jobs = jobs
+	return r.save()
+}
+
+// Wait polls the job until it has completed
+func (r *Retrieval) Wait(j *RetrievalJob) error {
+	for !j.Completed {
+		ok, err := r.update(j)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errors.New("retrieval job " + j.JobID + " has expired")
+		}
+		if j.Completed {
+			break
+		}
+		log.WithField("vault", j.VaultName).WithField("jobID", j.JobID).Debug("waiting for retrieval job")
+		time.Sleep(r.pollInterval)
+	}
+	if j.StatusCode != glacier.StatusCodeSucceeded {
+		return errors.New("retrieval job " + j.JobID + " failed")
+	}
+	return nil
+}
+
+// Done removes a job whose output is no longer needed from the state file
+func (r *Retrieval) Done(j *RetrievalJob) error {
+	r.remove(j.VaultName, j.Type, j.ArchiveID)
+	return r.save()
+}
+
+func (r *Retrieval) remove(vault, jobType, archiveID string) {
+	jobs := make([]*RetrievalJob, 0, len(r.jobs))
+	for _, j := range r.jobs {
+		if j.VaultName != vault || j.Type != jobType || j.ArchiveID != archiveID {
+			jobs = append(jobs, j)
+		}
+	}
+	r.jobs = jobs
+}
+
+func (r *Retrieval) save() error {
+	return writeJSONFile(r.stateFile, r.jobs)
+}
+
+// readJSONFile decodes the JSON file into v
+func readJSONFile(name string, v interface{}) error {
+	d, err := ioutil.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(d, v)
+}
+
+// writeJSONFile replaces the file with the JSON encoding of v
+// The file is written to a temporary file first, so a crash never leaves a partially written file behind.
+func writeJSONFile(name string, v interface{}) error {
+	d, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := name + ".tmp"
+	if err = ioutil.WriteFile(tmp, d, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
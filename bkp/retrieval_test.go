@@ -0,0 +1,113 @@
+package bkp
+
+import (
+	"testing"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/aws/aws-sdk-go/service/glacier"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+func TestNewRetrieval(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zfs2glacier")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	_, err = NewRetrieval(&GlacierAPI{}, filepath.Join(dir, jobStateFile), "Fast")
+	assert.Error(t, err)
+
+	r, err := NewRetrieval(&GlacierAPI{}, filepath.Join(dir, jobStateFile), TierExpedited)
+	assert.NoError(t, err)
+	assert.Empty(t, r.jobs)
+}
+
+func TestRetrieval_RetrieveArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zfs2glacier")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	stateFile := filepath.Join(dir, jobStateFile)
+
+	// no tracked job -> job is initiated with the selected tier and saved
+	api := &GlacierAPI{}
+	api.On("InitiateJob", mock.MatchedBy(func(i *glacier.InitiateJobInput) bool {
+		return *i.JobParameters.ArchiveId == "archive-1" && *i.JobParameters.Tier == TierBulk &&
+			*i.JobParameters.Type == "archive-retrieval"
+	})).Return(&glacier.InitiateJobOutput{JobId: aws.String("job-1")}, nil).Once()
+	r, err := NewRetrieval(api, stateFile, TierBulk)
+	require.NoError(t, err)
+	j, err := r.RetrieveArchive("tank_test", "archive-1")
+	assert.NoError(t, err)
+	assert.Equal(t, "job-1", j.JobID)
+	api.AssertExpectations(t)
+
+	// job is tracked in the state file -> job is picked up by a new Retrieval
+	api = &GlacierAPI{}
+	api.On("DescribeJob", mock.AnythingOfType("*glacier.DescribeJobInput")).Return(&glacier.JobDescription{
+		Completed:  aws.Bool(false),
+		StatusCode: aws.String(glacier.StatusCodeInProgress),
+	}, nil).Once()
+	r, err = NewRetrieval(api, stateFile, TierBulk)
+	require.NoError(t, err)
+	j, err = r.RetrieveArchive("tank_test", "archive-1")
+	assert.NoError(t, err)
+	assert.Equal(t, "job-1", j.JobID)
+	api.AssertExpectations(t)
+
+	// tracked job has expired -> job is initiated again
+	api = &GlacierAPI{}
+	api.On("DescribeJob", mock.AnythingOfType("*glacier.DescribeJobInput")).
+		Return(nil, awserr.New(glacier.ErrCodeResourceNotFoundException, "Simulated error", nil)).Once()
+	api.On("InitiateJob", mock.AnythingOfType("*glacier.InitiateJobInput")).
+		Return(&glacier.InitiateJobOutput{JobId: aws.String("job-2")}, nil).Once()
+	r, err = NewRetrieval(api, stateFile, TierBulk)
+	require.NoError(t, err)
+	j, err = r.RetrieveArchive("tank_test", "archive-1")
+	assert.NoError(t, err)
+	assert.Equal(t, "job-2", j.JobID)
+	assert.Len(t, r.jobs, 1)
+	api.AssertExpectations(t)
+
+	// job is done -> removed from the state file
+	assert.NoError(t, r.Done(j))
+	r, err = NewRetrieval(api, stateFile, TierBulk)
+	require.NoError(t, err)
+	assert.Empty(t, r.jobs)
+}
+
+func TestRetrieval_Refresh(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zfs2glacier")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	stateFile := filepath.Join(dir, jobStateFile)
+
+	jobs := []*RetrievalJob{
+		{JobID: "job-1", VaultName: "tank_test", ArchiveID: "archive-1", Type: archiveRetrieval},
+		{JobID: "job-2", VaultName: "tank_test", ArchiveID: "archive-2", Type: archiveRetrieval},
+		{JobID: "job-3", VaultName: "tank_other", ArchiveID: "archive-3", Type: archiveRetrieval},
+	}
+	require.NoError(t, writeJSONFile(stateFile, jobs))
+	api := &GlacierAPI{}
+	api.On("ListJobsPages", mock.AnythingOfType("*glacier.ListJobsInput"), mock.Anything).
+		Return(nil).Run(func(args mock.Arguments) {
+		fn := args.Get(1).(func(*glacier.ListJobsOutput, bool) bool)
+		fn(&glacier.ListJobsOutput{JobList: []*glacier.JobDescription{
+			{JobId: aws.String("job-1"), Completed: aws.Bool(true), StatusCode: aws.String(glacier.StatusCodeSucceeded)},
+		}}, true)
+	})
+	r, err := NewRetrieval(api, stateFile, TierStandard)
+	require.NoError(t, err)
+	err = r.Refresh("tank_test")
+	assert.NoError(t, err)
+
+	// job-1 completed, job-2 expired, job-3 belongs to another vault
+	require.Len(t, r.jobs, 2)
+	assert.Equal(t, "job-1", r.jobs[0].JobID)
+	assert.True(t, r.jobs[0].Completed)
+	assert.Equal(t, "job-3", r.jobs[1].JobID)
+	assert.NoError(t, r.Wait(r.jobs[0]))
+}
@@ -0,0 +1,440 @@
+package bkp
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	log "github.com/sirupsen/logrus"
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// s3DescriptionKey is the object metadata key the archive description is stored in
+const s3DescriptionKey = "Zfs2glacier-Description"
+
+// s3RestoreDays is the number of days a restored copy of an archived object is kept
+const s3RestoreDays = 7
+
+// s3MinPartSize and s3MaxPartSize are the part sizes of multipart uploads s3 accepts
+const (
+	s3MinPartSize int64 = 5 * 1024 * 1024
+	s3MaxPartSize int64 = 5 * 1024 * 1024 * 1024
+)
+
+// s3StorageClasses are the storage classes that can be set with the StorageClass zfs attribute
+var s3StorageClasses = []string{
+	s3.StorageClassStandard,
+	s3.StorageClassStandardIa,
+	s3.StorageClassOnezoneIa,
+	s3.StorageClassIntelligentTiering,
+	s3.StorageClassGlacierIr,
+	s3.StorageClassGlacier,
+	s3.StorageClassDeepArchive,
+}
+
+// s3Target stores archives as objects in an aws s3 bucket
+// Every filesystem has its own prefix below the target prefix, the vault name is used as container name.
+type s3Target struct {
+	s3           s3iface.S3API
+	bucket       string
+	prefix       string
+	tier         string
+	pollInterval time.Duration
+	aws          AWSConfig
+	// catalog holds the descriptions of known archives, ListArchives only requests the others from s3
+	catalog *Catalog
+}
+
+// NewS3Target creates a Target storing archives in the given bucket below prefix
+// If an endpoint is set, requests are sent there with path style addressing instead of to aws.
+func NewS3Target(bucket, prefix string, c AWSConfig) (Target, error) {
+	if bucket == "" {
+		return nil, errors.New("s3 target needs a bucket")
+	}
+	s, err := newAWSSession(c)
+	if err != nil {
+		return nil, err
+	}
+	cfg := c.endpointConfig()
+	if c.Endpoint != "" {
+		cfg.S3ForcePathStyle = aws.Bool(true)
+	}
+	t := newS3Target(s3.New(s, cfg), bucket, prefix)
+	t.aws = c
+	return t, nil
+}
+
+func newS3Target(api s3iface.S3API, bucket, prefix string) *s3Target {
+	return &s3Target{s3: api, bucket: bucket, prefix: strings.Trim(prefix, "/"), tier: TierStandard, pollInterval: 15 * time.Minute}
+}
+
+// withAWSConfig connects to the bucket with the settings of a filesystem, e.g. in another account
+func (t *s3Target) withAWSConfig(c AWSConfig) (Target, error) {
+	target, err := NewS3Target(t.bucket, t.prefix, t.aws.merge(c))
+	if err != nil {
+		return nil, err
+	}
+	target.(*s3Target).catalog = t.catalog
+	return target, nil
+}
+
+func (t *s3Target) setCatalog(c *Catalog) {
+	t.catalog = c
+}
+
+// containerPrefix returns the key prefix of all objects of a container
+func (t *s3Target) containerPrefix(container string) string {
+	if t.prefix == "" {
+		return container + "/"
+	}
+	return t.prefix + "/" + container + "/"
+}
+
+func (t *s3Target) key(container, archiveID string) string {
+	return t.containerPrefix(container) + archiveID
+}
+
+// ListContainers lists the prefixes below the target prefix
+// The size and number of archives are not counted, that would need a list of every object in the bucket.
+func (t *s3Target) ListContainers() ([]*Container, error) {
+	p := ""
+	if t.prefix != "" {
+		p = t.prefix + "/"
+	}
+	containers := make([]*Container, 0)
+	in := &s3.ListObjectsV2Input{Bucket: &t.bucket, Prefix: aws.String(p), Delimiter: aws.String("/")}
+	err := t.s3.ListObjectsV2Pages(in, func(o *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, cp := range o.CommonPrefixes {
+			name := strings.TrimSuffix(strings.TrimPrefix(aws.StringValue(cp.Prefix), p), "/")
+			containers = append(containers, &Container{Name: name, Listable: true})
+		}
+		return true
+	})
+	return containers, err
+}
+
+func (t *s3Target) CreateContainer(name string) error {
+	_, err := t.s3.PutObject(&s3.PutObjectInput{
+		Bucket: &t.bucket,
+		Key:    aws.String(t.containerPrefix(name)),
+		Body:   bytes.NewReader([]byte{}),
+	})
+	return err
+}
+
+func (t *s3Target) BeginUpload(container string, req *UploadRequest) (Upload, error) {
+	class := req.StorageClass
+	if class == "" {
+		class = s3.StorageClassDeepArchive
+	}
+	if !isS3StorageClass(class) {
+		return nil, errors.New("unknown s3 storage class " + class)
+	}
+	id, err := newObjectName()
+	if err != nil {
+		return nil, err
+	}
+	key := t.key(container, id)
+	o, err := t.s3.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+		Bucket:       &t.bucket,
+		Key:          &key,
+		StorageClass: &class,
+		Metadata:     aws.StringMap(map[string]string{s3DescriptionKey: req.Description}),
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.WithField("key", key).WithField("storageClass", class).Debug("multipart upload initiated")
+	return &s3Upload{
+		s3:       t.s3,
+		bucket:   t.bucket,
+		key:      key,
+		id:       id,
+		uploadID: aws.StringValue(o.UploadId),
+		partSize: int64(req.PartSize),
+	}, nil
+}
+
+// OpenRetrieval sets the tier in which archived objects are restored
+// aws s3 tracks the restore requests itself, so no state file is needed.
+func (t *s3Target) OpenRetrieval(stateFile, tier string) error {
+	if tier != TierExpedited && tier != TierStandard && tier != TierBulk {
+		return errors.New("unknown retrieval tier " + tier)
+	}
+	t.tier = tier
+	return nil
+}
+
+func (t *s3Target) RequestArchives(container string) error {
+	return nil
+}
+
+// ListArchives lists the objects of a container
+// The descriptions are taken from the catalog if the target has one, only unknown archives need a HEAD request.
+func (t *s3Target) ListArchives(container string) (*Inventory, error) {
+	inv := &Inventory{InventoryDate: time.Now(), ArchiveList: make([]*InventoryArchive, 0)}
+	p := t.containerPrefix(container)
+	err := t.s3.ListObjectsV2Pages(&s3.ListObjectsV2Input{Bucket: &t.bucket, Prefix: &p},
+		func(o *s3.ListObjectsV2Output, lastPage bool) bool {
+			for _, obj := range o.Contents {
+				if k := aws.StringValue(obj.Key); k != p {
+					inv.ArchiveList = append(inv.ArchiveList, &InventoryArchive{
+						ArchiveId:    strings.TrimPrefix(k, p),
+						CreationDate: aws.TimeValue(obj.LastModified),
+						Size:         aws.Int64Value(obj.Size),
+					})
+				}
+			}
+			return true
+		})
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range inv.ArchiveList {
+		if a.ArchiveDescription, err = t.description(container, a.ArchiveId); err != nil {
+			return nil, err
+		}
+		if m, err := ParseMetadata(a.ArchiveDescription); err == nil {
+			a.Metadata = m
+		}
+	}
+	return inv, nil
+}
+
+// description returns the description of an archive recorded in the catalog, or else the one of the object metadata
+func (t *s3Target) description(container, archiveID string) (string, error) {
+	if t.catalog != nil {
+		r, err := t.catalog.Get(archiveID)
+		if err != nil {
+			return "", err
+		}
+		if r != nil && r.Description != "" {
+			return r.Description, nil
+		}
+	}
+	h, err := t.s3.HeadObject(&s3.HeadObjectInput{Bucket: &t.bucket, Key: aws.String(t.key(container, archiveID))})
+	if err != nil {
+		return "", err
+	}
+	return s3Description(h.Metadata), nil
+}
+
+// RequestArchive restores an object of the GLACIER or DEEP_ARCHIVE storage class
+func (t *s3Target) RequestArchive(container, archiveID string) error {
+	_, err := t.request(t.key(container, archiveID))
+	return err
+}
+
+// request starts restoring an archived object and returns its current state
+func (t *s3Target) request(key string) (*s3.HeadObjectOutput, error) {
+	h, err := t.s3.HeadObject(&s3.HeadObjectInput{Bucket: &t.bucket, Key: &key})
+	if err != nil {
+		return nil, err
+	}
+	if !isArchived(h) || h.Restore != nil {
+		return h, nil
+	}
+	_, err = t.s3.RestoreObject(&s3.RestoreObjectInput{
+		Bucket: &t.bucket,
+		Key:    &key,
+		RestoreRequest: &s3.RestoreRequest{
+			Days:                 aws.Int64(s3RestoreDays),
+			GlacierJobParameters: &s3.GlacierJobParameters{Tier: &t.tier},
+		},
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "RestoreAlreadyInProgress" {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	log.WithField("key", key).WithField("tier", t.tier).Info("object restore requested")
+	return h, nil
+}
+
+func (t *s3Target) Retrieve(container, archiveID, file string) (string, error) {
+	key := t.key(container, archiveID)
+	h, err := t.request(key)
+	if err != nil {
+		return "", err
+	}
+	for isArchived(h) && !isRestored(h) {
+		log.WithField("key", key).WithField("next poll", t.pollInterval).Info("waiting for object restore")
+		time.Sleep(t.pollInterval)
+		h, err = t.s3.HeadObject(&s3.HeadObjectInput{Bucket: &t.bucket, Key: &key})
+		if err != nil {
+			return "", err
+		}
+	}
+
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	size := aws.Int64Value(h.ContentLength)
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return "", err
+	}
+	if offset > size {
+		if err = f.Truncate(0); err != nil {
+			return "", err
+		}
+		if offset, err = f.Seek(0, io.SeekStart); err != nil {
+			return "", err
+		}
+	}
+	if offset < size {
+		if offset > 0 {
+			log.WithField("key", key).WithField("offset", offset).Info("continuing download")
+		}
+		o, err := t.s3.GetObject(&s3.GetObjectInput{
+			Bucket: &t.bucket,
+			Key:    &key,
+			Range:  aws.String(fmt.Sprintf("bytes=%d-", offset)),
+		})
+		if err != nil {
+			return "", err
+		}
+		defer o.Body.Close()
+		if _, err = io.Copy(f, o.Body); err != nil {
+			return "", err
+		}
+		if err = f.Sync(); err != nil {
+			return "", err
+		}
+	}
+	if offset, err = f.Seek(0, io.SeekEnd); err != nil {
+		return "", err
+	}
+	if offset != size {
+		return "", fmt.Errorf("downloaded %d bytes of object %s, expected %d", offset, key, size)
+	}
+	log.WithField("key", key).WithField("size", size).Info("archive downloaded")
+	return s3Description(h.Metadata), nil
+}
+
+// s3Upload is a multipart upload of an object
+type s3Upload struct {
+	s3       s3iface.S3API
+	bucket   string
+	key      string
+	id       string
+	uploadID string
+	partSize int64
+	// mu guards parts, they are uploaded concurrently
+	mu    sync.Mutex
+	parts []*s3.CompletedPart
+}
+
+func (u *s3Upload) concurrent() {}
+
+func (u *s3Upload) UploadPart(offset int64, p io.ReadSeeker, h []byte) error {
+	sum := md5.New()
+	if _, err := io.Copy(sum, p); err != nil {
+		return err
+	}
+	if _, err := p.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	n := offset/u.partSize + 1
+	log.WithField("key", u.key).WithField("part", n).Debug("multipart uploading part")
+	o, err := u.s3.UploadPart(&s3.UploadPartInput{
+		Bucket:     &u.bucket,
+		Key:        &u.key,
+		UploadId:   &u.uploadID,
+		PartNumber: aws.Int64(n),
+		Body:       p,
+		ContentMD5: aws.String(base64.StdEncoding.EncodeToString(sum.Sum(nil))),
+	})
+	if err != nil {
+		return err
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.parts = append(u.parts, &s3.CompletedPart{ETag: o.ETag, PartNumber: aws.Int64(n)})
+	return nil
+}
+
+// Complete lists the parts in ascending order as s3 requires, they may have finished in any order
+func (u *s3Upload) Complete(size int64, h []byte) (string, error) {
+	sort.Slice(u.parts, func(i, j int) bool {
+		return aws.Int64Value(u.parts[i].PartNumber) < aws.Int64Value(u.parts[j].PartNumber)
+	})
+	_, err := u.s3.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:          &u.bucket,
+		Key:             &u.key,
+		UploadId:        &u.uploadID,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: u.parts},
+	})
+	if err != nil {
+		return "", err
+	}
+	o, err := u.s3.HeadObject(&s3.HeadObjectInput{Bucket: &u.bucket, Key: &u.key})
+	if err != nil {
+		return "", err
+	}
+	if aws.Int64Value(o.ContentLength) != size {
+		return "", fmt.Errorf("object %s has %d bytes, uploaded %d", u.key, aws.Int64Value(o.ContentLength), size)
+	}
+	return u.id, nil
+}
+
+func (u *s3Upload) Abort() error {
+	_, err := u.s3.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+		Bucket:   &u.bucket,
+		Key:      &u.key,
+		UploadId: &u.uploadID,
+	})
+	return err
+}
+
+// s3Description returns the archive description from the object metadata
+// Servers differ in the case of the returned metadata keys.
+func s3Description(m map[string]*string) string {
+	for k, v := range m {
+		if strings.EqualFold(k, s3DescriptionKey) {
+			return aws.StringValue(v)
+		}
+	}
+	return ""
+}
+
+func (t *s3Target) hasStorageClass(class string) bool {
+	return isS3StorageClass(class)
+}
+
+func (t *s3Target) partSizeLimits() (int64, int64) {
+	return s3MinPartSize, s3MaxPartSize
+}
+
+func isS3StorageClass(class string) bool {
+	for _, c := range s3StorageClasses {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
+
+// isArchived returns true if the object needs to be restored before it can be read
+func isArchived(h *s3.HeadObjectOutput) bool {
+	c := aws.StringValue(h.StorageClass)
+	return c == s3.StorageClassGlacier || c == s3.StorageClassDeepArchive
+}
+
+// isRestored returns true if a restored copy of an archived object is available
+func isRestored(h *s3.HeadObjectOutput) bool {
+	return strings.Contains(aws.StringValue(h.Restore), `ongoing-request="false"`)
+}
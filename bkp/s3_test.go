@@ -0,0 +1,280 @@
+package bkp
+
+import (
+	"testing"
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/timaebi/go-zfs/zfsiface"
+)
+
+// fakeObject is an object stored by fakeS3
+type fakeObject struct {
+	data     []byte
+	metadata map[string]*string
+	class    string
+	restore  *string
+}
+
+// fakeS3 implements the parts of the s3 api used by s3Target in memory
+type fakeS3 struct {
+	s3iface.S3API
+	objects map[string]*fakeObject
+	uploads map[string]map[int64][]byte
+	classes map[string]string
+	// restoreDelay is the number of HeadObject calls before a requested restore completes
+	restoreDelay int
+	heads        int
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{
+		objects: make(map[string]*fakeObject),
+		uploads: make(map[string]map[int64][]byte),
+		classes: make(map[string]string),
+	}
+}
+
+func (f *fakeS3) PutObject(i *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	d, err := ioutil.ReadAll(i.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.objects[*i.Key] = &fakeObject{data: d, metadata: i.Metadata, class: aws.StringValue(i.StorageClass)}
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (f *fakeS3) CreateMultipartUpload(i *s3.CreateMultipartUploadInput) (*s3.CreateMultipartUploadOutput, error) {
+	id := fmt.Sprintf("upload-%d", len(f.uploads)+1)
+	f.uploads[id] = make(map[int64][]byte)
+	f.classes[id] = aws.StringValue(i.StorageClass)
+	f.objects[*i.Key+"#"+id] = &fakeObject{metadata: i.Metadata, class: aws.StringValue(i.StorageClass)}
+	return &s3.CreateMultipartUploadOutput{UploadId: aws.String(id)}, nil
+}
+
+func (f *fakeS3) UploadPart(i *s3.UploadPartInput) (*s3.UploadPartOutput, error) {
+	parts, ok := f.uploads[*i.UploadId]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchUpload, "no such upload", nil)
+	}
+	d, err := ioutil.ReadAll(i.Body)
+	if err != nil {
+		return nil, err
+	}
+	sum := md5.Sum(d)
+	if base64.StdEncoding.EncodeToString(sum[:]) != aws.StringValue(i.ContentMD5) {
+		return nil, awserr.New("BadDigest", "md5 mismatch", nil)
+	}
+	parts[*i.PartNumber] = d
+	return &s3.UploadPartOutput{ETag: aws.String(fmt.Sprintf("%x", sum))}, nil
+}
+
+func (f *fakeS3) CompleteMultipartUpload(i *s3.CompleteMultipartUploadInput) (*s3.CompleteMultipartUploadOutput, error) {
+	parts, ok := f.uploads[*i.UploadId]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchUpload, "no such upload", nil)
+	}
+	o := f.objects[*i.Key+"#"+*i.UploadId]
+	for n, p := range i.MultipartUpload.Parts {
+		if *p.PartNumber != int64(n+1) {
+			return nil, errors.New("parts are not in order")
+		}
+		o.data = append(o.data, parts[*p.PartNumber]...)
+	}
+	delete(f.objects, *i.Key+"#"+*i.UploadId)
+	delete(f.uploads, *i.UploadId)
+	f.objects[*i.Key] = o
+	return &s3.CompleteMultipartUploadOutput{}, nil
+}
+
+func (f *fakeS3) AbortMultipartUpload(i *s3.AbortMultipartUploadInput) (*s3.AbortMultipartUploadOutput, error) {
+	delete(f.objects, *i.Key+"#"+*i.UploadId)
+	delete(f.uploads, *i.UploadId)
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+func (f *fakeS3) ListObjectsV2Pages(i *s3.ListObjectsV2Input, fn func(*s3.ListObjectsV2Output, bool) bool) error {
+	keys := make([]string, 0)
+	for k := range f.objects {
+		if strings.HasPrefix(k, aws.StringValue(i.Prefix)) && !strings.Contains(k, "#") {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	o := &s3.ListObjectsV2Output{}
+	prefixes := make(map[string]bool)
+	for _, k := range keys {
+		rest := strings.TrimPrefix(k, aws.StringValue(i.Prefix))
+		if d := aws.StringValue(i.Delimiter); d != "" && strings.Contains(rest, d) {
+			p := aws.StringValue(i.Prefix) + rest[:strings.Index(rest, d)+len(d)]
+			if !prefixes[p] {
+				prefixes[p] = true
+				o.CommonPrefixes = append(o.CommonPrefixes, &s3.CommonPrefix{Prefix: aws.String(p)})
+			}
+			continue
+		}
+		o.Contents = append(o.Contents, &s3.Object{Key: aws.String(k), Size: aws.Int64(int64(len(f.objects[k].data))),
+			LastModified: aws.Time(time.Date(2018, 3, 1, 10, 0, 0, 0, time.UTC))})
+	}
+	fn(o, true)
+	return nil
+}
+
+func (f *fakeS3) HeadObject(i *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	f.heads++
+	o, ok := f.objects[*i.Key]
+	if !ok {
+		return nil, awserr.New("NotFound", "not found", nil)
+	}
+	if o.restore != nil && *o.restore == `ongoing-request="true"` {
+		if f.restoreDelay == 0 {
+			o.restore = aws.String(`ongoing-request="false", expiry-date="Fri, 23 Mar 2018 00:00:00 GMT"`)
+		} else {
+			f.restoreDelay--
+		}
+	}
+	return &s3.HeadObjectOutput{
+		ContentLength: aws.Int64(int64(len(o.data))),
+		Metadata:      o.metadata,
+		StorageClass:  aws.String(o.class),
+		Restore:       o.restore,
+		LastModified:  aws.Time(time.Date(2018, 3, 1, 10, 0, 0, 0, time.UTC)),
+	}, nil
+}
+
+func (f *fakeS3) RestoreObject(i *s3.RestoreObjectInput) (*s3.RestoreObjectOutput, error) {
+	o, ok := f.objects[*i.Key]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "no such key", nil)
+	}
+	if o.restore != nil {
+		return nil, awserr.New("RestoreAlreadyInProgress", "restore in progress", nil)
+	}
+	o.restore = aws.String(`ongoing-request="true"`)
+	return &s3.RestoreObjectOutput{}, nil
+}
+
+func (f *fakeS3) GetObject(i *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	o, ok := f.objects[*i.Key]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "no such key", nil)
+	}
+	if (o.class == s3.StorageClassGlacier || o.class == s3.StorageClassDeepArchive) && !isRestored(&s3.HeadObjectOutput{Restore: o.restore}) {
+		return nil, awserr.New("InvalidObjectState", "object is archived", nil)
+	}
+	var start int
+	if _, err := fmt.Sscanf(aws.StringValue(i.Range), "bytes=%d-", &start); err != nil {
+		return nil, err
+	}
+	return &s3.GetObjectOutput{Body: ioutil.NopCloser(bytes.NewReader(o.data[start:]))}, nil
+}
+
+func TestS3Target(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zfs2glacier")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	api := newFakeS3()
+	target := newS3Target(api, "backup", "/zfs/")
+	target.pollInterval = time.Millisecond
+	require.NoError(t, target.CreateContainer("tank_test"))
+	containers, err := target.ListContainers()
+	assert.NoError(t, err)
+	assert.Equal(t, []*Container{{Name: "tank_test", Listable: true}}, containers)
+	c, err := OpenCatalog(filepath.Join(dir, "catalog.db"))
+	require.NoError(t, err)
+	defer c.Close()
+
+	// upload of 3 parts with the storage class of the dataset
+	data := bytes.Repeat([]byte{1, 2, 3, 4, 5}, 1024*512)
+	bkp := &zfsBackup{zfsReader: bytes.NewBuffer(data), partSize: 1024 * 1024, hasNext: true, dataset: testDataset()}
+	bkp.dataset.(*Dataset).On("SetProperty", glacierArchiveID, mock.AnythingOfType("string")).Return(nil).Once()
+	bkp.dataset.(*Dataset).On("Rename", "tank/test@glacier-full", false, false).Return(&Dataset{}, nil).Once()
+	b := &Batch{targets: defaultTargets(target)}
+	b.SetCatalog(c)
+	require.NoError(t, b.upload("tank_test", bkp, s3.StorageClassDeepArchive, allRequired(b)))
+	// containers are the prefixes, the archives in them are not counted
+	containers, err = target.ListContainers()
+	assert.NoError(t, err)
+	assert.Equal(t, []*Container{{Name: "tank_test", Listable: true}}, containers)
+
+	// the description of an archive in the catalog needs no HEAD request
+	api.heads = 0
+	inv, err := target.ListArchives("tank_test")
+	assert.NoError(t, err)
+	require.Len(t, inv.ArchiveList, 1)
+	a := inv.ArchiveList[0]
+	require.NotNil(t, a.Metadata)
+	assert.Equal(t, "1234567890", a.Metadata.GUID)
+	assert.Equal(t, int64(len(data)), a.Size)
+	assert.Equal(t, 0, api.heads)
+
+	// without catalog it is read from the object metadata
+	target.setCatalog(nil)
+	inv, err = target.ListArchives("tank_test")
+	assert.NoError(t, err)
+	require.Len(t, inv.ArchiveList, 1)
+	assert.Equal(t, a.ArchiveDescription, inv.ArchiveList[0].ArchiveDescription)
+	assert.Equal(t, 1, api.heads)
+	o := api.objects["zfs/tank_test/"+a.ArchiveId]
+	require.NotNil(t, o)
+	assert.Equal(t, s3.StorageClassDeepArchive, o.class)
+	assert.Equal(t, data, o.data)
+
+	// archived object is restored before it is downloaded, a partial download is continued
+	file := filepath.Join(dir, "archive")
+	require.NoError(t, ioutil.WriteFile(file, data[:1000], 0600))
+	api.restoreDelay = 2
+	require.NoError(t, target.OpenRetrieval(filepath.Join(dir, jobStateFile), TierBulk))
+	description, err := target.Retrieve("tank_test", a.ArchiveId, file)
+	assert.NoError(t, err)
+	assert.Equal(t, a.ArchiveDescription, description)
+	d, err := ioutil.ReadFile(file)
+	assert.NoError(t, err)
+	assert.Equal(t, data, d)
+
+	// unknown storage class
+	_, err = target.BeginUpload("tank_test", &UploadRequest{PartSize: 1024 * 1024, StorageClass: "COLD"})
+	assert.Error(t, err)
+	assert.Error(t, target.OpenRetrieval("", "Fast"))
+	_, err = target.Retrieve("tank_test", "unknown", file)
+	assert.Error(t, err)
+}
+
+func TestNewTarget(t *testing.T) {
+	target, err := NewTarget("s3://backup/zfs/hosts?endpoint=http://localhost:9000&region=eu-central-1")
+	require.NoError(t, err)
+	require.IsType(t, &s3Target{}, target)
+	assert.Equal(t, "backup", target.(*s3Target).bucket)
+	assert.Equal(t, "zfs/hosts", target.(*s3Target).prefix)
+	assert.Equal(t, "zfs/hosts/tank_test/", target.(*s3Target).containerPrefix("tank_test"))
+
+	_, err = NewTarget("s3:///zfs")
+	assert.Error(t, err)
+	_, err = NewTarget("ftp://backup")
+	assert.Error(t, err)
+}
+
+func TestZFSFilesystem_GetStorageClass(t *testing.T) {
+	m := &Dataset{}
+	m.On("GetProperty", StorageClass).Return("glacier_ir", zfsiface.Inherited, nil)
+	assert.Equal(t, s3.StorageClassGlacierIr, (&ZFSFilesystem{m}).GetStorageClass())
+	m = &Dataset{}
+	m.On("GetProperty", StorageClass).Return("-", zfsiface.None, nil)
+	assert.Equal(t, "", (&ZFSFilesystem{m}).GetStorageClass())
+}
@@ -0,0 +1,77 @@
+package bkp
+
+import (
+	"testing"
+	"io"
+	"io/ioutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/timaebi/go-zfs/zfsiface"
+)
+
+func TestParseSendFlags(t *testing.T) {
+	for value, expected := range map[string]string{
+		"-c -L":  "cL",
+		"cLe":    "cLe",
+		"p,c":    "cp",
+		"-e, -e": "e",
+		"":       "",
+	} {
+		flags, err := ParseSendFlags(value)
+		assert.NoError(t, err, value)
+		assert.Equal(t, expected, flags, value)
+	}
+	for _, value := range []string{"-R", "-c -w", "cD"} {
+		_, err := ParseSendFlags(value)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestNewBackup_sendFlags(t *testing.T) {
+	d := testDataset()
+	d.On("EstimateSnapshot", nil, []string{"-w", "-L", "-e"}).Return(int64(12), nil).Once()
+	d.On("SendSnapshotWithFlags", nil, []string{"-w", "-L", "-e"}, mock.Anything).Return(nil).
+		Run(func(args mock.Arguments) {
+			args.Get(2).(io.Writer).Write([]byte("large blocks"))
+		}).Once()
+	b := newBackup(d, nil, &StreamOptions{Raw: true, SendFlags: "Le"}).(*zfsBackup)
+	p, _ := b.NextPart()
+	sent, err := ioutil.ReadAll(p)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("large blocks"), sent)
+
+	// the flags are recorded, so restore knows what the receiving pool needs
+	description, err := b.GetDescription("")
+	require.NoError(t, err)
+	m, err := ParseMetadata(description)
+	require.NoError(t, err)
+	assert.Equal(t, "Le", m.SendFlags)
+	mock.AssertExpectationsForObjects(t, d)
+	assert.Equal(t, []string{"encryption", "large_blocks", "embedded_data"}, m.ReceiverFeatures())
+	assert.Empty(t, (&Metadata{SendFlags: "cp"}).ReceiverFeatures())
+}
+
+func TestZFSFilesystem_GetStreamOptionsSendFlags(t *testing.T) {
+	m := &Dataset{}
+	m.On("GetProperty", RawSend).Return("-", zfsiface.None, nil)
+	m.On("GetProperty", CompressionProperty).Return("-", zfsiface.None, nil)
+	m.On("GetProperty", AgeRecipients).Return("-", zfsiface.None, nil)
+	m.On("GetProperty", PassphraseFile).Return("-", zfsiface.None, nil)
+	m.On("GetProperty", PartSizeProperty).Return("-", zfsiface.None, nil)
+	m.On("GetNativeProperties").Return(&zfsiface.NativeProperties{Name: "tank/test"})
+	m.On("GetProperty", SendFlagsProperty).Return("-c -L", zfsiface.Inherited, nil).Once()
+	o, err := (&ZFSFilesystem{m}).GetStreamOptions()
+	require.NoError(t, err)
+	assert.Equal(t, "cL", o.SendFlags)
+	assert.Equal(t, []string{"-c", "-L"}, o.sendFlags())
+
+	m.On("GetProperty", SendFlagsProperty).Return("-", zfsiface.None, nil).Once()
+	o, err = (&ZFSFilesystem{m}).GetStreamOptions()
+	require.NoError(t, err)
+	assert.Empty(t, o.SendFlags)
+
+	m.On("GetProperty", SendFlagsProperty).Return("-R", zfsiface.Local, nil).Once()
+	_, err = (&ZFSFilesystem{m}).GetStreamOptions()
+	assert.Error(t, err)
+}
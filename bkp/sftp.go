@@ -0,0 +1,304 @@
+package bkp
+
+import (
+	"github.com/aws/aws-sdk-go/service/glacier"
+	"github.com/pkg/sftp"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// sftpTarget stores archives in a directory of a remote host reached over ssh
+// It uses the same layout as dirTarget: one directory per filesystem, archives are written to <id>.part and renamed
+// to <id> after their size and checksums have been verified, <id>.json describes a completed archive.
+type sftpTarget struct {
+	client *sftp.Client
+	root   string
+	// shell runs sha256sum on the remote host to verify completed archives, nil if they are not verified remotely
+	shell remoteShell
+}
+
+// NewSFTPTarget connects to host as user and creates a Target storing archives below root on the remote host
+// The client authenticates with the private key in keyFile, the host key is checked against knownHostsFile. If
+// verify is set, the SHA-256 of every archive is computed on the remote host with sha256sum and compared to the
+// uploaded stream, otherwise only the size of the remote file is checked.
+func NewSFTPTarget(host, user, root, keyFile, knownHostsFile string, verify bool) (Target, error) {
+	conn, err := dialSSH(host, user, keyFile, knownHostsFile)
+	if err != nil {
+		return nil, err
+	}
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	var shell remoteShell
+	if verify {
+		shell = &sshShell{client: conn}
+	}
+	return newSFTPTarget(client, root, shell)
+}
+
+// dialSSH opens an ssh connection authenticated with the private key in keyFile
+// The host key is checked against knownHostsFile, port 22 is used if host has none.
+func dialSSH(host, user, keyFile, knownHostsFile string) (*ssh.Client, error) {
+	key, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", keyFile, err)
+	}
+	hostKeys, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, err = net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, "22")
+	}
+	return ssh.Dial("tcp", host, &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKeys,
+		Timeout:         30 * time.Second,
+	})
+}
+
+func newSFTPTarget(client *sftp.Client, root string, shell remoteShell) (Target, error) {
+	fi, err := client.Stat(root)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", root, err)
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", root)
+	}
+	return &sftpTarget{client: client, root: root, shell: shell}, nil
+}
+
+func (t *sftpTarget) path(container, name string) string {
+	return path.Join(t.root, container, name)
+}
+
+func (t *sftpTarget) ListContainers() ([]*Container, error) {
+	entries, err := t.client.ReadDir(t.root)
+	if err != nil {
+		return nil, err
+	}
+	containers := make([]*Container, 0)
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		sidecars, err := t.sidecars(e.Name())
+		if err != nil {
+			return nil, err
+		}
+		c := &Container{Name: e.Name(), Archives: int64(len(sidecars)), Listable: true}
+		for _, s := range sidecars {
+			c.Size += s.Size
+		}
+		containers = append(containers, c)
+	}
+	return containers, nil
+}
+
+// sidecars returns the sidecars of all completed archives in a container keyed by archive id
+func (t *sftpTarget) sidecars(container string) (map[string]*dirSidecar, error) {
+	entries, err := t.client.ReadDir(path.Join(t.root, container))
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]bool)
+	for _, e := range entries {
+		files[e.Name()] = true
+	}
+	sidecars := make(map[string]*dirSidecar)
+	for name := range files {
+		id := strings.TrimSuffix(name, sidecarExt)
+		if id == name || !files[id] {
+			continue
+		}
+		s := &dirSidecar{}
+		if err = t.readSidecar(container, id, s); err != nil {
+			return nil, err
+		}
+		sidecars[id] = s
+	}
+	return sidecars, nil
+}
+
+func (t *sftpTarget) readSidecar(container, id string, s *dirSidecar) error {
+	f, err := t.client.Open(t.path(container, id+sidecarExt))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewDecoder(f).Decode(s)
+}
+
+// writeSidecar writes the sidecar to a temporary file and renames it, so it is never read partially
+func (t *sftpTarget) writeSidecar(container, id string, s *dirSidecar) error {
+	d, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	name := t.path(container, id+sidecarExt)
+	f, err := t.client.Create(name + ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(d); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return t.client.Rename(name+".tmp", name)
+}
+
+func (t *sftpTarget) CreateContainer(name string) error {
+	return t.client.Mkdir(path.Join(t.root, name))
+}
+
+func (t *sftpTarget) BeginUpload(container string, req *UploadRequest) (Upload, error) {
+	id, err := newObjectName()
+	if err != nil {
+		return nil, err
+	}
+	u := &sftpUpload{target: t, container: container, id: id, description: req.Description, sha: sha256.New()}
+	u.file, err = t.client.OpenFile(u.partial(), os.O_CREATE|os.O_EXCL|os.O_WRONLY)
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// OpenRetrieval does nothing, archives on the remote host are available immediately
+func (t *sftpTarget) OpenRetrieval(stateFile, tier string) error {
+	return nil
+}
+
+func (t *sftpTarget) RequestArchives(container string) error {
+	return nil
+}
+
+func (t *sftpTarget) ListArchives(container string) (*Inventory, error) {
+	sidecars, err := t.sidecars(container)
+	if err != nil {
+		return nil, err
+	}
+	inv := &Inventory{InventoryDate: time.Now(), ArchiveList: make([]*InventoryArchive, 0, len(sidecars))}
+	for id, s := range sidecars {
+		inv.ArchiveList = append(inv.ArchiveList, s.archive(id))
+	}
+	return inv, nil
+}
+
+func (t *sftpTarget) RequestArchive(container, archiveID string) error {
+	_, err := t.client.Stat(t.path(container, archiveID))
+	return err
+}
+
+// Retrieve downloads an archive to file and verifies its tree hash
+func (t *sftpTarget) Retrieve(container, archiveID, file string) (string, error) {
+	s := &dirSidecar{}
+	if err := t.readSidecar(container, archiveID, s); err != nil {
+		return "", err
+	}
+	src, err := t.client.Open(t.path(container, archiveID))
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	return copyArchive(src, s, archiveID, file)
+}
+
+// sftpUpload streams the parts of an archive into a temporary file on the remote host
+type sftpUpload struct {
+	target      *sftpTarget
+	container   string
+	id          string
+	description string
+	file        *sftp.File
+	size        int64
+	// sha is the SHA-256 of the parts, computed as they are written
+	sha hash.Hash
+}
+
+func (u *sftpUpload) partial() string {
+	return u.target.path(u.container, u.id+partialExt)
+}
+
+func (u *sftpUpload) UploadPart(offset int64, p io.ReadSeeker, h []byte) error {
+	if offset != u.size {
+		return fmt.Errorf("part at %d uploaded after %d bytes", offset, u.size)
+	}
+	n, err := io.Copy(io.MultiWriter(u.file, u.sha), p)
+	u.size += n
+	return err
+}
+
+// Complete verifies the size of the remote file, writes its sidecar and renames it to its final name
+// The checksums are those of the written bytes, the remote file is only read if the target verifies it with
+// sha256sum on the remote host.
+func (u *sftpUpload) Complete(size int64, h []byte) (string, error) {
+	if err := u.file.Close(); err != nil {
+		return "", err
+	}
+	fi, err := u.target.client.Stat(u.partial())
+	if err != nil {
+		return "", err
+	}
+	if fi.Size() != size || u.size != size {
+		return "", fmt.Errorf("remote file has %d bytes, expected %d", fi.Size(), size)
+	}
+	hashes := glacier.Hash{TreeHash: h, LinearHash: u.sha.Sum(nil)}
+	if err = u.target.verify(u.partial(), hashes.LinearHash); err != nil {
+		return "", err
+	}
+
+	if err = u.target.writeSidecar(u.container, u.id, newDirSidecar(u.description, size, hashes)); err != nil {
+		return "", err
+	}
+	if err = u.target.client.Rename(u.partial(), u.target.path(u.container, u.id)); err != nil {
+		return "", err
+	}
+	log.WithField("dir", u.container).WithField("id", u.id).WithField("size", size).Info("remote archive verified")
+	return u.id, nil
+}
+
+// verify runs sha256sum on the remote host and compares the SHA-256 of the file to sum
+func (t *sftpTarget) verify(file string, sum []byte) error {
+	if t.shell == nil {
+		return nil
+	}
+	out := &bytes.Buffer{}
+	if err := t.shell.run("sha256sum -- "+shellQuote(file), nil, out); err != nil {
+		return err
+	}
+	fields := strings.Fields(out.String())
+	if len(fields) == 0 || fields[0] != hex.EncodeToString(sum) {
+		return fmt.Errorf("SHA-256 of remote file is %s, expected %x", strings.TrimSpace(out.String()), sum)
+	}
+	return nil
+}
+
+func (u *sftpUpload) Abort() error {
+	u.file.Close()
+	return u.target.client.Remove(u.partial())
+}
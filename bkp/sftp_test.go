@@ -0,0 +1,199 @@
+package bkp
+
+import (
+	"testing"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/aws/aws-sdk-go/service/glacier"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// startSSHServer runs an ssh server with the sftp subsystem and the commands of execCommand on a random local port
+// The private key of the client and a known hosts file containing the host key are written to dir.
+func startSSHServer(t *testing.T, dir string) (addr, keyFile, knownHostsFile string, stop func()) {
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+	require.NoError(t, err)
+	clientPub, clientKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	authorized, err := ssh.NewPublicKey(clientPub)
+	require.NoError(t, err)
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if c.User() == "backup" && bytes.Equal(key.Marshal(), authorized.Marshal()) {
+				return nil, nil
+			}
+			return nil, assert.AnError
+		},
+	}
+	config.AddHostKey(hostSigner)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveSSH(c, config)
+		}
+	}()
+
+	block, err := ssh.MarshalPrivateKey(clientKey, "")
+	require.NoError(t, err)
+	keyFile = filepath.Join(dir, "id_ed25519")
+	require.NoError(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(block), 0600))
+	knownHostsFile = filepath.Join(dir, "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(l.Addr().String())}, hostSigner.PublicKey())
+	require.NoError(t, ioutil.WriteFile(knownHostsFile, []byte(line+"\n"), 0600))
+	return l.Addr().String(), keyFile, knownHostsFile, func() { l.Close() }
+}
+
+func serveSSH(c net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(c, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for nc := range chans {
+		if nc.ChannelType() != "session" {
+			nc.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		ch, requests, err := nc.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for req := range requests {
+				switch {
+				case req.Type == "subsystem" && string(req.Payload[4:]) == "sftp":
+					req.Reply(true, nil)
+					if s, err := sftp.NewServer(ch); err == nil {
+						s.Serve()
+					}
+					ch.Close()
+				case req.Type == "exec":
+					req.Reply(true, nil)
+					execCommand(ch, string(req.Payload[4:]))
+				default:
+					req.Reply(false, nil)
+				}
+			}
+		}()
+	}
+}
+
+// execCommand runs the commands the test server supports: cat echoes stdin, sha256sum hashes a local file,
+// everything else fails
+func execCommand(ch ssh.Channel, cmd string) {
+	status := uint32(0)
+	if cmd == "cat" {
+		io.Copy(ch, ch)
+	} else if strings.HasPrefix(cmd, "sha256sum -- ") {
+		file := strings.Trim(strings.TrimPrefix(cmd, "sha256sum -- "), "'")
+		d, err := ioutil.ReadFile(file)
+		if err != nil {
+			fmt.Fprintf(ch.Stderr(), "sha256sum: %v\n", err)
+			status = 1
+		}
+		fmt.Fprintf(ch, "%x  %s\n", sha256.Sum256(d), file)
+	} else {
+		fmt.Fprintf(ch.Stderr(), "%s: command not found\n", cmd)
+		status = 127
+	}
+	ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+	ch.Close()
+}
+
+func TestSFTPTarget(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zfs2glacier")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	addr, keyFile, knownHosts, stop := startSSHServer(t, dir)
+	defer stop()
+	root := filepath.Join(dir, "offsite")
+	require.NoError(t, os.Mkdir(root, 0700))
+
+	// unknown host key
+	_, err = NewSFTPTarget(addr, "backup", root, keyFile, filepath.Join(dir, "id_ed25519"), false)
+	assert.Error(t, err)
+	// key not authorized for the user
+	_, err = NewSFTPTarget(addr, "root", root, keyFile, knownHosts, false)
+	assert.Error(t, err)
+	// missing remote directory
+	_, err = NewSFTPTarget(addr, "backup", filepath.Join(dir, "missing"), keyFile, knownHosts, false)
+	assert.Error(t, err)
+
+	target, err := NewTarget("sftp://backup@" + addr + root + "?key=" + keyFile + "&known_hosts=" + knownHosts +
+		"&verify=sha256sum")
+	require.NoError(t, err)
+	require.NoError(t, target.CreateContainer("tank_test"))
+
+	// a batch uploads the parts into a temporary file which is renamed after it has been verified
+	data := bytes.Repeat([]byte{1, 2, 3, 4, 5}, 1024*512)
+	b := &Batch{targets: defaultTargets(target)}
+	require.NoError(t, b.upload("tank_test", &zfsBackup{zfsReader: bytes.NewBuffer(data), partSize: 1024 * 1024,
+		hasNext: true, dataset: withArchiveID(testDataset())}, "", allRequired(b)))
+	inv, err := target.ListArchives("tank_test")
+	require.NoError(t, err)
+	require.Len(t, inv.ArchiveList, 1)
+	a := inv.ArchiveList[0]
+	assert.Equal(t, int64(len(data)), a.Size)
+	assert.Equal(t, treeHash(data), a.SHA256TreeHash)
+	require.NotNil(t, a.Metadata)
+	assert.Equal(t, "1234567890", a.Metadata.GUID)
+	assert.NotEmpty(t, a.Metadata.StreamSHA256)
+	files, err := filepath.Glob(filepath.Join(root, "tank_test", "*"))
+	assert.NoError(t, err)
+	assert.Len(t, files, 2, "archive and sidecar")
+	containers, err := target.ListContainers()
+	assert.NoError(t, err)
+	assert.Equal(t, []*Container{{Name: "tank_test", Listable: true, Archives: 1, Size: int64(len(data))}}, containers)
+
+	// the archive is downloaded and verified
+	file := filepath.Join(dir, "archive")
+	description, err := target.Retrieve("tank_test", a.ArchiveId, file)
+	require.NoError(t, err)
+	m, err := ParseMetadata(description)
+	require.NoError(t, err)
+	assert.Equal(t, a.Metadata.StreamSHA256, m.StreamSHA256)
+	d, err := ioutil.ReadFile(file)
+	assert.NoError(t, err)
+	assert.Equal(t, data, d)
+
+	// the remote file does not contain what was uploaded -> sha256sum on the remote host fails the archive
+	u, err := target.BeginUpload("tank_test", &UploadRequest{Description: "other", PartSize: 1024 * 1024})
+	require.NoError(t, err)
+	require.NoError(t, u.UploadPart(0, bytes.NewReader(data[:100]), glacier.ComputeHashes(bytes.NewReader(data[:100])).TreeHash))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(root, "tank_test", u.(*sftpUpload).id+partialExt), data[1:101], 0600))
+	_, err = u.Complete(100, glacier.ComputeHashes(bytes.NewReader(data[:100])).TreeHash)
+	assert.Error(t, err)
+	assert.NoError(t, u.Abort())
+	inv, err = target.ListArchives("tank_test")
+	require.NoError(t, err)
+	assert.Len(t, inv.ArchiveList, 1)
+
+	// remote file is shorter than the stream
+	u, err = target.BeginUpload("tank_test", &UploadRequest{Description: "other", PartSize: 1024 * 1024})
+	require.NoError(t, err)
+	require.NoError(t, u.UploadPart(0, bytes.NewReader(data[:100]), glacier.ComputeHashes(bytes.NewReader(data[:100])).TreeHash))
+	_, err = u.Complete(200, glacier.ComputeHashes(bytes.NewReader(data[:200])).TreeHash)
+	assert.Error(t, err)
+}
@@ -0,0 +1,227 @@
+package bkp
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// A Container holds the archives of one filesystem, e.g. an aws glacier vault
+type Container struct {
+	Name     string
+	Size     int64
+	Archives int64
+	// Listable is false if the archives of the container can't be listed yet
+	Listable bool
+}
+
+// UploadRequest describes an archive before its upload is started
+type UploadRequest struct {
+	Description string
+	PartSize    int
+	// Size is the estimated size of the archive, 0 if unknown
+	Size int64
+	// StorageClass is set with the StorageClass zfs attribute if the target is a classTarget that has the class
+	StorageClass string
+}
+
+// A Target is a storage backend the archives of the filesystems are uploaded to and retrieved from
+type Target interface {
+	// ListContainers returns all existing containers
+	ListContainers() ([]*Container, error)
+	// CreateContainer creates the container with the given name
+	CreateContainer(name string) error
+	// BeginUpload starts the multipart upload of an archive into a container
+	BeginUpload(container string, req *UploadRequest) (Upload, error)
+	// OpenRetrieval prepares the target for listing and retrieving archives
+	// Targets on which retrievals take hours track them in stateFile, so they survive the process exiting.
+	OpenRetrieval(stateFile, tier string) error
+	// RequestArchives asks for the archive list of a container without waiting for it
+	RequestArchives(container string) error
+	// ListArchives returns the archives of a container, it blocks until the list is available
+	ListArchives(container string) (*Inventory, error)
+	// RequestArchive asks for an archive without waiting for it
+	RequestArchive(container, archiveID string) error
+	// Retrieve writes an archive to file and returns its description, it blocks until the archive is available
+	// A partially retrieved file is continued where the previous retrieval stopped.
+	Retrieve(container, archiveID, file string) (string, error)
+}
+
+// An Upload is a multipart upload of an archive
+// Parts are uploaded in order unless the upload is a concurrentUpload, offset is the position of the part in the
+// archive.
+type Upload interface {
+	UploadPart(offset int64, part io.ReadSeeker, treeHash []byte) error
+	// Complete finishes the upload and returns the id of the new archive
+	Complete(size int64, treeHash []byte) (string, error)
+	// Abort discards all uploaded parts
+	Abort() error
+}
+
+// A classTarget is a target with storage classes
+// A filesystem's storage class is only requested from the targets that have it, the others use their default.
+type classTarget interface {
+	Target
+	hasStorageClass(class string) bool
+}
+
+// A streamTarget receives the send stream with zfs receive instead of storing it as it is
+// It can't take streams that are compressed or encrypted before the upload.
+type streamTarget interface {
+	Target
+	receivesStream()
+}
+
+// A checksumUpload stores the SHA-256 of the stream with the archive, it is set before the upload is completed
+// Glacier and s3 can't change the description once the upload started, the catalog keeps the SHA-256 for them.
+type checksumUpload interface {
+	Upload
+	setStreamSHA256(sum string)
+}
+
+// A partSizeTarget accepts parts only within a range of sizes, the last part of an archive may be smaller
+type partSizeTarget interface {
+	Target
+	partSizeLimits() (min, max int64)
+}
+
+// A catalogTarget reads the descriptions of the archives it lists from the catalog, if it is given one
+// S3 only returns the description of one object per request, the catalog saves them for archives it knows.
+type catalogTarget interface {
+	Target
+	setCatalog(c *Catalog)
+}
+
+// A concurrentUpload accepts its parts in any order and from several goroutines at once
+type concurrentUpload interface {
+	Upload
+	// concurrent marks the upload as safe for concurrent calls of UploadPart
+	concurrent()
+}
+
+// A NamedTarget is a Target with the name filesystems select it by, see the Targets zfs attribute
+// The archive ids of every target are stored in their own zfs attribute, the target without name uses the one
+// zfs2glacier always used.
+type NamedTarget struct {
+	Name string
+	Target
+}
+
+// targetName matches the names of targets, they are part of a zfs attribute name
+var targetName = regexp.MustCompile("^([a-z0-9][-a-z0-9_.]*)=")
+
+// NewTargets creates the targets described by specs of the form [name=]spec, see NewTarget for the specs
+// Only one target may have no name.
+func NewTargets(specs []string) ([]*NamedTarget, error) {
+	targets := make([]*NamedTarget, 0, len(specs))
+	names := make(map[string]bool)
+	for _, spec := range specs {
+		nt := &NamedTarget{}
+		if m := targetName.FindStringSubmatch(spec); m != nil {
+			nt.Name = m[1]
+			spec = spec[len(m[0]):]
+		}
+		if names[nt.Name] {
+			if nt.Name == "" {
+				return nil, errors.New("only one target may have no name, name them with name=spec")
+			}
+			return nil, fmt.Errorf("target name %s is used twice", nt.Name)
+		}
+		names[nt.Name] = true
+		var err error
+		if nt.Target, err = NewTarget(spec); err != nil {
+			return nil, err
+		}
+		targets = append(targets, nt)
+	}
+	if len(targets) == 0 {
+		return nil, errors.New("no target given")
+	}
+	return targets, nil
+}
+
+// newObjectName returns a unique, time ordered name for a new archive on targets that don't assign ids
+func newObjectName() (string, error) {
+	r := make([]byte, 4)
+	if _, err := rand.Read(r); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s-%x", time.Now().UTC().Format("20060102T150405Z"), r), nil
+}
+
+// NewTarget creates the Target described by spec
+// Supported are "glacier" for aws glacier vaults, "s3://bucket/prefix" for aws s3, "azure://account/container/prefix"
+// for azure blob storage, "gs://bucket/prefix" for google cloud storage, "file:///path" for a local directory,
+// "sftp://user@host:port/path" for a directory on a remote host and "zfs://user@host:port/pool/dataset" for zfs
+// filesystems on a remote host which receive the backups. The aws targets take the query parameters profile,
+// region, role and endpoint on top of DefaultAWSConfig, e.g. "glacier?profile=offsite" or
+// "s3://backup/zfs?endpoint=http://localhost:9000". The azure and gcs endpoints, e.g. of an emulator, are set with
+// endpoint as well, the gcs credentials file with credentials.
+// The ssh private key and known hosts file are set with key and known_hosts, they default to the files in ~/.ssh.
+// "sftp://...?verify=sha256sum" verifies the uploaded archives with sha256sum on the remote host.
+func NewTarget(spec string) (Target, error) {
+	if spec == "" {
+		spec = "glacier"
+	}
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "":
+		if u.Path == "glacier" {
+			return NewGlacierTarget(awsParams(u.Query()))
+		}
+	case "s3":
+		return NewS3Target(u.Host, u.Path, awsParams(u.Query()))
+	case "azure":
+		parts := strings.SplitN(strings.TrimPrefix(u.Path, "/"), "/", 2)
+		if len(parts) == 1 {
+			parts = append(parts, "")
+		}
+		return NewAzureTarget(u.Host, parts[0], parts[1], u.Query().Get("endpoint"))
+	case "gs":
+		q := u.Query()
+		return NewGCSTarget(u.Host, u.Path, q.Get("endpoint"), q.Get("credentials"))
+	case "file":
+		return NewDirTarget(u.Path)
+	case "sftp", "zfs":
+		name, key, knownHosts, err := sshParams(u)
+		if err != nil {
+			return nil, err
+		}
+		if u.Scheme == "zfs" {
+			return NewReplicaTarget(u.Host, name, strings.TrimPrefix(u.Path, "/"), key, knownHosts)
+		}
+		return NewSFTPTarget(u.Host, name, u.Path, key, knownHosts, u.Query().Get("verify") == "sha256sum")
+	}
+	return nil, fmt.Errorf("unknown target %s", spec)
+}
+
+// sshParams returns the user, private key and known hosts file of a target spec connecting over ssh
+func sshParams(u *url.URL) (name, key, knownHosts string, err error) {
+	home := os.Getenv("HOME")
+	q := u.Query()
+	if key = q.Get("key"); key == "" {
+		key = filepath.Join(home, ".ssh", "id_rsa")
+	}
+	if knownHosts = q.Get("known_hosts"); knownHosts == "" {
+		knownHosts = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	if name = u.User.Username(); name == "" {
+		current, err := user.Current()
+		if err != nil {
+			return "", "", "", err
+		}
+		name = current.Username
+	}
+	return name, key, knownHosts, nil
+}
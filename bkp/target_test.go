@@ -0,0 +1,225 @@
+package bkp
+
+import (
+	"testing"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+	"github.com/aws/aws-sdk-go/service/glacier"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memArchive is an archive stored by memTarget
+type memArchive struct {
+	id          string
+	description string
+	data        []byte
+	created     time.Time
+}
+
+// memTarget is a Target which keeps the archives in memory
+type memTarget struct {
+	containers map[string][]*memArchive
+	nextID     int
+	// err is returned by every call if it is set
+	err error
+	// partErr is returned by UploadPart if it is set
+	partErr error
+	aborted int
+}
+
+func newMemTarget(containers ...string) *memTarget {
+	t := &memTarget{containers: make(map[string][]*memArchive)}
+	for _, c := range containers {
+		t.containers[c] = make([]*memArchive, 0)
+	}
+	return t
+}
+
+// put stores an archive with the given id in a container
+func (t *memTarget) put(container, id, description string, data []byte) {
+	t.containers[container] = append(t.containers[container],
+		&memArchive{id: id, description: description, data: data, created: time.Now()})
+}
+
+func (t *memTarget) archive(container, archiveID string) (*memArchive, error) {
+	if t.err != nil {
+		return nil, t.err
+	}
+	for _, a := range t.containers[container] {
+		if a.id == archiveID {
+			return a, nil
+		}
+	}
+	return nil, fmt.Errorf("archive %s does not exist in %s", archiveID, container)
+}
+
+func (t *memTarget) ListContainers() ([]*Container, error) {
+	if t.err != nil {
+		return nil, t.err
+	}
+	containers := make([]*Container, 0, len(t.containers))
+	for name, archives := range t.containers {
+		c := &Container{Name: name, Archives: int64(len(archives)), Listable: true}
+		for _, a := range archives {
+			c.Size += int64(len(a.data))
+		}
+		containers = append(containers, c)
+	}
+	sort.Slice(containers, func(i, j int) bool {
+		return containers[i].Name < containers[j].Name
+	})
+	return containers, nil
+}
+
+func (t *memTarget) CreateContainer(name string) error {
+	if t.err != nil {
+		return t.err
+	}
+	if _, ok := t.containers[name]; ok {
+		return errors.New("container " + name + " exists")
+	}
+	t.containers[name] = make([]*memArchive, 0)
+	return nil
+}
+
+func (t *memTarget) BeginUpload(container string, req *UploadRequest) (Upload, error) {
+	if t.err != nil {
+		return nil, t.err
+	}
+	if _, ok := t.containers[container]; !ok {
+		return nil, errors.New("container " + container + " does not exist")
+	}
+	return &memUpload{target: t, container: container, description: req.Description}, nil
+}
+
+func (t *memTarget) OpenRetrieval(stateFile, tier string) error {
+	return t.err
+}
+
+func (t *memTarget) RequestArchives(container string) error {
+	_, err := t.ListArchives(container)
+	return err
+}
+
+func (t *memTarget) ListArchives(container string) (*Inventory, error) {
+	if t.err != nil {
+		return nil, t.err
+	}
+	archives, ok := t.containers[container]
+	if !ok {
+		return nil, errors.New("container " + container + " does not exist")
+	}
+	inv := &Inventory{InventoryDate: time.Now(), ArchiveList: make([]*InventoryArchive, 0, len(archives))}
+	for _, a := range archives {
+		ia := &InventoryArchive{ArchiveId: a.id, ArchiveDescription: a.description, CreationDate: a.created,
+			Size: int64(len(a.data)), SHA256TreeHash: treeHash(a.data)}
+		ia.Metadata, _ = ParseMetadata(a.description)
+		inv.ArchiveList = append(inv.ArchiveList, ia)
+	}
+	return inv, nil
+}
+
+func (t *memTarget) RequestArchive(container, archiveID string) error {
+	_, err := t.archive(container, archiveID)
+	return err
+}
+
+func (t *memTarget) Retrieve(container, archiveID, file string) (string, error) {
+	a, err := t.archive(container, archiveID)
+	if err != nil {
+		return "", err
+	}
+	return a.description, ioutil.WriteFile(file, a.data, 0600)
+}
+
+// memUpload collects the uploaded parts in memory and verifies their tree hashes
+type memUpload struct {
+	target      *memTarget
+	container   string
+	description string
+	data        []byte
+}
+
+func (u *memUpload) UploadPart(offset int64, part io.ReadSeeker, h []byte) error {
+	if u.target.err != nil {
+		return u.target.err
+	}
+	if u.target.partErr != nil {
+		return u.target.partErr
+	}
+	if offset != int64(len(u.data)) {
+		return fmt.Errorf("part at %d uploaded after %d bytes", offset, len(u.data))
+	}
+	d, err := ioutil.ReadAll(part)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(glacier.ComputeHashes(bytes.NewReader(d)).TreeHash, h) {
+		return errors.New("tree hash of part does not match")
+	}
+	u.data = append(u.data, d...)
+	return nil
+}
+
+func (u *memUpload) Complete(size int64, h []byte) (string, error) {
+	if u.target.err != nil {
+		return "", u.target.err
+	}
+	if size != int64(len(u.data)) {
+		return "", fmt.Errorf("size %d does not match the %d uploaded bytes", size, len(u.data))
+	}
+	if !bytes.Equal(glacier.ComputeHashes(bytes.NewReader(u.data)).TreeHash, h) {
+		return "", errors.New("tree hash of archive does not match")
+	}
+	u.target.nextID++
+	id := fmt.Sprintf("archive-%d", u.target.nextID)
+	u.target.put(u.container, id, u.description, u.data)
+	return id, nil
+}
+
+func (u *memUpload) Abort() error {
+	u.target.aborted++
+	return nil
+}
+
+// defaultTargets returns t as the only target, it has no name
+func defaultTargets(t Target) []*NamedTarget {
+	return []*NamedTarget{{Target: t}}
+}
+
+// allRequired returns all targets of a batch as required upload targets
+func allRequired(b *Batch) []*uploadTarget {
+	targets := make([]*uploadTarget, len(b.targets))
+	for i, t := range b.targets {
+		targets[i] = &uploadTarget{NamedTarget: t, required: true}
+	}
+	return targets
+}
+
+func TestNewTargets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zfs2glacier")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	targets, err := NewTargets([]string{"s3://backup/zfs?region=eu-central-1", "nas=file://" + dir})
+	require.NoError(t, err)
+	require.Len(t, targets, 2)
+	assert.Equal(t, "", targets[0].Name)
+	assert.IsType(t, &s3Target{}, targets[0].Target)
+	assert.Equal(t, "nas", targets[1].Name)
+	assert.Equal(t, &dirTarget{root: dir}, targets[1].Target)
+
+	_, err = NewTargets([]string{"s3://backup/zfs", "file://" + dir})
+	assert.EqualError(t, err, "only one target may have no name, name them with name=spec")
+	_, err = NewTargets([]string{"nas=s3://backup/zfs", "nas=file://" + dir})
+	assert.EqualError(t, err, "target name nas is used twice")
+	_, err = NewTargets([]string{})
+	assert.Error(t, err)
+}
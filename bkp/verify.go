@@ -0,0 +1,179 @@
+package bkp
+
+import (
+	log "github.com/sirupsen/logrus"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// DefaultMaxChainLength is the number of archives a chain may contain before it is reported as too long
+const DefaultMaxChainLength = 60
+
+// archiveLookup returns the Metadata of an archive in a vault, nil is returned for unknown archives
+type archiveLookup func(vault, archiveID string) (*Metadata, error)
+
+// A ChainReport is the result of following the base archive links from the latest archive of a filesystem
+type ChainReport struct {
+	Filesystem string
+	// Target is the name of the target the chain was uploaded to
+	Target     string
+	VaultName  string
+	ArchiveID  string
+	// Chain contains the archive ids starting with the latest archive, followed by its base archives
+	Chain []string
+	// Problem describes why the chain can't be restored, it is empty for a valid chain
+	Problem string
+}
+
+// IsValid returns true if the chain ends in a full backup
+func (r *ChainReport) IsValid() bool {
+	return r.Problem == ""
+}
+
+// Print renders the report to stdout
+func (r *ChainReport) Print() {
+	status := "ok"
+	if !r.IsValid() {
+		status = "BROKEN: " + r.Problem
+	}
+	name := r.Filesystem
+	if r.Target != "" {
+		name += " on " + r.Target
+	}
+	fmt.Printf("%-50s | %3d archives | %s\n", name, len(r.Chain), status)
+	if !r.IsValid() {
+		fmt.Printf("  %s\n", strings.Join(r.Chain, " -> "))
+	}
+}
+
+// verifyChain follows the base archive links from archiveID down to a full backup
+func verifyChain(lookup archiveLookup, vault, archiveID string, maxLength int) (*ChainReport, error) {
+	r := &ChainReport{VaultName: vault, ArchiveID: archiveID, Chain: make([]string, 0)}
+	seen := make(map[string]bool)
+	id := archiveID
+	for {
+		if seen[id] {
+			r.Problem = fmt.Sprintf("archive %s is its own base", id)
+			return r, nil
+		}
+		seen[id] = true
+		if len(r.Chain) == maxLength {
+			r.Problem = fmt.Sprintf("chain has more than %d archives", maxLength)
+			return r, nil
+		}
+		m, err := lookup(vault, id)
+		if err != nil {
+			return nil, err
+		}
+		if m == nil {
+			r.Problem = fmt.Sprintf("archive %s does not exist", id)
+			return r, nil
+		}
+		r.Chain = append(r.Chain, id)
+		if !m.IsIncremental {
+			return r, nil
+		}
+		if m.BaseArchiveID == "" {
+			r.Problem = fmt.Sprintf("incremental archive %s has no base archive", id)
+			return r, nil
+		}
+		id = m.BaseArchiveID
+	}
+}
+
+// catalogLookup returns an archiveLookup reading the archives from the catalog
+func catalogLookup(c *Catalog) archiveLookup {
+	return func(vault, archiveID string) (*Metadata, error) {
+		r, err := c.Get(archiveID)
+		if err != nil || r == nil || r.VaultName != vault {
+			return nil, err
+		}
+		return &Metadata{IsIncremental: r.IsIncremental, BaseArchiveID: r.BaseArchiveID}, nil
+	}
+}
+
+// VerifyChains checks that the latest archive of every enabled filesystem can be restored
+// The base archive links are followed through the catalog.
+func (b *Batch) VerifyChains(c *Catalog, maxLength int) ([]*ChainReport, error) {
+	if !b.initialized {
+		return nil, errors.New("batch needs to be initialized before verifying chains")
+	}
+	reports := make([]*ChainReport, 0)
+	for _, fs := range b.filesystems {
+		if !fs.IsBackupEnabled() {
+			continue
+		}
+		r, err := b.verifyFilesystem(fs.(*ZFSFilesystem), catalogLookup(c), maxLength)
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, r...)
+	}
+	return reports, nil
+}
+
+// VerifyChainsInventory checks the chains like VerifyChains, but follows the links through the vault inventories
+// Archives uploaded after the inventory was taken are looked up in the catalog.
+func (b *Batch) VerifyChainsInventory(c *Catalog, stateFile string, maxLength int) ([]*ChainReport, error) {
+	if !b.initialized {
+		return nil, errors.New("batch needs to be initialized before verifying chains")
+	}
+	reports := make([]*ChainReport, 0)
+	err := b.inventories(stateFile, func(fs *ZFSFilesystem, inv *Inventory) error {
+		archives := make(map[string]*Metadata)
+		for _, a := range inv.ArchiveList {
+			if a.Metadata != nil {
+				archives[a.ArchiveId] = a.Metadata
+			}
+		}
+		lookup := func(vault, archiveID string) (*Metadata, error) {
+			if m, ok := archives[archiveID]; ok {
+				return m, nil
+			}
+			return catalogLookup(c)(vault, archiveID)
+		}
+		r, err := b.verifyFilesystem(fs, lookup, maxLength)
+		if err != nil {
+			return err
+		}
+		reports = append(reports, r...)
+		return nil
+	})
+	return reports, err
+}
+
+// verifyFilesystem follows the chain of the latest archive of a filesystem on every target it is uploaded to
+// A target without the latest archive is reported as broken, nothing is returned if there is no backup yet.
+func (b *Batch) verifyFilesystem(fs *ZFSFilesystem, lookup archiveLookup, maxLength int) ([]*ChainReport, error) {
+	name := fs.dataset.GetNativeProperties().Name
+	if fs.findBaseSnapshot() == nil {
+		log.WithField("fs", name).Info("no backup to verify")
+		return nil, nil
+	}
+	selected := fs.GetTargets()
+	reports := make([]*ChainReport, 0, len(b.targets))
+	for _, t := range b.targets {
+		if _, ok := selected[t.Name]; selected != nil && !ok {
+			continue
+		}
+		id, err := fs.GetLastArchiveID(t.Name)
+		if err != nil {
+			return nil, err
+		}
+		r := &ChainReport{VaultName: fs.GetVaultName(), Chain: make([]string, 0),
+			Problem: "the target has no archive of the latest backup"}
+		if id != "" {
+			if r, err = verifyChain(lookup, fs.GetVaultName(), id, maxLength); err != nil {
+				return nil, err
+			}
+		}
+		r.Filesystem = name
+		r.Target = t.Name
+		if !r.IsValid() {
+			log.WithField("fs", name).WithField("target", t.Name).WithField("archiveID", id).Warn(r.Problem)
+		}
+		reports = append(reports, r)
+	}
+	return reports, nil
+}
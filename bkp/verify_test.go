@@ -0,0 +1,111 @@
+package bkp
+
+import (
+	"testing"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/timaebi/go-zfs/zfsiface"
+)
+
+func TestVerifyChain(t *testing.T) {
+	archives := map[string]*Metadata{
+		"full":    {},
+		"incr-1":  {IsIncremental: true, BaseArchiveID: "full"},
+		"incr-2":  {IsIncremental: true, BaseArchiveID: "incr-1"},
+		"orphan":  {IsIncremental: true, BaseArchiveID: "deleted"},
+		"cycle-1": {IsIncremental: true, BaseArchiveID: "cycle-2"},
+		"cycle-2": {IsIncremental: true, BaseArchiveID: "cycle-1"},
+		"no-base": {IsIncremental: true},
+	}
+	lookup := func(vault, archiveID string) (*Metadata, error) {
+		return archives[archiveID], nil
+	}
+
+	r, err := verifyChain(lookup, "tank_test", "incr-2", 3)
+	assert.NoError(t, err)
+	assert.True(t, r.IsValid())
+	assert.Equal(t, []string{"incr-2", "incr-1", "full"}, r.Chain)
+
+	r, err = verifyChain(lookup, "tank_test", "incr-2", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, "chain has more than 2 archives", r.Problem)
+
+	r, err = verifyChain(lookup, "tank_test", "orphan", 10)
+	assert.NoError(t, err)
+	assert.Equal(t, "archive deleted does not exist", r.Problem)
+	assert.Equal(t, []string{"orphan"}, r.Chain)
+
+	r, err = verifyChain(lookup, "tank_test", "cycle-1", 10)
+	assert.NoError(t, err)
+	assert.Equal(t, "archive cycle-1 is its own base", r.Problem)
+
+	r, err = verifyChain(lookup, "tank_test", "no-base", 10)
+	assert.NoError(t, err)
+	assert.False(t, r.IsValid())
+}
+
+// verifyBatch returns an initialized batch with the filesystem tank/test whose latest archive is archive-3
+func verifyBatch(target Target) *Batch {
+	full := &Dataset{}
+	full.On("GetNativeProperties").Return(&zfsiface.NativeProperties{Name: "tank/test@glacier-full"})
+	incremental := &Dataset{}
+	incremental.On("GetNativeProperties").Return(&zfsiface.NativeProperties{Name: "tank/test@glacier-incremental"})
+	incremental.On("GetProperty", glacierArchiveID).Return("archive-3", zfsiface.Local, nil)
+	incremental.On("GetProperty", glacierArchiveID+":nas").Return("-", zfsiface.None, nil)
+	ds := &Dataset{}
+	ds.On("GetNativeProperties").Return(&zfsiface.NativeProperties{Name: "tank/test"})
+	ds.On("GetProperty", BackupEnabled).Return("true", zfsiface.Local, nil)
+	ds.On("GetProperty", Targets).Return("-", zfsiface.None, nil)
+	ds.On("Snapshots").Return([]zfsiface.Dataset{full, incremental}, nil)
+	return &Batch{
+		targets:     defaultTargets(target),
+		filesystems: []Filesystem{&ZFSFilesystem{ds}},
+		containers:  map[string][]*Container{"": {{Name: "tank_test"}}},
+		initialized: true,
+	}
+}
+
+func TestBatch_VerifyChains(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zfs2glacier")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c, err := OpenCatalog(filepath.Join(dir, "catalog.db"))
+	require.NoError(t, err)
+	defer c.Close()
+
+	// the base of archive-3 is not in the catalog
+	require.NoError(t, c.Put(&CatalogRecord{ArchiveID: "archive-3", VaultName: "tank_test", IsIncremental: true, BaseArchiveID: "archive-2"}))
+	reports, err := verifyBatch(newMemTarget("tank_test")).VerifyChains(c, DefaultMaxChainLength)
+	assert.NoError(t, err)
+	require.Len(t, reports, 1)
+	assert.Equal(t, "tank/test", reports[0].Filesystem)
+	assert.Equal(t, "archive archive-2 does not exist", reports[0].Problem)
+
+	// the inventory contains the missing archives
+	target := newMemTarget("tank_test")
+	target.put("tank_test", "archive-1", `{"IsIncremental":false}`, []byte{1})
+	target.put("tank_test", "archive-2", `{"BaseArchiveID":"archive-1","IsIncremental":true}`, []byte{2})
+	reports, err = verifyBatch(target).VerifyChainsInventory(c, filepath.Join(dir, jobStateFile), DefaultMaxChainLength)
+	assert.NoError(t, err)
+	require.Len(t, reports, 1)
+	assert.True(t, reports[0].IsValid())
+	assert.Equal(t, []string{"archive-3", "archive-2", "archive-1"}, reports[0].Chain)
+
+	// every target is verified, one without the latest archive is broken
+	require.NoError(t, c.Put(&CatalogRecord{ArchiveID: "archive-2", VaultName: "tank_test", IsIncremental: true, BaseArchiveID: "archive-1"}))
+	require.NoError(t, c.Put(&CatalogRecord{ArchiveID: "archive-1", VaultName: "tank_test"}))
+	b := verifyBatch(newMemTarget("tank_test"))
+	b.targets = append(b.targets, &NamedTarget{Name: "nas", Target: newMemTarget("tank_test")})
+	reports, err = b.VerifyChains(c, DefaultMaxChainLength)
+	assert.NoError(t, err)
+	require.Len(t, reports, 2)
+	assert.True(t, reports[0].IsValid())
+	assert.Equal(t, "nas", reports[1].Target)
+	assert.Equal(t, "the target has no archive of the latest backup", reports[1].Problem)
+
+	_, err = (&Batch{}).VerifyChains(c, DefaultMaxChainLength)
+	assert.Error(t, err)
+}
@@ -0,0 +1,124 @@
+package bkp
+
+import (
+	"github.com/timaebi/go-zfs/zfsiface"
+	"bytes"
+	"errors"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// An optionDataset sends its snapshots with further zfs send flags and estimates the size of their streams
+// The datasets of go-zfs only send plain streams, zfsDataset adds the options to them.
+type optionDataset interface {
+	zfsiface.Dataset
+	// SendSnapshotWithFlags writes the send stream with the given flags to output, incremental from base if set
+	SendSnapshotWithFlags(base zfsiface.Dataset, flags []string, output io.Writer) error
+	// EstimateSnapshot returns the size zfs send estimates for the stream SendSnapshotWithFlags writes
+	EstimateSnapshot(base zfsiface.Dataset, flags []string) (int64, error)
+}
+
+// zfsDataset wraps a dataset of go-zfs with the send options, the snapshots it returns are wrapped as well
+// Plain streams are sent with the same zfs send call as streams with flags, so its errors are always returned.
+type zfsDataset struct {
+	zfsiface.Dataset
+}
+
+func wrapDataset(d zfsiface.Dataset, err error) (zfsiface.Dataset, error) {
+	if err != nil || d == nil {
+		return d, err
+	}
+	return &zfsDataset{d}, nil
+}
+
+func wrapDatasets(datasets []zfsiface.Dataset, err error) ([]zfsiface.Dataset, error) {
+	for i, d := range datasets {
+		datasets[i] = &zfsDataset{d}
+	}
+	return datasets, err
+}
+
+func (d *zfsDataset) Children(depth uint64) ([]zfsiface.Dataset, error) {
+	return wrapDatasets(d.Dataset.Children(depth))
+}
+
+func (d *zfsDataset) Snapshot(name string, recursive bool) (zfsiface.Dataset, error) {
+	return wrapDataset(d.Dataset.Snapshot(name, recursive))
+}
+
+func (d *zfsDataset) Snapshots() ([]zfsiface.Dataset, error) {
+	return wrapDatasets(d.Dataset.Snapshots())
+}
+
+func (d *zfsDataset) Rename(name string, createParent bool, recursiveRenameSnapshots bool) (zfsiface.Dataset, error) {
+	return wrapDataset(d.Dataset.Rename(name, createParent, recursiveRenameSnapshots))
+}
+
+func (d *zfsDataset) SendSnapshot(output io.Writer) error {
+	return d.SendSnapshotWithFlags(nil, nil, output)
+}
+
+func (d *zfsDataset) SendIncrementalSnapshot(base zfsiface.Dataset, output io.Writer) error {
+	return d.SendSnapshotWithFlags(base, nil, output)
+}
+
+func (d *zfsDataset) SendSnapshotWithFlags(base zfsiface.Dataset, flags []string, output io.Writer) error {
+	cmd := exec.Command("zfs", d.sendArgs(base, flags)...)
+	cmd.Stdout = output
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		return errors.New(strings.TrimSpace(stderr.String()) + ": " + err.Error())
+	}
+	return nil
+}
+
+func (d *zfsDataset) EstimateSnapshot(base zfsiface.Dataset, flags []string) (int64, error) {
+	out, err := exec.Command("zfs", d.sendArgs(base, append([]string{"-n", "-P"}, flags...))...).CombinedOutput()
+	if err != nil {
+		return 0, errors.New(strings.TrimSpace(string(out)) + ": " + err.Error())
+	}
+	return parseSendSize(string(out))
+}
+
+// sendArgs returns the arguments of zfs send for the snapshot with the given flags, incremental from base if set
+func (d *zfsDataset) sendArgs(base zfsiface.Dataset, flags []string) []string {
+	args := append([]string{"send"}, flags...)
+	if base != nil {
+		args = append(args, "-i", base.GetNativeProperties().Name)
+	}
+	return append(args, d.GetNativeProperties().Name)
+}
+
+// parseSendSize reads the stream size from the parsable output of zfs send -nP, e.g. "full\ttank@a\t1024\nsize\t1024"
+func parseSendSize(out string) (int64, error) {
+	for _, l := range strings.Split(out, "\n") {
+		f := strings.Fields(l)
+		if len(f) == 2 && f[0] == "size" {
+			return strconv.ParseInt(f[1], 10, 64)
+		}
+	}
+	return 0, errors.New("zfs send printed no stream size")
+}
+
+// receiveSnapshot reads a zfs send stream from input and stores it as the snapshot with the given name
+// The filesystem is rolled back first if force is set, raw streams are received without mounting it.
+func receiveSnapshot(snapshot string, force, raw bool, input io.Reader) error {
+	args := []string{"receive"}
+	if force {
+		args = append(args, "-F")
+	}
+	if raw {
+		args = append(args, "-u")
+	}
+	args = append(args, snapshot)
+	cmd := exec.Command("zfs", args...)
+	cmd.Stdin = input
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return errors.New(strings.TrimSpace(string(out)) + ": " + err.Error())
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 // Code generated by mockery v1.0.0
 package bkp
 
+import io "io"
 import mock "github.com/stretchr/testify/mock"
 import zfsiface "github.com/timaebi/go-zfs/zfsiface"
 
@@ -31,3 +32,17 @@ func (_m *zfsAPIMock) filesystems(filter string) ([]zfsiface.Dataset, error) {
 
 	return r0, r1
 }
+
+// receive provides a mock function with given fields: snapshot, force, raw, input
+func (_m *zfsAPIMock) receive(snapshot string, force bool, raw bool, input io.Reader) error {
+	ret := _m.Called(snapshot, force, raw, input)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(string, bool, bool, io.Reader) error); ok {
+		r0 = rf(snapshot, force, raw, input)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
@@ -0,0 +1,36 @@
+package bkp
+
+import (
+	"testing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/timaebi/go-zfs/zfsiface"
+)
+
+func TestZFSDataset(t *testing.T) {
+	fs := &Dataset{}
+	snap := &Dataset{}
+	snap.On("GetNativeProperties").Return(&zfsiface.NativeProperties{Name: "tank/test@glacier-tmp"})
+	base := &Dataset{}
+	base.On("GetNativeProperties").Return(&zfsiface.NativeProperties{Name: "tank/test@glacier-full"})
+	fs.On("Snapshot", "glacier-tmp", false).Return(snap, nil).Once()
+	fs.On("Snapshots").Return([]zfsiface.Dataset{base}, nil).Once()
+	datasets, err := wrapDatasets([]zfsiface.Dataset{fs}, nil)
+	require.NoError(t, err)
+
+	// the snapshots of a wrapped dataset send with options as well
+	s, err := datasets[0].Snapshot("glacier-tmp", false)
+	require.NoError(t, err)
+	require.IsType(t, &zfsDataset{}, s)
+	assert.Equal(t, []string{"send", "tank/test@glacier-tmp"}, s.(*zfsDataset).sendArgs(nil, nil))
+	assert.Equal(t, []string{"send", "-w", "-L", "-i", "tank/test@glacier-full", "tank/test@glacier-tmp"},
+		s.(*zfsDataset).sendArgs(base, []string{"-w", "-L"}))
+	snapshots, err := datasets[0].Snapshots()
+	require.NoError(t, err)
+	require.Len(t, snapshots, 1)
+	assert.Implements(t, (*optionDataset)(nil), snapshots[0])
+
+	fs.On("Snapshot", "glacier-tmp", false).Return(nil, assert.AnError).Once()
+	_, err = datasets[0].Snapshot("glacier-tmp", false)
+	assert.Error(t, err)
+}
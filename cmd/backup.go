@@ -8,14 +8,28 @@ import (
 // command line argument for zfs path filter
 var filter string
 
+// uploadWorkers is the number of parts uploaded at once, uploadBuffer the memory in MiB their buffers may take
+var uploadWorkers int
+var uploadBuffer int64
+
+// partSize is the size of the parts archives are uploaded in, auto chooses it from the estimated stream size
+var partSize string
+
 // backupCmd represents the backup command
 var backupCmd = &cobra.Command{
 	Use:   "backup",
 	Short: "create a backup of all filesystems that are due",
 	Long:  ``,
 	Run: func(cmd *cobra.Command, args []string) {
-		b, err := bkp.NewBatch(filter)
+		var err error
+		bkp.DefaultPartSize, err = bkp.ParsePartSize(partSize)
+		check(err)
+		b := bkp.NewBatch(filter, targets())
+		c, err := bkp.OpenCatalog(catalogPath)
 		check(err)
+		defer c.Close()
+		b.SetCatalog(c)
+		b.SetConcurrency(uploadWorkers, uploadBuffer*1024*1024)
 		err = b.Init()
 		check(err)
 		err = b.Run()
@@ -27,4 +41,7 @@ func init() {
 	rootCmd.AddCommand(backupCmd)
 
 	backupCmd.Flags().StringVarP(&filter, "filter", "f", "", "restrict volumes to backup")
+	backupCmd.Flags().IntVar(&uploadWorkers, "upload-workers", 4, "number of parts uploaded at once")
+	backupCmd.Flags().Int64Var(&uploadBuffer, "upload-buffer", 1024, "memory in MiB the buffers of the parts being read and uploaded may take, limits the workers to the parts it holds")
+	backupCmd.Flags().StringVar(&partSize, "part-size", "auto", "size of the parts archives are uploaded in, a power of two from 1M to 4G (s3 targets need at least 8M, azure targets at most 2G) or auto to choose it from the size zfs estimates for the stream, overridden by the "+bkp.PartSizeProperty+" attribute of a filesystem")
 }
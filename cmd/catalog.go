@@ -0,0 +1,44 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+	"github.com/timaebi/zfs2glacier/bkp"
+	"path/filepath"
+)
+
+var catalogWorkDir string
+
+// catalogCmd represents the catalog command
+var catalogCmd = &cobra.Command{
+	Use:   "catalog",
+	Short: "manage the local catalog of uploaded archives",
+	Long:  ``,
+}
+
+// catalogRebuildCmd represents the catalog rebuild command
+var catalogRebuildCmd = &cobra.Command{
+	Use:   "rebuild",
+	Short: "rebuild the local catalog from the target",
+	Long: `Retrieves the inventory of every vault created by zfs2glacier and records its archives in the catalog.
+No local zfs state is needed, so a fresh machine can restore from the rebuilt catalog.
+
+Inventory retrieval takes several hours, jobs that did not complete are picked up when run again.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		c, err := bkp.OpenCatalog(catalogPath)
+		check(err)
+		defer c.Close()
+		vaults, err := bkp.RebuildCatalog(targets()[0], c, filepath.Join(catalogWorkDir, "catalog-jobs.json"), filter)
+		check(err)
+		for _, v := range vaults {
+			err = c.PrintChains(v)
+			check(err)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(catalogCmd)
+	catalogCmd.AddCommand(catalogRebuildCmd)
+	catalogRebuildCmd.Flags().StringVarP(&filter, "filter", "f", "", "restrict vaults to those of volumes under this path")
+	catalogRebuildCmd.Flags().StringVarP(&catalogWorkDir, "workdir", "w", "/var/tmp/zfs2glacier", "directory for the retrieval job state")
+}
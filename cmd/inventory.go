@@ -0,0 +1,44 @@
+package cmd
+
+import (
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/timaebi/zfs2glacier/bkp"
+	"path/filepath"
+)
+
+var inventoryWorkDir string
+
+// inventoryCmd represents the inventory command
+var inventoryCmd = &cobra.Command{
+	Use:   "inventory",
+	Short: "reconcile the vault inventories with the local backup snapshots",
+	Long: `Retrieves the inventory of the vault of every enabled filesystem and compares the archives with
+the archive ids stored on the glacier-full and glacier-incremental snapshots.
+
+Archives without a local reference and local references whose archive is missing are flagged.
+Inventory retrieval takes several hours, jobs that did not complete are picked up when run again.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		b := bkp.NewBatch(filter, targets())
+		// s3 targets read the archive descriptions known to the catalog from it instead of one request per archive
+		if c, err := bkp.OpenCatalog(catalogPath); err == nil {
+			defer c.Close()
+			b.SetCatalog(c)
+		} else {
+			log.Warn("could not open the catalog: ", err)
+		}
+		err := b.Init()
+		check(err)
+		recs, err := b.Inventory(filepath.Join(inventoryWorkDir, "inventory-jobs.json"))
+		check(err)
+		for _, r := range recs {
+			r.Print()
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(inventoryCmd)
+	inventoryCmd.Flags().StringVarP(&filter, "filter", "f", "", "restrict volumes to reconcile")
+	inventoryCmd.Flags().StringVarP(&inventoryWorkDir, "workdir", "w", "/var/tmp/zfs2glacier", "directory for the retrieval job state")
+}
@@ -0,0 +1,138 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+	"github.com/timaebi/zfs2glacier/bkp"
+	"errors"
+	"fmt"
+	"os"
+	"golang.org/x/term"
+	log "github.com/sirupsen/logrus"
+)
+
+var restoreTarget string
+var restoreFrom string
+var restoreArchiveID string
+var restoreWorkDir string
+var restoreTier string
+var restoreResume bool
+var restoreIdentity string
+var restorePassphraseFile string
+
+// restoreCmd represents the restore command
+var restoreCmd = &cobra.Command{
+	Use:   "restore [filesystem]",
+	Short: "restore a filesystem from its aws glacier vault",
+	Long: `Retrieves the latest archive of the filesystem together with all archives it is based on
+and receives them in the order they were created. Retrieving archives from glacier takes several hours.
+
+The latest archive is read from the local backup snapshots or from the catalog unless it is given with --archive.
+The archives of the chain recorded in the catalog are retrieved at once, run "catalog rebuild" first on a fresh machine.
+The archives are retrieved from the target named with --from, or else the unnamed or first one. Aws targets connect
+with the aws attributes of the filesystem, or of its closest parent if it does not exist.
+The progress is saved in the work directory, an interrupted restore is continued with --resume from the same target.
+Archives encrypted to age recipients are decrypted with the identities in the file given with --identity.
+The passphrase of passphrase encrypted archives is read from --passphrase-file or prompted for.
+Raw archives of natively encrypted filesystems are received unmounted, load their key with zfs load-key.
+Archives sent with -L or -e need a pool with the large_blocks or embedded_data feature, which is logged.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if restoreResume {
+			return cobra.NoArgs(cmd, args)
+		}
+		return cobra.ExactArgs(1)(cmd, args)
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		var r *bkp.Restore
+		var err error
+		if restoreResume {
+			if restoreArchiveID != "" || restoreTarget != "" {
+				check(errors.New("--archive and --into can't be changed when resuming"))
+			}
+			r, err = bkp.ResumeRestore(targets(), restoreFrom, restoreWorkDir, restoreTier)
+			check(err)
+		} else {
+			t, err := namedTarget(restoreFrom)
+			check(err)
+			id := restoreArchiveID
+			if id == "" {
+				id, err = latestArchiveID(args[0], t.Name)
+				check(err)
+			}
+			target := restoreTarget
+			if target == "" {
+				target = args[0]
+			}
+			r, err = bkp.NewRestore(t, args[0], target, id, restoreWorkDir, restoreTier)
+			check(err)
+		}
+		if restoreIdentity != "" {
+			ids, err := bkp.ReadIdentities(restoreIdentity)
+			check(err)
+			r.SetIdentities(ids)
+		}
+		// the catalog verifies archives whose description has no SHA-256, a restore on a fresh machine has none
+		if c, err := bkp.OpenCatalog(catalogPath); err == nil {
+			defer c.Close()
+			r.SetCatalog(c)
+		} else {
+			log.Warn("could not open the catalog, archives are only verified with their description: ", err)
+		}
+		r.SetPassphrase(func() ([]byte, error) {
+			if restorePassphraseFile != "" {
+				return bkp.ReadPassphrase(restorePassphraseFile)
+			}
+			return promptPassphrase()
+		})
+		err = r.Run()
+		check(err)
+	},
+}
+
+// promptPassphrase reads the passphrase from the terminal without echoing it
+func promptPassphrase() ([]byte, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return nil, errors.New("the archive is encrypted with a passphrase, set --passphrase-file")
+	}
+	fmt.Fprint(os.Stderr, "passphrase: ")
+	p, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	if len(p) == 0 {
+		return nil, errors.New("empty passphrase")
+	}
+	return p, nil
+}
+
+// latestArchiveID looks up the latest archive of a filesystem on the named target in its local snapshots
+// If the filesystem does not exist locally, e.g. on a fresh machine, the catalog is used.
+func latestArchiveID(filesystem, target string) (string, error) {
+	id, err := bkp.LatestArchiveID(filesystem, target)
+	if err == nil {
+		return id, nil
+	}
+	c, cerr := bkp.OpenCatalog(catalogPath)
+	if cerr != nil {
+		return "", err
+	}
+	defer c.Close()
+	r, cerr := c.Latest(bkp.VaultName(filesystem), target)
+	if cerr != nil || r == nil {
+		return "", err
+	}
+	return r.ArchiveID, nil
+}
+
+func init() {
+	rootCmd.AddCommand(restoreCmd)
+	restoreCmd.Flags().StringVarP(&restoreTarget, "into", "i", "", "filesystem to restore into, defaults to the backed up filesystem")
+	restoreCmd.Flags().StringVar(&restoreFrom, "from", "", "name of the target to restore from, defaults to the unnamed or first one")
+	restoreCmd.Flags().StringVarP(&restoreArchiveID, "archive", "a", "", "id of the archive to restore")
+	restoreCmd.Flags().StringVarP(&restoreWorkDir, "workdir", "w", "/var/tmp/zfs2glacier", "directory for downloaded archives and the restore progress")
+	restoreCmd.Flags().StringVarP(&restoreTier, "tier", "t", bkp.TierStandard, "retrieval tier: Expedited, Standard or Bulk")
+	restoreCmd.Flags().BoolVarP(&restoreResume, "resume", "r", false, "resume the restore saved in the work directory")
+	restoreCmd.Flags().StringVar(&restoreIdentity, "identity", "", "file with the age identities to decrypt encrypted archives")
+	restoreCmd.Flags().StringVar(&restorePassphraseFile, "passphrase-file", "", "file with the passphrase of passphrase encrypted archives, prompted for if not set")
+}
@@ -1,16 +1,20 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"github.com/spf13/cobra"
 	log "github.com/sirupsen/logrus"
 	logrus_syslog "github.com/sirupsen/logrus/hooks/syslog"
 	"log/syslog"
+	"github.com/timaebi/zfs2glacier/bkp"
 )
 
 var verbose bool
 var version string
+var catalogPath string
+var targetSpecs []string
 
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
@@ -36,6 +40,7 @@ var rootCmd = &cobra.Command{
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute(v string) {
 	version = v
+	bkp.Version = v
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Println(err)
 		os.Exit(1)
@@ -44,6 +49,35 @@ func Execute(v string) {
 
 func init() {
 	rootCmd.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "verbose logging to stdout")
+	rootCmd.PersistentFlags().StringArrayVar(&targetSpecs, "target", []string{"glacier"}, "where archives are stored: [name=]spec with spec glacier, s3://bucket/prefix (aws options: ?profile=name&region=name&role=arn&endpoint=url), azure://account/container/prefix?endpoint=url (key in $AZURE_STORAGE_KEY), gs://bucket/prefix?endpoint=url&credentials=file, file:///path, sftp://user@host/path (?verify=sha256sum checks archives on the remote host) or zfs://user@host/pool/dataset (ssh options: ?key=file&known_hosts=file), repeat to upload to several targets, other commands use the first one, restore the one named with --from")
+	rootCmd.PersistentFlags().StringVar(&bkp.DefaultAWSConfig.ConfigFile, "aws-config", bkp.DefaultAWSConfig.ConfigFile, "aws config file with the credentials and profiles")
+	rootCmd.PersistentFlags().StringVar(&bkp.DefaultAWSConfig.Profile, "aws-profile", "", "profile of the aws config file, overridden by the "+bkp.AWSProfile+" attribute of a filesystem")
+	rootCmd.PersistentFlags().StringVar(&bkp.DefaultAWSConfig.Region, "aws-region", "", "aws region, overridden by the "+bkp.AWSRegion+" attribute of a filesystem")
+	rootCmd.PersistentFlags().StringVar(&bkp.DefaultAWSConfig.Role, "aws-role", "", "arn of a role to assume, overridden by the "+bkp.AWSRole+" attribute of a filesystem")
+	rootCmd.PersistentFlags().StringVar(&bkp.DefaultAWSConfig.Endpoint, "aws-endpoint", "", "url replacing the aws endpoint, e.g. of a local stand-in, overridden by the "+bkp.AWSEndpoint+" attribute of a filesystem")
+	rootCmd.PersistentFlags().StringVar(&catalogPath, "catalog", "/var/lib/zfs2glacier/catalog.db", "local catalog of uploaded archives")
+}
+
+// targets creates the targets given with --target
+func targets() []*bkp.NamedTarget {
+	ts, err := bkp.NewTargets(targetSpecs)
+	check(err)
+	return ts
+}
+
+// namedTarget returns the target given with --target under name
+// If name is empty and every target is named, the first one is returned.
+func namedTarget(name string) (*bkp.NamedTarget, error) {
+	ts := targets()
+	for _, t := range ts {
+		if t.Name == name {
+			return t, nil
+		}
+	}
+	if name == "" {
+		return ts[0], nil
+	}
+	return nil, errors.New("no target is named " + name)
 }
 
 func check(err error) {
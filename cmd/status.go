@@ -12,11 +12,12 @@ var statusCmd = &cobra.Command{
 	Short: "print current backup status to stdout",
 	Long:  `Shows all zfs filesystems for which a backup should be created. It also shows the last backup status and date`,
 	Run: func(cmd *cobra.Command, args []string) {
-		batch, err := bkp.NewBatch(filter)
+		ts, err := bkp.NewTargets(targetSpecs)
 		if err != nil {
 			fmt.Print(err)
 			return
 		}
+		batch := bkp.NewBatch(filter, ts)
 		err = batch.Init()
 		if err != nil {
 			fmt.Print(err)
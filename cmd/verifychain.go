@@ -0,0 +1,56 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+	"github.com/timaebi/zfs2glacier/bkp"
+	log "github.com/sirupsen/logrus"
+	"path/filepath"
+)
+
+var verifyMaxLength int
+var verifyInventory bool
+var verifyWorkDir string
+
+// verifyChainCmd represents the verify-chain command
+var verifyChainCmd = &cobra.Command{
+	Use:   "verify-chain",
+	Short: "verify that the latest backup of every enabled filesystem can be restored",
+	Long: `Follows the base archive links from the latest archive of every enabled filesystem down to its full backup,
+on every target the filesystem is uploaded to. Broken links, cycles, targets without the latest archive and chains
+with more than --max-length archives are reported and the command exits with status 1.
+
+The links are read from the catalog, with --inventory the vault inventories are retrieved from aws glacier instead.
+Inventory retrieval takes several hours, jobs that did not complete are picked up when run again.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		b := bkp.NewBatch(filter, targets())
+		err := b.Init()
+		check(err)
+		c, err := bkp.OpenCatalog(catalogPath)
+		check(err)
+		var reports []*bkp.ChainReport
+		if verifyInventory {
+			reports, err = b.VerifyChainsInventory(c, filepath.Join(verifyWorkDir, "verify-jobs.json"), verifyMaxLength)
+		} else {
+			reports, err = b.VerifyChains(c, verifyMaxLength)
+		}
+		c.Close()
+		check(err)
+		valid := true
+		for _, r := range reports {
+			r.Print()
+			valid = valid && r.IsValid()
+		}
+		if !valid {
+			log.Error("broken archive chains found")
+			log.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(verifyChainCmd)
+	verifyChainCmd.Flags().StringVarP(&filter, "filter", "f", "", "restrict volumes to verify")
+	verifyChainCmd.Flags().IntVarP(&verifyMaxLength, "max-length", "m", bkp.DefaultMaxChainLength, "maximal number of archives in a chain")
+	verifyChainCmd.Flags().BoolVarP(&verifyInventory, "inventory", "i", false, "follow the links through the vault inventories instead of the catalog")
+	verifyChainCmd.Flags().StringVarP(&verifyWorkDir, "workdir", "w", "/var/tmp/zfs2glacier", "directory for the retrieval job state")
+}